@@ -0,0 +1,90 @@
+use serde::Serialize;
+use serde_json::Value;
+
+/// State events of group calls (MSC3401), as used by Element Call.
+const GROUP_CALL: &str = "org.matrix.msc3401.call";
+const GROUP_CALL_MEMBER: &str = "org.matrix.msc3401.call.member";
+
+/// A step in the lifecycle of a call.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub(crate) enum CallPhase {
+    Started,
+    Answered,
+    HungUp,
+    Ended,
+    MemberJoined,
+    MemberLeft,
+}
+
+impl CallPhase {
+    pub(crate) fn describe(self) -> &'static str {
+        match self {
+            Self::Started => "started a call",
+            Self::Answered => "answered the call",
+            Self::HungUp => "hung up",
+            Self::Ended => "ended the call",
+            Self::MemberJoined => "joined the call",
+            Self::MemberLeft => "left the call",
+        }
+    }
+}
+
+/// An m.call.* event of a 1:1 call or a state event of a group call.
+#[derive(Clone, Debug)]
+pub(crate) struct CallEvent {
+    pub(crate) phase: CallPhase,
+    /// Empty for the call of a room, which is what Element Call uses
+    pub(crate) call_id: String,
+    pub(crate) group: bool,
+}
+
+impl CallEvent {
+    pub(crate) fn parse(event: &Value) -> Option<Self> {
+        let content = event.get("content")?;
+        let call_id = |content: &Value| {
+            content
+                .get("call_id")
+                .and_then(Value::as_str)
+                .unwrap_or("")
+                .to_string()
+        };
+        let (phase, call_id, group) = match event.get("type")?.as_str()? {
+            "m.call.invite" => (CallPhase::Started, call_id(content), false),
+            "m.call.answer" => (CallPhase::Answered, call_id(content), false),
+            "m.call.hangup" | "m.call.reject" => (CallPhase::HungUp, call_id(content), false),
+            GROUP_CALL => {
+                let phase = if content.get("m.terminated").is_some() {
+                    CallPhase::Ended
+                } else {
+                    CallPhase::Started
+                };
+                let state_key = event.get("state_key").and_then(Value::as_str);
+                (phase, state_key.unwrap_or("").to_string(), true)
+            }
+            GROUP_CALL_MEMBER => {
+                // Older clients send a list of memberships per user, newer
+                // ones an event per device; leaving empties either.
+                let memberships = content.get("memberships").and_then(Value::as_array);
+                let membership = match memberships {
+                    Some(memberships) => memberships.first(),
+                    None => content
+                        .as_object()
+                        .filter(|o| !o.is_empty())
+                        .map(|_| content),
+                };
+                let phase = match membership {
+                    Some(_) => CallPhase::MemberJoined,
+                    None => CallPhase::MemberLeft,
+                };
+                (phase, membership.map(call_id).unwrap_or_default(), true)
+            }
+            _ => return None,
+        };
+        Some(Self {
+            phase,
+            call_id,
+            group,
+        })
+    }
+}
@@ -0,0 +1,3926 @@
+use std::env;
+use std::fs;
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, bail};
+use clap::builder::{OsStringValueParser, TypedValueParser};
+use clap::{Args, Parser, Subcommand, ValueEnum};
+use clap_verbosity_flag::Verbosity;
+
+use futures::{stream, StreamExt};
+use matrix_sdk::ruma::presence::PresenceState;
+use matrix_sdk::ruma::{
+    OwnedDeviceId, OwnedEventId, OwnedMxcUri, OwnedRoomId, OwnedServerName, OwnedUserId, RoomId,
+};
+use regex::Regex;
+
+use serde::Serialize;
+use serde_json::value::RawValue;
+use tracing::warn;
+
+mod repl;
+
+use crate::client::approve::ApprovalOptions;
+use crate::client::archive::ArchiveQuery;
+use crate::client::audit::AuditOptions;
+use crate::client::batch::Cancel;
+use crate::client::bridge::BridgeSenders;
+use crate::client::calls::CallOptions;
+use crate::client::decrypt::PrintOptions;
+use crate::client::dedupe::{Dedupe, Duplicate};
+use crate::client::direct::DirectOptions;
+use crate::client::download::DownloadOptions;
+use crate::client::follow::Interrupted;
+use crate::client::health::HealthOptions;
+use crate::client::identity::Identity;
+use crate::client::init::{InitOptions, LoginMethod};
+use crate::client::join::AutojoinOptions;
+use crate::client::keys::HygieneOptions;
+use crate::client::members::MemberSyncOptions;
+use crate::client::migrate::MigrateOptions;
+use crate::client::mirror::MirrorOptions;
+use crate::client::oversize::Oversize;
+use crate::client::power::PowerPreset;
+use crate::client::publish::{PublishOptions, UnpublishOptions};
+use crate::client::sas::VerifyOptions;
+use crate::client::schedule::Schedule;
+use crate::client::signing::SigningKey;
+use crate::client::snapshot::RoomFixture;
+use crate::client::spec::RoomSpec;
+use crate::client::spool::SpoolEntry;
+use crate::client::stream::StreamOptions;
+use crate::client::tombstone::TombstoneOptions;
+use crate::client::triage::TriageOptions;
+use crate::client::whois::WhoisOptions;
+use crate::client::{
+    alias, archive, batch, builder, config, cursor, extremities, init, keys, login, publish,
+    session, snapshot, spool, stats, synapse, sync, vault, Client,
+};
+use crate::email::SmtpConfig;
+use crate::exit::ExitCode;
+use crate::filter::Filter;
+use crate::link::RoomLink;
+use crate::outputs::{
+    AliasState, ApprovalDecision, JoinState, RoomDelivery, RoomInfo, SentMessage, Severity,
+};
+use crate::room_arg::RoomArg;
+use crate::skew::{Skew, TsSource};
+use crate::table::{Cell, Column, Table, TableOptions, Units};
+use crate::{
+    exit, filter, format, hook, outputs, render, room_arg, skew, terminal, util, CRATE_NAME,
+};
+
+#[derive(Parser, Debug)]
+#[command(author, version, about, long_about = None)]
+struct Cli {
+    #[command(flatten)]
+    verbose: Verbosity,
+
+    /// Request the full state during sync
+    #[arg(short, long)]
+    full_state: bool,
+
+    /// Presence value while syncing
+    #[arg(short, long, default_value = "online")]
+    presense: PresenceState,
+
+    /// Abort the whole invocation after this duration
+    #[arg(long, value_parser = humantime::parse_duration)]
+    timeout: Option<Duration>,
+
+    /// Appended to the User-Agent of all requests, e.g. "deploy-notifier/2.1"
+    #[arg(long)]
+    user_agent_suffix: Option<String>,
+
+    /// Tag all requests of this invocation, to trace them in the homeserver logs
+    #[arg(long)]
+    request_tag: Option<String>,
+
+    /// Read the passphrase of the encrypted config from this file
+    #[arg(long)]
+    passphrase_file: Option<PathBuf>,
+
+    /// Only run while holding this advisory lock of the account, e.g. maintenance
+    #[arg(long, value_name = "NAME")]
+    lock: Option<String>,
+
+    /// Timestamp of time windows like `age < 10m` and `archive query --since`
+    #[arg(long, value_enum, default_value = "origin")]
+    ts_source: TsSource,
+
+    /// Mark synced events "ts_suspect": true if their origin_server_ts is
+    /// further than this from their arrival
+    #[arg(long, value_parser = humantime::parse_duration, default_value = skew::DEFAULT_THRESHOLD)]
+    skew_threshold: Duration,
+
+    #[command(subcommand)]
+    command: Command,
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum Command {
+    /// Check and register families of room aliases
+    Alias {
+        #[command(subcommand)]
+        command: AliasCommand,
+    },
+    /// Ask for approval and wait for the reactions of the approvers
+    Approve {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Users whose reactions count
+        #[arg(long, value_delimiter = ',', required = true)]
+        approvers: Vec<OwnedUserId>,
+
+        /// Number of required approvals
+        #[arg(long, default_value = "1")]
+        require: usize,
+
+        /// Give up after this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1h")]
+        timeout: Duration,
+
+        /// The question to ask; read from stdin if omitted
+        message: Option<String>,
+    },
+    /// Keep the synced events in a local database and search them offline
+    Archive {
+        #[command(subcommand)]
+        command: ArchiveCommand,
+    },
+    /// Delete session store and secrets (dangerous!)
+    Clean { user_id: OwnedUserId },
+    /// Export or import the login config, e.g. for provisioning machines
+    Config {
+        #[command(subcommand)]
+        command: ConfigCommand,
+    },
+    /// Check the hashes and server signatures of an event
+    Event {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        #[arg(short, long, required = true)]
+        event_id: OwnedEventId,
+
+        /// Fetch the full PDU over federation as this server; the client
+        /// API does not return hashes and signatures
+        #[arg(long, requires = "signing_key")]
+        origin: Option<String>,
+
+        /// The synapse signing key of --origin
+        #[arg(long, requires = "origin")]
+        signing_key: Option<PathBuf>,
+    },
+    /// Get information about your homeserver and login
+    #[command(alias = "hs")]
+    Homeserver {
+        /// Really print the token
+        #[arg(short, long)]
+        force: bool,
+
+        /// Include the bearer token
+        #[arg(short = 't', long = "token")]
+        include_token: bool,
+    },
+    /// Set up an account step by step: discovery, login, encryption and a
+    /// default room; every answer can be given as flag for scripts
+    Init {
+        user_id: Option<OwnedUserId>,
+
+        #[arg(short, long, default_value = CRATE_NAME)]
+        device_name: String,
+
+        /// Login method; asked if the homeserver offers several
+        #[arg(long, value_enum)]
+        method: Option<LoginMethod>,
+
+        #[arg(short, long)]
+        password: Option<String>,
+
+        /// Bootstrap cross-signing if the account has none
+        #[arg(long, value_name = "BOOL")]
+        cross_signing: Option<bool>,
+
+        /// Create a key backup if the server has none
+        #[arg(long, value_name = "BOOL")]
+        backup: Option<bool>,
+
+        /// Room send uses without --room-id
+        #[arg(long)]
+        default_room: Option<OwnedRoomId>,
+    },
+    /// Inspect the encryption keys of this account
+    Keys {
+        #[command(subcommand)]
+        command: KeysCommand,
+    },
+    /// Login to a homeserver and create a session store
+    Login {
+        #[arg(required_unless_present = "homeserver_url")]
+        user_id: Option<OwnedUserId>,
+
+        #[arg(short, long)]
+        password: Option<String>,
+
+        #[arg(short, long, default_value = CRATE_NAME)]
+        device_name: String,
+
+        /// Log in with the OAuth 2.0 device authorization grant, e.g. for
+        /// homeservers using the Matrix Authentication Service
+        #[arg(long, conflicts_with = "password")]
+        oauth: bool,
+
+        /// Request access to the synapse admin API with --oauth
+        #[arg(long, requires = "oauth")]
+        admin: bool,
+
+        /// Only print the supported login flows, without logging in
+        #[arg(long, conflicts_with_all = ["password", "oauth"])]
+        flows: bool,
+
+        /// Homeserver to probe with --flows; discovered from the user id otherwise
+        #[arg(short = 'U', long, requires = "flows")]
+        homeserver_url: Option<String>,
+
+        /// Print the login flows for humans instead of JSON
+        #[arg(long, requires = "flows")]
+        text: bool,
+
+        /// Log in non-interactively with the password or provisioning token in this environment variable
+        #[arg(long, value_name = "ENV", conflicts_with_all = ["password", "oauth", "flows"])]
+        register_device_from: Option<String>,
+    },
+    /// Logout and delete all state
+    Logout {},
+    /// Inspect or break the advisory locks taken with --lock
+    Lock {
+        #[command(subcommand)]
+        command: LockCommand,
+    },
+    /// Access the media repository
+    Media {
+        #[command(subcommand)]
+        command: MediaCommand,
+    },
+    /// Dump messages of a room
+    #[command(group(clap::ArgGroup::new("advance").args(["cursor", "new_only"])))]
+    Messages {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Dump all event types
+        // #[arg(short, long)]
+        // all_types: bool,
+
+        /// Only request this number of events
+        #[arg(short, long, default_value = "10")]
+        limit: u64,
+
+        /// Continue from a pagination token returned by a previous --ndjson run
+        #[arg(long)]
+        from: Option<String>,
+
+        /// Order of the printed events
+        #[arg(long, value_enum, default_value = "asc")]
+        order: Order,
+
+        /// Print one event per line followed by a line with the pagination cursor
+        #[arg(long)]
+        ndjson: bool,
+
+        /// Print one readable line per message instead of JSON
+        #[arg(long, conflicts_with = "ndjson")]
+        text: bool,
+
+        /// Print the message bodies as sent, without stripping reply fallbacks or rendering html
+        #[arg(long, requires = "text")]
+        raw_body: bool,
+
+        /// Only return events after the cursor stored in this room account data type
+        #[arg(long, conflicts_with = "from")]
+        cursor: Option<String>,
+
+        /// Continue in the predecessor rooms of upgraded rooms
+        #[arg(long, conflicts_with = "cursor")]
+        follow_predecessors: bool,
+
+        /// Keep printing new messages as they arrive, like tail -f; one
+        /// event per line unless --text
+        #[arg(long, conflicts_with_all = ["from", "order", "cursor", "new_only", "follow_predecessors"])]
+        follow: bool,
+
+        /// Exit --follow after no message arrived for this long, e.g. 5m
+        #[arg(long, requires = "follow", value_parser = humantime::parse_duration)]
+        follow_timeout: Option<Duration>,
+
+        /// Only return events after our m.fully_read marker and move it to the newest one
+        #[arg(long, conflicts_with_all = ["from", "cursor", "follow_predecessors"])]
+        new_only: bool,
+
+        /// Do not advance the cursor or read marker, e.g. for dry runs
+        #[arg(long, requires = "advance")]
+        no_advance: bool,
+
+        /// Only print events matching this expression; see `--filter-expr help`
+        #[arg(long, value_parser = Filter::parse)]
+        filter_expr: Option<Filter>,
+
+        /// Add the sender_attribution of bridge ghost users, e.g. "Alice (via Telegram)"
+        #[arg(long)]
+        resolve_bridge_senders: bool,
+    },
+    /// Re-post the messages of one room into another until interrupted
+    Mirror {
+        #[arg(long, required = true, value_parser = room_arg::parse)]
+        from: RoomArg,
+
+        #[arg(long, required = true, value_parser = room_arg::parse)]
+        to: RoomArg,
+
+        /// Prepended to the sender name of mirrored messages
+        #[arg(long)]
+        prefix: Option<String>,
+
+        /// Upload media to our homeserver instead of linking the original
+        #[arg(long)]
+        reupload_media: bool,
+    },
+    /// Debug push notifications of this account
+    Push {
+        #[command(subcommand)]
+        command: PushCommand,
+    },
+    /// Send a read receipt, by default for the latest event
+    Read {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Defaults to the latest event of the thread or the main timeline
+        #[arg(short, long)]
+        event_id: Option<OwnedEventId>,
+
+        /// Only mark this thread, given by its root event, as read
+        #[arg(long)]
+        thread: Option<OwnedEventId>,
+    },
+    /// Redact events; a failure does not stop the others
+    Redact {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        #[arg(short, long, required = true, num_args = 1..)]
+        event_id: Vec<OwnedEventId>,
+
+        #[arg(long)]
+        reason: Option<String>,
+
+        /// Write the failed redactions to this file as NDJSON
+        #[arg(long)]
+        report: Option<PathBuf>,
+    },
+    /// Run commands with one client, without the startup per command
+    Repl,
+    /// Manage rooms
+    Room {
+        #[command(subcommand)]
+        command: RoomCommand,
+    },
+    /// Query room information
+    Rooms {
+        /// Only query this room
+        #[arg(long, value_parser = room_arg::parse)]
+        room_id: Option<RoomArg>,
+
+        /// Query room members
+        #[arg(long = "members")]
+        query_members: bool,
+
+        /// Query avatars
+        #[arg(long = "avatars")]
+        query_avatars: bool,
+
+        /// Number of rooms queried concurrently
+        #[arg(long, default_value = "16")]
+        jobs: usize,
+
+        /// Reuse cached room summaries younger than this; 0 disables the cache
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "5m")]
+        cache_ttl: Duration,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Manage recurring messages stored in the account data
+    Schedule {
+        #[command(subcommand)]
+        command: ScheduleCommand,
+    },
+    /// Send a message to a room
+    Send {
+        /// Repeat or separate by commas to send to several rooms
+        /// concurrently; the default room of init if omitted
+        #[arg(short, long, value_delimiter = ',', value_parser = room_arg::parse)]
+        room_id: Vec<RoomArg>,
+
+        /// Number of rooms sent to concurrently
+        #[arg(long, default_value = "4")]
+        jobs: usize,
+
+        /// Enable markdown formatting
+        #[arg(short, long)]
+        markdown: bool,
+
+        /// Send a notice message
+        #[arg(short, long)]
+        notice: bool,
+
+        /// Send an emote message
+        #[arg(short, long, conflicts_with = "notice")]
+        emote: bool,
+
+        /// Send with this msgtype instead of m.text, e.g. of a bot protocol
+        #[arg(long, conflicts_with_all = ["notice", "emote", "attachment", "reply_to", "kv", "table_csv", "table_json", "content_file"])]
+        msgtype: Option<String>,
+
+        /// Send file as an attachment; `-` reads it from stdin
+        #[arg(short, long, visible_alias = "file", conflicts_with = "message")]
+        attachment: Option<PathBuf>,
+
+        /// File name of the attachment shown in the body
+        #[arg(long, requires = "attachment")]
+        name: Option<String>,
+
+        /// Do not upload a thumbnail of images, to save bandwidth
+        #[arg(long, requires = "attachment")]
+        no_thumbnail: bool,
+
+        /// Reply to a specific event_id
+        #[arg(long, conflicts_with_all = ["emote", "attachment"])]
+        reply_to: Option<OwnedEventId>,
+
+        /// Send to the thread of this root event; with --reply-to as reply
+        /// within the thread
+        #[arg(long, value_name = "EVENT_ID", conflicts_with_all = ["emote", "msgtype", "attachment", "edit", "content_file"])]
+        thread: Option<OwnedEventId>,
+
+        /// Replace the body of a message we sent
+        #[arg(long, value_name = "EVENT_ID", conflicts_with_all = ["reply_to", "emote", "msgtype", "attachment", "kv", "table_csv", "table_json", "content_file", "as_identity"])]
+        edit: Option<OwnedEventId>,
+
+        /// React to --event with this key, e.g. an emoji, instead of sending a
+        /// message; reacting twice with the same key is not an error
+        #[arg(long, value_name = "KEY", requires = "event", conflicts_with_all = ["message", "markdown", "notice", "emote", "msgtype", "attachment", "reply_to", "edit", "kv", "table_csv", "table_json", "content_file", "as_identity", "preview", "wait_ack", "wait", "dedupe_window"])]
+        react: Option<String>,
+
+        /// Event to react to
+        #[arg(long, value_name = "EVENT_ID", requires = "react")]
+        event: Option<OwnedEventId>,
+
+        /// Send the message as code block, e.g. command output; with a
+        /// language like --code=diff for highlighting
+        #[arg(long, value_name = "LANGUAGE", num_args = 0..=1, require_equals = true, default_missing_value = "", conflicts_with_all = ["markdown", "emote", "msgtype", "attachment", "edit", "react", "kv", "table_csv", "table_json", "content_file", "stream", "spool", "flush"])]
+        code: Option<String>,
+
+        /// Append an aligned key/value block; can be repeated
+        #[arg(long, value_name = "KEY=VALUE", value_parser = format::parse_key_val, conflicts_with_all = ["emote", "attachment", "markdown", "table_csv", "table_json"])]
+        kv: Vec<(String, String)>,
+
+        /// Render a CSV file as table
+        #[arg(long, conflicts_with_all = ["emote", "attachment", "markdown", "table_json"])]
+        table_csv: Option<PathBuf>,
+
+        /// Render a JSON file as table
+        #[arg(long, conflicts_with_all = ["emote", "attachment", "markdown"])]
+        table_json: Option<PathBuf>,
+
+        /// Maximum number of table rows before truncating
+        #[arg(long, default_value = "20")]
+        max_rows: usize,
+
+        /// Send this m.room.message content object; msgtype defaults to m.text
+        #[arg(long, conflicts_with_all = ["emote", "attachment", "markdown", "reply_to", "kv", "table_csv", "table_json"])]
+        content_file: Option<PathBuf>,
+
+        /// Replace the body of --content-file with the message
+        #[arg(long, requires = "content_file")]
+        merge: bool,
+
+        /// Send our position as m.location message, e.g. 52.52,13.405
+        #[arg(long, value_name = "LAT,LON", value_parser = format::parse_location, allow_hyphen_values = true, conflicts_with_all = ["message", "markdown", "emote", "msgtype", "attachment", "reply_to", "thread", "edit", "react", "code", "kv", "table_csv", "table_json", "content_file", "raw", "mention", "mention_room", "stream", "spool", "flush"])]
+        location: Option<format::Location>,
+
+        /// Text shown with --location, e.g. the name of the place
+        #[arg(long, value_name = "TEXT", requires = "location")]
+        location_description: Option<String>,
+
+        /// Send the JSON object of stdin or --content-file verbatim as
+        /// content of an event of --type
+        #[arg(long, requires = "event_type", conflicts_with_all = ["message", "markdown", "notice", "emote", "msgtype", "attachment", "reply_to", "thread", "edit", "react", "kv", "table_csv", "table_json", "merge", "code", "mention", "mention_room", "as_identity", "preview", "dedupe_window", "stream", "spool", "flush", "wait_ack"])]
+        raw: bool,
+
+        /// Event type of --raw, e.g. com.example.ci.status
+        #[arg(long = "type", value_name = "EVENT_TYPE", requires = "raw")]
+        event_type: Option<String>,
+
+        /// Send --raw as state event
+        #[arg(long, requires = "raw", conflicts_with = "wait")]
+        state: bool,
+
+        /// State key of --state; empty by default
+        #[arg(long, value_name = "KEY", requires = "state")]
+        state_key: Option<String>,
+
+        /// Send as this identity; a name from identities.yaml or a display name
+        #[arg(long = "as", conflicts_with = "attachment")]
+        as_identity: Option<String>,
+
+        /// Avatar of the identity given by --as
+        #[arg(long, requires = "as_identity")]
+        as_avatar: Option<OwnedMxcUri>,
+
+        /// Ping this user with a pill in front of the message; can be repeated
+        #[arg(long, value_name = "USER_ID", conflicts_with_all = ["attachment", "edit", "react", "spool", "flush"])]
+        mention: Vec<OwnedUserId>,
+
+        /// Ping the whole room with @room
+        #[arg(long, conflicts_with_all = ["attachment", "edit", "react", "spool", "flush"])]
+        mention_room: bool,
+
+        /// Wait until the receiving side acknowledged the message; exits
+        /// with 17 if the ack reports a failed hook
+        #[arg(long, requires = "ack_type")]
+        wait_ack: bool,
+
+        /// Send unencrypted, also to encrypted rooms
+        #[arg(long, conflicts_with_all = ["attachment", "react", "state", "spool", "flush"])]
+        force_plaintext: bool,
+
+        /// Print the event content which would be sent instead of sending it
+        #[arg(long, conflicts_with_all = ["attachment", "wait_ack", "wait"])]
+        preview: bool,
+
+        /// Preview against this snapshot of `mn room snapshot` instead of
+        /// the joined room, offline and without a session
+        #[arg(long, value_name = "SNAPSHOT", requires = "preview")]
+        fixture: Option<PathBuf>,
+
+        /// Only succeed once the message came back through the sync
+        #[arg(long)]
+        wait: bool,
+
+        /// Give up waiting for the message to come back after this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "30s", requires = "wait")]
+        wait_timeout: Duration,
+
+        /// Skip the message if we sent an identical body within this duration, e.g. 10m
+        #[arg(long, value_parser = humantime::parse_duration, conflicts_with = "attachment")]
+        dedupe_window: Option<Duration>,
+
+        /// Look for duplicates only in the local cache of sent messages, not in the room history
+        #[arg(long, requires = "dedupe_window")]
+        dedupe_cache: bool,
+
+        /// Exit with 18 instead of 0 if the message was suppressed as duplicate
+        #[arg(long, requires = "dedupe_window")]
+        fail_on_duplicate: bool,
+
+        /// Send every non-empty line of stdin as a message as it arrives
+        #[arg(long, conflicts_with_all = ["message", "attachment", "reply_to", "thread", "edit", "react", "kv", "table_csv", "table_json", "content_file", "emote", "msgtype", "wait", "wait_ack"])]
+        stream: bool,
+
+        /// Coalesce the lines arriving within this duration into one message, e.g. 5s
+        #[arg(long, value_parser = humantime::parse_duration, requires = "stream")]
+        batch_interval: Option<Duration>,
+
+        /// Keep the message in the spool if the homeserver is unreachable or
+        /// fails, to be sent later by --flush
+        #[arg(long, conflicts_with_all = ["attachment", "reply_to", "thread", "edit", "react", "kv", "table_csv", "table_json", "content_file", "as_identity", "preview", "wait", "wait_ack"])]
+        spool: bool,
+
+        /// Send the spooled messages in order instead of a new message
+        #[arg(long, conflicts_with_all = ["spool", "message", "room_id", "attachment", "reply_to", "thread", "edit", "react", "kv", "table_csv", "table_json", "content_file", "as_identity", "preview", "wait", "wait_ack"])]
+        flush: bool,
+
+        /// Discard spooled messages older than this with --flush, e.g. 1d
+        #[arg(long, value_parser = humantime::parse_duration, requires = "flush")]
+        max_age: Option<Duration>,
+
+        /// What to do with messages too large for one event
+        #[arg(long, value_enum, default_value = "error")]
+        overflow: Oversize,
+
+        /// Send messages too large for one event in several parts; same as --overflow split
+        #[arg(long, conflicts_with = "overflow")]
+        split: bool,
+
+        /// Event type of acknowledgements
+        #[arg(long)]
+        ack_type: Option<String>,
+
+        /// Give up waiting for an acknowledgement after this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "2m")]
+        timeout: Duration,
+
+        /// String to send; read from stdin if omitted
+        message: Option<String>,
+    },
+    /// Manage spaces
+    Space {
+        #[command(subcommand)]
+        command: SpaceCommand,
+    },
+    /// Use the synapse admin API
+    Synapse {
+        #[command(subcommand)]
+        command: SynapseCommand,
+    },
+    /// Run sync and print all events
+    Sync {
+        /// Serve the synced rooms and events on this unix socket
+        #[arg(long, default_value = sync::SOCKET_PATH)]
+        socket: PathBuf,
+
+        /// Run this command for new room messages; the event is passed on stdin
+        #[arg(long)]
+        exec: Option<String>,
+
+        /// Run --exec for received to-device events of this type instead
+        #[arg(long, requires = "exec")]
+        to_device_type: Option<String>,
+
+        /// After --exec finished, send an event of this type referencing
+        /// the processed message
+        #[arg(long, requires = "exec", conflicts_with = "to_device_type")]
+        ack_type: Option<String>,
+
+        /// Limit --exec runs to this rate, e.g. 5/s, 30/m or 100/h
+        #[arg(long, requires = "exec", value_parser = hook::parse_rate)]
+        exec_rate: Option<f64>,
+
+        /// Number of --exec runs allowed at once before --exec-rate applies
+        #[arg(long, requires = "exec_rate", default_value = "10", value_parser = clap::value_parser!(u32).range(1..))]
+        exec_burst: u32,
+
+        /// What to do with events exceeding --exec-rate
+        #[arg(long, requires = "exec_rate", value_enum, default_value = "queue")]
+        exec_overflow: hook::Overflow,
+
+        /// Maximum number of events waiting for --exec; further events are dropped
+        #[arg(long, requires = "exec_rate", default_value = "1000")]
+        exec_queue: usize,
+
+        /// Only pass events matching this expression to --exec and the socket; see `--filter-expr help`
+        #[arg(long, value_parser = Filter::parse)]
+        filter_expr: Option<Filter>,
+
+        /// Add the sender_attribution of bridge ghost users to events for --exec and the socket
+        #[arg(long)]
+        resolve_bridge_senders: bool,
+
+        /// Print the timeline events as NDJSON on stdout; undecryptable
+        /// ones carry "decrypted": false
+        #[arg(long)]
+        print_events: bool,
+
+        /// Print one readable line per event instead of NDJSON
+        #[arg(long, requires = "print_events")]
+        text: bool,
+
+        /// Print the message bodies as sent, without stripping reply fallbacks or rendering html
+        #[arg(long, requires = "text")]
+        raw_body: bool,
+
+        /// Print read receipts as NDJSON on stdout
+        #[arg(long)]
+        include_receipts: bool,
+
+        /// Only print receipts of this thread root, or `main`; unthreaded receipts are always printed
+        #[arg(long, requires = "include_receipts")]
+        receipts_thread: Option<String>,
+
+        /// Print typing notifications as NDJSON on stdout
+        #[arg(long)]
+        include_typing: bool,
+
+        /// Print calls starting, being answered, hung up and joined as NDJSON on stdout
+        #[arg(long)]
+        include_calls: bool,
+
+        /// Ring the terminal bell and run --exec for incoming 1:1 calls
+        #[arg(long, conflicts_with = "to_device_type")]
+        notify_calls: bool,
+
+        /// Accept all room invites
+        #[arg(long)]
+        autojoin: bool,
+
+        /// Leave autojoined rooms again if this user is not a member
+        #[arg(long, requires = "autojoin")]
+        require_member: Option<OwnedUserId>,
+
+        /// Only stay in autojoined rooms which are children of this space
+        #[arg(long, requires = "autojoin", value_name = "SPACE_ID", value_parser = room_arg::parse)]
+        space_policy: Option<RoomArg>,
+
+        /// Automatically accept SAS verification requests from these users
+        #[arg(long, value_delimiter = ',')]
+        auto_verify_from: Vec<OwnedUserId>,
+
+        /// Wait this long before confirming an automatic verification
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "10s")]
+        auto_verify_delay: Duration,
+
+        /// Print the sync lag, event age percentiles and event rate to
+        /// stderr this often, e.g. 60s; 0s disables it
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "0s")]
+        health_interval: Duration,
+
+        /// Exit with code 14 if no sync succeeds for this long, e.g. 120s
+        #[arg(long, value_parser = humantime::parse_duration)]
+        max_lag: Option<Duration>,
+    },
+    /// Send a to-device message to devices of a user
+    ToDevice {
+        #[arg(long, required = true)]
+        to: OwnedUserId,
+
+        /// Target device id; `*` addresses all devices
+        #[arg(long, default_value = "*")]
+        device: String,
+
+        /// The event type, e.g. `io.example.signal`
+        #[arg(long = "type", required = true)]
+        event_type: String,
+
+        /// The event content as JSON
+        #[arg(long, required = true)]
+        content: String,
+    },
+    /// Send typing notifications
+    Typing {
+        #[arg(long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Disable typing
+        #[arg(long)]
+        disable: bool,
+    },
+    /// Verify a device interactively by comparing emojis; without
+    /// --user, wait for a request of the other side
+    Verify {
+        /// Request the verification of this user, e.g. ourselves for our other devices
+        #[arg(long)]
+        user: Option<OwnedUserId>,
+
+        /// Only verify this device of --user
+        #[arg(long, requires = "user")]
+        device: Option<OwnedDeviceId>,
+
+        /// Cancel the verification if it is not finished by then
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "5m")]
+        timeout: Duration,
+    },
+    /// Ask the homeserver who we are
+    Whoami,
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum AliasCommand {
+    /// Report which aliases are free and which room has the taken ones
+    Check {
+        /// Alias with a * for each candidate, e.g. '#project-*:example.org'
+        pattern: String,
+
+        /// File with one candidate per line
+        #[arg(long, required = true)]
+        candidates: PathBuf,
+
+        /// Pause between two alias requests
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1s")]
+        pace: Duration,
+    },
+    /// Point the free aliases at a room
+    Claim {
+        /// Alias with a * for each candidate, e.g. '#project-*:example.org'
+        pattern: String,
+
+        /// File with one candidate per line
+        #[arg(long, required = true)]
+        candidates: PathBuf,
+
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Pause between two alias requests
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1s")]
+        pace: Duration,
+    },
+    /// Remove the aliases which point at a room, to undo a claim
+    Release {
+        /// Alias with a * for each candidate, e.g. '#project-*:example.org'
+        #[arg(requires = "candidates", required_unless_present = "claimed")]
+        pattern: Option<String>,
+
+        /// File with one candidate per line
+        #[arg(long, requires = "pattern")]
+        candidates: Option<PathBuf>,
+
+        /// Release the aliases claimed according to this output of a claim
+        #[arg(long, conflicts_with = "pattern")]
+        claimed: Option<PathBuf>,
+
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Pause between two alias requests
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1s")]
+        pace: Duration,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum ArchiveCommand {
+    /// Make `mn sync` write every event into the archive
+    Enable,
+    /// Stop archiving; the archived events are kept
+    Disable,
+    /// Print the archived events matching all given conditions
+    Query {
+        #[arg(short, long, value_parser = room_arg::parse)]
+        room_id: Option<RoomArg>,
+
+        #[arg(long)]
+        sender: Option<OwnedUserId>,
+
+        /// Only events whose body contains this text, ignoring case
+        #[arg(long)]
+        contains: Option<String>,
+
+        /// Only events sent within this time, e.g. 30d
+        #[arg(long, value_parser = humantime::parse_duration)]
+        since: Option<Duration>,
+
+        /// Only return this number of the newest matching events
+        #[arg(short, long, default_value = "100")]
+        limit: u64,
+
+        /// Order of the printed events
+        #[arg(long, value_enum, default_value = "asc")]
+        order: Order,
+
+        /// Print one event per line
+        #[arg(long)]
+        ndjson: bool,
+
+        /// Print one readable line per message instead of JSON
+        #[arg(long, conflicts_with = "ndjson")]
+        text: bool,
+
+        /// Print the message bodies as sent, without stripping reply fallbacks or rendering html
+        #[arg(long, requires = "text")]
+        raw_body: bool,
+    },
+    /// Delete the archived events older than this, e.g. 180d
+    Prune {
+        #[arg(value_parser = humantime::parse_duration)]
+        older_than: Duration,
+    },
+    /// Report the number of archived events and the size of the archive
+    Stats,
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum ConfigCommand {
+    /// Print meta.json and the session as one JSON object
+    Export {
+        /// Replace the access and refresh token with a placeholder
+        #[arg(long)]
+        redact_token: bool,
+    },
+    /// Validate and write a config printed by `mn config export`
+    Import {
+        file: PathBuf,
+
+        /// Merge the file into the current config instead of replacing it
+        #[arg(long)]
+        merge: bool,
+    },
+    /// Encrypt meta.json and the session with a passphrase or a key in the keyring
+    Encrypt {
+        /// Use a random key kept in the OS keyring instead of a passphrase
+        #[arg(long)]
+        keyring: bool,
+    },
+    /// Write meta.json and the session in plain again
+    Decrypt,
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum KeysCommand {
+    /// Check whether the current key backup is signed by a trusted key
+    BackupVerify,
+    /// Export all room keys in the passphrase-encrypted format of Element
+    Export {
+        #[arg(long, required = true)]
+        output: PathBuf,
+
+        /// Passphrase of the export; else $MN_KEYS_PASSPHRASE or a prompt
+        #[arg(long)]
+        passphrase: Option<String>,
+    },
+    /// Report one-time keys, unsigned devices and stale device lists
+    Hygiene {
+        /// Warn if fewer one-time keys are left on the server
+        #[arg(long, default_value = "10")]
+        min_one_time_keys: u64,
+
+        /// Upload new one-time keys if fewer are left
+        #[arg(long)]
+        replenish: bool,
+
+        /// Exit with 2 if there are warnings
+        #[arg(long)]
+        strict: bool,
+    },
+    /// Import room keys exported by Element or `keys export`; better
+    /// sessions in the store are kept
+    Import {
+        input: PathBuf,
+
+        /// Passphrase of the export; else $MN_KEYS_PASSPHRASE or a prompt
+        #[arg(long)]
+        passphrase: Option<String>,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum LockCommand {
+    /// Print the lease of a lock
+    Status { name: String },
+    /// Remove the lease of a lock, e.g. of a crashed holder
+    Break { name: String },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum ScheduleCommand {
+    /// Add a recurring message
+    Add {
+        /// Name of the schedule, used by `schedule remove`
+        #[arg(long, required = true)]
+        id: String,
+
+        /// When to send, as five field cron expression in UTC, e.g. "0 9 * * MON"
+        #[arg(long, required = true)]
+        cron: String,
+
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Send a notice message
+        #[arg(short, long)]
+        notice: bool,
+
+        /// Enable markdown formatting
+        #[arg(short, long)]
+        markdown: bool,
+
+        message: String,
+    },
+    /// List the schedules and their last runs
+    List {},
+    /// Remove a schedule
+    Remove { id: String },
+    /// Send due messages every minute until interrupted
+    Run {
+        /// Only send the messages due now, e.g. when run by cron
+        #[arg(long)]
+        once: bool,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum MediaCommand {
+    /// Print the OpenGraph data the homeserver scraped for an url
+    PreviewUrl { url: String },
+    /// Report the media usage of this account
+    Usage {
+        /// Scan the joined rooms if the synapse admin API is not available
+        #[arg(long)]
+        scan: bool,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Re-upload the media of an old homeserver referenced in the joined
+    /// rooms, e.g. after moving to a new account
+    Migrate {
+        /// Server name of the old homeserver
+        #[arg(long)]
+        from: OwnedServerName,
+
+        /// Append old and new mxc uris here as NDJSON; media already listed is
+        /// not uploaded again
+        #[arg(long)]
+        mapping: PathBuf,
+
+        /// Pause between two uploads and between two edits
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1s")]
+        pace: Duration,
+
+        /// Edit our messages to reference the re-uploaded media
+        #[arg(long)]
+        rewrite_events: bool,
+
+        /// Record rewritten events here and skip them when run again
+        #[arg(long, requires = "rewrite_events")]
+        progress: Option<PathBuf>,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum PushCommand {
+    /// Trigger a push through the registered pushers and check each step;
+    /// requires a synapse admin
+    Test {
+        /// Also check the /health endpoint of this Sygnal instance
+        #[arg(long)]
+        gateway_url: Option<String>,
+
+        /// Give up waiting for the notification after this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "30s")]
+        timeout: Duration,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum RoomCommand {
+    /// Check rooms where we are at least moderator for misconfigurations
+    Audit {
+        /// Only audit this room; all joined rooms otherwise
+        #[arg(short, long, value_parser = room_arg::parse)]
+        room_id: Option<RoomArg>,
+
+        /// Rooms with a matching name are expected to be private
+        #[arg(long, default_value = "(?i)internal")]
+        private_name: Regex,
+
+        /// All rooms of this space must be encrypted
+        #[arg(long, value_parser = room_arg::parse)]
+        encrypted_space: Vec<RoomArg>,
+    },
+    /// Show how the room state changed over time
+    StateDiff {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Show changes of this time span, e.g. `7d`
+        #[arg(long, value_parser = humantime::parse_duration, required_unless_present = "between")]
+        since: Option<Duration>,
+
+        /// Show changes between these two events
+        #[arg(long, num_args = 2, value_names = ["FROM", "TO"], conflicts_with = "since")]
+        between: Option<Vec<OwnedEventId>>,
+    },
+    /// Write the members with their power levels and the key state of a room
+    Snapshot {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Write the snapshot to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+
+        /// Compress the snapshot with gzip
+        #[arg(long)]
+        gzip: bool,
+    },
+    /// Compare two snapshots: joined, left, renamed and power changes
+    SnapshotDiff {
+        old: PathBuf,
+        new: PathBuf,
+
+        /// Print one readable line per change instead of JSON
+        #[arg(long)]
+        text: bool,
+    },
+    /// Download the media of a room with a manifest.json of who sent them
+    /// when; files present from an earlier run are skipped
+    DownloadMedia {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Only media sent within this time span, e.g. `30d`
+        #[arg(long, value_parser = humantime::parse_duration)]
+        since: Option<Duration>,
+
+        /// Directory the files and the manifest are written to
+        #[arg(short, long, default_value = ".")]
+        output: PathBuf,
+    },
+    /// Make the members of a room equal to those of a reference room or space
+    SyncMembers {
+        #[arg(value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// Room or space whose joined members are expected in the room
+        #[arg(long, required = true, value_parser = room_arg::parse)]
+        from_room: RoomArg,
+
+        /// Kick members which are not in the reference room
+        #[arg(long)]
+        remove_extra: bool,
+
+        /// Never kick these users, e.g. bots and admins
+        #[arg(long, value_delimiter = ',')]
+        keep: Vec<OwnedUserId>,
+
+        /// Apply the printed plan
+        #[arg(long)]
+        yes: bool,
+
+        /// Write the failed changes as NDJSON to this file
+        #[arg(long, requires = "yes")]
+        report: Option<PathBuf>,
+
+        /// Only apply the changes for the users of a previous --report
+        #[arg(long)]
+        retry_from: Option<PathBuf>,
+    },
+    /// Retire a room in favor of an existing successor room
+    Tombstone {
+        #[arg(value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        #[arg(long, value_parser = room_arg::parse)]
+        successor: RoomArg,
+
+        /// Final message; it is pinned and used as tombstone body
+        #[arg(long)]
+        message: Option<String>,
+
+        /// Set the join rule to invite-only
+        #[arg(long)]
+        invite_only: bool,
+
+        /// Replace an existing tombstone
+        #[arg(long)]
+        force: bool,
+    },
+    /// Apply a named power level preset from power-presets.yaml
+    PowerPreset {
+        #[arg(value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        preset: String,
+
+        /// Apply the preset even if it demotes us below admin
+        #[arg(long)]
+        force: bool,
+    },
+    /// Join a room by id, alias or matrix.to link
+    Join {
+        /// Room id, alias or matrix.to link; the event of a permalink is printed after joining
+        #[arg(value_parser = RoomLink::parse)]
+        room: RoomLink,
+
+        /// Leave the room again if this user is not a member
+        #[arg(long)]
+        require_member: Option<OwnedUserId>,
+    },
+    /// Create a room from a YAML spec
+    Create {
+        #[arg(long, required_unless_present_any = ["direct", "alias"])]
+        from_spec: Option<PathBuf>,
+
+        /// Localpart of the alias; overrides the alias of the spec
+        #[arg(long)]
+        alias: Option<String>,
+
+        /// Return the room of the alias if it is taken instead of failing
+        #[arg(long, conflicts_with = "reconcile")]
+        if_not_exists: bool,
+
+        /// Exit with 19 if the room of the alias was returned
+        #[arg(long, requires = "if_not_exists")]
+        fail_if_exists: bool,
+
+        /// Create a direct room with this user instead, recorded in m.direct
+        #[arg(long, value_name = "USER_ID", conflicts_with_all = ["from_spec", "alias", "if_not_exists", "reconcile", "invite", "smtp_url", "power_preset"])]
+        direct: Option<OwnedUserId>,
+
+        /// Do not enable encryption in the direct room
+        #[arg(long, requires = "direct")]
+        no_encrypt: bool,
+
+        /// Return the latest existing direct room with the user instead
+        #[arg(long, requires = "direct")]
+        reuse_existing: bool,
+
+        /// Create a direct room even if one with the user exists
+        #[arg(long, requires = "direct", conflicts_with = "reuse_existing")]
+        force: bool,
+
+        /// Apply the spec to this existing room instead of creating a new one
+        #[arg(long, value_name = "ROOM_ID", value_parser = room_arg::parse)]
+        reconcile: Option<RoomArg>,
+
+        /// Additionally invite this matrix id or email address
+        #[arg(long)]
+        invite: Vec<String>,
+
+        /// SMTP relay for email invitations, e.g. smtps://relay.example.org
+        #[arg(long, requires = "smtp_from")]
+        smtp_url: Option<String>,
+
+        /// Sender address of email invitations
+        #[arg(long)]
+        smtp_from: Option<String>,
+
+        /// File with the invitation email body; {inviter}, {room} and {link} are replaced
+        #[arg(long, requires = "smtp_url")]
+        email_template: Option<PathBuf>,
+
+        /// Apply this power level preset after creating the room
+        #[arg(long)]
+        power_preset: Option<String>,
+
+        /// Wait until the invited users joined or declined; exits with 12 if
+        /// some did not answer and with 13 if some declined
+        #[arg(long)]
+        wait_join: bool,
+
+        /// Give up waiting for the invitees after this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "10m", requires = "wait_join")]
+        timeout: Duration,
+    },
+    /// Find members by display name, or show the member state of a user id
+    Who {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// A display name or part of it; or a matrix id
+        query: String,
+    },
+    /// Print the name, topic, canonical alias and number of members of a room
+    Info {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// List the messages of a time window with or without the reaction of a
+    /// handler, e.g. alerts marked ✅; prints NDJSON
+    #[command(group(clap::ArgGroup::new("mode").args(["handled", "unhandled"]).required(true)))]
+    Triage {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// List the messages without such a reaction
+        #[arg(long)]
+        unhandled: bool,
+
+        /// List the messages with such a reaction
+        #[arg(long)]
+        handled: bool,
+
+        /// The reaction marking a message handled
+        #[arg(long, default_value = "✅")]
+        reaction: String,
+
+        /// Only reactions of these users count; those of anyone otherwise
+        #[arg(long, value_delimiter = ',')]
+        by: Vec<OwnedUserId>,
+
+        /// Only messages sent within this duration
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "24h")]
+        since: Duration,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Set the name, topic or avatar of a room and print it like `info`
+    #[command(group(clap::ArgGroup::new("fields").args(["name", "topic", "avatar"]).required(true).multiple(true)))]
+    Set {
+        #[arg(short, long, required = true, value_parser = room_arg::parse)]
+        room_id: RoomArg,
+
+        /// The new name; an empty one clears it
+        #[arg(long)]
+        name: Option<String>,
+
+        /// The new topic; an empty one clears it
+        #[arg(long)]
+        topic: Option<String>,
+
+        /// Upload this image as the new avatar; an empty path clears it
+        #[arg(long, value_parser = OsStringValueParser::new().map(PathBuf::from))]
+        avatar: Option<PathBuf>,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum SpaceCommand {
+    /// Audit the power levels of all rooms in a space
+    PowerAudit {
+        #[arg(value_parser = room_arg::parse)]
+        space_id: RoomArg,
+
+        /// YAML file with the expected power levels content
+        #[arg(long, conflicts_with = "reference")]
+        policy: Option<PathBuf>,
+
+        /// Room whose power levels serve as the expected power levels
+        #[arg(long, value_parser = room_arg::parse)]
+        reference: Option<RoomArg>,
+    },
+    /// Invite a user to a space and its invite-only children
+    Grant {
+        user_id: OwnedUserId,
+        #[arg(value_parser = room_arg::parse)]
+        space_id: RoomArg,
+    },
+    /// Kick a user from a space and all of its children
+    Revoke {
+        user_id: OwnedUserId,
+        #[arg(value_parser = room_arg::parse)]
+        space_id: RoomArg,
+
+        #[arg(long)]
+        reason: Option<String>,
+    },
+    /// Open a space to the public: join rule, room directory, join rules of
+    /// children and a pinned index message; stops at the first failure
+    Publish {
+        #[arg(value_parser = room_arg::parse)]
+        space_id: RoomArg,
+
+        /// Join rule for the children, e.g. public
+        #[arg(long, value_parser = publish::JOIN_RULES)]
+        children_join_rule: Option<String>,
+
+        /// Only change the join rule of these children; repeat or separate by commas
+        #[arg(long, value_delimiter = ',', requires = "children_join_rule", value_parser = room_arg::parse)]
+        child: Vec<RoomArg>,
+
+        /// Post an index of the children with matrix.to links in this room and pin it
+        #[arg(long, value_name = "ROOM_ID", value_parser = room_arg::parse)]
+        index_message: Option<RoomArg>,
+
+        /// Go on with the remaining steps after a failure
+        #[arg(long)]
+        continue_on_error: bool,
+    },
+    /// Undo publish: hide a space from the room directory and restrict it
+    /// and its public children again
+    Unpublish {
+        #[arg(value_parser = room_arg::parse)]
+        space_id: RoomArg,
+
+        /// Join rule for the space
+        #[arg(long, value_parser = publish::JOIN_RULES, default_value = "invite")]
+        join_rule: String,
+
+        /// Join rule for the children which are public
+        #[arg(long, value_parser = publish::JOIN_RULES, default_value = "restricted")]
+        children_join_rule: String,
+
+        /// Unpin our pinned messages in this room, e.g. the index message
+        #[arg(long, value_name = "ROOM_ID", value_parser = room_arg::parse)]
+        unpin: Option<RoomArg>,
+
+        /// Go on with the remaining steps after a failure
+        #[arg(long)]
+        continue_on_error: bool,
+    },
+}
+
+#[derive(Clone, Debug, Subcommand)]
+enum SynapseCommand {
+    /// Inspect and clean up the forward extremities of rooms; prints NDJSON
+    #[command(group(clap::ArgGroup::new("rooms").args(["room_id", "all"]).required(true)))]
+    Room {
+        /// Print the forward extremities
+        #[arg(long, required = true)]
+        extremities: bool,
+
+        #[arg(short, long, short_alias = 'R', value_parser = room_arg::parse)]
+        room_id: Option<RoomArg>,
+
+        /// Scan all rooms of the homeserver, those with the most extremities first
+        #[arg(long)]
+        all: bool,
+
+        /// Only print rooms with at least this number of forward extremities
+        #[arg(long, requires = "all", default_value = "10")]
+        min_extremities: u64,
+
+        /// Delete the forward extremities synapse can do without, after confirmation
+        #[arg(long)]
+        delete_extremities: bool,
+
+        /// Delete without asking
+        #[arg(long, requires = "delete_extremities")]
+        yes: bool,
+    },
+    /// List all rooms of the homeserver as NDJSON
+    Rooms {
+        /// Only list rooms whose name, alias or id contains this term
+        #[arg(long)]
+        search_term: Option<String>,
+
+        /// Sort the room list
+        #[arg(long, value_enum)]
+        order_by: Option<RoomOrder>,
+
+        /// Sort direction; forwards or backwards
+        #[arg(long, value_enum, default_value = "f")]
+        dir: Direction,
+
+        /// Number of rooms to request per page
+        #[arg(long, default_value = "100")]
+        limit: u64,
+
+        /// Only print rooms with at least this number of joined members
+        #[arg(long)]
+        min_members: Option<u64>,
+
+        /// Only print rooms with at most this number of joined members
+        #[arg(long)]
+        max_members: Option<u64>,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Snapshot the user, room and media counts, or report their growth
+    #[command(group(clap::ArgGroup::new("mode").args(["snapshot", "report"]).required(true)))]
+    Stats {
+        /// Append the current counts with a timestamp to --output
+        #[arg(long)]
+        snapshot: bool,
+
+        /// Print the growth of the counts in --output
+        #[arg(long)]
+        report: bool,
+
+        /// NDJSON file of the snapshots
+        #[arg(long, required = true)]
+        output: PathBuf,
+
+        /// Only report the snapshots taken within this duration
+        #[arg(long, requires = "report", value_parser = humantime::parse_duration, default_value = "90d")]
+        since: Duration,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Find users without activity and optionally act on them; prints NDJSON
+    #[command(alias = "user")]
+    Users {
+        /// Report users without activity within this duration, e.g. 180d
+        #[arg(long, value_parser = humantime::parse_duration, required = true)]
+        inactive: Duration,
+
+        /// Deactivate the found users
+        #[arg(long, requires = "yes")]
+        deactivate_found: bool,
+
+        /// Send this server notice to the found users
+        #[arg(long)]
+        notice_found: Option<String>,
+
+        /// Confirm destructive actions
+        #[arg(long)]
+        yes: bool,
+
+        /// Pause between two users
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "1s")]
+        pace: Duration,
+
+        /// Record processed users here and skip them when run again
+        #[arg(long)]
+        progress: Option<PathBuf>,
+
+        /// Append the actions to this CSV file
+        #[arg(long)]
+        report: Option<PathBuf>,
+
+        /// Number of users to request per page
+        #[arg(long, default_value = "100")]
+        limit: u64,
+
+        #[command(flatten)]
+        table: TableArgs,
+    },
+    /// Show the sessions of a user by device and flag anomalies
+    Whois {
+        user_id: OwnedUserId,
+
+        /// Locate the session IPs with this GeoLite2 or GeoIP2 City database
+        #[arg(long, value_name = "MMDB")]
+        geoip: Option<PathBuf>,
+
+        /// Flag connections from more countries within 24 hours
+        #[arg(long, default_value = "1", requires = "geoip")]
+        max_countries: usize,
+
+        /// Exit with 2 if anomalies were found
+        #[arg(long)]
+        fail_on_anomaly: bool,
+    },
+}
+
+#[derive(Clone, Debug, ValueEnum)]
+enum RoomOrder {
+    JoinedMembers,
+    StateEvents,
+    Name,
+}
+
+impl RoomOrder {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::JoinedMembers => "joined_members",
+            Self::StateEvents => "state_events",
+            Self::Name => "name",
+        }
+    }
+}
+
+#[derive(Clone, Debug, ValueEnum)]
+enum Order {
+    /// Oldest event first
+    Asc,
+    /// Newest event first
+    Desc,
+}
+
+#[derive(Clone, Debug, ValueEnum)]
+enum Direction {
+    F,
+    B,
+}
+
+/// Table output of the list commands; JSON stays the default.
+#[derive(Args, Clone, Debug)]
+struct TableArgs {
+    /// Print an aligned table instead of JSON
+    #[arg(long)]
+    table: bool,
+
+    /// Byte sizes and counts in the table; human abbreviates them
+    #[arg(long, value_enum, default_value = "human", requires = "table")]
+    bytes: Units,
+
+    /// Do not shorten long names to the terminal width
+    #[arg(long, requires = "table")]
+    no_truncate: bool,
+}
+
+impl TableArgs {
+    /// The table to print instead of JSON, if requested.
+    fn table(&self, columns: &[Column]) -> Option<Table> {
+        self.table
+            .then(|| Table::new(columns, TableOptions::new(self.bytes, self.no_truncate)))
+    }
+}
+
+/// `mn room info` as JSON or, with --table, as one row.
+fn print_room_info(info: &RoomInfo, table: &TableArgs) -> anyhow::Result<()> {
+    let columns = [
+        Column::text("ROOM ID"),
+        Column::name("NAME"),
+        Column::name("TOPIC"),
+        Column::text("ALIAS"),
+        Column::text("AVATAR"),
+        Column::number("MEMBERS"),
+    ];
+    let Some(mut out) = table.table(&columns) else {
+        println!("{}", serde_json::to_string(info)?);
+        return Ok(());
+    };
+    out.row(vec![
+        info.room_id.as_str().into(),
+        info.name.clone().into(),
+        info.topic.clone().into(),
+        info.canonical_alias.clone().into(),
+        info.avatar_url.clone().into(),
+        Cell::Count(info.joined_members),
+    ]);
+    out.print();
+    Ok(())
+}
+
+/// A timestamp in milliseconds of table cells.
+fn format_ts(ms: u64) -> String {
+    let t = UNIX_EPOCH + Duration::from_millis(ms);
+    humantime::format_rfc3339_seconds(t).to_string()
+}
+
+async fn create_client(args: &Cli) -> anyhow::Result<Client> {
+    let builder = match args.command {
+        Command::Login {
+            user_id: Some(ref user_id),
+            ref device_name,
+            ..
+        } => Client::builder()
+            .user_id(user_id.to_owned())
+            .device_name(device_name.to_owned()),
+        Command::Login { user_id: None, .. } => bail!("a user id is required to log in"),
+        Command::Clean { ref user_id } => Client::builder().user_id(user_id.to_owned()),
+        _ => Client::builder().load_meta()?,
+    };
+    let client = builder
+        .user_agent_suffix(args.user_agent_suffix.clone())
+        .request_tag(args.request_tag.clone())
+        .build()
+        .await?;
+
+    match args.command {
+        Command::Login { .. } | Command::Clean { .. } => Ok(client),
+        _ => client.ensure_login(),
+    }
+}
+
+/// Spool the message of `send --spool` if the client could not even be
+/// created, e.g. because discovery failed; returns whether it was.
+fn spool_unreachable(command: &Command, e: &anyhow::Error) -> anyhow::Result<bool> {
+    let Command::Send {
+        spool: true,
+        ref room_id,
+        markdown,
+        notice,
+        emote,
+        ref msgtype,
+        ref message,
+        ..
+    } = *command
+    else {
+        return Ok(false);
+    };
+    if !spool::unreachable(e) {
+        return Ok(false);
+    }
+    let meta = session::Meta::load()?;
+    // Aliases cannot be resolved now; the flush resolves them.
+    let room_ids: Vec<RoomArg> = if room_id.is_empty() {
+        meta.default_room.into_iter().map(RoomArg::from).collect()
+    } else {
+        room_id.clone()
+    };
+    if room_ids.is_empty() {
+        return Ok(false);
+    }
+    let body = match message {
+        Some(message) => message.clone(),
+        None => terminal::read_stdin_to_string()?,
+    };
+    for room_id in room_ids {
+        let entry = SpoolEntry::new(
+            room_id,
+            body.clone(),
+            markdown,
+            notice,
+            emote,
+            msgtype.clone(),
+        );
+        spool::spool(&meta.user_id, &entry)?;
+    }
+    eprintln!("spooled for send --flush: {}", e);
+    Ok(true)
+}
+
+/// Run the `mn` command line.
+#[tokio::main]
+pub async fn main() -> anyhow::Result<()> {
+    let args = Cli::parse();
+
+    tracing_subscriber::fmt()
+        .with_max_level(util::convert_filter(args.verbose.log_level_filter()))
+        .init();
+
+    // `send --stream` sends its pending lines before it exits on Ctrl-C;
+    // in the repl Ctrl-C only stops the running command. A lock of --lock
+    // is released first.
+    let interrupt = async {
+        if !handles_interrupt(&args.command) || args.lock.is_some() {
+            std::future::pending().await
+        } else {
+            tokio::signal::ctrl_c().await
+        }
+    };
+
+    // With --lock, the lock is released first on a timeout as well.
+    let res = tokio::select! {
+        res = execute(&args) => res,
+        _ = interrupt => Err(Interrupted.into()),
+        _ = deadline(args.timeout), if args.lock.is_none() => Err(timed_out(args.timeout)),
+    };
+    match res {
+        Err(e) if e.is::<Interrupted>() => {
+            eprintln!("interrupted");
+            std::process::exit(exit::INTERRUPTED);
+        }
+        Err(e) => match e.downcast_ref::<ExitCode>() {
+            Some(code) => std::process::exit(code.0),
+            None => Err(e),
+        },
+        res => res,
+    }
+}
+
+/// Wait for the end of `--timeout`; forever without one.
+async fn deadline(timeout: Option<Duration>) {
+    match timeout {
+        Some(timeout) => tokio::time::sleep(timeout).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// Report that `--timeout` passed; ends with `exit::TIMEOUT`.
+fn timed_out(timeout: Option<Duration>) -> anyhow::Error {
+    let timeout = humantime::format_duration(timeout.unwrap_or_default());
+    eprintln!("error: timed out after {}", timeout);
+    ExitCode(exit::TIMEOUT).into()
+}
+
+async fn execute(args: &Cli) -> anyhow::Result<()> {
+    if let Command::Messages {
+        filter_expr: Some(ref filter),
+        ..
+    }
+    | Command::Sync {
+        filter_expr: Some(ref filter),
+        ..
+    } = args.command
+    {
+        if filter.is_help() {
+            println!("{}", filter::HELP);
+            return Ok(());
+        }
+    }
+
+    // Unlock an encrypted config once, before anything reads it.
+    let offline = matches!(
+        args.command,
+        Command::Room {
+            command: RoomCommand::SnapshotDiff { .. }
+        }
+    );
+    if vault::is_encrypted()? && !offline {
+        if let Err(e) = vault::unlock(args.passphrase_file.as_deref()) {
+            eprintln!("error: {}", e);
+            return Err(ExitCode(exit::LOCKED).into());
+        }
+    }
+
+    // The config is moved between machines without a client.
+    if let Command::Config { ref command } = args.command {
+        match command {
+            ConfigCommand::Export { redact_token } => {
+                let config = config::export_config(*redact_token)?;
+                println!("{}", serde_json::to_string(&config)?);
+            }
+            ConfigCommand::Import { file, merge } => {
+                let summary = config::import_config(file, *merge)?;
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+            ConfigCommand::Encrypt { keyring } => {
+                let summary = vault::encrypt(args.passphrase_file.as_deref(), *keyring)?;
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+            ConfigCommand::Decrypt => {
+                let summary = vault::decrypt(args.passphrase_file.as_deref())?;
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+        }
+        return Ok(());
+    }
+
+    // The archive is searched offline.
+    if let Command::Archive { ref command } = args.command {
+        match command {
+            ArchiveCommand::Enable => {
+                println!("{}", serde_json::to_string(&archive::set_enabled(true)?)?);
+            }
+            ArchiveCommand::Disable => {
+                println!("{}", serde_json::to_string(&archive::set_enabled(false)?)?);
+            }
+            ArchiveCommand::Query {
+                room_id,
+                sender,
+                contains,
+                since,
+                limit,
+                order,
+                ndjson,
+                text,
+                raw_body,
+            } => {
+                let room_id = match room_id {
+                    Some(RoomArg::Alias(_)) => {
+                        bail!("room aliases cannot be resolved offline; give the room id")
+                    }
+                    Some(RoomArg::Id(room_id)) => Some(room_id.clone()),
+                    None => None,
+                };
+                let mut events = archive::query(&ArchiveQuery {
+                    room_id,
+                    sender: sender.clone(),
+                    contains: contains.clone(),
+                    since: *since,
+                    ts_source: args.ts_source,
+                    limit: *limit,
+                })?;
+                if matches!(order, Order::Asc) {
+                    events.reverse();
+                }
+                if *text {
+                    let events: Vec<&RawValue> = events.iter().map(|e| e.as_ref()).collect();
+                    render::print_event_lines(&events, *raw_body)?;
+                } else if *ndjson {
+                    for event in events {
+                        println!("{}", event.get());
+                    }
+                } else {
+                    println!("{}", serde_json::to_string(&events)?);
+                }
+            }
+            ArchiveCommand::Prune { older_than } => {
+                println!("{}", serde_json::to_string(&archive::prune(*older_than)?)?);
+            }
+            ArchiveCommand::Stats => {
+                println!("{}", serde_json::to_string(&archive::stats()?)?);
+            }
+        }
+        return Ok(());
+    }
+
+    // Snapshots are compared offline, e.g. in the archive.
+    if let Command::Room {
+        command:
+            RoomCommand::SnapshotDiff {
+                ref old,
+                ref new,
+                text,
+            },
+    } = args.command
+    {
+        let diff = snapshot::diff_snapshots(old, new)?;
+        if text {
+            println!("{}", snapshot::describe_diff(&diff));
+        } else {
+            println!("{}", serde_json::to_string(&diff)?);
+        }
+        return Ok(());
+    }
+
+    // The setup creates the session and its clients itself.
+    if let Command::Init {
+        ref user_id,
+        ref device_name,
+        method,
+        ref password,
+        cross_signing,
+        backup,
+        ref default_room,
+    } = args.command
+    {
+        let summary = init::init(InitOptions {
+            user_id: user_id.clone(),
+            device_name: device_name.clone(),
+            method,
+            password: password.clone(),
+            cross_signing,
+            backup,
+            default_room: default_room.clone(),
+            user_agent_suffix: args.user_agent_suffix.clone(),
+            request_tag: args.request_tag.clone(),
+        })
+        .await?;
+        println!("{}", serde_json::to_string(&summary)?);
+        eprintln!("{}", init::next_steps(&summary));
+        return Ok(());
+    }
+
+    // Probing the login flows needs neither a session nor a state store.
+    if let Command::Login {
+        flows: true,
+        ref user_id,
+        ref homeserver_url,
+        text,
+        ..
+    } = args.command
+    {
+        let http = builder::transport(
+            args.user_agent_suffix.as_deref(),
+            args.request_tag.as_deref(),
+        )?;
+        let homeserver = match (homeserver_url, user_id) {
+            (Some(url), _) => url.clone(),
+            (None, Some(user_id)) => {
+                login::discover_homeserver(&http, user_id.server_name()).await?
+            }
+            (None, None) => bail!("either a user id or --homeserver-url is required"),
+        };
+        let flows = login::login_flows(&http, &homeserver).await?;
+        if text {
+            println!("{}", login::describe_login_flows(&flows));
+        } else {
+            println!("{}", serde_json::to_string(&flows)?);
+        }
+        return Ok(());
+    }
+
+    // A preview against a snapshot needs neither session nor homeserver.
+    if let Command::Send {
+        fixture: Some(ref path),
+        ..
+    } = args.command
+    {
+        let client = Client::builder()
+            .user_agent_suffix(args.user_agent_suffix.clone())
+            .request_tag(args.request_tag.clone())
+            .build_offline()
+            .await?
+            .with_fixture(RoomFixture::load(path)?);
+        return run_command(&client, args.command.clone()).await;
+    }
+
+    let client = match create_client(args).await {
+        Ok(client) => client,
+        Err(e) => {
+            if spool_unreachable(&args.command, &e)? {
+                return Ok(());
+            }
+            return Err(e);
+        }
+    };
+    let client = match args.command {
+        Command::Messages {
+            resolve_bridge_senders: true,
+            ..
+        }
+        | Command::Sync {
+            resolve_bridge_senders: true,
+            ..
+        } => client.with_bridge_senders(BridgeSenders::load()?),
+        _ => client,
+    };
+    let client = client.with_skew(Skew {
+        source: args.ts_source,
+        threshold: args.skew_threshold,
+    });
+
+    match client.clone().sliding_sync {
+        Some(s) => {
+            let sync = s.sync();
+            let mut sync_stream = Box::pin(sync);
+            sync_stream.next().await;
+        }
+        None => {}
+    };
+
+    let work = async {
+        // The repl runs many commands with this client.
+        if let Command::Repl = args.command {
+            return repl::repl(&client).await;
+        }
+        run_command(&client, args.command.clone()).await
+    };
+    let Some(ref name) = args.lock else {
+        return work.await;
+    };
+    let lock = match client.acquire_lock(name).await? {
+        Ok(lock) => lock,
+        Err(held) => {
+            eprintln!("error: {}", held);
+            return Err(ExitCode(exit::HELD).into());
+        }
+    };
+    let work = async {
+        tokio::select! {
+            res = work => res,
+            _ = deadline(args.timeout) => Err(timed_out(args.timeout)),
+        }
+    };
+    client
+        .while_locked(lock, work, handles_interrupt(&args.command))
+        .await
+}
+
+/// Whether Ctrl-C ends `command` right away; `send --stream`, `messages
+/// --follow`, `messages --cursor`, the batch commands with checkpoints and
+/// the repl handle it themselves.
+fn handles_interrupt(command: &Command) -> bool {
+    !matches!(
+        command,
+        Command::Send { stream: true, .. }
+            | Command::Media {
+                command: MediaCommand::Migrate { .. }
+            }
+            | Command::Room {
+                command: RoomCommand::SyncMembers { yes: true, .. }
+            }
+            | Command::Synapse {
+                command: SynapseCommand::Users { .. }
+            }
+            | Command::Messages { follow: true, .. }
+            | Command::Messages {
+                cursor: Some(_),
+                no_advance: false,
+                ..
+            }
+            | Command::Repl
+    )
+}
+
+/// Run `command`; duplicates and sessions logged out remotely end it
+/// with their exit codes.
+async fn run_command(client: &Client, command: Command) -> anyhow::Result<()> {
+    match run(client, command.clone()).await {
+        Ok(()) => Ok(()),
+        Err(e) => {
+            if let Some(duplicate) = e.downcast_ref::<Duplicate>() {
+                eprintln!("{}", duplicate);
+                if duplicate.fail {
+                    return Err(ExitCode(exit::DUPLICATE).into());
+                }
+                return Ok(());
+            }
+            let Some(unknown_token) = login::unknown_token(&e) else {
+                return Err(e);
+            };
+            if unknown_token.soft_logout {
+                match client.refresh_session().await {
+                    Ok(true) => return run(client, command).await,
+                    Ok(false) => {}
+                    Err(e) => warn!("refreshing the access token failed: {}", e),
+                }
+            }
+            eprintln!("error: {}", e);
+            eprintln!("this session was logged out remotely; run `mn login` to create a new one");
+            return Err(ExitCode(exit::AUTH).into());
+        }
+    }
+}
+
+/// Apply `--filter-expr` to a raw event; events of predecessor rooms
+/// carry their own room id.
+fn event_matches(filter: &Filter, room_id: &RoomId, event: &RawValue) -> bool {
+    let Ok(event) = serde_json::from_str::<serde_json::Value>(event.get()) else {
+        return false;
+    };
+    let room_id = event
+        .get("room_id")
+        .and_then(serde_json::Value::as_str)
+        .unwrap_or(room_id.as_str());
+    filter.matches(room_id, &event)
+}
+
+async fn run(client: &Client, command: Command) -> anyhow::Result<()> {
+    match command {
+        Command::Alias { command } => {
+            let statuses = match command {
+                AliasCommand::Check {
+                    pattern,
+                    candidates,
+                    pace,
+                } => {
+                    let aliases = alias::expand_aliases(&pattern, candidates)?;
+                    client.check_aliases(&aliases, pace).await
+                }
+                AliasCommand::Claim {
+                    pattern,
+                    candidates,
+                    room_id,
+                    pace,
+                } => {
+                    let room_id = client.resolve_room(&room_id).await?;
+                    let aliases = alias::expand_aliases(&pattern, candidates)?;
+                    client.claim_aliases(&aliases, &room_id, pace).await
+                }
+                AliasCommand::Release {
+                    pattern,
+                    candidates,
+                    claimed,
+                    room_id,
+                    pace,
+                } => {
+                    let room_id = client.resolve_room(&room_id).await?;
+                    let aliases = match (pattern, candidates, claimed) {
+                        (_, _, Some(path)) => alias::claimed_aliases(path)?,
+                        (Some(pattern), Some(candidates), None) => {
+                            alias::expand_aliases(&pattern, candidates)?
+                        }
+                        _ => bail!("either a pattern with --candidates or --claimed is required"),
+                    };
+                    client.release_aliases(&aliases, &room_id, pace).await
+                }
+            };
+            for status in &statuses {
+                println!("{}", serde_json::to_string(status)?);
+            }
+            let failed = statuses
+                .iter()
+                .filter(|s| s.state == AliasState::Failed)
+                .count();
+            if failed > 0 {
+                bail!("{} of {} aliases failed", failed, statuses.len());
+            }
+        }
+        Command::Approve {
+            room_id,
+            approvers,
+            require,
+            timeout,
+            message,
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let message = match message {
+                Some(message) => message,
+                None => terminal::read_stdin_to_string()?,
+            };
+            let opts = ApprovalOptions {
+                approvers,
+                require,
+                timeout,
+            };
+            let outcome = client.request_approval(&room_id, &message, &opts).await?;
+            println!("{}", serde_json::to_string(&outcome)?);
+            match outcome.decision {
+                ApprovalDecision::Approved => {}
+                ApprovalDecision::Rejected => return Err(ExitCode(exit::REJECTED).into()),
+                ApprovalDecision::Timeout => return Err(ExitCode(exit::TIMEOUT).into()),
+            }
+        }
+        Command::Clean { .. } => {
+            client.clean()?;
+        }
+        // Handled by execute without a client.
+        Command::Archive { .. } | Command::Config { .. } | Command::Init { .. } | Command::Repl => {
+        }
+        Command::Homeserver {
+            force,
+            include_token,
+        } => {
+            let home_server = client.homeserver().to_string();
+            let user_id = client.user_id().unwrap().to_string();
+
+            #[derive(Serialize)]
+            struct HomeserverOutput {
+                home_server: String,
+                user_id: String,
+                token: Option<String>,
+            }
+
+            let mut out = HomeserverOutput {
+                home_server,
+                user_id,
+                token: None,
+            };
+
+            if include_token {
+                if !force {
+                    eprintln!("!!!!!!!!!!!!!!!!!!!!!! WARNING !!!!!!!!!!!!!!!!!!!!!!!!!");
+                    eprintln!("!!        Keep this token secret at all times         !!");
+                    eprintln!("!! Do not publish it and do not store it as plaintext !!");
+                    eprintln!("!!!!!!!!!!!!!!!!!!!!!! WARNING !!!!!!!!!!!!!!!!!!!!!!!!!");
+                    eprintln!();
+                    eprintln!(
+                        "Use -f/--force to display the token if you know what you are doing!"
+                    );
+                    return Err(ExitCode(1).into());
+                }
+                out.token = client.access_token();
+            }
+
+            println!("{}", serde_json::to_string(&out)?);
+        }
+        Command::Event {
+            room_id,
+            event_id,
+            origin,
+            signing_key,
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let key = match (origin, signing_key) {
+                (Some(origin), Some(path)) => Some(SigningKey::load(origin, path)?),
+                _ => None,
+            };
+            let report = client.verify_event(room_id, event_id, key.as_ref()).await?;
+            println!("{}", serde_json::to_string(&report)?);
+            if report.verdict == "invalid" {
+                return Err(ExitCode(exit::FINDINGS).into());
+            }
+        }
+        Command::Keys { command } => match command {
+            KeysCommand::BackupVerify => {
+                let report = client.verify_key_backup().await?;
+                println!("{}", serde_json::to_string(&report)?);
+                for warning in &report.warnings {
+                    warn!("{}", warning);
+                }
+                let unknown = report.signatures.iter().any(|s| s.signer == "unknown");
+                if !report.trusted || unknown {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+            KeysCommand::Export { output, passphrase } => {
+                let passphrase = keys::export_passphrase(passphrase, true)?;
+                let export = client.export_keys(&output, &passphrase).await?;
+                println!("{}", serde_json::to_string(&export)?);
+            }
+            KeysCommand::Import { input, passphrase } => {
+                let passphrase = keys::export_passphrase(passphrase, false)?;
+                let import = client.import_keys(&input, &passphrase).await?;
+                println!("{}", serde_json::to_string(&import)?);
+            }
+            KeysCommand::Hygiene {
+                min_one_time_keys,
+                replenish,
+                strict,
+            } => {
+                let opts = HygieneOptions {
+                    min_one_time_keys,
+                    replenish,
+                };
+                let report = client.key_hygiene(&opts).await?;
+                println!("{}", serde_json::to_string(&report)?);
+                for warning in &report.warnings {
+                    warn!("{}", warning);
+                }
+                if strict && !report.warnings.is_empty() {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+        },
+        Command::Login {
+            user_id,
+            device_name,
+            password,
+            oauth,
+            admin,
+            register_device_from,
+            ..
+        } => {
+            let Some(user_id) = user_id else {
+                bail!("a user id is required to log in");
+            };
+            if client.logged_in() {
+                bail!("already logged in");
+            }
+
+            if session::Meta::exists()? {
+                bail!("meta exists");
+            }
+
+            let oauth = if oauth {
+                Some(client.login_oauth(admin).await?)
+            } else {
+                let password = match (password, register_device_from) {
+                    (Some(p), _) => p,
+                    (None, Some(var)) => env::var(&var)
+                        .map_err(|_| anyhow!("environment variable {} is not set", var))?,
+                    (None, None) => terminal::read_password()?,
+                };
+
+                if let Err(e) = client.login_password(&password).await {
+                    bail!("login failed: {}", e);
+                }
+                None
+            };
+
+            session::Meta {
+                user_id,
+                device_name: Some(device_name),
+                oauth,
+                default_room: None,
+                archive: false,
+            }
+            .dump()?;
+        }
+        Command::Logout {} => {
+            client.logout().await?;
+        }
+        Command::Lock { command } => {
+            let status = match command {
+                LockCommand::Status { name } => client.lock_status(&name).await?,
+                LockCommand::Break { name } => client.break_lock(&name).await?,
+            };
+            println!("{}", serde_json::to_string(&status)?);
+        }
+        Command::Schedule { command } => match command {
+            ScheduleCommand::Add {
+                id,
+                cron,
+                room_id,
+                notice,
+                markdown,
+                message,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let schedule = Schedule {
+                    cron,
+                    room_id,
+                    message,
+                    notice,
+                    markdown,
+                    created_at: SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs(),
+                };
+                client.add_schedule(&id, schedule).await?;
+            }
+            ScheduleCommand::List {} => {
+                let schedules = client.list_schedules().await?;
+                println!("{}", serde_json::to_string(&schedules)?);
+            }
+            ScheduleCommand::Remove { id } => client.remove_schedule(&id).await?,
+            ScheduleCommand::Run { once } => client.run_schedules(once).await?,
+        },
+        Command::Media { command } => match command {
+            MediaCommand::PreviewUrl { url } => {
+                let preview = client.preview_url(&url).await?;
+                println!("{}", serde_json::to_string(&preview)?);
+            }
+            MediaCommand::Usage { scan, table } => {
+                let usage = client.media_usage(scan).await?;
+                let columns = [
+                    Column::number("SIZE"),
+                    Column::name("NAME"),
+                    Column::text("ROOM"),
+                    Column::text("MXC"),
+                ];
+                let Some(mut out) = table.table(&columns) else {
+                    println!("{}", serde_json::to_string(&usage)?);
+                    return Ok(());
+                };
+                for item in &usage.largest {
+                    out.row(vec![
+                        Cell::Bytes(item.size),
+                        item.name.clone().into(),
+                        item.room_id.clone().into(),
+                        item.mxc_uri.clone().into(),
+                    ]);
+                }
+                out.row(vec![
+                    Cell::Bytes(usage.total_bytes),
+                    format!("total of {} files", usage.count).into(),
+                ]);
+                out.print();
+            }
+            MediaCommand::Migrate {
+                from,
+                mapping,
+                pace,
+                rewrite_events,
+                progress,
+            } => {
+                let opts = MigrateOptions {
+                    from,
+                    mapping,
+                    pace,
+                    rewrite_events,
+                    progress,
+                };
+                let failures = client.migrate_media(&opts, &Cancel::on_ctrl_c()).await?;
+                if failures > 0 {
+                    bail!("{} media files or events failed to migrate", failures);
+                }
+            }
+        },
+        Command::Messages {
+            room_id,
+            limit,
+            order,
+            ndjson,
+            text,
+            raw_body,
+            new_only: true,
+            no_advance,
+            filter_expr,
+            ..
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let filter_expr = client.resolve_filter(filter_expr).await?;
+            let mut batch = client.messages_after_read_marker(&room_id, limit).await?;
+            client.attribute_events(&room_id, &mut batch.events).await?;
+            let mut events = batch.events.iter().collect::<Vec<_>>();
+            if let Some(ref filter) = filter_expr {
+                events.retain(|e| event_matches(filter, &room_id, e));
+            }
+            if matches!(order, Order::Desc) {
+                events.reverse();
+            }
+            if text {
+                let events: Vec<&RawValue> = events.iter().map(|e| e.as_ref()).collect();
+                render::print_event_lines(&events, raw_body)?;
+            } else if ndjson {
+                for event in events {
+                    println!("{}", event.get());
+                }
+            } else {
+                println!("{}", serde_json::to_string(&events)?);
+            }
+
+            // The marker also moves past filtered events, so that they are
+            // not fetched again by the next run.
+            let next = if no_advance {
+                None
+            } else {
+                client.advance_read_marker(&room_id, &batch).await?
+            };
+            if ndjson {
+                let summary = outputs::MarkerSummary {
+                    previous: batch.previous.as_ref().map(|e| e.to_string()),
+                    next: next.as_ref().map(|e| e.to_string()),
+                    count: batch.events.len(),
+                    advanced: next.is_some(),
+                    fallback: batch.fallback,
+                };
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+        }
+        Command::Messages {
+            room_id,
+            limit,
+            from,
+            order,
+            ndjson,
+            text,
+            raw_body,
+            cursor: Some(cursor_type),
+            no_advance,
+            filter_expr,
+            ..
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let filter_expr = client.resolve_filter(filter_expr).await?;
+            let work = async {
+                let mut batch = client
+                    .messages_after_cursor(&room_id, &cursor_type, limit)
+                    .await?;
+                client.attribute_events(&room_id, &mut batch.events).await?;
+                let summary = outputs::CursorSummary {
+                    cursor_type: cursor_type.clone(),
+                    previous: batch.previous.as_ref().map(|c| c.token.clone()),
+                    next: batch.next.token.clone(),
+                    count: batch.events.len(),
+                    advanced: !no_advance,
+                };
+
+                let mut events = batch.events.iter().collect::<Vec<_>>();
+                if let Some(ref filter) = filter_expr {
+                    events.retain(|e| event_matches(filter, &room_id, e));
+                }
+                if matches!(order, Order::Desc) {
+                    events.reverse();
+                }
+                if text {
+                    let events: Vec<&RawValue> = events.iter().map(|e| e.as_ref()).collect();
+                    render::print_event_lines(&events, raw_body)?;
+                } else if ndjson {
+                    for event in events {
+                        println!("{}", event.get());
+                    }
+                    println!("{}", serde_json::to_string(&summary)?);
+                } else {
+                    println!("{}", serde_json::to_string(&events)?);
+                }
+
+                if !no_advance {
+                    client
+                        .advance_cursor(&room_id, &cursor_type, &batch)
+                        .await?;
+                }
+                Ok::<_, anyhow::Error>(())
+            };
+            if no_advance {
+                return work.await;
+            }
+            // Concurrent runs would print the same events; the lease keeps
+            // them out between reading and advancing the cursor.
+            let name = cursor::lock_name(&room_id, &cursor_type);
+            let lock = match client.acquire_lock(&name).await? {
+                Ok(lock) => lock,
+                Err(held) => {
+                    eprintln!("error: {}", held);
+                    return Err(ExitCode(exit::HELD).into());
+                }
+            };
+            client.while_locked(lock, work, true).await?;
+        }
+        Command::Messages {
+            room_id,
+            limit,
+            from,
+            order,
+            ndjson,
+            text,
+            raw_body,
+            follow_predecessors,
+            follow,
+            follow_timeout,
+            filter_expr,
+            ..
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let filter_expr = client.resolve_filter(filter_expr).await?;
+            // The server returns the newest event first.
+            let (mut events, pagination, live_end): (Vec<Box<RawValue>>, _, _) =
+                if follow_predecessors {
+                    let msgs = client
+                        .messages_following_predecessors(&room_id, limit, from)
+                        .await?;
+                    let pagination = outputs::Pagination {
+                        start_reached: msgs.start_reached,
+                        end: msgs.end,
+                        count: msgs.events.len(),
+                        room_id: Some(msgs.room_id.to_string()),
+                        gap: msgs.gap,
+                    };
+                    (msgs.events, pagination, None)
+                } else {
+                    let msgs = client.messages(&room_id, limit, from).await?;
+                    let pagination = outputs::Pagination {
+                        start_reached: msgs.end.is_none(),
+                        end: msgs.end,
+                        count: msgs.chunk.len(),
+                        room_id: None,
+                        gap: None,
+                    };
+                    let events = msgs
+                        .chunk
+                        .into_iter()
+                        .map(|e| e.event.into_json())
+                        .collect();
+                    (events, pagination, Some(msgs.start))
+                };
+            if let Some(ref gap) = pagination.gap {
+                warn!("{}", gap);
+            }
+            client.attribute_events(&room_id, &mut events).await?;
+            if let Some(ref filter) = filter_expr {
+                events.retain(|e| event_matches(filter, &room_id, e));
+            }
+            if matches!(order, Order::Asc) {
+                events.reverse();
+            }
+
+            if text {
+                let events: Vec<&RawValue> = events.iter().map(|e| e.as_ref()).collect();
+                render::print_event_lines(&events, raw_body)?;
+            } else if follow {
+                // No pagination line, the live events continue the log.
+                for event in events {
+                    println!("{}", event.get());
+                }
+            } else if ndjson {
+                for event in events {
+                    println!("{}", event.get());
+                }
+                println!("{}", serde_json::to_string(&pagination)?);
+            } else {
+                println!("{}", serde_json::to_string(&events)?);
+            }
+
+            if let (true, Some(token)) = (follow, live_end) {
+                client
+                    .follow_messages(&room_id, token, follow_timeout, |mut events| {
+                        if let Some(ref filter) = filter_expr {
+                            events.retain(|e| event_matches(filter, &room_id, e));
+                        }
+                        if text {
+                            let events: Vec<&RawValue> =
+                                events.iter().map(|e| e.as_ref()).collect();
+                            render::print_event_lines(&events, raw_body)?;
+                        } else {
+                            for event in events {
+                                println!("{}", event.get());
+                            }
+                        }
+                        Ok(())
+                    })
+                    .await?;
+            }
+        }
+        Command::Room { command } => match command {
+            RoomCommand::Audit {
+                room_id,
+                private_name,
+                encrypted_space,
+            } => {
+                let room_id = client.resolve_optional_room(room_id.as_ref()).await?;
+                let encrypted_space = client.resolve_rooms(&encrypted_space).await?;
+                let opts = AuditOptions {
+                    private_name,
+                    encrypted_spaces: encrypted_space,
+                };
+                let findings = client.audit_rooms(room_id.as_deref(), &opts).await?;
+                println!("{}", serde_json::to_string(&findings)?);
+                if findings.iter().any(|f| f.severity == Severity::Error) {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+            RoomCommand::StateDiff {
+                room_id,
+                since,
+                between,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let changes = match (since, between.as_deref()) {
+                    (_, Some([from, to])) => client.state_diff_between(&room_id, from, to).await?,
+                    (Some(since), _) => client.state_diff_since(&room_id, since).await?,
+                    _ => bail!("either --since or --between is required"),
+                };
+                println!("{}", serde_json::to_string(&changes)?);
+            }
+            RoomCommand::Snapshot {
+                room_id,
+                output,
+                gzip,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let members = client
+                    .snapshot_room(&room_id, output.as_deref(), gzip)
+                    .await?;
+                if let Some(path) = output {
+                    let summary = outputs::SnapshotSummary {
+                        room_id: room_id.to_string(),
+                        path: path.display().to_string(),
+                        members,
+                        gzip,
+                    };
+                    println!("{}", serde_json::to_string(&summary)?);
+                }
+            }
+            RoomCommand::SnapshotDiff { .. } => {}
+            RoomCommand::DownloadMedia {
+                room_id,
+                since,
+                output,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let opts = DownloadOptions { since, output };
+                let summary = client.download_media(&room_id, &opts).await?;
+                println!("{}", serde_json::to_string(&summary)?);
+                if summary.failed > 0 {
+                    bail!("{} downloads failed", summary.failed);
+                }
+            }
+            RoomCommand::SyncMembers {
+                room_id,
+                from_room,
+                remove_extra,
+                keep,
+                yes,
+                report,
+                retry_from,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let from_room = client.resolve_room(&from_room).await?;
+                let opts = MemberSyncOptions {
+                    remove_extra,
+                    keep,
+                    apply: yes,
+                    only: retry_from.map(batch::read_report).transpose()?,
+                };
+                let cancel = Cancel::on_ctrl_c();
+                let plan = client
+                    .sync_members(&room_id, &from_room, &opts, &cancel)
+                    .await?;
+                println!("{}", serde_json::to_string(&plan)?);
+                let failures: Vec<_> = plan
+                    .iter()
+                    .filter_map(|a| {
+                        Some(outputs::BatchFailure {
+                            item: a.user_id.clone(),
+                            action: a.action.to_string(),
+                            errcode: a.errcode.clone(),
+                            error: a.error.clone()?,
+                            retryable: a.retryable.unwrap_or(false),
+                        })
+                    })
+                    .collect();
+                if let Some(path) = report {
+                    batch::write_report(path, &failures)?;
+                }
+                if cancel.requested() {
+                    return Err(Interrupted.into());
+                }
+                if !failures.is_empty() {
+                    bail!("{} membership changes failed", failures.len());
+                }
+            }
+            RoomCommand::Info { room_id, table } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                print_room_info(&client.room_info(&room_id).await?, &table)?;
+            }
+            RoomCommand::Set {
+                room_id,
+                name,
+                topic,
+                avatar,
+                table,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                client
+                    .set_room_profile(
+                        &room_id,
+                        name.as_deref(),
+                        topic.as_deref(),
+                        avatar.as_deref(),
+                    )
+                    .await?;
+                print_room_info(&client.room_info(&room_id).await?, &table)?;
+            }
+            RoomCommand::Triage {
+                room_id,
+                handled,
+                reaction,
+                by,
+                since,
+                table,
+                ..
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let opts = TriageOptions {
+                    reaction,
+                    by,
+                    since,
+                    handled,
+                };
+                let entries = client.triage(&room_id, &opts).await?;
+                let columns = [
+                    Column::text("SENT"),
+                    Column::text("SENDER"),
+                    Column::name("BODY"),
+                    Column::text("HANDLED BY"),
+                    Column::text("HANDLED"),
+                ];
+                let Some(mut out) = table.table(&columns) else {
+                    for entry in &entries {
+                        println!("{}", serde_json::to_string(entry)?);
+                    }
+                    return Ok(());
+                };
+                for entry in &entries {
+                    out.row(vec![
+                        format_ts(entry.origin_server_ts).into(),
+                        entry.sender.as_str().into(),
+                        entry.body.clone().into(),
+                        Some(entry.handled_by.join(","))
+                            .filter(|h| !h.is_empty())
+                            .into(),
+                        entry.handled_at.map(format_ts).into(),
+                    ]);
+                }
+                out.print();
+            }
+            RoomCommand::Who { room_id, query } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let matches = client.find_members(&room_id, &query).await?;
+                println!("{}", serde_json::to_string(&matches)?);
+                if matches.is_empty() {
+                    bail!("no member of {} matches {}", room_id, query);
+                }
+            }
+            RoomCommand::Tombstone {
+                room_id,
+                successor,
+                message,
+                invite_only,
+                force,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let successor = client.resolve_room(&successor).await?;
+                let opts = TombstoneOptions {
+                    message,
+                    invite_only,
+                    force,
+                };
+                let summary = client.tombstone_room(&room_id, &successor, &opts).await?;
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+            RoomCommand::PowerPreset {
+                room_id,
+                preset,
+                force,
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let preset = PowerPreset::load(&preset)?;
+                let summary = client.apply_power_preset(&room_id, &preset, force).await?;
+                println!("{}", serde_json::to_string(&summary)?);
+            }
+            RoomCommand::Join {
+                room,
+                require_member,
+            } => {
+                let outcome = client
+                    .join_guarded(&room.room, &room.via, require_member.as_deref())
+                    .await?;
+                println!("{}", serde_json::to_string(&outcome)?);
+                if !outcome.joined {
+                    return Err(ExitCode(1).into());
+                }
+                if let Some(ref event_id) = room.event_id {
+                    let room_id = RoomId::parse(&outcome.room_id)?;
+                    let event = client.room_event(&room_id, event_id).await?;
+                    println!("{}", event.get());
+                }
+            }
+            RoomCommand::Create {
+                from_spec,
+                alias,
+                if_not_exists,
+                fail_if_exists,
+                direct,
+                no_encrypt,
+                reuse_existing,
+                force,
+                reconcile,
+                invite,
+                smtp_url,
+                smtp_from,
+                email_template,
+                power_preset,
+                wait_join,
+                timeout,
+            } => {
+                let reconcile = client.resolve_optional_room(reconcile.as_ref()).await?;
+                if let Some(user_id) = direct {
+                    let opts = DirectOptions {
+                        encrypt: !no_encrypt,
+                        reuse_existing,
+                        force,
+                    };
+                    let room = client.create_direct_room(&user_id, &opts).await?;
+                    println!("{}", serde_json::to_string(&room)?);
+                    return Ok(());
+                }
+                let mut spec = match from_spec {
+                    Some(path) => RoomSpec::load(path)?,
+                    None => RoomSpec::default(),
+                };
+                if alias.is_some() {
+                    spec.alias = alias;
+                }
+                spec.invite.extend(invite);
+                // A broken preset would leave a half set up room behind.
+                let power_preset = power_preset
+                    .map(|name| PowerPreset::load(&name))
+                    .transpose()?;
+                if let Some(ref preset) = power_preset {
+                    preset.check_new_room(client.user_id.as_str())?;
+                }
+
+                let smtp = match (smtp_url, smtp_from) {
+                    (Some(url), Some(from)) => Some(SmtpConfig {
+                        url,
+                        from,
+                        template: email_template.map(fs::read_to_string).transpose()?,
+                    }),
+                    _ => None,
+                };
+
+                let mut summary = match reconcile {
+                    Some(room_id) => client.reconcile_room(&room_id, &spec).await?,
+                    None if if_not_exists => {
+                        client.find_or_create_room(&spec, smtp.as_ref()).await?
+                    }
+                    None => client.create_room_from_spec(&spec, smtp.as_ref()).await?,
+                };
+                if summary.existed {
+                    println!("{}", serde_json::to_string(&summary)?);
+                    if fail_if_exists {
+                        return Err(ExitCode(exit::EXISTS).into());
+                    }
+                    return Ok(());
+                }
+                if let Some(ref preset) = power_preset {
+                    let room_id: OwnedRoomId = summary.room_id.parse()?;
+                    let applied = client.apply_power_preset(&room_id, preset, false).await?;
+                    if !applied.changes.is_empty() {
+                        summary.changes.push(String::from("power_levels"));
+                    }
+                }
+                println!("{}", serde_json::to_string(&summary)?);
+
+                if wait_join && !summary.invited.is_empty() {
+                    let room_id: OwnedRoomId = summary.room_id.parse()?;
+                    let users = summary.invited.iter().map(|u| u.parse()).collect::<Result<
+                        Vec<OwnedUserId>,
+                        _,
+                    >>(
+                    )?;
+                    let wait = client.wait_for_joins(&room_id, &users, timeout).await?;
+                    println!("{}", serde_json::to_string(&wait)?);
+                    let has = |state| wait.invitees.iter().any(|i| i.state == state);
+                    if has(JoinState::Declined) {
+                        return Err(ExitCode(exit::JOIN_DECLINED).into());
+                    }
+                    if has(JoinState::Pending) {
+                        return Err(ExitCode(exit::JOIN_PENDING).into());
+                    }
+                }
+            }
+        },
+        Command::Rooms {
+            room_id,
+            query_members,
+            query_avatars,
+            jobs,
+            cache_ttl,
+            table,
+        } => {
+            let room_id = client.resolve_optional_room(room_id.as_ref()).await?;
+            let single = room_id.is_some();
+            let rooms = match room_id {
+                Some(room_id) => {
+                    let Some(room) = client.get_room(&room_id) else {
+                        bail!("no such room: {}", room_id);
+                    };
+                    let (output, _) = client
+                        .query_room(room, query_avatars, query_members, None)
+                        .await?;
+                    vec![output]
+                }
+                None => {
+                    client
+                        .list_rooms(query_avatars, query_members, jobs, cache_ttl)
+                        .await?
+                }
+            };
+
+            let columns = [
+                Column::text("ROOM ID"),
+                Column::name("NAME"),
+                Column::number("MEMBERS"),
+                Column::number("UNREAD"),
+                Column::text("ENCRYPTED"),
+            ];
+            match table.table(&columns) {
+                Some(mut out) => {
+                    for room in &rooms {
+                        out.row(vec![
+                            room.room_id.as_str().into(),
+                            room.display_name.as_str().into(),
+                            Cell::Count(room.joined_members),
+                            Cell::Count(room.unread_notifications.notification_count),
+                            (if room.is_encrypted { "yes" } else { "no" }).into(),
+                        ]);
+                    }
+                    out.print();
+                }
+                None if single => println!("{}", serde_json::to_string(&rooms[0])?),
+                None => println!("{}", serde_json::to_string(&rooms)?),
+            }
+        }
+        Command::Mirror {
+            from,
+            to,
+            prefix,
+            reupload_media,
+        } => {
+            let from = client.resolve_room(&from).await?;
+            let to = client.resolve_room(&to).await?;
+            client
+                .mirror(MirrorOptions {
+                    from,
+                    to,
+                    prefix,
+                    reupload_media,
+                })
+                .await?;
+        }
+        Command::Push { command } => match command {
+            PushCommand::Test {
+                gateway_url,
+                timeout,
+            } => {
+                let test = client.test_push(gateway_url.as_deref(), timeout).await?;
+                println!("{}", serde_json::to_string(&test)?);
+                let failed = !test.flagged
+                    || test
+                        .pushers
+                        .iter()
+                        .any(|p| p.accepted == Some(false) || p.error.is_some())
+                    || test.gateway.as_ref().is_some_and(|g| !g.ok);
+                if failed {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+        },
+        Command::Read {
+            room_id,
+            event_id,
+            thread,
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let marker = client
+                .mark_read(&room_id, event_id.as_deref(), thread.as_deref())
+                .await?;
+            println!("{}", serde_json::to_string(&marker)?);
+        }
+        Command::Redact {
+            room_id,
+            event_id,
+            reason,
+            report,
+        } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let redactions = client
+                .redact_events(&room_id, &event_id, reason.as_deref())
+                .await?;
+            for redaction in &redactions {
+                println!("{}", serde_json::to_string(redaction)?);
+            }
+            let failures: Vec<_> = redactions
+                .iter()
+                .filter_map(|r| {
+                    Some(outputs::BatchFailure {
+                        item: r.event_id.clone(),
+                        action: String::from("redact"),
+                        errcode: r.errcode.clone(),
+                        error: r.error.clone()?,
+                        retryable: r.retryable,
+                    })
+                })
+                .collect();
+            if let Some(path) = report {
+                batch::write_report(path, &failures)?;
+            }
+            if !failures.is_empty() {
+                bail!(
+                    "{} of {} redactions failed",
+                    failures.len(),
+                    redactions.len()
+                );
+            }
+        }
+        Command::Verify {
+            user,
+            device,
+            timeout,
+        } => {
+            let opts = VerifyOptions {
+                user_id: user,
+                device_id: device,
+                timeout,
+            };
+            let result = client.verify(&opts).await?;
+            println!("{}", serde_json::to_string(&result)?);
+            if result.timed_out {
+                return Err(ExitCode(exit::TIMEOUT).into());
+            }
+            if !result.verified {
+                bail!("verification failed");
+            }
+        }
+        Command::Send {
+            room_id,
+            jobs,
+            reply_to,
+            thread,
+            edit,
+            react,
+            event,
+            markdown,
+            notice,
+            emote,
+            msgtype,
+            attachment,
+            name,
+            no_thumbnail,
+            code,
+            kv,
+            table_csv,
+            table_json,
+            max_rows,
+            content_file,
+            merge,
+            location,
+            location_description,
+            raw,
+            event_type,
+            state,
+            state_key,
+            as_identity,
+            as_avatar,
+            mention,
+            mention_room,
+            wait_ack,
+            force_plaintext,
+            preview,
+            fixture: _,
+            wait,
+            wait_timeout,
+            dedupe_window,
+            dedupe_cache,
+            fail_on_duplicate,
+            stream,
+            batch_interval,
+            spool,
+            flush,
+            max_age,
+            overflow,
+            split,
+            ack_type,
+            timeout,
+            message,
+        } => {
+            if flush {
+                let flush = client.flush_spool(max_age).await?;
+                println!("{}", serde_json::to_string(&flush)?);
+                if let Some(ref error) = flush.error {
+                    bail!("{} messages left in the spool: {}", flush.remaining, error);
+                }
+                if flush.failed > 0 {
+                    bail!("{} spooled messages were rejected", flush.failed);
+                }
+                return Ok(());
+            }
+            let room_id = match client.fixture_room() {
+                // Aliases cannot be resolved offline.
+                Some(fixture) => {
+                    if room_id
+                        .iter()
+                        .any(|room| !matches!(room, RoomArg::Id(id) if **id == *fixture))
+                    {
+                        bail!("the fixture is a snapshot of {}", fixture);
+                    }
+                    vec![fixture.to_owned()]
+                }
+                None if room_id.is_empty() => match session::Meta::load()?.default_room {
+                    Some(room_id) => vec![room_id],
+                    None => bail!("--room-id is required without a default room"),
+                },
+                None => client.resolve_rooms(&room_id).await?,
+            };
+            // These refer to one event or wait for it.
+            let single = attachment.is_some()
+                || reply_to.is_some()
+                || thread.is_some()
+                || edit.is_some()
+                || react.is_some()
+                || stream
+                || wait
+                || wait_ack;
+            if room_id.len() > 1 && single {
+                bail!("--attachment, --reply-to, --thread, --edit, --react, --stream, --wait and --wait-ack take one room");
+            }
+            if let (Some(key), Some(event_id)) = (react, event) {
+                let reaction = client.send_reaction(&room_id[0], &event_id, &key).await?;
+                if reaction.duplicate {
+                    eprintln!("already reacted to {} with {}", event_id, key);
+                }
+                println!("{}", serde_json::to_string(&reaction)?);
+                return Ok(());
+            }
+            let client = match as_identity {
+                Some(name) => client
+                    .clone()
+                    .with_identity(Identity::resolve(&name, as_avatar)?),
+                None => client.clone(),
+            };
+            let client = if mention.is_empty() && !mention_room {
+                client
+            } else {
+                let mentions = client.resolve_mentions(&mention, mention_room).await;
+                client.with_mentions(mentions)
+            };
+            let client = if preview {
+                client.with_preview()
+            } else {
+                client
+            };
+            let client = if force_plaintext {
+                client.with_plaintext()
+            } else {
+                client
+            };
+            let client = match dedupe_window {
+                Some(window) => client.with_dedupe(Dedupe {
+                    window,
+                    cache_only: dedupe_cache,
+                    fail_on_duplicate,
+                }),
+                None => client,
+            };
+            let client = client.with_oversize(if split { Oversize::Split } else { overflow });
+
+            if stream {
+                let opts = StreamOptions {
+                    batch_interval,
+                    markdown,
+                    notice,
+                };
+                if client.stream_stdin(&room_id[0], &opts).await? {
+                    return Err(Interrupted.into());
+                }
+                return Ok(());
+            }
+
+            let table = match (table_csv, table_json) {
+                (Some(path), _) => Some(format::Table::from_csv(path)?),
+                (_, Some(path)) => Some(format::Table::from_json(path)?),
+                _ => None,
+            };
+
+            // Read what to send once; it is the same for every room.
+            let raw_content = if raw {
+                let raw = match content_file {
+                    Some(ref path) => fs::read_to_string(path)?,
+                    None => terminal::read_stdin_to_string()?,
+                };
+                let content: serde_json::Value = serde_json::from_str(&raw)
+                    .map_err(|e| anyhow!("--raw content is not valid JSON: {}", e))?;
+                if !content.is_object() {
+                    bail!("--raw content must be a JSON object");
+                }
+                Some(content)
+            } else {
+                None
+            };
+            let content = match content_file {
+                _ if raw => None,
+                Some(path) => {
+                    let mut content: serde_json::Value =
+                        serde_json::from_str(&fs::read_to_string(path)?)?;
+                    match (message.as_ref(), merge) {
+                        (Some(message), true) => {
+                            if let Some(object) = content.as_object_mut() {
+                                // The html version would contradict the new body.
+                                object.remove("format");
+                                object.remove("formatted_body");
+                                object.insert(String::from("body"), message.clone().into());
+                            }
+                        }
+                        (Some(_), false) => {
+                            bail!("use --merge to combine --content-file with a message")
+                        }
+                        (None, _) => {}
+                    }
+                    Some(content)
+                }
+                None => None,
+            };
+            let content = match location {
+                Some(location) => Some(location.content(location_description.as_deref())),
+                None => content,
+            };
+            let formatted = match table {
+                _ if content.is_some() => None,
+                Some(table) => Some(table.render(max_rows)),
+                None if !kv.is_empty() => Some(format::kv_block(&kv)),
+                None => None,
+            }
+            .map(|body| body.with_intro(message.as_deref().unwrap_or("")));
+            let formatted = match code {
+                Some(ref language) => {
+                    let text = match message {
+                        Some(ref message) => message.clone(),
+                        None => terminal::read_stdin_to_string()?,
+                    };
+                    Some(format::code_block(&text, language))
+                }
+                None => formatted,
+            };
+            let body = match message {
+                _ if attachment.is_some()
+                    || content.is_some()
+                    || formatted.is_some()
+                    || raw_content.is_some() =>
+                {
+                    None
+                }
+                Some(message) => Some(message),
+                None => Some(terminal::read_stdin_to_string()?),
+            };
+
+            let spool_entry = |room_id: OwnedRoomId| {
+                let body = body.clone().unwrap_or_default();
+                SpoolEntry::new(
+                    room_id.into(),
+                    body,
+                    markdown,
+                    notice,
+                    emote,
+                    msgtype.clone(),
+                )
+            };
+
+            let send = |room_id: OwnedRoomId| {
+                let (client, attachment, name) = (&client, &attachment, &name);
+                let (content, formatted, body) = (&content, &formatted, &body);
+                let (reply_to, thread, edit, msgtype) = (&reply_to, &thread, &edit, &msgtype);
+                let (raw_content, event_type, state_key) = (&raw_content, &event_type, &state_key);
+                async move {
+                    let event_id = if let Some(content) = raw_content {
+                        let event_type = event_type.as_deref().unwrap_or_default();
+                        let state_key = state.then(|| state_key.as_deref().unwrap_or(""));
+                        Some(
+                            client
+                                .send_raw_event(&room_id, event_type, state_key, content.clone())
+                                .await?,
+                        )
+                    } else if let Some(path) = attachment {
+                        Some(
+                            client
+                                .send_attachment(&room_id, path, name.as_deref(), !no_thumbnail)
+                                .await?,
+                        )
+                    } else if let Some(content) = content {
+                        client
+                            .send_content(&room_id, content.clone(), notice)
+                            .await?
+                    } else if let Some(body) = formatted {
+                        client
+                            .send_formatted(
+                                &room_id,
+                                body,
+                                notice,
+                                reply_to.as_ref(),
+                                thread.as_ref(),
+                            )
+                            .await?
+                    } else {
+                        let body = body.as_deref().unwrap_or("");
+                        if let Some(root) = thread {
+                            let reply_to = reply_to.as_deref();
+                            client
+                                .send_message_thread(
+                                    &room_id, root, reply_to, body, markdown, notice,
+                                )
+                                .await?
+                        } else if let Some(event_id) = reply_to {
+                            client
+                                .send_message_reply(&room_id, event_id, body, markdown, notice)
+                                .await?
+                        } else if let Some(event_id) = edit {
+                            client
+                                .send_edit(&room_id, event_id, body, markdown, notice)
+                                .await?
+                        } else if notice {
+                            client.send_notice(&room_id, body, markdown).await?
+                        } else if emote {
+                            client.send_emote(&room_id, body, markdown).await?
+                        } else if let Some(msgtype) = msgtype {
+                            client
+                                .send_message_type(&room_id, body, markdown, msgtype)
+                                .await?
+                        } else {
+                            client.send_message(&room_id, body, markdown).await?
+                        }
+                    };
+                    Ok::<_, anyhow::Error>(event_id)
+                }
+            };
+
+            if room_id.len() > 1 {
+                let deliveries: Vec<RoomDelivery> = stream::iter(room_id)
+                    .map(|room_id| {
+                        let send = &send;
+                        async move {
+                            let result = batch::with_retries(|| async {
+                                match send(room_id.clone()).await {
+                                    Ok(event_id) => Ok(Ok(event_id)),
+                                    Err(e) => match e.downcast::<Duplicate>() {
+                                        Ok(duplicate) => Ok(Err(duplicate)),
+                                        Err(e) => Err(e),
+                                    },
+                                }
+                            })
+                            .await;
+                            let mut delivery = RoomDelivery {
+                                room_id: room_id.to_string(),
+                                event_id: None,
+                                duplicate: false,
+                                spooled: false,
+                                errcode: None,
+                                error: None,
+                            };
+                            match result {
+                                Ok(Ok(event_id)) => {
+                                    delivery.event_id = event_id.map(|e| e.to_string())
+                                }
+                                Ok(Err(_)) => delivery.duplicate = true,
+                                Err(e) => {
+                                    if spool && e.retryable {
+                                        match client.spool_message(&spool_entry(room_id)) {
+                                            Ok(_) => delivery.spooled = true,
+                                            Err(e) => warn!("spooling failed: {}", e),
+                                        }
+                                    }
+                                    delivery.errcode = e.errcode;
+                                    delivery.error = Some(e.error);
+                                }
+                            }
+                            delivery
+                        }
+                    })
+                    .buffered(jobs.max(1))
+                    .collect()
+                    .await;
+                println!("{}", serde_json::to_string(&deliveries)?);
+
+                let failed = deliveries
+                    .iter()
+                    .filter(|d| d.error.is_some() && !d.spooled)
+                    .count();
+                if failed > 0 {
+                    bail!("sending failed in {} of {} rooms", failed, deliveries.len());
+                }
+                if fail_on_duplicate && deliveries.iter().any(|d| d.duplicate) {
+                    return Err(ExitCode(exit::DUPLICATE).into());
+                }
+                return Ok(());
+            }
+
+            let room_id = room_id.into_iter().next().unwrap();
+            let event_id = match send(room_id.clone()).await {
+                Ok(event_id) => event_id,
+                Err(e) if spool && spool::unreachable(&e) => {
+                    client.spool_message(&spool_entry(room_id))?;
+                    eprintln!("spooled for send --flush: {}", e);
+                    return Ok(());
+                }
+                Err(e) => return Err(e),
+            };
+            if let Some(ref event_id) = event_id {
+                let sent = SentMessage {
+                    room_id: room_id.to_string(),
+                    event_id: event_id.to_string(),
+                };
+                println!("{}", serde_json::to_string(&sent)?);
+            }
+            if let (true, Some(event_id)) = (wait, &event_id) {
+                if !client
+                    .wait_for_echo(&room_id, event_id, wait_timeout)
+                    .await?
+                {
+                    eprintln!(
+                        "error: {} did not come back within {}",
+                        event_id,
+                        humantime::format_duration(wait_timeout)
+                    );
+                    return Err(ExitCode(exit::TIMEOUT).into());
+                }
+            }
+            if let (true, Some(ack_type), Some(event_id)) = (wait_ack, ack_type, event_id) {
+                let ack = client
+                    .wait_for_ack(&room_id, &event_id, &ack_type, timeout)
+                    .await?;
+                println!("{}", serde_json::to_string(&ack)?);
+                // Acks without a status of 0 do not confirm the delivery.
+                if ack.get("status").and_then(serde_json::Value::as_i64) != Some(0) {
+                    eprintln!("error: the hook for {} did not succeed", event_id);
+                    return Err(ExitCode(exit::ACK_FAILED).into());
+                }
+            }
+        }
+        Command::Space { command } => match command {
+            SpaceCommand::PowerAudit {
+                space_id,
+                policy,
+                reference,
+            } => {
+                let space_id = client.resolve_room(&space_id).await?;
+                let reference = client.resolve_optional_room(reference.as_ref()).await?;
+                let policy = match (policy, reference) {
+                    (Some(path), _) => Some(serde_yaml::from_str(&fs::read_to_string(path)?)?),
+                    (None, Some(room_id)) => {
+                        client
+                            .get_state(&room_id, "m.room.power_levels", "")
+                            .await?
+                    }
+                    (None, None) => None,
+                };
+                let report = client.power_audit(&space_id, policy.as_ref()).await?;
+                println!("{}", serde_json::to_string(&report)?);
+                if report.iter().any(|r| !r.findings.is_empty()) {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+            SpaceCommand::Grant { user_id, space_id } => {
+                let space_id = client.resolve_room(&space_id).await?;
+                let report = client.grant_space_access(&space_id, &user_id).await?;
+                println!("{}", serde_json::to_string(&report)?);
+                let failed = report.iter().filter(|r| r.error.is_some()).count();
+                if failed > 0 {
+                    bail!("granting access failed in {} rooms", failed);
+                }
+            }
+            SpaceCommand::Revoke {
+                user_id,
+                space_id,
+                reason,
+            } => {
+                let space_id = client.resolve_room(&space_id).await?;
+                let report = client
+                    .revoke_space_access(&space_id, &user_id, reason.as_deref())
+                    .await?;
+                println!("{}", serde_json::to_string(&report)?);
+                let failed = report.iter().filter(|r| r.error.is_some()).count();
+                if failed > 0 {
+                    bail!("revoking access failed in {} rooms", failed);
+                }
+            }
+            SpaceCommand::Publish {
+                space_id,
+                children_join_rule,
+                child,
+                index_message,
+                continue_on_error,
+            } => {
+                let space_id = client.resolve_room(&space_id).await?;
+                let child = client.resolve_rooms(&child).await?;
+                let index_message = client.resolve_optional_room(index_message.as_ref()).await?;
+                let opts = PublishOptions {
+                    children: child,
+                    children_join_rule,
+                    index_room: index_message,
+                    continue_on_error,
+                };
+                let steps = client.publish_space(&space_id, &opts).await?;
+                println!("{}", serde_json::to_string(&steps)?);
+                let failed = steps.iter().filter(|s| s.error.is_some()).count();
+                if failed > 0 {
+                    bail!("{} steps of publishing {} failed", failed, space_id);
+                }
+            }
+            SpaceCommand::Unpublish {
+                space_id,
+                join_rule,
+                children_join_rule,
+                unpin,
+                continue_on_error,
+            } => {
+                let space_id = client.resolve_room(&space_id).await?;
+                let unpin = client.resolve_optional_room(unpin.as_ref()).await?;
+                let opts = UnpublishOptions {
+                    join_rule,
+                    children_join_rule,
+                    unpin_room: unpin,
+                    continue_on_error,
+                };
+                let steps = client.unpublish_space(&space_id, &opts).await?;
+                println!("{}", serde_json::to_string(&steps)?);
+                let failed = steps.iter().filter(|s| s.error.is_some()).count();
+                if failed > 0 {
+                    bail!("{} steps of unpublishing {} failed", failed, space_id);
+                }
+            }
+        },
+        Command::Synapse { command } => match command {
+            SynapseCommand::Room {
+                room_id: Some(room_id),
+                delete_extremities,
+                yes,
+                ..
+            } => {
+                let room_id = client.resolve_room(&room_id).await?;
+                let room = client.forward_extremities(room_id.as_str()).await?;
+                if !delete_extremities {
+                    println!("{}", serde_json::to_string(&room)?);
+                    return Ok(());
+                }
+                let question = format!(
+                    "delete the forward extremities of {} ({} now)?",
+                    room_id, room.count
+                );
+                extremities::confirm_delete(&question, yes).await?;
+                let left = client.delete_forward_extremities(room_id.as_str()).await?;
+                println!("{}", serde_json::to_string(&left)?);
+            }
+            SynapseCommand::Room {
+                min_extremities,
+                delete_extremities,
+                yes,
+                ..
+            } => {
+                let rooms = client.rooms_with_extremities(min_extremities).await?;
+                if !delete_extremities {
+                    for room in &rooms {
+                        println!("{}", serde_json::to_string(room)?);
+                    }
+                    return Ok(());
+                }
+                if rooms.is_empty() {
+                    return Ok(());
+                }
+                for room in &rooms {
+                    eprintln!("{} {}", room.count, room.room_id);
+                }
+                let question = format!(
+                    "delete the forward extremities of these {} rooms?",
+                    rooms.len()
+                );
+                extremities::confirm_delete(&question, yes).await?;
+                for room in rooms {
+                    match client.delete_forward_extremities(&room.room_id).await {
+                        Ok(mut left) => {
+                            left.name = room.name;
+                            println!("{}", serde_json::to_string(&left)?);
+                        }
+                        Err(e) => warn!("{}: {}", room.room_id, e),
+                    }
+                }
+            }
+            SynapseCommand::Rooms {
+                search_term,
+                order_by,
+                dir,
+                limit,
+                min_members,
+                max_members,
+                table,
+            } => {
+                let opts = synapse::RoomListOptions {
+                    search_term,
+                    order_by: order_by.map(|o| o.as_str().to_string()),
+                    backwards: matches!(dir, Direction::B),
+                    limit,
+                    min_members,
+                    max_members,
+                };
+                let columns = [
+                    Column::text("ROOM ID"),
+                    Column::name("NAME"),
+                    Column::number("MEMBERS"),
+                    Column::number("LOCAL"),
+                    Column::number("STATE"),
+                    Column::text("VERSION"),
+                ];
+                // The table needs all rows for its widths; NDJSON streams.
+                let mut out = table.table(&columns);
+                client
+                    .synapse_rooms(&opts, |room| {
+                        let Some(ref mut out) = out else {
+                            println!("{}", serde_json::to_string(room)?);
+                            return Ok(());
+                        };
+                        let text = |key: &str| room.get(key).and_then(serde_json::Value::as_str);
+                        let count = |key: &str| room.get(key).and_then(serde_json::Value::as_u64);
+                        out.row(vec![
+                            text("room_id").into(),
+                            text("name").or(text("canonical_alias")).into(),
+                            count("joined_members").map(Cell::Count).into(),
+                            count("joined_local_members").map(Cell::Count).into(),
+                            count("state_events").map(Cell::Count).into(),
+                            text("version").into(),
+                        ]);
+                        Ok(())
+                    })
+                    .await?;
+                if let Some(out) = out {
+                    out.print();
+                }
+            }
+            SynapseCommand::Stats {
+                snapshot: true,
+                output,
+                ..
+            } => {
+                let snapshot = client.append_stats_snapshot(&output).await?;
+                println!("{}", serde_json::to_string(&snapshot)?);
+            }
+            SynapseCommand::Stats {
+                output,
+                since,
+                table,
+                ..
+            } => {
+                let report = stats::report(&output, since)?;
+                let columns = [
+                    Column::text("METRIC"),
+                    Column::number("FIRST"),
+                    Column::number("LAST"),
+                    Column::number("CHANGE"),
+                    Column::number("%"),
+                    Column::text("TREND"),
+                ];
+                let Some(mut out) = table.table(&columns) else {
+                    println!("{}", serde_json::to_string(&report)?);
+                    return Ok(());
+                };
+                for metric in &report.metrics {
+                    let count = |n| {
+                        if metric.bytes {
+                            Cell::Bytes(n)
+                        } else {
+                            Cell::Count(n)
+                        }
+                    };
+                    out.row(vec![
+                        metric.name.into(),
+                        count(metric.first),
+                        count(metric.last),
+                        Cell::Change {
+                            delta: metric.delta,
+                            bytes: metric.bytes,
+                        },
+                        metric.percent.map(|p| format!("{:+.1}", p)).into(),
+                        metric.sparkline.as_str().into(),
+                    ]);
+                }
+                out.print();
+            }
+            SynapseCommand::Users {
+                inactive,
+                deactivate_found,
+                notice_found,
+                yes: _,
+                pace,
+                progress,
+                report,
+                limit,
+                table,
+            } => {
+                let actions = synapse::UserActions {
+                    deactivate: deactivate_found,
+                    notice: notice_found,
+                    pace,
+                    progress,
+                    report,
+                };
+                let cancel = Cancel::on_ctrl_c();
+                let mut users = client.inactive_users(inactive, limit).await?;
+                if !actions.is_empty() {
+                    client.act_on_users(&mut users, &actions, &cancel).await?;
+                }
+                let columns = [
+                    Column::text("USER ID"),
+                    Column::text("LAST SEEN"),
+                    Column::text("CREATED"),
+                    Column::text("ACTIONS"),
+                    Column::name("ERROR"),
+                ];
+                match table.table(&columns) {
+                    Some(mut out) => {
+                        for user in &users {
+                            out.row(vec![
+                                user.user_id.as_str().into(),
+                                user.last_seen_ts.map(format_ts).into(),
+                                user.creation_ts.map(format_ts).into(),
+                                Some(user.actions.join(","))
+                                    .filter(|a| !a.is_empty())
+                                    .into(),
+                                user.error.clone().into(),
+                            ]);
+                        }
+                        out.print();
+                    }
+                    None => {
+                        for user in &users {
+                            println!("{}", serde_json::to_string(user)?);
+                        }
+                    }
+                }
+                if cancel.requested() {
+                    return Err(Interrupted.into());
+                }
+                let failed = users.iter().filter(|u| u.error.is_some()).count();
+                if failed > 0 {
+                    bail!("actions failed for {} users", failed);
+                }
+            }
+            SynapseCommand::Whois {
+                user_id,
+                geoip,
+                max_countries,
+                fail_on_anomaly,
+            } => {
+                let opts = WhoisOptions {
+                    geoip,
+                    max_countries,
+                };
+                let report = client.whois_user(&user_id, &opts).await?;
+                println!("{}", serde_json::to_string(&report)?);
+                if fail_on_anomaly && !report.findings.is_empty() {
+                    return Err(ExitCode(exit::FINDINGS).into());
+                }
+            }
+        },
+        Command::Sync {
+            socket,
+            exec,
+            to_device_type,
+            ack_type,
+            exec_rate,
+            exec_burst,
+            exec_overflow,
+            exec_queue,
+            filter_expr,
+            print_events,
+            text,
+            raw_body,
+            include_receipts,
+            receipts_thread,
+            include_typing,
+            include_calls,
+            notify_calls,
+            autojoin,
+            require_member,
+            space_policy,
+            auto_verify_from,
+            auto_verify_delay,
+            health_interval,
+            max_lag,
+            ..
+        } => {
+            let filter_expr = client.resolve_filter(filter_expr).await?;
+            let space_policy = client.resolve_optional_room(space_policy.as_ref()).await?;
+            let client = client.clone().with_sync_health(HealthOptions {
+                interval: health_interval,
+                max_lag,
+            });
+            if !auto_verify_from.is_empty() {
+                client.set_auto_verify_handlers(auto_verify_from, auto_verify_delay);
+            }
+            if autojoin {
+                client.add_autojoin_handler(AutojoinOptions {
+                    require_member,
+                    space: space_policy,
+                })?;
+            }
+            let limiter = hook::Limiter::new(exec_rate.map(|rate| hook::RateLimit {
+                rate,
+                burst: exec_burst,
+                overflow: exec_overflow,
+                queue: exec_queue,
+            }));
+            if include_calls || notify_calls {
+                client.add_call_handler(CallOptions {
+                    print: include_calls,
+                    bell: notify_calls,
+                    exec: exec
+                        .clone()
+                        .filter(|_| notify_calls)
+                        .map(|cmd| (cmd, limiter.clone())),
+                });
+            }
+            match (exec, to_device_type) {
+                (Some(cmd), Some(event_type)) => {
+                    client.add_to_device_hook(event_type, cmd, limiter)
+                }
+                (Some(cmd), None) => {
+                    client.add_message_hook(cmd, ack_type, limiter, filter_expr.clone())?
+                }
+                _ => {}
+            }
+            if print_events {
+                client.add_event_printer(PrintOptions {
+                    text,
+                    raw_body,
+                    filter: filter_expr.clone(),
+                });
+            }
+            if include_receipts {
+                client.add_receipt_handler(receipts_thread);
+            }
+            if include_typing {
+                client.add_typing_handler();
+            }
+            client.add_archive_handler()?;
+            tokio::select! {
+                res = client.socket(socket, filter_expr) => res?,
+                _ = client.sync_stalled() => return Err(ExitCode(exit::STALLED).into()),
+            }
+        }
+        Command::ToDevice {
+            to,
+            device,
+            event_type,
+            content,
+        } => {
+            let content: serde_json::Value = serde_json::from_str(&content)?;
+            if !content.is_object() {
+                bail!("content must be a JSON object");
+            }
+            let device_id: Option<OwnedDeviceId> = match device.as_str() {
+                "*" => None,
+                d => Some(d.into()),
+            };
+            client
+                .send_to_device(&to, device_id.as_deref(), &event_type, &content)
+                .await?;
+        }
+        Command::Typing { room_id, disable } => {
+            let room_id = client.resolve_room(&room_id).await?;
+            let room = client.get_joined_room(room_id)?;
+            room.typing_notice(!disable).await?;
+        }
+        Command::Whoami => {
+            let resp = client.whoami().await?;
+            println!("{}", serde_json::to_string(&resp)?);
+        }
+    };
+
+    Ok(())
+}
@@ -0,0 +1,248 @@
+use std::path::PathBuf;
+
+use clap::{CommandFactory, Parser};
+use matrix_sdk::ruma::{OwnedRoomAliasId, OwnedRoomId};
+use rustyline::completion::Completer;
+use rustyline::error::ReadlineError;
+use rustyline::highlight::Highlighter;
+use rustyline::hint::Hinter;
+use rustyline::history::DefaultHistory;
+use rustyline::validate::Validator;
+use rustyline::{Context, Editor, Helper};
+use tracing::warn;
+
+use super::{handles_interrupt, run_command, Cli, Command, RoomCommand};
+use crate::client::follow::Interrupted;
+use crate::client::Client;
+use crate::exit::ExitCode;
+use crate::{exit, CRATE_NAME};
+
+/// Words of the repl itself, besides the subcommands.
+const BUILTINS: [&str; 3] = ["use", "exit", "quit"];
+
+/// Completes subcommands and the ids and aliases of the joined rooms.
+struct ReplHelper {
+    rooms: Vec<String>,
+}
+
+/// The names of the subcommands below `words`, e.g. those of `room`.
+fn subcommands(words: &[&str]) -> Vec<String> {
+    let mut command = Cli::command();
+    for word in words {
+        let Some(sub) = command.find_subcommand(word) else {
+            return vec![];
+        };
+        command = sub.clone();
+    }
+    command
+        .get_subcommands()
+        .map(|c| c.get_name().to_string())
+        .collect()
+}
+
+impl Completer for ReplHelper {
+    type Candidate = String;
+
+    fn complete(
+        &self,
+        line: &str,
+        pos: usize,
+        _ctx: &Context<'_>,
+    ) -> rustyline::Result<(usize, Vec<String>)> {
+        let start = line[..pos].rfind(' ').map_or(0, |n| n + 1);
+        let word = &line[start..pos];
+        let before: Vec<&str> = line[..start].split_whitespace().collect();
+
+        let mut candidates = if word.starts_with(['!', '#']) || before == ["use"] {
+            self.rooms.clone()
+        } else {
+            subcommands(&before)
+        };
+        if before.is_empty() {
+            candidates.extend(BUILTINS.iter().map(|b| b.to_string()));
+        }
+        candidates.retain(|c| c.starts_with(word));
+        candidates.sort();
+        Ok((start, candidates))
+    }
+}
+
+impl Hinter for ReplHelper {
+    type Hint = String;
+}
+
+impl Highlighter for ReplHelper {}
+
+impl Validator for ReplHelper {}
+
+impl Helper for ReplHelper {}
+
+fn history_path() -> anyhow::Result<PathBuf> {
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+    Ok(xdg_dirs.place_state_file("repl_history")?)
+}
+
+/// The ids and canonical aliases of the joined rooms.
+fn joined_rooms(client: &Client) -> Vec<String> {
+    let mut rooms = vec![];
+    for room in client.joined_rooms() {
+        rooms.push(room.room_id().to_string());
+        if let Some(alias) = room.canonical_alias() {
+            rooms.push(alias.to_string());
+        }
+    }
+    rooms
+}
+
+/// The room of `use`, by id or alias.
+async fn resolve_room(client: &Client, room: &str) -> anyhow::Result<OwnedRoomId> {
+    if room.starts_with('#') {
+        let alias = OwnedRoomAliasId::try_from(room)?;
+        return client.resolve_alias(&alias).await;
+    }
+    Ok(OwnedRoomId::try_from(room)?)
+}
+
+/// Parse a line like the arguments of `mn`. With a room of `use`, it is
+/// passed as --room-id to commands which take one and got none.
+fn parse(words: &[String], room: Option<&OwnedRoomId>) -> Result<Cli, clap::Error> {
+    let args = || std::iter::once(String::from("mn")).chain(words.iter().cloned());
+    let explicit = words
+        .iter()
+        .any(|w| w == "-r" || w.starts_with("--room-id"));
+    if let (Some(room), false) = (room, explicit) {
+        let with_room = args().chain([String::from("--room-id"), room.to_string()]);
+        if let Ok(cli) = Cli::try_parse_from(with_room) {
+            return Ok(cli);
+        }
+    }
+    Cli::try_parse_from(args())
+}
+
+/// Whether `command` runs in the repl; the others need no client or a
+/// fresh process.
+fn available(command: &Command) -> bool {
+    !matches!(
+        command,
+        Command::Repl
+            | Command::Archive { .. }
+            | Command::Config { .. }
+            | Command::Init { .. }
+            | Command::Login { .. }
+            | Command::Room {
+                command: RoomCommand::SnapshotDiff { .. }
+            }
+    )
+}
+
+/// Read commands from the terminal and run them with `client` until EOF
+/// or `exit`. They print and fail like in separate invocations, and their
+/// exit code shows in the prompt. `use ROOM` sets the room of the
+/// commands without --room-id. Ctrl-C stops the running command only. The
+/// history is written after every line, so that a crash keeps it.
+pub(crate) async fn repl(client: &Client) -> anyhow::Result<()> {
+    let mut editor: Editor<ReplHelper, DefaultHistory> = Editor::new()?;
+    editor.set_helper(Some(ReplHelper { rooms: vec![] }));
+    let history = history_path()?;
+    // There is none before the first run.
+    let _ = editor.load_history(&history);
+
+    let mut room: Option<OwnedRoomId> = None;
+    let mut status = 0;
+    loop {
+        if let Some(helper) = editor.helper_mut() {
+            helper.rooms = joined_rooms(client);
+        }
+        let prompt = match (&room, status) {
+            (Some(room), 0) => format!("mn {}> ", room),
+            (Some(room), status) => format!("mn {} [{}]> ", room, status),
+            (None, 0) => String::from("mn> "),
+            (None, status) => format!("mn [{}]> ", status),
+        };
+        let line = match tokio::task::block_in_place(|| editor.readline(&prompt)) {
+            Ok(line) => line,
+            Err(ReadlineError::Interrupted) => continue,
+            Err(ReadlineError::Eof) => break,
+            Err(e) => return Err(e.into()),
+        };
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        editor.add_history_entry(line)?;
+        if let Err(e) = editor.append_history(&history) {
+            warn!("writing the history: {}", e);
+        }
+
+        let Some(words) = shlex::split(line) else {
+            eprintln!("error: unbalanced quotes");
+            status = 1;
+            continue;
+        };
+        match words.first().map(String::as_str) {
+            Some("exit" | "quit") => break,
+            Some("use") => {
+                status = match words.get(1) {
+                    Some(name) => match resolve_room(client, name).await {
+                        Ok(room_id) => {
+                            room = Some(room_id);
+                            0
+                        }
+                        Err(e) => {
+                            eprintln!("error: {}: {}", name, e);
+                            1
+                        }
+                    },
+                    None => {
+                        room = None;
+                        0
+                    }
+                };
+                continue;
+            }
+            _ => {}
+        }
+
+        let cli = match parse(&words, room.as_ref()) {
+            Ok(cli) => cli,
+            Err(e) => {
+                let _ = e.print();
+                status = e.exit_code();
+                continue;
+            }
+        };
+        if !available(&cli.command) {
+            eprintln!("error: `{}` is not available in the repl", words[0]);
+            status = 1;
+            continue;
+        }
+
+        // Batch commands stop on Ctrl-C themselves, after their summary.
+        let interruptible = handles_interrupt(&cli.command);
+        let result = tokio::select! {
+            result = run_command(client, cli.command) => Some(result),
+            _ = tokio::signal::ctrl_c(), if interruptible => None,
+        };
+        status = match result {
+            Some(Ok(())) => 0,
+            Some(Err(e)) if e.is::<Interrupted>() => {
+                eprintln!("interrupted");
+                exit::INTERRUPTED
+            }
+            Some(Err(e)) => match e.downcast_ref::<ExitCode>() {
+                Some(code) => code.0,
+                // Like the error `mn` exits with.
+                None => {
+                    eprintln!("Error: {:?}", e);
+                    1
+                }
+            },
+            None => {
+                eprintln!("interrupted");
+                exit::INTERRUPTED
+            }
+        };
+    }
+
+    Ok(())
+}
@@ -0,0 +1,439 @@
+use std::collections::{BTreeMap, HashMap, HashSet, VecDeque};
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use futures::StreamExt;
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::api::client::relations::get_relating_events_with_rel_type;
+use matrix_sdk::ruma::events::relation::RelationType;
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{EventId, RoomId, UserId};
+use serde_json::{json, Value};
+use tokio::time::sleep;
+use tracing::{info, warn};
+
+use super::cursor::events_since;
+use super::session::{hook_positions_path, write_atomic};
+use crate::filter::Filter;
+use crate::hook::{self, Outcome};
+
+const ACK_POLL_INTERVAL: Duration = Duration::from_secs(2);
+/// Messages replayed per room on start, at most; the oldest come first.
+const MAX_REPLAY: u64 = 1000;
+/// Event ids remembered to run the hook once for messages which are both
+/// replayed and delivered by the sync.
+const SEEN: usize = 1000;
+
+/// How far the message hook got per room, stored next to the session, so
+/// that messages which arrived while `mn sync` was down are replayed on
+/// the next start.
+struct Positions {
+    path: PathBuf,
+    /// origin_server_ts up to which every message of a room was processed
+    done: BTreeMap<String, u64>,
+    /// Timestamps of the messages whose run did not finish yet, by room
+    running: HashMap<String, Vec<u64>>,
+    /// The newest message whose run finished, by room
+    finished: HashMap<String, u64>,
+    seen: HashSet<String>,
+    order: VecDeque<String>,
+}
+
+impl Positions {
+    fn load(user_id: &UserId) -> anyhow::Result<Self> {
+        let path = hook_positions_path(user_id)?;
+        let done = match fs::read_to_string(&path) {
+            Ok(raw) => serde_json::from_str(&raw)?,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => BTreeMap::new(),
+            Err(e) => return Err(e.into()),
+        };
+        Ok(Self {
+            path,
+            done,
+            running: HashMap::new(),
+            finished: HashMap::new(),
+            seen: HashSet::new(),
+            order: VecDeque::new(),
+        })
+    }
+
+    fn persist(&self) -> anyhow::Result<()> {
+        write_atomic(&self.path, &serde_json::to_vec(&self.done)?, 0o600)
+    }
+
+    /// Whether the message `event_id` sent at `ts` needs a run; if so, it
+    /// counts as running until `finish`. Rooms without a position start
+    /// at `started`, so that their history is skipped.
+    fn start(&mut self, room_id: &str, event_id: &str, ts: u64, started: u64) -> bool {
+        let done = *self.done.entry(room_id.to_string()).or_insert(started);
+        if ts <= done || !self.seen.insert(event_id.to_string()) {
+            return false;
+        }
+        self.order.push_back(event_id.to_string());
+        if self.order.len() > SEEN {
+            if let Some(old) = self.order.pop_front() {
+                self.seen.remove(&old);
+            }
+        }
+        self.running
+            .entry(room_id.to_string())
+            .or_default()
+            .push(ts);
+        true
+    }
+
+    /// Record that the run of the message sent at `ts` finished, and
+    /// advance the position of the room up to the oldest message still
+    /// running.
+    fn finish(&mut self, room_id: &str, ts: u64) -> anyhow::Result<()> {
+        let running = self.running.entry(room_id.to_string()).or_default();
+        if let Some(pos) = running.iter().position(|t| *t == ts) {
+            running.swap_remove(pos);
+        }
+        let finished = self.finished.entry(room_id.to_string()).or_default();
+        *finished = (*finished).max(ts);
+        let until = match running.iter().min() {
+            Some(oldest) => oldest.saturating_sub(1).min(*finished),
+            None => *finished,
+        };
+        let done = self.done.entry(room_id.to_string()).or_default();
+        if until <= *done {
+            return Ok(());
+        }
+        *done = until;
+        self.persist()
+    }
+}
+
+/// The `--exec` hook of `add_message_hook`.
+#[derive(Clone)]
+struct MessageHook {
+    cmd: String,
+    ack_type: Option<String>,
+    limiter: hook::Limiter,
+    filter: Option<Filter>,
+    positions: Arc<Mutex<Positions>>,
+    started: u64,
+}
+
+impl super::Client {
+    /// Run `cmd` for every new room message; the event is passed as JSON on
+    /// stdin. With `ack_type`, an event of that type referencing the
+    /// processed event is sent once `cmd` exited with 0; failed runs are
+    /// not acknowledged, so the message counts as undelivered. Messages
+    /// not passing `filter` are skipped.
+    ///
+    /// The position up to which the messages of each room were processed
+    /// is persisted; on start, the messages after it are replayed, so
+    /// that none which arrived meanwhile is missed. Messages whose command
+    /// could not be started are replayed again on the next start.
+    pub(crate) fn add_message_hook(
+        &self,
+        cmd: String,
+        ack_type: Option<String>,
+        limiter: hook::Limiter,
+        filter: Option<Filter>,
+    ) -> anyhow::Result<()> {
+        let started = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_millis() as u64)
+            .unwrap_or(0);
+        let mut positions = Positions::load(&self.user_id)?;
+        let replay: Vec<(String, u64)> = positions
+            .done
+            .iter()
+            .filter(|(_, done)| **done < started)
+            .map(|(room_id, done)| (room_id.clone(), *done))
+            .collect();
+        // Messages arriving from now on are replayed after a restart.
+        for room in self.joined_rooms() {
+            positions
+                .done
+                .entry(room.room_id().to_string())
+                .or_insert(started);
+        }
+        positions.persist()?;
+
+        let hook = MessageHook {
+            cmd,
+            ack_type,
+            limiter,
+            filter: filter.map(|f| f.with_ts_source(self.skew.source)),
+            positions: Arc::new(Mutex::new(positions)),
+            started,
+        };
+
+        let this = self.clone();
+        let replay_hook = hook.clone();
+        tokio::spawn(async move {
+            for (room_id, since) in replay {
+                let Some(room) = RoomId::parse(&room_id)
+                    .ok()
+                    .and_then(|id| this.inner.get_room(&id))
+                else {
+                    continue;
+                };
+                let events = match events_since(&room, since, MAX_REPLAY).await {
+                    Ok(events) => events,
+                    Err(e) => {
+                        warn!("replaying the messages of {}: {}", room_id, e);
+                        continue;
+                    }
+                };
+                if events.len() as u64 == MAX_REPLAY {
+                    warn!(
+                        "replaying only the oldest {} messages of {}",
+                        MAX_REPLAY, room_id
+                    );
+                } else if !events.is_empty() {
+                    info!("replaying {} messages of {}", events.len(), room_id);
+                }
+                for event in events {
+                    if let Ok(event) = serde_json::from_str::<Value>(event.get()) {
+                        this.run_message_hook(&replay_hook, room.clone(), event)
+                            .await;
+                    }
+                }
+            }
+        });
+
+        let this = self.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                let this = this.clone();
+                let hook = hook.clone();
+                async move {
+                    let Ok(event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    this.run_message_hook(&hook, room, event).await;
+                }
+            });
+        Ok(())
+    }
+
+    async fn run_message_hook(&self, hook: &MessageHook, room: Room, mut event: Value) {
+        if event.get("type").and_then(Value::as_str) != Some("m.room.message") {
+            return;
+        }
+        let (Some(event_id), Some(ts)) = (
+            event
+                .get("event_id")
+                .and_then(Value::as_str)
+                .map(String::from),
+            event.get("origin_server_ts").and_then(Value::as_u64),
+        ) else {
+            return;
+        };
+        let room_id = room.room_id().to_string();
+        self.skew.annotate(&mut event);
+        // Our own messages and those not passing the filter count as
+        // processed right away.
+        let own = event.get("sender").and_then(Value::as_str) == Some(self.user_id.as_str());
+        let skipped = own
+            || hook
+                .filter
+                .as_ref()
+                .is_some_and(|filter| !filter.matches(&room_id, &event));
+        {
+            let mut positions = hook.positions.lock().unwrap();
+            // History delivered by the initial sync, or seen before.
+            if !positions.start(&room_id, &event_id, ts, hook.started) {
+                return;
+            }
+            if skipped {
+                if let Err(e) = positions.finish(&room_id, ts) {
+                    warn!("saving the hook position: {}", e);
+                }
+                return;
+            }
+        }
+
+        self.attribute_event(&room, &mut event).await;
+        let payload = event.to_string();
+
+        let run = hook.limiter.clone();
+        let cmd = hook.cmd.clone();
+        let ack_type = hook.ack_type.clone();
+        let positions = hook.positions.clone();
+        let task = async move {
+            let start = Instant::now();
+            let outcome = run.exec(&cmd, payload.as_bytes()).await;
+            // Replayed on the next start.
+            if let Outcome::Failed(ref e) = outcome {
+                warn!("message hook failed: {}", e);
+                return;
+            }
+            if let Err(e) = positions.lock().unwrap().finish(&room_id, ts) {
+                warn!("saving the hook position: {}", e);
+            }
+            let Outcome::Exited(status) = outcome else {
+                return;
+            };
+            if !status.success() {
+                warn!("message hook failed: {}", status);
+                return;
+            }
+
+            let Some(ack_type) = ack_type else {
+                return;
+            };
+            let content = json!({
+                "m.relates_to": {
+                    "rel_type": "m.reference",
+                    "event_id": event_id,
+                },
+                "status": status.code(),
+                "duration_ms": start.elapsed().as_millis() as u64,
+            });
+            if let Err(e) = room.send_raw(&ack_type, content).await {
+                warn!("sending ack for {} failed: {}", event_id, e);
+            }
+        };
+        hook.limiter.dispatch(task).await;
+    }
+
+    /// Block until an event of type `ack_type` references `event_id`.
+    /// Returns the content of the ack.
+    pub(crate) async fn wait_for_ack(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        ack_type: &str,
+        timeout: Duration,
+    ) -> anyhow::Result<Value> {
+        let room = self.get_joined_room(room_id)?;
+        let deadline = Instant::now() + timeout;
+
+        while Instant::now() < deadline {
+            let request = get_relating_events_with_rel_type::v1::Request::new(
+                room_id.to_owned(),
+                event_id.to_owned(),
+                RelationType::Reference,
+            );
+            let resp = self.inner.send(request, None).await?;
+
+            for raw in resp.chunk {
+                // Encrypted acks are only recognizable after decryption.
+                let event = match raw.get_field::<String>("type")?.as_deref() {
+                    Some("m.room.encrypted") => {
+                        let Some(id) = raw.get_field::<String>("event_id")? else {
+                            continue;
+                        };
+                        let id = EventId::parse(id)?;
+                        room.event(&id).await?.event.deserialize_as::<Value>()?
+                    }
+                    _ => raw.deserialize_as::<Value>()?,
+                };
+                if event.get("type").and_then(Value::as_str) == Some(ack_type) {
+                    return Ok(event.get("content").cloned().unwrap_or_default());
+                }
+            }
+
+            sleep(ACK_POLL_INTERVAL).await;
+        }
+
+        anyhow::bail!("no {} for {} within {:?}", ack_type, event_id, timeout)
+    }
+
+    /// Block until `event_id` comes down the sync in `room_id`, i.e. the
+    /// homeserver persisted it into the timeline. False if it did not
+    /// within `timeout`.
+    pub(crate) async fn wait_for_echo(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        timeout: Duration,
+    ) -> anyhow::Result<bool> {
+        let Some(ref ss) = self.sliding_sync else {
+            anyhow::bail!("waiting for the echo requires sliding sync");
+        };
+        let echoed = Arc::new(AtomicBool::new(false));
+        let handle = {
+            let echoed = echoed.clone();
+            let room_id = room_id.to_string();
+            let event_id = event_id.to_string();
+            self.inner
+                .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                    let echoed = echoed.clone();
+                    let found = room.room_id().as_str() == room_id
+                        && matches!(ev.get_field::<String>("event_id"), Ok(Some(id)) if id == event_id);
+                    async move {
+                        if found {
+                            echoed.store(true, Ordering::SeqCst);
+                        }
+                    }
+                })
+        };
+        self.subscribe(room_id.to_owned());
+
+        // Event handlers run before the stream yields the response.
+        let deadline = Instant::now() + timeout;
+        let mut sync_stream = Box::pin(ss.sync());
+        let result = loop {
+            if echoed.load(Ordering::SeqCst) {
+                break Ok(true);
+            }
+            let left = deadline.saturating_duration_since(Instant::now());
+            match tokio::time::timeout(left, sync_stream.next()).await {
+                Ok(Some(Ok(_))) => {}
+                Ok(Some(Err(e))) => break Err(e.into()),
+                Ok(None) | Err(_) => break Ok(echoed.load(Ordering::SeqCst)),
+            }
+        };
+        self.inner.remove_event_handler(handle);
+        result
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn positions(name: &str) -> Positions {
+        Positions {
+            path: std::env::temp_dir().join(format!("mn-hook-positions-{}.json", name)),
+            done: BTreeMap::new(),
+            running: HashMap::new(),
+            finished: HashMap::new(),
+            seen: HashSet::new(),
+            order: VecDeque::new(),
+        }
+    }
+
+    #[test]
+    fn skips_history_and_repeats() {
+        let mut p = positions("skips");
+        assert!(!p.start("!r", "$old", 100, 100));
+        assert!(p.start("!r", "$new", 101, 100));
+        assert!(!p.start("!r", "$new", 101, 100));
+        p.finish("!r", 101).unwrap();
+        assert_eq!(p.done["!r"], 101);
+        assert!(!p.start("!r", "$other", 101, 100));
+        let _ = fs::remove_file(&p.path);
+    }
+
+    #[test]
+    fn advances_up_to_the_oldest_running() {
+        let mut p = positions("advances");
+        for (id, ts) in [("$a", 10), ("$b", 20), ("$c", 30)] {
+            assert!(p.start("!r", id, ts, 0));
+        }
+        p.finish("!r", 30).unwrap();
+        assert_eq!(p.done["!r"], 9);
+        p.finish("!r", 10).unwrap();
+        assert_eq!(p.done["!r"], 19);
+        p.finish("!r", 20).unwrap();
+        assert_eq!(p.done["!r"], 30);
+
+        let stored: BTreeMap<String, u64> =
+            serde_json::from_str(&fs::read_to_string(&p.path).unwrap()).unwrap();
+        assert_eq!(stored["!r"], 30);
+        let _ = fs::remove_file(&p.path);
+    }
+}
@@ -0,0 +1,237 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::Path;
+use std::time::Duration;
+
+use anyhow::bail;
+use matrix_sdk::ruma::api::client::alias::{create_alias, delete_alias};
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::{OwnedRoomAliasId, OwnedRoomId, RoomAliasId, RoomId};
+use tokio::time::sleep;
+
+use super::batch::{with_retries, ItemError};
+use crate::filter::Filter;
+use crate::outputs::{AliasState, AliasStatus};
+use crate::room_arg::RoomArg;
+
+/// The aliases of `pattern` with its `*` replaced by each line of the
+/// candidates file; empty lines and lines starting with `#` are skipped.
+pub(crate) fn expand_aliases(
+    pattern: &str,
+    candidates: impl AsRef<Path>,
+) -> anyhow::Result<Vec<OwnedRoomAliasId>> {
+    if !pattern.contains('*') {
+        bail!("the alias pattern {} has no * to replace", pattern);
+    }
+    let raw = fs::read_to_string(candidates)?;
+    let mut aliases = vec![];
+    for name in raw.lines().map(str::trim) {
+        if name.is_empty() || name.starts_with('#') {
+            continue;
+        }
+        aliases.push(RoomAliasId::parse(pattern.replace('*', name))?);
+    }
+    Ok(aliases)
+}
+
+/// The aliases claimed according to the output of an earlier claim.
+pub(crate) fn claimed_aliases(path: impl AsRef<Path>) -> anyhow::Result<Vec<OwnedRoomAliasId>> {
+    let raw = fs::read_to_string(path)?;
+    let mut aliases = vec![];
+    for line in raw.lines().filter(|l| !l.trim().is_empty()) {
+        let status: AliasStatus = serde_json::from_str(line)?;
+        if status.state == AliasState::Claimed {
+            aliases.push(RoomAliasId::parse(status.alias)?);
+        }
+    }
+    Ok(aliases)
+}
+
+fn status(alias: &RoomAliasId, state: AliasState, room_id: Option<String>) -> AliasStatus {
+    AliasStatus {
+        alias: alias.to_string(),
+        state,
+        room_id,
+        errcode: None,
+        error: None,
+    }
+}
+
+fn failed(alias: &RoomAliasId, e: ItemError) -> AliasStatus {
+    AliasStatus {
+        alias: alias.to_string(),
+        state: AliasState::Failed,
+        room_id: None,
+        errcode: e.errcode,
+        error: Some(e.error),
+    }
+}
+
+impl super::Client {
+    /// The room `alias` points to, looked up once per client, i.e. also
+    /// once for all lines of the repl.
+    pub(crate) async fn resolve_alias(&self, alias: &RoomAliasId) -> anyhow::Result<OwnedRoomId> {
+        if let Some(room_id) = self.aliases.lock().unwrap().get(alias) {
+            return Ok(room_id.clone());
+        }
+        match self.resolve_room_alias(alias).await {
+            Ok(resp) => {
+                self.aliases
+                    .lock()
+                    .unwrap()
+                    .insert(alias.to_owned(), resp.room_id.clone());
+                Ok(resp.room_id)
+            }
+            Err(e) if matches!(e.client_api_error_kind(), Some(ErrorKind::NotFound)) => {
+                bail!("no such alias {}", alias)
+            }
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    /// The room id of a room argument.
+    pub(crate) async fn resolve_room(&self, room: &RoomArg) -> anyhow::Result<OwnedRoomId> {
+        match room {
+            RoomArg::Id(room_id) => Ok(room_id.clone()),
+            RoomArg::Alias(alias) => self.resolve_alias(alias).await,
+        }
+    }
+
+    pub(crate) async fn resolve_rooms(
+        &self,
+        rooms: &[RoomArg],
+    ) -> anyhow::Result<Vec<OwnedRoomId>> {
+        let mut room_ids = vec![];
+        for room in rooms {
+            room_ids.push(self.resolve_room(room).await?);
+        }
+        Ok(room_ids)
+    }
+
+    pub(crate) async fn resolve_optional_room(
+        &self,
+        room: Option<&RoomArg>,
+    ) -> anyhow::Result<Option<OwnedRoomId>> {
+        match room {
+            Some(room) => Ok(Some(self.resolve_room(room).await?)),
+            None => Ok(None),
+        }
+    }
+
+    /// `filter` with the aliases of its `room ==` and `room !=`
+    /// comparisons replaced by their room ids.
+    pub(crate) async fn resolve_filter(
+        &self,
+        filter: Option<Filter>,
+    ) -> anyhow::Result<Option<Filter>> {
+        let Some(filter) = filter else {
+            return Ok(None);
+        };
+        let mut room_ids = HashMap::new();
+        for alias in filter.room_aliases() {
+            let room_id = self.resolve_alias(&alias).await?;
+            room_ids.insert(alias, room_id);
+        }
+        Ok(Some(filter.with_room_ids(&room_ids)))
+    }
+
+    /// Whether `alias` is free or which room it points to. Rate limits are
+    /// waited out, as alias lookups are throttled hard on some servers.
+    async fn alias_status(&self, alias: &RoomAliasId) -> AliasStatus {
+        let result = with_retries(|| async {
+            Ok::<_, anyhow::Error>(self.resolve_room_alias(alias).await?)
+        })
+        .await;
+        match result {
+            Ok(resp) => status(alias, AliasState::Taken, Some(resp.room_id.to_string())),
+            Err(e) if e.errcode.as_deref() == Some("M_NOT_FOUND") => {
+                status(alias, AliasState::Free, None)
+            }
+            Err(e) => failed(alias, e),
+        }
+    }
+
+    /// Report which of `aliases` are free, pausing between lookups.
+    pub(crate) async fn check_aliases(
+        &self,
+        aliases: &[OwnedRoomAliasId],
+        pace: Duration,
+    ) -> Vec<AliasStatus> {
+        let mut statuses = vec![];
+        for (n, alias) in aliases.iter().enumerate() {
+            if n > 0 {
+                sleep(pace).await;
+            }
+            statuses.push(self.alias_status(alias).await);
+        }
+        statuses
+    }
+
+    /// Point the free ones of `aliases` at `room_id`. Taken aliases are
+    /// reported with their room, also if someone claimed them meanwhile.
+    pub(crate) async fn claim_aliases(
+        &self,
+        aliases: &[OwnedRoomAliasId],
+        room_id: &RoomId,
+        pace: Duration,
+    ) -> Vec<AliasStatus> {
+        let mut statuses = vec![];
+        for (n, alias) in aliases.iter().enumerate() {
+            if n > 0 {
+                sleep(pace).await;
+            }
+            let current = self.alias_status(alias).await;
+            if current.state != AliasState::Free {
+                statuses.push(current);
+                continue;
+            }
+            sleep(pace).await;
+            let result = with_retries(|| async {
+                let request = create_alias::v3::Request::new(alias.clone(), room_id.to_owned());
+                Ok::<_, anyhow::Error>(self.inner.send(request, None).await?)
+            })
+            .await;
+            statuses.push(match result {
+                Ok(_) => status(alias, AliasState::Claimed, Some(room_id.to_string())),
+                // Lost a race; the spec has no errcode for a taken alias.
+                Err(e) => match self.alias_status(alias).await {
+                    taken if taken.state == AliasState::Taken => taken,
+                    _ => failed(alias, e),
+                },
+            });
+        }
+        statuses
+    }
+
+    /// Remove those of `aliases` which point at `room_id`; others are left
+    /// alone, so a release only undoes our own claims.
+    pub(crate) async fn release_aliases(
+        &self,
+        aliases: &[OwnedRoomAliasId],
+        room_id: &RoomId,
+        pace: Duration,
+    ) -> Vec<AliasStatus> {
+        let mut statuses = vec![];
+        for (n, alias) in aliases.iter().enumerate() {
+            if n > 0 {
+                sleep(pace).await;
+            }
+            let current = self.alias_status(alias).await;
+            if current.room_id.as_deref() != Some(room_id.as_str()) {
+                statuses.push(current);
+                continue;
+            }
+            sleep(pace).await;
+            let result = with_retries(|| async {
+                let request = delete_alias::v3::Request::new(alias.clone());
+                Ok::<_, anyhow::Error>(self.inner.send(request, None).await?)
+            })
+            .await;
+            statuses.push(match result {
+                Ok(_) => status(alias, AliasState::Released, None),
+                Err(e) => failed(alias, e),
+            });
+        }
+        statuses
+    }
+}
@@ -0,0 +1,92 @@
+use std::fmt;
+
+use anyhow::anyhow;
+use reqwest::header::CONTENT_TYPE;
+use reqwest::Method;
+use serde::Deserialize;
+use serde_json::Value;
+
+// Error returned by the homeserver for non matrix-sdk requests,
+// e.g. the synapse admin API.
+#[derive(Debug, Deserialize)]
+pub(crate) struct ApiError {
+    #[serde(skip)]
+    pub(crate) status: u16,
+    pub(crate) errcode: String,
+    #[serde(default)]
+    pub(crate) error: String,
+    #[serde(default)]
+    pub(crate) soft_logout: bool,
+}
+
+impl fmt::Display for ApiError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {} (HTTP {})", self.errcode, self.error, self.status)
+    }
+}
+
+impl std::error::Error for ApiError {}
+
+impl super::Client {
+    pub(super) fn http_client(&self) -> reqwest::Client {
+        self.http.clone()
+    }
+
+    /// Perform a request against the homeserver which is not covered by
+    /// the matrix-sdk. `path` is relative to the homeserver url, e.g.
+    /// `_synapse/admin/v1/rooms`.
+    pub(crate) async fn api_request(
+        &self,
+        method: Method,
+        path: &str,
+        query: &[(&str, String)],
+        body: Option<&Value>,
+    ) -> anyhow::Result<Value> {
+        let url = format!("{}{}", self.inner.homeserver(), path);
+        let token = self
+            .inner
+            .access_token()
+            .ok_or_else(|| anyhow!("client not logged in"))?;
+
+        let mut req = self
+            .http_client()
+            .request(method, url)
+            .bearer_auth(token)
+            .query(query);
+
+        if let Some(body) = body {
+            req = req
+                .header(CONTENT_TYPE, "application/json")
+                .body(serde_json::to_vec(body)?);
+        }
+
+        let resp = req.send().await?;
+        let status = resp.status();
+        let raw = resp.bytes().await?;
+
+        if !status.is_success() {
+            let mut err = serde_json::from_slice::<ApiError>(&raw).unwrap_or_else(|_| ApiError {
+                status: 0,
+                errcode: String::from("M_UNKNOWN"),
+                error: String::from_utf8_lossy(&raw).to_string(),
+                soft_logout: false,
+            });
+            err.status = status.as_u16();
+            return Err(err.into());
+        }
+
+        if raw.is_empty() {
+            return Ok(Value::Null);
+        }
+
+        Ok(serde_json::from_slice(&raw)?)
+    }
+
+    pub(crate) async fn api_get(
+        &self,
+        path: &str,
+        query: &[(&str, String)],
+    ) -> anyhow::Result<Value> {
+        self.api_request(Method::GET, path, query, None).await
+    }
+}
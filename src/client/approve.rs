@@ -0,0 +1,133 @@
+use std::collections::BTreeMap;
+use std::time::{Duration, Instant};
+
+use anyhow::bail;
+use matrix_sdk::ruma::api::client::relations::get_relating_events_with_rel_type;
+use matrix_sdk::ruma::events::relation::RelationType;
+use matrix_sdk::ruma::{EventId, OwnedUserId, RoomId};
+use serde_json::Value;
+use tokio::time::sleep;
+
+use crate::outputs::{ApprovalDecision, ApprovalOutcome};
+
+const POLL_INTERVAL: Duration = Duration::from_secs(5);
+const APPROVE: &str = "👍";
+const REJECT: &str = "👎";
+
+pub(crate) struct ApprovalOptions {
+    pub(crate) approvers: Vec<OwnedUserId>,
+    pub(crate) require: usize,
+    pub(crate) timeout: Duration,
+}
+
+impl super::Client {
+    /// Latest reaction key per approver on `event_id`.
+    async fn approver_reactions(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        approvers: &[OwnedUserId],
+    ) -> anyhow::Result<BTreeMap<String, String>> {
+        let mut latest: BTreeMap<String, (u64, String)> = BTreeMap::new();
+        let mut from = None;
+
+        loop {
+            let mut request = get_relating_events_with_rel_type::v1::Request::new(
+                room_id.to_owned(),
+                event_id.to_owned(),
+                RelationType::Annotation,
+            );
+            request.from = from;
+            let resp = self.inner.send(request, None).await?;
+
+            // m.relates_to stays unencrypted, so encrypted reactions work too.
+            // Redacted reactions lose their relation and are not returned.
+            for raw in resp.chunk {
+                let event = raw.deserialize_as::<Value>()?;
+                let Some(sender) = event.get("sender").and_then(Value::as_str) else {
+                    continue;
+                };
+                if !approvers.iter().any(|a| a.as_str() == sender) {
+                    continue;
+                }
+                let Some(key) = event
+                    .pointer("/content/m.relates_to/key")
+                    .and_then(Value::as_str)
+                else {
+                    continue;
+                };
+                let ts = event
+                    .get("origin_server_ts")
+                    .and_then(Value::as_u64)
+                    .unwrap_or(0);
+                let key = key.trim_end_matches('\u{fe0f}').to_string();
+                if latest.get(sender).map_or(true, |(old, _)| ts >= *old) {
+                    latest.insert(sender.to_string(), (ts, key));
+                }
+            }
+
+            from = resp.next_batch;
+            if from.is_none() {
+                break;
+            }
+        }
+
+        Ok(latest.into_iter().map(|(k, (_, v))| (k, v)).collect())
+    }
+
+    /// Send `message` and wait until enough approvers reacted with 👍.
+    /// A 👎 of any approver rejects.
+    pub(crate) async fn request_approval(
+        &self,
+        room_id: &RoomId,
+        message: &str,
+        opts: &ApprovalOptions,
+    ) -> anyhow::Result<ApprovalOutcome> {
+        let approvers: Vec<&str> = opts.approvers.iter().map(|a| a.as_str()).collect();
+        let body = format!(
+            "{}\n\n{} of {} must react with {} to approve; {} rejects.",
+            message,
+            opts.require,
+            approvers.join(", "),
+            APPROVE,
+            REJECT,
+        );
+        let Some(event_id) = self.send_message(room_id, &body, true).await? else {
+            bail!("approval requests cannot be previewed");
+        };
+        let deadline = Instant::now() + opts.timeout;
+
+        loop {
+            let reactions = self
+                .approver_reactions(room_id, &event_id, &opts.approvers)
+                .await?;
+            let with_key = |key: &str| -> Vec<String> {
+                reactions
+                    .iter()
+                    .filter(|(_, k)| k.as_str() == key)
+                    .map(|(u, _)| u.clone())
+                    .collect()
+            };
+            let mut outcome = ApprovalOutcome {
+                event_id: event_id.to_string(),
+                decision: ApprovalDecision::Timeout,
+                approvals: with_key(APPROVE),
+                rejections: with_key(REJECT),
+            };
+
+            if !outcome.rejections.is_empty() {
+                outcome.decision = ApprovalDecision::Rejected;
+                return Ok(outcome);
+            }
+            if outcome.approvals.len() >= opts.require {
+                outcome.decision = ApprovalDecision::Approved;
+                return Ok(outcome);
+            }
+            if Instant::now() >= deadline {
+                return Ok(outcome);
+            }
+
+            sleep(POLL_INTERVAL).await;
+        }
+    }
+}
@@ -0,0 +1,321 @@
+use std::fs;
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::{AnySyncTimelineEvent, AnyToDeviceEvent};
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{OwnedRoomId, OwnedUserId, UserId};
+use rusqlite::{params, Connection};
+use serde_json::value::RawValue;
+use serde_json::{json, Value};
+use tracing::warn;
+
+use super::decrypt::Pending;
+use super::session::{archive_db_path, Meta};
+use crate::outputs::{ArchivePrune, ArchiveStats};
+use crate::skew::TsSource;
+
+const SCHEMA: &str = "
+CREATE TABLE IF NOT EXISTS events (
+    event_id TEXT PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    origin_server_ts INTEGER NOT NULL,
+    body TEXT,
+    event TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_room_ts ON events (room_id, origin_server_ts);
+CREATE INDEX IF NOT EXISTS events_ts ON events (origin_server_ts);
+";
+
+/// Which archived events `query` returns.
+#[derive(Debug)]
+pub(crate) struct ArchiveQuery {
+    pub(crate) room_id: Option<OwnedRoomId>,
+    pub(crate) sender: Option<OwnedUserId>,
+    /// Only events whose body contains this text, ignoring case
+    pub(crate) contains: Option<String>,
+    /// Only events sent within this time
+    pub(crate) since: Option<Duration>,
+    /// Whether `since` counts from origin_server_ts or arrival_ts
+    pub(crate) ts_source: TsSource,
+    pub(crate) limit: u64,
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// The local database of the events seen by the sync loop.
+#[derive(Clone)]
+pub(crate) struct Archive {
+    conn: Arc<Mutex<Connection>>,
+    path: PathBuf,
+}
+
+impl Archive {
+    /// Open the archive of `user_id`, creating it if needed.
+    pub(crate) fn open(user_id: &UserId) -> anyhow::Result<Self> {
+        let path = archive_db_path(user_id)?;
+        // The archive holds decrypted messages; sqlite would create it and
+        // its journal files under the umask.
+        for file in [path.clone(), wal_path(&path), shm_path(&path)] {
+            fs::OpenOptions::new()
+                .write(true)
+                .create(true)
+                .mode(0o600)
+                .open(&file)?;
+            fs::set_permissions(&file, fs::Permissions::from_mode(0o600))?;
+        }
+        let conn = Connection::open(&path)?;
+        // The sync loop writes while queries read.
+        conn.busy_timeout(Duration::from_secs(5))?;
+        conn.pragma_update_and_check(None, "journal_mode", "WAL", |row| row.get::<_, String>(0))?;
+        conn.execute_batch(SCHEMA)?;
+        Ok(Self {
+            conn: Arc::new(Mutex::new(conn)),
+            path,
+        })
+    }
+
+    /// Store a timeline event of `room_id`. Events seen before are
+    /// ignored, unless they were stored undecryptable and are decrypted
+    /// now. Returns whether it was stored.
+    pub(crate) fn insert(&self, room_id: &str, event: &Value) -> anyhow::Result<bool> {
+        let field = |name: &str| event.get(name).and_then(Value::as_str);
+        let (Some(event_id), Some(sender), Some(event_type), Some(ts)) = (
+            field("event_id"),
+            field("sender"),
+            field("type"),
+            event.get("origin_server_ts").and_then(Value::as_u64),
+        ) else {
+            return Ok(false);
+        };
+        let body = event.pointer("/content/body").and_then(Value::as_str);
+        // Sync events come without their room.
+        let mut event = event.clone();
+        if let Some(map) = event.as_object_mut() {
+            map.insert(String::from("room_id"), json!(room_id));
+        }
+
+        let conn = self.conn.lock().unwrap();
+        let inserted = conn.execute(
+            "INSERT INTO events \
+             (event_id, room_id, sender, event_type, origin_server_ts, body, event) \
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7) \
+             ON CONFLICT(event_id) DO UPDATE SET \
+             event_type = excluded.event_type, body = excluded.body, event = excluded.event \
+             WHERE events.event_type = 'm.room.encrypted' \
+             AND excluded.event_type != 'm.room.encrypted'",
+            params![
+                event_id,
+                room_id,
+                sender,
+                event_type,
+                ts as i64,
+                body,
+                serde_json::to_string(&event)?
+            ],
+        )?;
+        Ok(inserted > 0)
+    }
+
+    /// The newest `query.limit` events matching `query`, newest first.
+    pub(crate) fn query(&self, query: &ArchiveQuery) -> anyhow::Result<Vec<Box<RawValue>>> {
+        let mut sql = String::from("SELECT event FROM events WHERE 1 = 1");
+        let mut args: Vec<rusqlite::types::Value> = vec![];
+        if let Some(ref room_id) = query.room_id {
+            args.push(room_id.to_string().into());
+            sql.push_str(&format!(" AND room_id = ?{}", args.len()));
+        }
+        if let Some(ref sender) = query.sender {
+            args.push(sender.to_string().into());
+            sql.push_str(&format!(" AND sender = ?{}", args.len()));
+        }
+        if let Some(ref contains) = query.contains {
+            // instr instead of LIKE, so that % and _ match themselves.
+            args.push(contains.to_lowercase().into());
+            sql.push_str(&format!(" AND instr(lower(body), ?{}) > 0", args.len()));
+        }
+        if let Some(since) = query.since {
+            let cutoff = now_millis().saturating_sub(since.as_millis() as u64);
+            args.push((cutoff as i64).into());
+            let ts = match query.ts_source {
+                TsSource::Origin => "origin_server_ts",
+                // Events archived before arrival_ts was kept have none.
+                TsSource::Arrival => {
+                    "coalesce(json_extract(event, '$.arrival_ts'), origin_server_ts)"
+                }
+            };
+            sql.push_str(&format!(" AND {} >= ?{}", ts, args.len()));
+        }
+        args.push((query.limit as i64).into());
+        sql.push_str(&format!(
+            " ORDER BY origin_server_ts DESC LIMIT ?{}",
+            args.len()
+        ));
+
+        let conn = self.conn.lock().unwrap();
+        let mut stmt = conn.prepare(&sql)?;
+        let rows = stmt.query_map(rusqlite::params_from_iter(args), |row| {
+            row.get::<_, String>(0)
+        })?;
+        let mut events = vec![];
+        for row in rows {
+            events.push(RawValue::from_string(row?)?);
+        }
+        Ok(events)
+    }
+
+    /// Delete the events older than `older_than` and give their space
+    /// back. Returns the number of deleted events.
+    pub(crate) fn prune(&self, older_than: Duration) -> anyhow::Result<usize> {
+        let cutoff = now_millis().saturating_sub(older_than.as_millis() as u64);
+        let conn = self.conn.lock().unwrap();
+        let removed = conn.execute(
+            "DELETE FROM events WHERE origin_server_ts < ?1",
+            params![cutoff as i64],
+        )?;
+        if removed > 0 {
+            conn.execute_batch("VACUUM")?;
+        }
+        Ok(removed)
+    }
+
+    pub(crate) fn stats(&self, enabled: bool) -> anyhow::Result<ArchiveStats> {
+        let conn = self.conn.lock().unwrap();
+        let (events, rooms, oldest, newest) = conn.query_row(
+            "SELECT count(*), count(DISTINCT room_id), \
+             min(origin_server_ts), max(origin_server_ts) FROM events",
+            [],
+            |row| {
+                Ok((
+                    row.get::<_, i64>(0)?,
+                    row.get::<_, i64>(1)?,
+                    row.get::<_, Option<i64>>(2)?,
+                    row.get::<_, Option<i64>>(3)?,
+                ))
+            },
+        )?;
+        Ok(ArchiveStats {
+            enabled,
+            path: self.path.display().to_string(),
+            events: events as u64,
+            rooms: rooms as u64,
+            oldest: oldest.map(|ts| ts as u64),
+            newest: newest.map(|ts| ts as u64),
+            bytes: file_size(&self.path) + file_size(&wal_path(&self.path)),
+        })
+    }
+}
+
+fn wal_path(path: &Path) -> PathBuf {
+    let mut wal = path.as_os_str().to_owned();
+    wal.push("-wal");
+    PathBuf::from(wal)
+}
+
+fn shm_path(path: &Path) -> PathBuf {
+    let mut shm = path.as_os_str().to_owned();
+    shm.push("-shm");
+    PathBuf::from(shm)
+}
+
+fn file_size(path: &Path) -> u64 {
+    fs::metadata(path).map(|m| m.len()).unwrap_or(0)
+}
+
+/// Turn archiving by the sync loop on or off. The archived events are
+/// kept when it is turned off.
+pub(crate) fn set_enabled(enabled: bool) -> anyhow::Result<ArchiveStats> {
+    let mut meta = Meta::load()?;
+    let archive = Archive::open(&meta.user_id)?;
+    if meta.archive != enabled {
+        meta.archive = enabled;
+        meta.dump()?;
+    }
+    archive.stats(enabled)
+}
+
+/// The archive of the logged in user and whether it is enabled.
+fn open_current() -> anyhow::Result<(Archive, bool)> {
+    let meta = Meta::load()?;
+    Ok((Archive::open(&meta.user_id)?, meta.archive))
+}
+
+pub(crate) fn query(query: &ArchiveQuery) -> anyhow::Result<Vec<Box<RawValue>>> {
+    open_current()?.0.query(query)
+}
+
+pub(crate) fn prune(older_than: Duration) -> anyhow::Result<ArchivePrune> {
+    let (archive, enabled) = open_current()?;
+    let removed = archive.prune(older_than)?;
+    Ok(ArchivePrune {
+        removed,
+        stats: archive.stats(enabled)?,
+    })
+}
+
+pub(crate) fn stats() -> anyhow::Result<ArchiveStats> {
+    let (archive, enabled) = open_current()?;
+    archive.stats(enabled)
+}
+
+impl super::Client {
+    /// Write every timeline event the sync loop receives into the
+    /// archive, if it is enabled. Encrypted events are stored as the
+    /// sync delivers them, i.e. decrypted if the keys are there; once the
+    /// room key of an undecryptable one arrives, it is stored again
+    /// decrypted.
+    pub(crate) fn add_archive_handler(&self) -> anyhow::Result<()> {
+        if !Meta::load()?.archive {
+            return Ok(());
+        }
+        let archive = Archive::open(&self.user_id)?;
+        let pending = Arc::new(Mutex::new(Pending::default()));
+
+        let skew = self.skew;
+        let timeline_archive = archive.clone();
+        let timeline_pending = pending.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                let archive = timeline_archive.clone();
+                let pending = timeline_pending.clone();
+                async move {
+                    let Ok(mut event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    skew.annotate(&mut event);
+                    if event.get("type").and_then(Value::as_str) == Some("m.room.encrypted") {
+                        pending.lock().unwrap().push(room.clone(), ev.cast());
+                    }
+                    if let Err(e) = archive.insert(room.room_id().as_str(), &event) {
+                        warn!("archive: {}", e);
+                    }
+                }
+            });
+
+        let this = self.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnyToDeviceEvent>| {
+                let this = this.clone();
+                let archive = archive.clone();
+                let pending = pending.clone();
+                async move {
+                    for (room, event) in this.decrypt_pending(&pending, &ev).await {
+                        if let Err(e) = archive.insert(room.room_id().as_str(), &event) {
+                            warn!("archive: {}", e);
+                        }
+                    }
+                }
+            });
+        Ok(())
+    }
+}
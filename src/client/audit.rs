@@ -0,0 +1,150 @@
+use std::collections::HashSet;
+
+use matrix_sdk::ruma::api::client::directory::get_room_visibility;
+use matrix_sdk::ruma::api::client::room::Visibility;
+use matrix_sdk::ruma::{OwnedRoomId, RoomId};
+use regex::Regex;
+use serde_json::Value;
+
+use crate::outputs::{AuditFinding, Severity};
+
+pub(crate) struct AuditOptions {
+    /// Rooms whose name matches are meant to be private
+    pub(crate) private_name: Regex,
+    /// Rooms in these spaces must be encrypted
+    pub(crate) encrypted_spaces: Vec<OwnedRoomId>,
+}
+
+impl super::Client {
+    async fn own_power_level(&self, room_id: &RoomId) -> anyhow::Result<i64> {
+        let content = self
+            .get_state(room_id, "m.room.power_levels", "")
+            .await?
+            .unwrap_or_default();
+        let level = content
+            .pointer(&format!("/users/{}", self.user_id))
+            .or_else(|| content.get("users_default"))
+            .and_then(Value::as_i64)
+            .unwrap_or(0);
+        Ok(level)
+    }
+
+    async fn audit_room(
+        &self,
+        room_id: &RoomId,
+        name: Option<String>,
+        encrypted_rooms: &HashSet<OwnedRoomId>,
+        opts: &AuditOptions,
+    ) -> anyhow::Result<Vec<AuditFinding>> {
+        let mut findings = vec![];
+        let mut finding = |severity, message: String| {
+            findings.push(AuditFinding {
+                room_id: room_id.to_string(),
+                name: name.clone(),
+                severity,
+                message,
+            })
+        };
+
+        let state_str = |content: Option<Value>, key: &str| {
+            content.and_then(|c| c.get(key).and_then(Value::as_str).map(String::from))
+        };
+
+        let history = state_str(
+            self.get_state(room_id, "m.room.history_visibility", "")
+                .await?,
+            "history_visibility",
+        );
+        let join_rule = state_str(
+            self.get_state(room_id, "m.room.join_rules", "").await?,
+            "join_rule",
+        );
+        if history.as_deref() == Some("world_readable") && join_rule.as_deref() == Some("invite") {
+            finding(
+                Severity::Error,
+                String::from("history is world readable although the room is invite only"),
+            );
+        }
+
+        let request = get_room_visibility::v3::Request::new(room_id.to_owned());
+        let visibility = self.inner.send(request, None).await?.visibility;
+        let private_name = name
+            .as_deref()
+            .is_some_and(|n| opts.private_name.is_match(n));
+        if matches!(visibility, Visibility::Public) && private_name {
+            finding(
+                Severity::Error,
+                String::from("room looks private but is published in the room directory"),
+            );
+        }
+
+        let alias = state_str(
+            self.get_state(room_id, "m.room.canonical_alias", "")
+                .await?,
+            "alias",
+        );
+        if alias.is_none() {
+            finding(Severity::Warn, String::from("room has no canonical alias"));
+        }
+
+        if encrypted_rooms.contains(room_id)
+            && self
+                .get_state(room_id, "m.room.encryption", "")
+                .await?
+                .is_none()
+        {
+            finding(
+                Severity::Error,
+                String::from("room is part of an encrypted space but not encrypted"),
+            );
+        }
+
+        Ok(findings)
+    }
+
+    /// Check all rooms where we are at least moderator for misconfigurations.
+    pub(crate) async fn audit_rooms(
+        &self,
+        room_id: Option<&RoomId>,
+        opts: &AuditOptions,
+    ) -> anyhow::Result<Vec<AuditFinding>> {
+        let mut encrypted_rooms = HashSet::new();
+        for space_id in &opts.encrypted_spaces {
+            for chunk in self.space_hierarchy(space_id).await? {
+                if &chunk.room_id != space_id {
+                    encrypted_rooms.insert(chunk.room_id);
+                }
+            }
+        }
+
+        let rooms = match room_id {
+            Some(room_id) => vec![self.get_joined_room(room_id)?],
+            None => self.inner.joined_rooms(),
+        };
+
+        // A room which cannot be checked is a finding of its own; the
+        // other rooms are still audited.
+        let mut findings = vec![];
+        for room in rooms {
+            let checked = match self.own_power_level(room.room_id()).await {
+                Ok(level) if level < 50 => continue,
+                Ok(_) => {
+                    self.audit_room(room.room_id(), room.name(), &encrypted_rooms, opts)
+                        .await
+                }
+                Err(e) => Err(e),
+            };
+            match checked {
+                Ok(room_findings) => findings.extend(room_findings),
+                Err(e) => findings.push(AuditFinding {
+                    room_id: room.room_id().to_string(),
+                    name: room.name(),
+                    severity: Severity::Error,
+                    message: format!("cannot audit the room: {}", e),
+                }),
+            }
+        }
+
+        Ok(findings)
+    }
+}
@@ -0,0 +1,169 @@
+use std::collections::BTreeSet;
+use std::fs::{self, File};
+use std::future::Future;
+use std::io::{BufWriter, Write};
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use tokio::task::JoinHandle;
+use tokio::time::sleep;
+use tracing::warn;
+
+use super::api::ApiError;
+use crate::outputs::BatchFailure;
+
+/// Attempts per item before a retryable error is given up.
+const MAX_ATTEMPTS: u32 = 5;
+const INITIAL_BACKOFF: Duration = Duration::from_secs(1);
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+/// Set by Ctrl-C while a batch command runs. Batch loops check it
+/// before each item and stop there, so that they still print what they
+/// did and keep their checkpoints; `mn` then exits with
+/// `exit::INTERRUPTED`.
+pub(crate) struct Cancel {
+    requested: Arc<AtomicBool>,
+    listener: JoinHandle<()>,
+}
+
+impl Cancel {
+    pub(crate) fn on_ctrl_c() -> Self {
+        let requested = Arc::new(AtomicBool::new(false));
+        let flag = requested.clone();
+        let listener = tokio::spawn(async move {
+            if tokio::signal::ctrl_c().await.is_ok() {
+                eprintln!("interrupted; stopping after the current item");
+                flag.store(true, Ordering::SeqCst);
+            }
+        });
+        Self {
+            requested,
+            listener,
+        }
+    }
+
+    pub(crate) fn requested(&self) -> bool {
+        self.requested.load(Ordering::SeqCst)
+    }
+}
+
+impl Drop for Cancel {
+    fn drop(&mut self) {
+        self.listener.abort();
+    }
+}
+
+/// The error of a failed batch item.
+#[derive(Debug)]
+pub(crate) struct ItemError {
+    pub(crate) error: String,
+    pub(crate) errcode: Option<String>,
+    /// Rate limits, server errors and network failures; rejections like
+    /// M_TOO_LARGE or M_FORBIDDEN of a spam checker are permanent.
+    pub(crate) retryable: bool,
+    pub(crate) retry_after: Option<Duration>,
+}
+
+fn classify(e: &anyhow::Error) -> ItemError {
+    let mut out = ItemError {
+        error: e.to_string(),
+        errcode: None,
+        retryable: false,
+        retry_after: None,
+    };
+
+    let http = e.downcast_ref::<matrix_sdk::HttpError>().or_else(|| {
+        match e.downcast_ref::<matrix_sdk::Error>() {
+            Some(matrix_sdk::Error::Http(http)) => Some(http),
+            _ => None,
+        }
+    });
+    if let Some(http) = http {
+        match http.client_api_error_kind() {
+            Some(kind) => {
+                out.errcode = Some(kind.to_string());
+                if let ErrorKind::LimitExceeded { retry_after_ms } = kind {
+                    out.retryable = true;
+                    out.retry_after = *retry_after_ms;
+                }
+            }
+            None => out.retryable = matches!(http, matrix_sdk::HttpError::Reqwest(_)),
+        }
+        if let Some(api) = http.as_client_api_error() {
+            out.retryable |= api.status_code.is_server_error();
+        }
+    } else if let Some(api) = e.downcast_ref::<ApiError>() {
+        out.errcode = Some(api.errcode.clone());
+        out.retryable = api.status == 429 || api.status >= 500;
+    } else if e.downcast_ref::<reqwest::Error>().is_some() {
+        out.retryable = true;
+    }
+    out
+}
+
+/// Whether `e` is a rate limit, server or network error.
+pub(crate) fn is_retryable(e: &anyhow::Error) -> bool {
+    classify(e).retryable
+}
+
+/// Run `op`, retrying rate limited, server and network errors with
+/// exponential backoff or the delay the server asked for.
+pub(crate) async fn with_retries<T, F, Fut>(mut op: F) -> Result<T, ItemError>
+where
+    F: FnMut() -> Fut,
+    Fut: Future<Output = anyhow::Result<T>>,
+{
+    let mut backoff = INITIAL_BACKOFF;
+    let mut attempts = 0;
+    loop {
+        attempts += 1;
+        let e = match op().await {
+            Ok(value) => return Ok(value),
+            Err(e) => e,
+        };
+        let mut error = classify(&e);
+        if !error.retryable {
+            return Err(error);
+        }
+        if attempts >= MAX_ATTEMPTS {
+            error.error = format!("{} (gave up after {} attempts)", error.error, attempts);
+            return Err(error);
+        }
+        let delay = error.retry_after.unwrap_or(backoff);
+        warn!(
+            "{}; retrying in {}",
+            error.error,
+            humantime::format_duration(delay)
+        );
+        sleep(delay).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+/// Write the failures as NDJSON, suitable for `--retry-from`.
+pub(crate) fn write_report(
+    path: impl AsRef<Path>,
+    failures: &[BatchFailure],
+) -> anyhow::Result<()> {
+    let mut out = BufWriter::new(File::create(path)?);
+    for failure in failures {
+        serde_json::to_writer(&mut out, failure)?;
+        out.write_all(b"\n")?;
+    }
+    out.flush()?;
+    Ok(())
+}
+
+/// The items of a failure report written by `write_report`.
+pub(crate) fn read_report(path: impl AsRef<Path>) -> anyhow::Result<BTreeSet<String>> {
+    let raw = fs::read_to_string(path)?;
+    let mut items = BTreeSet::new();
+    for line in raw.lines().filter(|l| !l.trim().is_empty()) {
+        let failure: BatchFailure = serde_json::from_str(line)?;
+        items.insert(failure.item);
+    }
+    Ok(items)
+}
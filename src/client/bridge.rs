@@ -0,0 +1,142 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::{RoomId, UserId};
+use serde::Deserialize;
+use serde_json::value::RawValue;
+use serde_json::Value;
+
+use super::CRATE_NAME;
+
+// Per-message profiles as used by bridges (MSC4144).
+const PROFILE_KEY: &str = "com.beeper.per_message_profile";
+
+/// Localpart prefixes of common bridges' ghost users.
+const DEFAULT_PREFIXES: &[(&str, &str)] = &[
+    ("discord_", "Discord"),
+    ("irc_", "IRC"),
+    ("signal_", "Signal"),
+    ("slack_", "Slack"),
+    ("telegram_", "Telegram"),
+    ("whatsapp_", "WhatsApp"),
+];
+
+#[derive(Debug, Default, Deserialize)]
+struct BridgeConfig {
+    #[serde(default)]
+    bridge_prefix: BTreeMap<String, String>,
+}
+
+/// Resolves ghost users of bridges to "name (via Network)".
+#[derive(Clone, Debug)]
+pub(crate) struct BridgeSenders {
+    /// Localpart prefixes and the name of their network
+    prefixes: BTreeMap<String, String>,
+}
+
+impl BridgeSenders {
+    /// The default prefixes, extended and overridden by the `bridge_prefix`
+    /// table of `$XDG_CONFIG_HOME/mnotify/bridges.yaml`.
+    pub(crate) fn load() -> anyhow::Result<Self> {
+        let mut prefixes: BTreeMap<String, String> = DEFAULT_PREFIXES
+            .iter()
+            .map(|(prefix, network)| (prefix.to_string(), network.to_string()))
+            .collect();
+
+        let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+        if let Some(path) = xdg_dirs.find_config_file("bridges.yaml") {
+            let config: BridgeConfig = match fs::read_to_string(path) {
+                Ok(raw) => serde_yaml::from_str(&raw)?,
+                Err(e) if e.kind() == io::ErrorKind::NotFound => BridgeConfig::default(),
+                Err(e) => return Err(e.into()),
+            };
+            prefixes.extend(config.bridge_prefix);
+        }
+        Ok(Self { prefixes })
+    }
+
+    /// The network of a ghost user by its localpart; the longest prefix
+    /// wins, so that a configured `telegram_bot_` beats `telegram_`.
+    fn network_of(&self, user_id: &UserId) -> Option<&str> {
+        self.prefixes
+            .iter()
+            .filter(|(prefix, _)| user_id.localpart().starts_with(prefix.as_str()))
+            .max_by_key(|(prefix, _)| prefix.len())
+            .map(|(_, network)| network.as_str())
+    }
+}
+
+/// The host of the external_url bridges attach to messages, as network
+/// name for bridges without a configured prefix.
+fn external_host(content: &Value) -> Option<String> {
+    let url = content.get("external_url")?.as_str()?;
+    let host = url.split_once("://")?.1.split(['/', '?', '#']).next()?;
+    (!host.is_empty()).then(|| host.to_string())
+}
+
+impl super::Client {
+    /// The friendly sender of a bridged event, e.g. `Alice (via
+    /// Telegram)`. The name comes from the per-message profile or the
+    /// member event; none for senders which are not bridged.
+    async fn sender_attribution(
+        &self,
+        bridges: &BridgeSenders,
+        room: &Room,
+        event: &Value,
+    ) -> Option<String> {
+        let sender = UserId::parse(event.get("sender")?.as_str()?).ok()?;
+        let content = event.get("content");
+        let network = match bridges.network_of(&sender) {
+            Some(network) => network.to_string(),
+            None => content.and_then(external_host)?,
+        };
+
+        let profile_name = content
+            .and_then(|c| c.pointer(&format!("/{}/displayname", PROFILE_KEY)))
+            .and_then(Value::as_str)
+            .map(String::from);
+        let name = match profile_name {
+            Some(name) => name,
+            None => match room.get_member_no_sync(&sender).await {
+                Ok(Some(member)) => member.name().to_string(),
+                _ => sender.localpart().to_string(),
+            },
+        };
+        Some(format!("{} (via {})", name, network))
+    }
+
+    /// Add `sender_attribution` to bridged events of a room if resolving
+    /// bridge senders is enabled; `sender` keeps the matrix id.
+    pub(crate) async fn attribute_event(&self, room: &Room, event: &mut Value) {
+        let Some(ref bridges) = self.bridges else {
+            return;
+        };
+        if let Some(attribution) = self.sender_attribution(bridges, room, event).await {
+            if let Some(object) = event.as_object_mut() {
+                object.insert(String::from("sender_attribution"), attribution.into());
+            }
+        }
+    }
+
+    /// Like `attribute_event`, for events as they came from the server.
+    pub(crate) async fn attribute_events(
+        &self,
+        room_id: &RoomId,
+        events: &mut [Box<RawValue>],
+    ) -> anyhow::Result<()> {
+        if self.bridges.is_none() {
+            return Ok(());
+        }
+        let room = self.get_joined_room(room_id)?;
+        for event in events.iter_mut() {
+            let mut value: Value = serde_json::from_str(event.get())?;
+            self.attribute_event(&room, &mut value).await;
+            if value.get("sender_attribution").is_some() {
+                *event = serde_json::value::to_raw_value(&value)?;
+            }
+        }
+        Ok(())
+    }
+}
@@ -1,19 +1,77 @@
 use std::env;
+use std::path::Path;
 
-use anyhow::anyhow;
+use anyhow::{anyhow, bail};
 use matrix_sdk::ruma::api::client::sync::sync_events::v4::SyncRequestListFilters;
 use matrix_sdk::ruma::events::{StateEventType, TimelineEventType};
+use matrix_sdk::ruma::owned_user_id;
 use matrix_sdk::{ruma::OwnedUserId, SlidingSyncList};
 use matrix_sdk::{Client as MatrixClient, SlidingSyncMode};
+use reqwest::header::{HeaderMap, HeaderValue, USER_AGENT};
+use rusqlite::{Connection, OpenFlags};
+use tracing::warn;
 
+use super::oversize::Oversize;
 use super::session::state_db_path;
 use super::{session, Client};
+use crate::skew::Skew;
 use crate::CRATE_NAME;
 
 #[derive(Debug)]
 pub(crate) struct ClientBuilder {
     user_id: Option<OwnedUserId>,
     device_name: Option<String>,
+    user_agent_suffix: Option<String>,
+    request_tag: Option<String>,
+    /// Check the crypto store of a restored session: refuse one which
+    /// cannot be read, warn about a missing one
+    require_crypto_store: bool,
+}
+
+/// File of the crypto store in the sqlite store directory.
+const CRYPTO_STORE: &str = "matrix-sdk-crypto.sqlite3";
+
+/// The header carrying the request tag; synapse logs the user agent, the
+/// header is meant for reverse proxies.
+const REQUEST_TAG_HEADER: &str = "x-request-tag";
+
+/// Whether the crypto store at `path` is an sqlite database we can read.
+fn check_crypto_store(path: &Path) -> anyhow::Result<()> {
+    let conn = Connection::open_with_flags(path, OpenFlags::SQLITE_OPEN_READ_ONLY)?;
+    conn.query_row("SELECT count(*) FROM sqlite_master", [], |row| {
+        row.get::<_, i64>(0)
+    })?;
+    Ok(())
+}
+
+/// Build the HTTP client used for all requests, by the matrix-sdk as well
+/// as for the synapse admin and federation APIs.
+pub(crate) fn transport(
+    user_agent_suffix: Option<&str>,
+    request_tag: Option<&str>,
+) -> anyhow::Result<reqwest::Client> {
+    let mut user_agent = format!("{}/{}", CRATE_NAME, env!("CARGO_PKG_VERSION"));
+    if let Some(suffix) = user_agent_suffix {
+        user_agent = format!("{} {}", user_agent, suffix);
+    }
+    let mut headers = HeaderMap::new();
+    if let Some(tag) = request_tag {
+        user_agent = format!("{} (tag {})", user_agent, tag);
+        headers.insert(REQUEST_TAG_HEADER, HeaderValue::from_str(tag)?);
+    }
+    headers.insert(USER_AGENT, HeaderValue::from_str(&user_agent)?);
+
+    let mut builder = reqwest::Client::builder().default_headers(headers);
+
+    if let Ok(proxy) = env::var("HTTPS_PROXY") {
+        builder = builder.proxy(reqwest::Proxy::all(proxy)?);
+    }
+
+    if env::var("MN_INSECURE").is_ok() {
+        builder = builder.danger_accept_invalid_certs(true);
+    }
+
+    Ok(builder.build()?)
 }
 
 impl ClientBuilder {
@@ -27,6 +85,20 @@ impl ClientBuilder {
         self
     }
 
+    /// Appended to the User-Agent of every request; defaults to
+    /// `MN_USER_AGENT_SUFFIX`.
+    pub(crate) fn user_agent_suffix(mut self, suffix: Option<String>) -> Self {
+        self.user_agent_suffix = suffix.or_else(|| env::var("MN_USER_AGENT_SUFFIX").ok());
+        self
+    }
+
+    /// Tag every request of this invocation, e.g. to find the traffic of
+    /// a cron job in the homeserver logs.
+    pub(crate) fn request_tag(mut self, tag: Option<String>) -> Self {
+        self.request_tag = tag;
+        self
+    }
+
     pub(crate) fn load_meta(self) -> anyhow::Result<Self> {
         let meta = session::Meta::load().map_err(|e| anyhow!("could not load meta.json: {}", e))?;
         Ok(Self::from(meta))
@@ -41,25 +113,40 @@ impl ClientBuilder {
         };
 
         let state_path = state_db_path(user_id.clone())?;
-
-        let mut builder = MatrixClient::builder()
-            .server_name(user_id.server_name())
-            .sqlite_store(state_path, None);
-
-        if let Ok(proxy) = env::var("HTTPS_PROXY") {
-            builder = builder.proxy(proxy);
+        let crypto_store = state_path.join(CRYPTO_STORE);
+        if self.require_crypto_store && matches!(session::load_session(&user_id), Ok(Some(_))) {
+            if crypto_store.try_exists()? {
+                // The SDK would replace a store it cannot open, and with it
+                // the keys of our device.
+                if let Err(e) = check_crypto_store(&crypto_store) {
+                    bail!(
+                        "the crypto store {} cannot be read: {}; \
+                         fix or remove it, or log in again with `mn login`",
+                        crypto_store.display(),
+                        e
+                    );
+                }
+            } else {
+                // E.g. a session brought along with `mn config import`.
+                warn!(
+                    "the crypto store in {} is missing; creating a new one, \
+                     so the keys of earlier encrypted messages are gone",
+                    state_path.display()
+                );
+            }
         }
 
-        if env::var("MN_INSECURE").is_ok() {
-            builder = builder.disable_ssl_verification();
-        }
+        let http = transport(
+            self.user_agent_suffix.as_deref(),
+            self.request_tag.as_deref(),
+        )?;
 
-        let mut client = Client {
-            inner: builder.build().await?,
-            user_id,
-            device_name,
-            sliding_sync: None,
-        };
+        let builder = MatrixClient::builder()
+            .server_name(user_id.server_name())
+            .sqlite_store(state_path, None)
+            .http_client(http.clone());
+
+        let mut client = Client::new(builder.build().await?, http, user_id, device_name);
 
         client.connect().await?;
 
@@ -98,6 +185,54 @@ impl ClientBuilder {
 
         Ok(client)
     }
+
+    /// A client which never connects: without store, session and sync, for
+    /// `send --preview --fixture`. The user id is a placeholder if unset.
+    pub(crate) async fn build_offline(self) -> anyhow::Result<Client> {
+        let user_id = self
+            .user_id
+            .unwrap_or_else(|| owned_user_id!("@mn:localhost"));
+        let device_name = self.device_name.unwrap_or_else(|| CRATE_NAME.to_string());
+        let http = transport(
+            self.user_agent_suffix.as_deref(),
+            self.request_tag.as_deref(),
+        )?;
+        let inner = MatrixClient::builder()
+            .homeserver_url(format!("https://{}", user_id.server_name()))
+            .http_client(http.clone())
+            .build()
+            .await?;
+        Ok(Client::new(inner, http, user_id, device_name))
+    }
+}
+
+impl Client {
+    fn new(
+        inner: MatrixClient,
+        http: reqwest::Client,
+        user_id: OwnedUserId,
+        device_name: String,
+    ) -> Self {
+        Self {
+            inner,
+            http,
+            user_id,
+            device_name,
+            sliding_sync: None,
+            identity: None,
+            mentions: None,
+            preview: false,
+            fixture: None,
+            dedupe: None,
+            bridges: None,
+            oversize: Oversize::default(),
+            sync_health: None,
+            skew: Skew::default(),
+            txn_id: None,
+            plaintext: false,
+            aliases: Default::default(),
+        }
+    }
 }
 
 impl Default for ClientBuilder {
@@ -105,6 +240,9 @@ impl Default for ClientBuilder {
         Self {
             user_id: None,
             device_name: Some(CRATE_NAME.to_string()),
+            user_agent_suffix: None,
+            request_tag: None,
+            require_crypto_store: false,
         }
     }
 }
@@ -115,6 +253,77 @@ impl From<session::Meta> for ClientBuilder {
         Self {
             user_id: Some(config.user_id),
             device_name: Some(device_name),
+            user_agent_suffix: None,
+            request_tag: None,
+            require_crypto_store: true,
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    use super::*;
+
+    /// The headers of a request sent by `http` to a local listener, by
+    /// lowercase name.
+    async fn request_headers(http: reqwest::Client) -> HashMap<String, String> {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let url = format!("http://{}/", listener.local_addr().unwrap());
+        let server = tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut head = vec![];
+            let mut buf = [0; 1024];
+            while !head.ends_with(b"\r\n\r\n") {
+                let n = stream.read(&mut buf).await.unwrap();
+                if n == 0 {
+                    break;
+                }
+                head.extend_from_slice(&buf[..n]);
+            }
+            stream
+                .write_all(b"HTTP/1.1 204 No Content\r\ncontent-length: 0\r\n\r\n")
+                .await
+                .unwrap();
+            head
+        });
+        http.get(url).send().await.unwrap();
+
+        let head = String::from_utf8(server.await.unwrap()).unwrap();
+        head.lines()
+            .skip(1)
+            .filter_map(|line| line.split_once(": "))
+            .map(|(name, value)| (name.to_ascii_lowercase(), value.to_string()))
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn sends_user_agent() {
+        let headers = request_headers(transport(None, None).unwrap()).await;
+        let user_agent = format!("{}/{}", CRATE_NAME, env!("CARGO_PKG_VERSION"));
+        assert_eq!(headers["user-agent"], user_agent);
+        assert!(!headers.contains_key(REQUEST_TAG_HEADER));
+    }
+
+    #[tokio::test]
+    async fn sends_suffix_and_request_tag() {
+        let http = transport(Some("ci-runner/2"), Some("nightly-42")).unwrap();
+        let headers = request_headers(http).await;
+        let user_agent = format!(
+            "{}/{} ci-runner/2 (tag nightly-42)",
+            CRATE_NAME,
+            env!("CARGO_PKG_VERSION")
+        );
+        assert_eq!(headers["user-agent"], user_agent);
+        assert_eq!(headers[REQUEST_TAG_HEADER], "nightly-42");
+    }
+
+    #[test]
+    fn rejects_invalid_request_tag() {
+        assert!(transport(None, Some("two\nlines")).is_err());
+    }
+}
@@ -0,0 +1,78 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use serde::{Deserialize, Serialize};
+use serde_json::value::RawValue;
+
+use super::session::{room_cache_path, write_atomic};
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// The parts of a room listing which need a request to the homeserver.
+#[derive(Clone, Deserialize, Serialize)]
+pub(crate) struct CachedRoom {
+    /// Unix timestamp in seconds
+    pub(crate) fetched_at: u64,
+    pub(crate) is_encrypted: bool,
+    pub(crate) events: Vec<Box<RawValue>>,
+}
+
+impl CachedRoom {
+    pub(crate) fn new(is_encrypted: bool, events: Vec<Box<RawValue>>) -> Self {
+        Self {
+            fetched_at: now(),
+            is_encrypted,
+            events,
+        }
+    }
+}
+
+/// Room summaries keyed by room id, stored next to the state store.
+pub(crate) struct RoomCache {
+    path: PathBuf,
+    ttl: Duration,
+    entries: BTreeMap<String, CachedRoom>,
+}
+
+impl RoomCache {
+    pub(crate) fn load(client: &super::Client, ttl: Duration) -> anyhow::Result<Self> {
+        let path = room_cache_path(&client.user_id)?;
+        let entries = match fs::read_to_string(&path) {
+            Ok(raw) => serde_json::from_str(&raw).unwrap_or_default(),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => BTreeMap::new(),
+            Err(e) => return Err(e.into()),
+        };
+
+        Ok(Self { path, ttl, entries })
+    }
+
+    /// A cached entry which is younger than the TTL.
+    pub(crate) fn get(&self, room_id: &str) -> Option<CachedRoom> {
+        let entry = self.entries.get(room_id)?;
+        if now().saturating_sub(entry.fetched_at) >= self.ttl.as_secs() {
+            return None;
+        }
+        Some(entry.clone())
+    }
+
+    /// Forget rooms which are not in `room_ids`, e.g. rooms we left.
+    pub(crate) fn retain(&mut self, room_ids: &[String]) {
+        self.entries.retain(|id, _| room_ids.contains(id));
+    }
+
+    pub(crate) fn insert(&mut self, room_id: String, entry: CachedRoom) {
+        self.entries.insert(room_id, entry);
+    }
+
+    pub(crate) fn persist(&self) -> anyhow::Result<()> {
+        write_atomic(&self.path, &serde_json::to_vec(&self.entries)?, 0o600)
+    }
+}
@@ -0,0 +1,140 @@
+use std::collections::HashMap;
+use std::io::{self, Write};
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use serde_json::Value;
+use tracing::warn;
+
+use crate::call::{CallEvent, CallPhase};
+use crate::hook::{self, Outcome};
+use crate::outputs::CallEntry;
+
+/// What `add_call_handler` does with call events.
+pub(crate) struct CallOptions {
+    /// Print the lifecycle of calls as NDJSON on stdout
+    pub(crate) print: bool,
+    /// Ring the terminal bell for incoming 1:1 calls
+    pub(crate) bell: bool,
+    /// Run this command for incoming 1:1 calls; the invite is passed on
+    /// stdin
+    pub(crate) exec: Option<(String, hook::Limiter)>,
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+impl super::Client {
+    /// Follow calls in the synced rooms. 1:1 calls are timed from their
+    /// answer, group calls from their start and their members from
+    /// joining; the duration is part of the hang up, end or leave entry.
+    pub(crate) fn add_call_handler(&self, opts: CallOptions) {
+        let this = self.clone();
+        let opts = Arc::new(opts);
+        // Start of calls and memberships by room and call id or member.
+        let since: Arc<Mutex<HashMap<(String, String), u64>>> = Arc::default();
+        let started = now_millis();
+
+        self.inner
+            .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                let this = this.clone();
+                let opts = opts.clone();
+                let since = since.clone();
+                async move {
+                    let Ok(event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    let Some(call) = CallEvent::parse(&event) else {
+                        return;
+                    };
+                    // Ignore history delivered by the initial sync.
+                    let ts = event
+                        .get("origin_server_ts")
+                        .and_then(Value::as_u64)
+                        .unwrap_or(0);
+                    if ts < started {
+                        return;
+                    }
+                    let sender = event
+                        .get("sender")
+                        .and_then(Value::as_str)
+                        .unwrap_or("")
+                        .to_string();
+                    let state_key = event.get("state_key").and_then(Value::as_str);
+
+                    let room_id = room.room_id().to_string();
+                    let key = match call.phase {
+                        CallPhase::MemberJoined | CallPhase::MemberLeft => (
+                            room_id.clone(),
+                            format!("member {}", state_key.unwrap_or("")),
+                        ),
+                        _ => (room_id.clone(), call.call_id.clone()),
+                    };
+                    let duration_ms = {
+                        let mut since = since.lock().unwrap();
+                        match call.phase {
+                            CallPhase::Started if !call.group => None,
+                            CallPhase::Started | CallPhase::Answered | CallPhase::MemberJoined => {
+                                since.insert(key, ts);
+                                None
+                            }
+                            CallPhase::HungUp | CallPhase::Ended | CallPhase::MemberLeft => {
+                                since.remove(&key).map(|start| ts.saturating_sub(start))
+                            }
+                        }
+                    };
+
+                    if opts.print {
+                        let entry = CallEntry {
+                            kind: "call",
+                            room_id,
+                            call_id: call.call_id.clone(),
+                            phase: call.phase,
+                            sender: sender.clone(),
+                            ts,
+                            duration_ms,
+                        };
+                        if let Ok(out) = serde_json::to_string(&entry) {
+                            println!("{}", out);
+                        }
+                    }
+
+                    // Invites without invitee ring everyone in the room.
+                    let invitee = event.pointer("/content/invitee").and_then(Value::as_str);
+                    let incoming = call.phase == CallPhase::Started
+                        && !call.group
+                        && sender != this.user_id.as_str()
+                        && invitee.map_or(true, |i| i == this.user_id.as_str());
+                    if !incoming {
+                        return;
+                    }
+                    if opts.bell {
+                        eprint!("\x07");
+                        let _ = io::stderr().flush();
+                    }
+                    if let Some((ref cmd, ref limiter)) = opts.exec {
+                        let cmd = cmd.clone();
+                        let run = limiter.clone();
+                        let payload = ev.json().get().to_string();
+                        let task = async move {
+                            match run.exec(&cmd, payload.as_bytes()).await {
+                                Outcome::Exited(status) if !status.success() => {
+                                    warn!("call hook failed: {}", status)
+                                }
+                                Outcome::Failed(e) => warn!("call hook failed: {}", e),
+                                _ => {}
+                            }
+                        };
+                        limiter.dispatch(task).await;
+                    }
+                }
+            });
+    }
+}
@@ -0,0 +1,136 @@
+use std::fs;
+use std::path::Path;
+
+use anyhow::{anyhow, bail};
+use matrix_sdk::matrix_auth::MatrixSession;
+use serde_json::{json, Map, Value};
+
+use super::session::{self, Meta};
+use crate::outputs::ConfigImport;
+
+/// Version of the exported config format.
+const FORMAT_VERSION: u64 = 1;
+/// Placeholder of tokens in configs exported with `--redact-token`.
+const REDACTED: &str = "<redacted>";
+
+/// The login config, i.e. meta.json and the session, as one JSON object
+/// with sorted keys.
+pub(crate) fn export_config(redact_token: bool) -> anyhow::Result<Value> {
+    let meta = Meta::load().map_err(|e| anyhow!("could not load meta.json: {}", e))?;
+    let mut session = match session::load_session(&meta.user_id) {
+        Ok(Some(session)) => serde_json::to_value(session)?,
+        _ => Value::Null,
+    };
+    if redact_token {
+        if let Some(session) = session.as_object_mut() {
+            for key in ["access_token", "refresh_token"] {
+                if session.contains_key(key) {
+                    session.insert(String::from(key), json!(REDACTED));
+                }
+            }
+        }
+    }
+
+    Ok(json!({
+        "version": FORMAT_VERSION,
+        "meta": meta,
+        "session": session,
+    }))
+}
+
+// Redacted tokens keep the current ones, so that a redacted export can
+// serve as the template for all machines.
+fn merge(base: &mut Map<String, Value>, update: Map<String, Value>) {
+    for (key, value) in update {
+        match (base.get_mut(&key), value) {
+            (Some(Value::Object(current)), Value::Object(nested)) => merge(current, nested),
+            (Some(_), Value::String(s)) if s == REDACTED => {}
+            (_, value) => {
+                base.insert(key, value);
+            }
+        }
+    }
+}
+
+/// Check an imported config; errors name the offending field.
+fn validate(config: &Value) -> anyhow::Result<(Meta, Option<MatrixSession>)> {
+    let Some(object) = config.as_object() else {
+        bail!("config must be a JSON object");
+    };
+    for key in object.keys() {
+        if !["version", "meta", "session"].contains(&key.as_str()) {
+            bail!("unknown field `{}`", key);
+        }
+    }
+    match object.get("version").and_then(Value::as_u64) {
+        Some(FORMAT_VERSION) => {}
+        Some(v) => bail!("field `version`: unsupported version {}", v),
+        None => bail!("field `version`: missing or not a number"),
+    }
+
+    let meta = object
+        .get("meta")
+        .ok_or_else(|| anyhow!("field `meta`: missing"))?;
+    let meta: Meta =
+        serde_json::from_value(meta.clone()).map_err(|e| anyhow!("field `meta`: {}", e))?;
+
+    let session = match object.get("session") {
+        None | Some(Value::Null) => None,
+        Some(session) => {
+            for key in ["access_token", "refresh_token"] {
+                if session.get(key).and_then(Value::as_str) == Some(REDACTED) {
+                    bail!("field `session.{}`: the token was redacted on export", key);
+                }
+            }
+            let session: MatrixSession = serde_json::from_value(session.clone())
+                .map_err(|e| anyhow!("field `session`: {}", e))?;
+            if session.meta.user_id != meta.user_id {
+                bail!(
+                    "field `session.user_id`: {} does not match meta.user_id {}",
+                    session.meta.user_id,
+                    meta.user_id
+                );
+            }
+            Some(session)
+        }
+    };
+
+    Ok((meta, session))
+}
+
+/// Validate and write a config exported by `export_config`. With
+/// `merge_current` the file is merged into the current config first, e.g. to
+/// change the device name only. Nothing is written if validation fails.
+pub(crate) fn import_config(
+    path: impl AsRef<Path>,
+    merge_current: bool,
+) -> anyhow::Result<ConfigImport> {
+    let raw = fs::read_to_string(path)?;
+    let imported: Value = serde_json::from_str(&raw)?;
+
+    let config = if merge_current {
+        let Value::Object(update) = imported else {
+            bail!("config must be a JSON object");
+        };
+        let mut current = match export_config(false)? {
+            Value::Object(current) => current,
+            _ => Map::new(),
+        };
+        merge(&mut current, update);
+        Value::Object(current)
+    } else {
+        imported
+    };
+
+    let (meta, session) = validate(&config)?;
+    if let Some(ref session) = session {
+        session::persist_session(&meta.user_id, session)?;
+    }
+    meta.dump()?;
+
+    Ok(ConfigImport {
+        user_id: meta.user_id.to_string(),
+        device_id: session.map(|s| s.meta.device_id.to_string()),
+        merged: merge_current,
+    })
+}
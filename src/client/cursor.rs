@@ -0,0 +1,315 @@
+use anyhow::bail;
+use matrix_sdk::room::{MessagesOptions, Room};
+use matrix_sdk::ruma::api::client::config::{get_room_account_data, set_room_account_data};
+use matrix_sdk::ruma::api::client::context::get_context;
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::api::client::read_marker::set_read_marker;
+use matrix_sdk::ruma::events::receipt::{ReceiptThread, ReceiptType};
+use matrix_sdk::ruma::events::RoomAccountDataEventType;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{uint, EventId, OwnedEventId, RoomId};
+use serde::{Deserialize, Serialize};
+use serde_json::value::RawValue;
+use serde_json::Value;
+use tracing::warn;
+
+/// Position of a message processing pipeline, stored as room account data.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+pub(crate) struct Cursor {
+    /// Forward pagination token pointing after the last processed event
+    pub(crate) token: String,
+    pub(crate) event_id: Option<String>,
+}
+
+pub(crate) struct CursorBatch {
+    /// Events after the cursor, oldest first
+    pub(crate) events: Vec<Box<RawValue>>,
+    pub(crate) previous: Option<Cursor>,
+    pub(crate) next: Cursor,
+}
+
+pub(crate) struct MarkerBatch {
+    /// Events after the m.fully_read marker, oldest first
+    pub(crate) events: Vec<Box<RawValue>>,
+    pub(crate) previous: Option<OwnedEventId>,
+    /// The marker event was unreachable; the events were selected by the
+    /// timestamp of our read receipt instead
+    pub(crate) fallback: bool,
+}
+
+/// Name of the lock held while the cursor `cursor_type` in the room is
+/// read and advanced.
+pub(crate) fn lock_name(room_id: &RoomId, cursor_type: &str) -> String {
+    format!("cursor.{}.{}", cursor_type, room_id)
+}
+
+fn event_id_of(event: &RawValue) -> Option<OwnedEventId> {
+    let event: Value = serde_json::from_str(event.get()).ok()?;
+    EventId::parse(event.get("event_id")?.as_str()?).ok()
+}
+
+fn ts_of(event: &RawValue) -> Option<u64> {
+    let event: Value = serde_json::from_str(event.get()).ok()?;
+    event.get("origin_server_ts")?.as_u64()
+}
+
+/// Up to `limit` events after the forward pagination `token`, and the
+/// token after the last one.
+async fn paginate_forward(
+    room: &Room,
+    mut token: String,
+    limit: u64,
+) -> anyhow::Result<(Vec<Box<RawValue>>, String)> {
+    let mut events = vec![];
+    while (events.len() as u64) < limit {
+        let mut options = MessagesOptions::forward();
+        options.from = Some(token.clone());
+        options.limit = (limit - events.len() as u64).try_into()?;
+        let msgs = room.messages(options).await?;
+
+        if msgs.chunk.is_empty() {
+            break;
+        }
+        events.extend(msgs.chunk.into_iter().map(|e| e.event.into_json()));
+        match msgs.end {
+            Some(end) => token = end,
+            None => break,
+        }
+    }
+    Ok((events, token))
+}
+
+/// The latest `limit` events, oldest first, and the token of the most
+/// recent position.
+async fn latest_events(room: &Room, limit: u64) -> anyhow::Result<(Vec<Box<RawValue>>, String)> {
+    let mut options = MessagesOptions::backward();
+    options.limit = limit.try_into()?;
+    let msgs = room.messages(options).await?;
+    // The start of a backwards pagination is the most recent position.
+    let mut events: Vec<_> = msgs
+        .chunk
+        .into_iter()
+        .map(|e| e.event.into_json())
+        .collect();
+    events.reverse();
+    Ok((events, msgs.start))
+}
+
+/// The oldest `limit` events sent after `since`, a unix timestamp in
+/// milliseconds, paginating backwards from the latest event.
+pub(super) async fn events_since(
+    room: &Room,
+    since: u64,
+    limit: u64,
+) -> anyhow::Result<Vec<Box<RawValue>>> {
+    let mut events = vec![];
+    let mut from = None;
+    loop {
+        let mut options = MessagesOptions::backward();
+        options.limit = limit.try_into()?;
+        options.from = from;
+        let msgs = room.messages(options).await?;
+
+        let mut reached = msgs.chunk.is_empty();
+        for event in msgs.chunk {
+            let event = event.event.into_json();
+            if ts_of(&event).is_some_and(|ts| ts <= since) {
+                reached = true;
+                break;
+            }
+            events.push(event);
+        }
+        match msgs.end {
+            Some(end) if !reached => from = Some(end),
+            _ => break,
+        }
+    }
+    events.reverse();
+    events.truncate(limit.try_into()?);
+    Ok(events)
+}
+
+impl super::Client {
+    pub(crate) async fn get_room_account_data(
+        &self,
+        room_id: &RoomId,
+        event_type: &str,
+    ) -> anyhow::Result<Option<Value>> {
+        let request = get_room_account_data::v3::Request::new(
+            self.user_id.clone(),
+            room_id.to_owned(),
+            RoomAccountDataEventType::from(event_type),
+        );
+
+        match self.inner.send(request, None).await {
+            Ok(resp) => Ok(Some(resp.account_data.deserialize_as::<Value>()?)),
+            Err(e) if matches!(e.client_api_error_kind(), Some(ErrorKind::NotFound)) => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    pub(crate) async fn put_room_account_data(
+        &self,
+        room_id: &RoomId,
+        event_type: &str,
+        content: &Value,
+    ) -> anyhow::Result<()> {
+        let request = set_room_account_data::v3::Request::new_raw(
+            self.user_id.clone(),
+            room_id.to_owned(),
+            RoomAccountDataEventType::from(event_type),
+            Raw::new(content)?.cast(),
+        );
+
+        self.inner.send(request, None).await?;
+        Ok(())
+    }
+
+    async fn get_cursor(
+        &self,
+        room_id: &RoomId,
+        cursor_type: &str,
+    ) -> anyhow::Result<Option<Cursor>> {
+        match self.get_room_account_data(room_id, cursor_type).await? {
+            // An empty object is what remains after a reset.
+            Some(Value::Object(o)) if o.is_empty() => Ok(None),
+            Some(content) => Ok(Some(serde_json::from_value(content)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Fetch up to `limit` events after the cursor stored under
+    /// `cursor_type`. Without a cursor the latest `limit` events are
+    /// returned.
+    pub(crate) async fn messages_after_cursor(
+        &self,
+        room_id: &RoomId,
+        cursor_type: &str,
+        limit: u64,
+    ) -> anyhow::Result<CursorBatch> {
+        let room = self.get_joined_room(room_id)?;
+        let previous = self.get_cursor(room_id, cursor_type).await?;
+
+        let (events, token) = match previous {
+            Some(ref cursor) => paginate_forward(&room, cursor.token.clone(), limit).await?,
+            None => latest_events(&room, limit).await?,
+        };
+
+        let event_id = events
+            .last()
+            .and_then(|e| serde_json::from_str::<Value>(e.get()).ok())
+            .and_then(|e| e.get("event_id").and_then(Value::as_str).map(String::from))
+            .or_else(|| previous.as_ref().and_then(|c| c.event_id.clone()));
+
+        Ok(CursorBatch {
+            events,
+            previous,
+            next: Cursor { token, event_id },
+        })
+    }
+
+    /// Store `batch.next` as new cursor. Fails if another run moved the
+    /// cursor since the batch was fetched.
+    pub(crate) async fn advance_cursor(
+        &self,
+        room_id: &RoomId,
+        cursor_type: &str,
+        batch: &CursorBatch,
+    ) -> anyhow::Result<()> {
+        let current = self.get_cursor(room_id, cursor_type).await?;
+        if current != batch.previous {
+            bail!(
+                "cursor {} in {} was moved by another run; not advancing",
+                cursor_type,
+                room_id
+            );
+        }
+
+        self.put_room_account_data(room_id, cursor_type, &serde_json::to_value(&batch.next)?)
+            .await
+    }
+
+    /// The event our m.fully_read marker in the room points at.
+    async fn fully_read(&self, room_id: &RoomId) -> anyhow::Result<Option<OwnedEventId>> {
+        let content = self.get_room_account_data(room_id, "m.fully_read").await?;
+        Ok(content
+            .as_ref()
+            .and_then(|c| c.get("event_id"))
+            .and_then(Value::as_str)
+            .and_then(|id| EventId::parse(id).ok()))
+    }
+
+    /// Fetch up to `limit` events after our m.fully_read marker. Without
+    /// a marker the latest `limit` events are returned. If the marker
+    /// event cannot be fetched, e.g. because it was redacted and purged,
+    /// the events after the timestamp of our read receipt are returned.
+    pub(crate) async fn messages_after_read_marker(
+        &self,
+        room_id: &RoomId,
+        limit: u64,
+    ) -> anyhow::Result<MarkerBatch> {
+        let room = self.get_joined_room(room_id)?;
+        let Some(marker) = self.fully_read(room_id).await? else {
+            let (events, _) = latest_events(&room, limit).await?;
+            return Ok(MarkerBatch {
+                events,
+                previous: None,
+                fallback: false,
+            });
+        };
+
+        let mut request = get_context::v3::Request::new(room_id.to_owned(), marker.clone());
+        request.limit = uint!(0);
+        let token = match self.inner.send(request, None).await {
+            Ok(resp) => resp.end,
+            Err(e) => {
+                warn!("cannot fetch the read marker event {}: {}", marker, e);
+                None
+            }
+        };
+        if let Some(token) = token {
+            let (events, _) = paginate_forward(&room, token, limit).await?;
+            return Ok(MarkerBatch {
+                events,
+                previous: Some(marker),
+                fallback: false,
+            });
+        }
+
+        let receipt = room
+            .user_receipt(ReceiptType::Read, ReceiptThread::Unthreaded, &self.user_id)
+            .await?;
+        let since = receipt.and_then(|(_, r)| r.ts).map(|ts| u64::from(ts.0));
+        let events = match since {
+            Some(since) => {
+                warn!("falling back to the events after our read receipt");
+                events_since(&room, since, limit).await?
+            }
+            None => {
+                warn!("no read receipt either; falling back to the latest events");
+                latest_events(&room, limit).await?.0
+            }
+        };
+        Ok(MarkerBatch {
+            events,
+            previous: Some(marker),
+            fallback: true,
+        })
+    }
+
+    /// Move our m.fully_read marker to the newest event of `batch`.
+    /// Returns the new marker, none if the batch was empty.
+    pub(crate) async fn advance_read_marker(
+        &self,
+        room_id: &RoomId,
+        batch: &MarkerBatch,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let Some(event_id) = batch.events.last().and_then(|e| event_id_of(e)) else {
+            return Ok(None);
+        };
+        let mut request = set_read_marker::v3::Request::new(room_id.to_owned());
+        request.fully_read = Some(event_id.clone());
+        self.inner.send(request, None).await?;
+        Ok(Some(event_id))
+    }
+}
@@ -0,0 +1,188 @@
+use std::collections::HashMap;
+use std::io;
+use std::sync::{Arc, Mutex};
+
+use is_terminal::IsTerminal;
+use matrix_sdk::deserialized_responses::EncryptionInfo;
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::room::encrypted::OriginalSyncRoomEncryptedEvent;
+use matrix_sdk::ruma::events::{AnySyncTimelineEvent, AnyToDeviceEvent};
+use matrix_sdk::ruma::serde::Raw;
+use serde_json::{json, Value};
+use tracing::{debug, warn};
+
+use crate::filter::Filter;
+use crate::render;
+
+/// Undecryptable events kept for keys which may arrive later; further
+/// ones are printed as undecryptable only.
+const MAX_PENDING: usize = 1000;
+
+/// How `mn sync --print-events` prints the timeline events.
+#[derive(Clone, Debug)]
+pub(crate) struct PrintOptions {
+    /// One readable line per event instead of NDJSON
+    pub(crate) text: bool,
+    /// Print the bodies as sent with `text`
+    pub(crate) raw_body: bool,
+    pub(crate) filter: Option<Filter>,
+}
+
+/// Encrypted events waiting for their megolm session, by session id.
+#[derive(Default)]
+pub(crate) struct Pending {
+    events: HashMap<String, Vec<(Room, Raw<OriginalSyncRoomEncryptedEvent>)>>,
+    len: usize,
+}
+
+impl Pending {
+    pub(crate) fn push(&mut self, room: Room, event: Raw<OriginalSyncRoomEncryptedEvent>) {
+        let Some(session_id) = session_id(&event) else {
+            return;
+        };
+        if self.len >= MAX_PENDING {
+            debug!("too many undecryptable events; not retrying {}", session_id);
+            return;
+        }
+        self.events
+            .entry(session_id)
+            .or_default()
+            .push((room, event));
+        self.len += 1;
+    }
+
+    fn take(&mut self, session_id: &str) -> Vec<(Room, Raw<OriginalSyncRoomEncryptedEvent>)> {
+        let events = self.events.remove(session_id).unwrap_or_default();
+        self.len -= events.len();
+        events
+    }
+}
+
+/// The megolm session of an encrypted event or room key.
+fn session_id<T>(event: &Raw<T>) -> Option<String> {
+    let content = event.get_field::<Value>("content").ok()??;
+    content
+        .get("session_id")
+        .and_then(Value::as_str)
+        .map(String::from)
+}
+
+/// Mark an event of an encrypted room with whether it could be
+/// decrypted; events of unencrypted rooms stay as they are.
+pub(crate) fn mark_decrypted(event: &mut Value, encrypted: bool) {
+    let undecryptable = event.get("type").and_then(Value::as_str) == Some("m.room.encrypted");
+    let Some(map) = event.as_object_mut() else {
+        return;
+    };
+    if undecryptable {
+        map.insert(String::from("decrypted"), json!(false));
+    } else if encrypted {
+        map.insert(String::from("decrypted"), json!(true));
+    }
+}
+
+/// The session id of a received room key, directly or forwarded.
+fn room_key_session(event: &Raw<AnyToDeviceEvent>) -> Option<String> {
+    match event.get_field::<String>("type").ok()??.as_str() {
+        "m.room_key" | "m.forwarded_room_key" => {}
+        _ => return None,
+    }
+    session_id(event)
+}
+
+impl super::Client {
+    /// Decrypt the events of `pending` waiting for the room key `ev`, if it
+    /// is one. The events come marked and annotated like those of the sync.
+    pub(crate) async fn decrypt_pending(
+        &self,
+        pending: &Mutex<Pending>,
+        ev: &Raw<AnyToDeviceEvent>,
+    ) -> Vec<(Room, Value)> {
+        let Some(session_id) = room_key_session(ev) else {
+            return vec![];
+        };
+        let waiting = pending.lock().unwrap().take(&session_id);
+        let mut events = vec![];
+        for (room, encrypted) in waiting {
+            let decrypted = match room.decrypt_event(&encrypted).await {
+                Ok(decrypted) => decrypted,
+                Err(e) => {
+                    warn!("decrypting with session {}: {}", session_id, e);
+                    continue;
+                }
+            };
+            let Ok(mut event) = decrypted.event.deserialize_as::<Value>() else {
+                continue;
+            };
+            mark_decrypted(&mut event, true);
+            self.skew.annotate(&mut event);
+            events.push((room, event));
+        }
+        events
+    }
+
+    async fn print_event(&self, room: &Room, mut event: Value, opts: &PrintOptions) {
+        if let Some(ref filter) = opts.filter {
+            if !filter.matches(room.room_id().as_str(), &event) {
+                return;
+            }
+        }
+        self.attribute_event(room, &mut event).await;
+        if opts.text {
+            let ansi = io::stdout().is_terminal();
+            if let Some(line) = render::event_line(&event, opts.raw_body, ansi) {
+                println!("{} {}", room.room_id(), line);
+            }
+            return;
+        }
+        // Sync events come without their room.
+        if let Some(map) = event.as_object_mut() {
+            map.insert(String::from("room_id"), json!(room.room_id()));
+        }
+        println!("{}", event);
+    }
+
+    /// Print the timeline events of the sync loop on stdout. Events which
+    /// could not be decrypted carry `"decrypted": false`, or read `<unable
+    /// to decrypt>` with `opts.text`; once their room key arrives, they are
+    /// decrypted and printed again.
+    pub(crate) fn add_event_printer(&self, mut opts: PrintOptions) {
+        opts.filter = opts.filter.map(|f| f.with_ts_source(self.skew.source));
+        let pending = Arc::new(Mutex::new(Pending::default()));
+
+        let this = self.clone();
+        let timeline_opts = opts.clone();
+        let timeline_pending = pending.clone();
+        self.inner.add_event_handler(
+            move |ev: Raw<AnySyncTimelineEvent>, room: Room, encryption: Option<EncryptionInfo>| {
+                let this = this.clone();
+                let opts = timeline_opts.clone();
+                let pending = timeline_pending.clone();
+                async move {
+                    let Ok(mut event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    mark_decrypted(&mut event, encryption.is_some());
+                    this.skew.annotate(&mut event);
+                    if event.get("decrypted") == Some(&json!(false)) {
+                        pending.lock().unwrap().push(room.clone(), ev.cast());
+                    }
+                    this.print_event(&room, event, &opts).await;
+                }
+            },
+        );
+
+        let this = self.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnyToDeviceEvent>| {
+                let this = this.clone();
+                let opts = opts.clone();
+                let pending = pending.clone();
+                async move {
+                    for (room, event) in this.decrypt_pending(&pending, &ev).await {
+                        this.print_event(&room, event, &opts).await;
+                    }
+                }
+            });
+    }
+}
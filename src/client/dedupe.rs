@@ -0,0 +1,159 @@
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::io;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use base64::engine::general_purpose::STANDARD_NO_PAD;
+use base64::Engine;
+use matrix_sdk::room::MessagesOptions;
+use matrix_sdk::ruma::RoomId;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+
+use super::room::Target;
+use super::session::{self, sent_cache_path, FileLock};
+
+/// Number of recent events searched for a duplicate.
+const HISTORY_SCAN: u32 = 50;
+/// Cache entries are kept at least this long, independent of the window.
+const CACHE_KEEP: Duration = Duration::from_secs(24 * 60 * 60);
+
+#[derive(Clone, Debug)]
+pub(crate) struct Dedupe {
+    pub(crate) window: Duration,
+    /// Only consult the local cache of sent messages, not the room history
+    pub(crate) cache_only: bool,
+    pub(crate) fail_on_duplicate: bool,
+}
+
+/// Returned instead of sending when an identical message was sent within
+/// the dedupe window.
+#[derive(Debug)]
+pub(crate) struct Duplicate {
+    /// The earlier event; unknown if it was found in the local cache
+    pub(crate) event_id: Option<String>,
+    pub(crate) fail: bool,
+}
+
+impl fmt::Display for Duplicate {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.event_id {
+            Some(ref event_id) => write!(f, "suppressed duplicate of {}", event_id),
+            None => write!(f, "suppressed duplicate of a recently sent message"),
+        }
+    }
+}
+
+impl std::error::Error for Duplicate {}
+
+#[derive(Clone, Deserialize, Serialize)]
+struct SentEntry {
+    hash: String,
+    /// Unix timestamp in milliseconds
+    ts: u64,
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+fn body_hash(body: &str) -> String {
+    STANDARD_NO_PAD.encode(Sha256::digest(body.as_bytes()))
+}
+
+impl super::Client {
+    fn load_sent(&self) -> anyhow::Result<BTreeMap<String, Vec<SentEntry>>> {
+        let path = sent_cache_path(&self.user_id)?;
+        match fs::read_to_string(path) {
+            Ok(raw) => Ok(serde_json::from_str(&raw).unwrap_or_default()),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    /// Remember a sent body so that `--dedupe-cache` works without
+    /// fetching the room history. Concurrent sends take turns, so that
+    /// none of their entries is lost.
+    pub(super) fn remember_sent(
+        &self,
+        room_id: &RoomId,
+        body: &str,
+        dedupe: &Dedupe,
+    ) -> anyhow::Result<()> {
+        let path = sent_cache_path(&self.user_id)?;
+        let _lock = FileLock::acquire(&path)?;
+        let mut sent = self.load_sent()?;
+        let keep = dedupe.window.max(CACHE_KEEP).as_millis() as u64;
+        let now = now_millis();
+        for entries in sent.values_mut() {
+            entries.retain(|e| now.saturating_sub(e.ts) < keep);
+        }
+        sent.retain(|_, entries| !entries.is_empty());
+        sent.entry(room_id.to_string())
+            .or_default()
+            .push(SentEntry {
+                hash: body_hash(body),
+                ts: now,
+            });
+
+        session::write_atomic(path, &serde_json::to_vec(&sent)?, 0o600)
+    }
+
+    /// An identical body sent by us within the window, from the local
+    /// cache or the recent room history; none for a fixture, which has
+    /// neither.
+    pub(super) async fn find_duplicate(
+        &self,
+        room: &Target,
+        body: &str,
+        dedupe: &Dedupe,
+    ) -> anyhow::Result<Option<Duplicate>> {
+        let Target::Joined(room) = room else {
+            return Ok(None);
+        };
+        let since = now_millis().saturating_sub(dedupe.window.as_millis() as u64);
+        let duplicate = |event_id| Duplicate {
+            event_id,
+            fail: dedupe.fail_on_duplicate,
+        };
+
+        let hash = body_hash(body);
+        let cached = self
+            .load_sent()?
+            .remove(room.room_id().as_str())
+            .unwrap_or_default()
+            .into_iter()
+            .any(|e| e.ts >= since && e.hash == hash);
+        if cached {
+            return Ok(Some(duplicate(None)));
+        }
+        if dedupe.cache_only {
+            return Ok(None);
+        }
+
+        let mut options = MessagesOptions::backward();
+        options.limit = HISTORY_SCAN.into();
+        let msgs = room.messages(options).await?;
+        for event in msgs.chunk {
+            let event = event.event.deserialize_as::<Value>()?;
+            let field = |key: &str| event.get(key).and_then(Value::as_str);
+            if event.get("origin_server_ts").and_then(Value::as_u64) < Some(since) {
+                break;
+            }
+            if field("type") != Some("m.room.message")
+                || field("sender") != Some(self.user_id.as_str())
+            {
+                continue;
+            }
+            if event.pointer("/content/body").and_then(Value::as_str) == Some(body) {
+                return Ok(Some(duplicate(field("event_id").map(String::from))));
+            }
+        }
+        Ok(None)
+    }
+}
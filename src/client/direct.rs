@@ -0,0 +1,150 @@
+use std::collections::BTreeMap;
+use std::env;
+
+use anyhow::bail;
+use matrix_sdk::ruma::api::client::config::{get_global_account_data, set_global_account_data};
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::api::client::room::create_room::{self, v3::RoomPreset};
+use matrix_sdk::ruma::events::GlobalAccountDataEventType;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{OwnedRoomId, RoomId, UserId};
+use matrix_sdk::RoomState;
+use serde_json::{json, Value};
+use tracing::warn;
+
+use crate::outputs::DirectRoom;
+
+#[derive(Debug, Default)]
+pub(crate) struct DirectOptions {
+    /// Add m.room.encryption to the initial state
+    pub(crate) encrypt: bool,
+    /// Return an existing direct room instead of creating one
+    pub(crate) reuse_existing: bool,
+    /// Create a new room even if one exists
+    pub(crate) force: bool,
+}
+
+impl super::Client {
+    /// The m.direct account data, read from the server since the local
+    /// copy may be outdated; user ids map to room ids.
+    async fn direct_rooms(&self) -> anyhow::Result<BTreeMap<String, Vec<OwnedRoomId>>> {
+        let request = get_global_account_data::v3::Request::new(
+            self.user_id.clone(),
+            GlobalAccountDataEventType::Direct,
+        );
+        match self.inner.send(request, None).await {
+            Ok(resp) => Ok(resp.account_data.deserialize_as()?),
+            Err(e) if matches!(e.client_api_error_kind(), Some(ErrorKind::NotFound)) => {
+                Ok(BTreeMap::new())
+            }
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    async fn add_direct_room(&self, user_id: &UserId, room_id: &RoomId) -> anyhow::Result<()> {
+        let mut direct = self.direct_rooms().await?;
+        let rooms = direct.entry(user_id.to_string()).or_default();
+        if rooms.iter().any(|r| r == room_id) {
+            return Ok(());
+        }
+        rooms.push(room_id.to_owned());
+
+        let request = set_global_account_data::v3::Request::new_raw(
+            self.user_id.clone(),
+            GlobalAccountDataEventType::Direct,
+            Raw::new(&direct)?.cast(),
+        );
+        self.inner.send(request, None).await?;
+        Ok(())
+    }
+
+    /// Direct rooms with `user_id` which we are still joined to and the
+    /// user did not leave; the most recent one last.
+    async fn existing_direct_rooms(&self, user_id: &UserId) -> anyhow::Result<Vec<OwnedRoomId>> {
+        let mut direct = self.direct_rooms().await?;
+        let mut rooms = vec![];
+        for room_id in direct.remove(user_id.as_str()).unwrap_or_default() {
+            let Some(room) = self.inner.get_room(&room_id) else {
+                continue;
+            };
+            if room.state() != RoomState::Joined {
+                continue;
+            }
+            let membership = self
+                .get_state(&room_id, "m.room.member", user_id.as_str())
+                .await?
+                .and_then(|c| {
+                    c.get("membership")
+                        .and_then(Value::as_str)
+                        .map(String::from)
+                });
+            if matches!(membership.as_deref(), Some("join" | "invite")) {
+                rooms.push(room_id);
+            }
+        }
+        Ok(rooms)
+    }
+
+    /// Create a direct room with `user_id`, recorded in m.direct so that
+    /// other clients show it as such. Existing direct rooms with the user
+    /// are reused with `reuse_existing`; otherwise `force` is required.
+    pub(crate) async fn create_direct_room(
+        &self,
+        user_id: &UserId,
+        opts: &DirectOptions,
+    ) -> anyhow::Result<DirectRoom> {
+        let existing = self.existing_direct_rooms(user_id).await?;
+        if let Some(room_id) = existing.last() {
+            if opts.reuse_existing {
+                return Ok(DirectRoom {
+                    room_id: room_id.to_string(),
+                    user_id: user_id.to_string(),
+                    created: false,
+                    encrypted: self
+                        .get_state(room_id, "m.room.encryption", "")
+                        .await?
+                        .is_some(),
+                    existing: existing.iter().map(|r| r.to_string()).collect(),
+                });
+            }
+            if !opts.force {
+                bail!(
+                    "{} direct room(s) with {} exist, the latest is {}; use --reuse-existing or --force",
+                    existing.len(),
+                    user_id,
+                    room_id
+                );
+            }
+            warn!(
+                "creating another direct room with {} besides {} existing",
+                user_id,
+                existing.len()
+            );
+        }
+
+        let encrypted = opts.encrypt && env::var("MN_DIRECT_NO_ENCRYPT").is_err();
+        let mut request = create_room::v3::Request::new();
+        request.is_direct = true;
+        request.invite = vec![user_id.to_owned()];
+        request.preset = Some(RoomPreset::TrustedPrivateChat);
+        if encrypted {
+            let encryption = json!({
+                "type": "m.room.encryption",
+                "state_key": "",
+                "content": { "algorithm": "m.megolm.v1.aes-sha2" },
+            });
+            request.initial_state = vec![Raw::new(&encryption)?.cast()];
+        }
+
+        let room = self.inner.create_room(request).await?;
+        self.add_direct_room(user_id, room.room_id()).await?;
+
+        Ok(DirectRoom {
+            room_id: room.room_id().to_string(),
+            user_id: user_id.to_string(),
+            created: true,
+            encrypted,
+            existing: existing.iter().map(|r| r.to_string()).collect(),
+        })
+    }
+}
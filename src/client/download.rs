@@ -0,0 +1,220 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::media::{MediaFormat, MediaRequest};
+use matrix_sdk::room::MessagesOptions;
+use matrix_sdk::ruma::events::room::MediaSource;
+use matrix_sdk::ruma::RoomId;
+use serde_json::Value;
+
+use super::session::write_atomic;
+use crate::outputs::{MediaDownload, MediaManifestEntry};
+
+/// Name of the manifest in the output directory.
+const MANIFEST: &str = "manifest.json";
+/// Characters of the event id in front of the file names.
+const EVENT_PREFIX: usize = 12;
+
+/// What `download_media` fetches and where to.
+#[derive(Debug)]
+pub(crate) struct DownloadOptions {
+    /// Only media sent within this time; the whole history if none
+    pub(crate) since: Option<Duration>,
+    pub(crate) output: PathBuf,
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// A media event of the history.
+struct Media {
+    event_id: String,
+    sender: String,
+    origin_server_ts: u64,
+    name: String,
+    mimetype: Option<String>,
+    source: MediaSource,
+}
+
+/// The media of a decrypted m.room.message or m.sticker event; None for
+/// other events and redacted media.
+fn media_of(event: &Value) -> Option<Media> {
+    let event_type = event.get("type")?.as_str()?;
+    let content = event.get("content")?;
+    match event_type {
+        "m.sticker" => {}
+        "m.room.message" => {
+            let msgtype = content.get("msgtype")?.as_str()?;
+            if !["m.image", "m.file", "m.video", "m.audio"].contains(&msgtype) {
+                return None;
+            }
+        }
+        _ => return None,
+    }
+    let source = match (content.get("url"), content.get("file")) {
+        (Some(url), _) => MediaSource::Plain(serde_json::from_value(url.clone()).ok()?),
+        (None, Some(file)) => MediaSource::Encrypted(serde_json::from_value(file.clone()).ok()?),
+        (None, None) => return None,
+    };
+    // With a caption the body is the caption and the name in filename.
+    let name = content
+        .get("filename")
+        .or_else(|| content.get("body"))
+        .and_then(Value::as_str)
+        .unwrap_or("")
+        .to_string();
+
+    Some(Media {
+        event_id: event.get("event_id")?.as_str()?.to_string(),
+        sender: event.get("sender")?.as_str()?.to_string(),
+        origin_server_ts: event.get("origin_server_ts")?.as_u64()?,
+        name,
+        mimetype: content
+            .pointer("/info/mimetype")
+            .and_then(Value::as_str)
+            .map(String::from),
+        source,
+    })
+}
+
+/// The file name of `media`: its original name, without directories,
+/// behind a prefix of the event id, so that files of the same name do
+/// not overwrite each other.
+fn file_name(media: &Media) -> String {
+    let safe = |c: char| c.is_alphanumeric() || "-_.".contains(c);
+    let prefix: String = media
+        .event_id
+        .trim_start_matches('$')
+        .chars()
+        .filter(|&c| safe(c))
+        .take(EVENT_PREFIX)
+        .collect();
+    let name = Path::new(&media.name)
+        .file_name()
+        .and_then(|n| n.to_str())
+        .unwrap_or("")
+        .chars()
+        .map(|c| if c.is_control() { '_' } else { c })
+        .collect::<String>();
+    match name.trim_start_matches('.') {
+        "" => format!("{}-file", prefix),
+        name => format!("{}-{}", prefix, name),
+    }
+}
+
+fn load_manifest(path: &Path) -> anyhow::Result<BTreeMap<String, MediaManifestEntry>> {
+    match fs::read_to_string(path) {
+        Ok(raw) => Ok(serde_json::from_str(&raw)?),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+impl super::Client {
+    async fn download(&self, media: &Media, path: &Path) -> anyhow::Result<u64> {
+        let request = MediaRequest {
+            source: media.source.clone(),
+            format: MediaFormat::File,
+        };
+        let data = self
+            .inner
+            .media()
+            .get_media_content(&request, false)
+            .await?;
+        // Written atomically, so that an interrupted download is not
+        // taken for a complete file on the next run.
+        write_atomic(path, &data, 0o644)?;
+        Ok(data.len() as u64)
+    }
+
+    /// Download the media of a room, newest first, into `opts.output` and
+    /// record them in its manifest.json by event id. Encrypted media are
+    /// decrypted. Files which exist already are skipped, so that an
+    /// interrupted download is resumed by running it again; failed
+    /// downloads are reported and skipped.
+    pub(crate) async fn download_media(
+        &self,
+        room_id: &RoomId,
+        opts: &DownloadOptions,
+    ) -> anyhow::Result<MediaDownload> {
+        let room = self.get_joined_room(room_id)?;
+        fs::create_dir_all(&opts.output)?;
+        let manifest_path = opts.output.join(MANIFEST);
+        let mut manifest = load_manifest(&manifest_path)?;
+        let cutoff = opts
+            .since
+            .map(|since| now_millis().saturating_sub(since.as_millis() as u64));
+        let mut summary = MediaDownload {
+            room_id: room_id.to_string(),
+            downloaded: 0,
+            skipped: 0,
+            failed: 0,
+            bytes: 0,
+            manifest: manifest_path.display().to_string(),
+        };
+
+        let mut from = None;
+        'pages: loop {
+            let mut options = MessagesOptions::backward();
+            options.from = from;
+            options.limit = 100u32.into();
+            let msgs = room.messages(options).await?;
+
+            for event in msgs.chunk {
+                let event = event.event.deserialize_as::<Value>()?;
+                let ts = event.get("origin_server_ts").and_then(Value::as_u64);
+                if let (Some(ts), Some(cutoff)) = (ts, cutoff) {
+                    if ts < cutoff {
+                        break 'pages;
+                    }
+                }
+                let Some(media) = media_of(&event) else {
+                    continue;
+                };
+                let name = file_name(&media);
+                let path = opts.output.join(&name);
+                if path.exists() {
+                    summary.skipped += 1;
+                } else {
+                    match self.download(&media, &path).await {
+                        Ok(bytes) => {
+                            eprintln!("downloaded {}", name);
+                            summary.downloaded += 1;
+                            summary.bytes += bytes;
+                        }
+                        Err(e) => {
+                            eprintln!("download of {} failed: {}", media.event_id, e);
+                            summary.failed += 1;
+                            continue;
+                        }
+                    }
+                }
+                manifest.insert(
+                    media.event_id,
+                    MediaManifestEntry {
+                        file: name,
+                        sender: media.sender,
+                        origin_server_ts: media.origin_server_ts,
+                        mimetype: media.mimetype,
+                    },
+                );
+            }
+
+            match msgs.end {
+                Some(end) => from = Some(end),
+                None => break,
+            }
+        }
+
+        let mut raw = serde_json::to_string_pretty(&manifest)?;
+        raw.push('\n');
+        write_atomic(&manifest_path, raw.as_bytes(), 0o644)?;
+        Ok(summary)
+    }
+}
@@ -0,0 +1,222 @@
+use std::collections::{HashMap, VecDeque};
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::anyhow;
+use matrix_sdk::room::{MessagesOptions, Room};
+use matrix_sdk::ruma::api::client::receipt::create_receipt::v3::ReceiptType;
+use matrix_sdk::ruma::api::client::relations::get_relating_events_with_rel_type;
+use matrix_sdk::ruma::events::receipt::{ReceiptThread, SyncReceiptEvent};
+use matrix_sdk::ruma::events::relation::RelationType;
+use matrix_sdk::ruma::events::typing::SyncTypingEvent;
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{uint, EventId, OwnedEventId, RoomId};
+use serde_json::Value;
+
+use crate::outputs::{ReadMarker, ReceiptEntry, TypingEntry};
+
+/// Number of events searched for the latest one outside of threads.
+const MAIN_TIMELINE_SCAN: u32 = 50;
+
+const TS_CACHE_SIZE: usize = 4096;
+
+// origin_server_ts of recently synced timeline events, used to compute
+// how long it took until an event was read.
+#[derive(Default)]
+struct TsCache {
+    ts: HashMap<String, u64>,
+    order: VecDeque<String>,
+}
+
+impl TsCache {
+    fn insert(&mut self, event_id: String, ts: u64) {
+        if self.ts.insert(event_id.clone(), ts).is_none() {
+            self.order.push_back(event_id);
+        }
+        while self.order.len() > TS_CACHE_SIZE {
+            if let Some(old) = self.order.pop_front() {
+                self.ts.remove(&old);
+            }
+        }
+    }
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+impl super::Client {
+    /// Print m.typing events as NDJSON on stdout.
+    pub(crate) fn add_typing_handler(&self) {
+        self.inner
+            .add_event_handler(|ev: Raw<SyncTypingEvent>, room: Room| async move {
+                let Ok(Some(content)) = ev.get_field::<Value>("content") else {
+                    return;
+                };
+                let user_ids = content
+                    .get("user_ids")
+                    .and_then(Value::as_array)
+                    .map(|ids| {
+                        ids.iter()
+                            .filter_map(|id| id.as_str().map(String::from))
+                            .collect()
+                    })
+                    .unwrap_or_default();
+                let entry = TypingEntry {
+                    kind: "typing",
+                    room_id: room.room_id().to_string(),
+                    user_ids,
+                };
+                if let Ok(out) = serde_json::to_string(&entry) {
+                    println!("{}", out);
+                }
+            });
+    }
+
+    /// The latest event of the thread `root`, or of the main timeline.
+    async fn latest_event(
+        &self,
+        room: &Room,
+        root: Option<&EventId>,
+    ) -> anyhow::Result<OwnedEventId> {
+        if let Some(root) = root {
+            let mut request = get_relating_events_with_rel_type::v1::Request::new(
+                room.room_id().to_owned(),
+                root.to_owned(),
+                RelationType::Thread,
+            );
+            request.limit = Some(uint!(1));
+            let resp = self.inner.send(request, None).await?;
+            return match resp.chunk.first() {
+                Some(event) => Ok(event
+                    .get_field::<OwnedEventId>("event_id")?
+                    .ok_or_else(|| anyhow!("thread event without event_id"))?),
+                None => Ok(root.to_owned()),
+            };
+        }
+
+        let mut options = MessagesOptions::backward();
+        options.limit = MAIN_TIMELINE_SCAN.into();
+        let msgs = room.messages(options).await?;
+        for event in msgs.chunk {
+            let event = event.event.deserialize_as::<Value>()?;
+            let rel_type = event
+                .pointer("/content/m.relates_to/rel_type")
+                .and_then(Value::as_str);
+            if rel_type == Some("m.thread") {
+                continue;
+            }
+            if let Some(event_id) = event.get("event_id").and_then(Value::as_str) {
+                return Ok(EventId::parse(event_id)?);
+            }
+        }
+        Err(anyhow!(
+            "no recent event outside of threads in {}",
+            room.room_id()
+        ))
+    }
+
+    /// Send a read receipt for `event_id`, by default the latest event.
+    /// With `thread` the receipt is threaded (MSC4102) and only marks the
+    /// thread as read; otherwise it applies to the main timeline.
+    pub(crate) async fn mark_read(
+        &self,
+        room_id: &RoomId,
+        event_id: Option<&EventId>,
+        thread: Option<&EventId>,
+    ) -> anyhow::Result<ReadMarker> {
+        let room = self.get_joined_room(room_id)?;
+        let event_id = match event_id {
+            Some(event_id) => event_id.to_owned(),
+            None => self.latest_event(&room, thread).await?,
+        };
+        let receipt_thread = match thread {
+            Some(root) => ReceiptThread::Thread(root.to_owned()),
+            None => ReceiptThread::Main,
+        };
+        room.send_single_receipt(ReceiptType::Read, receipt_thread, event_id.clone())
+            .await?;
+
+        Ok(ReadMarker {
+            room_id: room_id.to_string(),
+            event_id: event_id.to_string(),
+            thread_id: thread.map(|t| t.to_string()),
+        })
+    }
+
+    /// Print m.receipt events as NDJSON on stdout, one entry per user
+    /// and receipt. With `thread`, a thread root or `main`, receipts of
+    /// other threads are skipped; unthreaded receipts always apply.
+    pub(crate) fn add_receipt_handler(&self, thread: Option<String>) {
+        let cache = Arc::new(Mutex::new(TsCache::default()));
+
+        let timeline_cache = cache.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>| {
+                let cache = timeline_cache.clone();
+                async move {
+                    let (Ok(Some(event_id)), Ok(Some(ts))) = (
+                        ev.get_field::<String>("event_id"),
+                        ev.get_field::<u64>("origin_server_ts"),
+                    ) else {
+                        return;
+                    };
+                    cache.lock().unwrap().insert(event_id, ts);
+                }
+            });
+
+        self.inner
+            .add_event_handler(move |ev: Raw<SyncReceiptEvent>, room: Room| {
+                let cache = cache.clone();
+                let thread = thread.clone();
+                async move {
+                    let Ok(Some(Value::Object(content))) = ev.get_field::<Value>("content") else {
+                        return;
+                    };
+                    for (event_id, receipts) in content {
+                        let event_ts = cache.lock().unwrap().ts.get(&event_id).copied();
+                        let Some(receipts) = receipts.as_object() else {
+                            continue;
+                        };
+                        for (receipt_type, users) in receipts {
+                            let Some(users) = users.as_object() else {
+                                continue;
+                            };
+                            for (user_id, receipt) in users {
+                                let thread_id = receipt
+                                    .get("thread_id")
+                                    .and_then(Value::as_str)
+                                    .map(String::from);
+                                if let (Some(wanted), Some(thread_id)) = (&thread, &thread_id) {
+                                    if wanted != thread_id {
+                                        continue;
+                                    }
+                                }
+                                let ts = receipt.get("ts").and_then(Value::as_u64);
+                                let delta = event_ts.map(|event_ts| {
+                                    ts.unwrap_or_else(now_millis) as i64 - event_ts as i64
+                                });
+                                let entry = ReceiptEntry {
+                                    kind: "receipt",
+                                    room_id: room.room_id().to_string(),
+                                    event_id: event_id.clone(),
+                                    receipt_type: receipt_type.clone(),
+                                    user_id: user_id.clone(),
+                                    thread_id,
+                                    ts,
+                                    delta_ms: delta,
+                                };
+                                if let Ok(out) = serde_json::to_string(&entry) {
+                                    println!("{}", out);
+                                }
+                            }
+                        }
+                    }
+                }
+            });
+    }
+}
@@ -0,0 +1,122 @@
+use reqwest::Method;
+use serde_json::Value;
+use tracing::warn;
+
+use super::synapse::{admin_v1, RoomListOptions};
+use crate::outputs::{ForwardExtremity, RoomExtremities};
+use crate::terminal;
+
+/// Rooms requested per page while scanning the server.
+const PAGE: u64 = 500;
+
+fn extremities_path(room_id: &str) -> String {
+    format!("{}/rooms/{}/forward_extremities", admin_v1(), room_id)
+}
+
+fn extremity(value: &Value) -> Option<ForwardExtremity> {
+    let field = |key: &str| value.get(key).and_then(Value::as_u64);
+    Some(ForwardExtremity {
+        event_id: value.get("event_id")?.as_str()?.to_string(),
+        state_group: field("state_group"),
+        depth: field("depth"),
+        received_ts: field("received_ts"),
+    })
+}
+
+/// Ask before deleting extremities unless `yes`; without a terminal only
+/// `yes` deletes.
+pub(crate) async fn confirm_delete(question: &str, yes: bool) -> anyhow::Result<()> {
+    if yes {
+        return Ok(());
+    }
+    if !terminal::interactive() {
+        anyhow::bail!("not deleting forward extremities without a terminal; pass --yes");
+    }
+    if !terminal::confirm(question).await? {
+        anyhow::bail!("not deleting forward extremities");
+    }
+    Ok(())
+}
+
+impl super::Client {
+    /// The forward extremities synapse stores for `room_id`.
+    pub(crate) async fn forward_extremities(
+        &self,
+        room_id: &str,
+    ) -> anyhow::Result<RoomExtremities> {
+        let resp = self.api_get(&extremities_path(room_id), &[]).await?;
+        let extremities: Vec<ForwardExtremity> = resp
+            .get("results")
+            .and_then(Value::as_array)
+            .into_iter()
+            .flatten()
+            .filter_map(extremity)
+            .collect();
+        Ok(RoomExtremities {
+            room_id: room_id.to_string(),
+            name: None,
+            count: resp
+                .get("count")
+                .and_then(Value::as_u64)
+                .unwrap_or(extremities.len() as u64),
+            extremities,
+            deleted: None,
+        })
+    }
+
+    /// Let synapse delete the forward extremities of `room_id` it can do
+    /// without; returns those left.
+    pub(crate) async fn delete_forward_extremities(
+        &self,
+        room_id: &str,
+    ) -> anyhow::Result<RoomExtremities> {
+        let resp = self
+            .api_request(Method::DELETE, &extremities_path(room_id), &[], None)
+            .await?;
+        let mut left = self.forward_extremities(room_id).await?;
+        left.deleted = Some(resp.get("deleted").and_then(Value::as_u64).unwrap_or(0));
+        Ok(left)
+    }
+
+    /// The rooms of the server with at least `min` forward extremities,
+    /// those with the most first. Rooms failing to answer, e.g. purged
+    /// during the scan, are skipped with a warning.
+    pub(crate) async fn rooms_with_extremities(
+        &self,
+        min: u64,
+    ) -> anyhow::Result<Vec<RoomExtremities>> {
+        let opts = RoomListOptions {
+            limit: PAGE,
+            ..Default::default()
+        };
+        let mut rooms = vec![];
+        self.synapse_rooms(&opts, |room| {
+            let text = |key: &str| room.get(key).and_then(Value::as_str);
+            if let Some(room_id) = text("room_id") {
+                let name = text("name").or(text("canonical_alias"));
+                rooms.push((room_id.to_string(), name.map(String::from)));
+            }
+            Ok(())
+        })
+        .await?;
+
+        let total = rooms.len();
+        let mut found = vec![];
+        for (n, (room_id, name)) in rooms.into_iter().enumerate() {
+            eprint!("\rchecked {}/{} rooms", n + 1, total);
+            match self.forward_extremities(&room_id).await {
+                Ok(mut room) if room.count >= min => {
+                    room.name = name;
+                    found.push(room);
+                }
+                Ok(_) => {}
+                Err(e) => warn!("{}: {}", room_id, e),
+            }
+        }
+        if total > 0 {
+            eprintln!();
+        }
+        found.sort_by(|a, b| b.count.cmp(&a.count));
+        Ok(found)
+    }
+}
@@ -0,0 +1,130 @@
+use std::collections::{HashSet, VecDeque};
+use std::fmt;
+use std::time::{Duration, Instant};
+
+use futures::StreamExt;
+use matrix_sdk::room::MessagesOptions;
+use matrix_sdk::ruma::RoomId;
+use serde_json::value::RawValue;
+
+/// Events requested per forward page.
+const PAGE: u32 = 100;
+/// Event ids remembered to drop events the server returns twice.
+const SEEN: usize = 1000;
+
+/// Ctrl-C ended following a room; `mn` exits with `exit::INTERRUPTED`.
+#[derive(Debug)]
+pub(crate) struct Interrupted;
+
+impl fmt::Display for Interrupted {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "interrupted")
+    }
+}
+
+impl std::error::Error for Interrupted {}
+
+/// The ids of the newest printed events.
+#[derive(Default)]
+struct Seen {
+    ids: HashSet<String>,
+    order: VecDeque<String>,
+}
+
+impl Seen {
+    /// Remember `event`; false if it was printed before.
+    fn insert(&mut self, event: &RawValue) -> bool {
+        let Ok(Some(event_id)) = serde_json::from_str::<serde_json::Value>(event.get()).map(|e| {
+            e.get("event_id")
+                .and_then(|id| id.as_str())
+                .map(String::from)
+        }) else {
+            return true;
+        };
+        if !self.ids.insert(event_id.clone()) {
+            return false;
+        }
+        self.order.push_back(event_id);
+        if self.order.len() > SEEN {
+            if let Some(old) = self.order.pop_front() {
+                self.ids.remove(&old);
+            }
+        }
+        true
+    }
+}
+
+impl super::Client {
+    /// Pass the events of `room_id` after `token`, the live end of the
+    /// printed history, to `f` as they arrive, oldest first. Paginating
+    /// forwards from the token leaves neither a gap nor duplicates at the
+    /// seam; the sync of the room only wakes us up. Ends when no event
+    /// arrived for `quiet`, or fails with `Interrupted` on Ctrl-C.
+    pub(crate) async fn follow_messages(
+        &self,
+        room_id: &RoomId,
+        mut token: String,
+        quiet: Option<Duration>,
+        mut f: impl FnMut(Vec<Box<RawValue>>) -> anyhow::Result<()>,
+    ) -> anyhow::Result<()> {
+        let Some(ref ss) = self.sliding_sync else {
+            anyhow::bail!("following a room requires sliding sync");
+        };
+        let room = self.get_joined_room(room_id)?;
+        self.subscribe(room_id.to_owned());
+
+        let mut seen = Seen::default();
+        let mut last_event = Instant::now();
+        let mut sync_stream = Box::pin(ss.sync());
+        let interrupt = tokio::signal::ctrl_c();
+        tokio::pin!(interrupt);
+        loop {
+            loop {
+                let mut options = MessagesOptions::forward();
+                options.from = Some(token.clone());
+                options.limit = PAGE.into();
+                let msgs = room.messages(options).await?;
+                let fetched = msgs.chunk.len();
+                let mut events: Vec<Box<RawValue>> = msgs
+                    .chunk
+                    .into_iter()
+                    .map(|e| e.event.into_json())
+                    .filter(|e| seen.insert(e))
+                    .collect();
+                let more = fetched > 0 && msgs.end.as_ref().is_some_and(|end| *end != token);
+                if let Some(end) = msgs.end {
+                    token = end;
+                }
+                if !events.is_empty() {
+                    last_event = Instant::now();
+                    self.attribute_events(room_id, &mut events).await?;
+                    f(events)?;
+                }
+                if !more {
+                    break;
+                }
+            }
+
+            let wait = async {
+                match quiet {
+                    Some(quiet) => {
+                        let left = (last_event + quiet).saturating_duration_since(Instant::now());
+                        tokio::time::timeout(left, sync_stream.next()).await.ok()
+                    }
+                    None => Some(sync_stream.next().await),
+                }
+            };
+            let next = tokio::select! {
+                next = wait => next,
+                _ = &mut interrupt => return Err(Interrupted.into()),
+            };
+            match next {
+                // Quiet for long enough.
+                None => return Ok(()),
+                Some(Some(Ok(_))) => {}
+                Some(Some(Err(e))) => return Err(e.into()),
+                Some(None) => sync_stream = Box::pin(ss.sync()),
+            }
+        }
+    }
+}
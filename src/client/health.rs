@@ -0,0 +1,157 @@
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use tokio::sync::Notify;
+use tokio::time::interval;
+
+/// How often `--max-lag` is checked at most.
+const LAG_CHECK: Duration = Duration::from_secs(5);
+
+#[derive(Debug)]
+pub(crate) struct HealthOptions {
+    /// Print a health line this often; never if zero
+    pub(crate) interval: Duration,
+    /// End the sync with `exit::STALLED` if no sync succeeds for this long
+    pub(crate) max_lag: Option<Duration>,
+}
+
+/// Health of the sync loop, shared by the loop, the event handler and
+/// the reporter.
+#[derive(Debug)]
+pub(crate) struct SyncHealth {
+    last_sync: Mutex<Instant>,
+    /// Age in milliseconds of the events received since the last report
+    ages: Mutex<Vec<u64>>,
+    /// Notified once the sync stalled for longer than `max_lag`
+    stalled: Notify,
+}
+
+impl SyncHealth {
+    fn new() -> Self {
+        Self {
+            last_sync: Mutex::new(Instant::now()),
+            ages: Mutex::default(),
+            stalled: Notify::new(),
+        }
+    }
+
+    /// Record a successful sync response.
+    pub(crate) fn synced(&self) {
+        *self.last_sync.lock().unwrap() = Instant::now();
+    }
+
+    fn since_last_sync(&self) -> Duration {
+        self.last_sync.lock().unwrap().elapsed()
+    }
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// The nearest-rank percentile `p` of sorted `values`.
+fn percentile(values: &[u64], p: usize) -> u64 {
+    if values.is_empty() {
+        return 0;
+    }
+    let rank = ((values.len() * p + 99) / 100).max(1);
+    values[rank - 1]
+}
+
+/// One line about the sync loop for the events received in `window`.
+fn describe(since_sync: Duration, ages: &mut [u64], window: Duration) -> String {
+    ages.sort_unstable();
+    let per_minute = ages.len() as f64 * 60.0 / window.as_secs_f64().max(1.0);
+    let mut out = format!(
+        "sync health: last sync {} ago, {:.1} events/min",
+        humantime::format_duration(Duration::from_secs(since_sync.as_secs())),
+        per_minute
+    );
+    if !ages.is_empty() {
+        let ms = |p| humantime::format_duration(Duration::from_millis(percentile(ages, p)));
+        out += &format!(", event age p50 {} p90 {} p99 {}", ms(50), ms(90), ms(99));
+    }
+    out
+}
+
+impl super::Client {
+    /// Track the health of the sync loop: the time since the last
+    /// successful sync and the age of new events, i.e. how long after
+    /// `origin_server_ts` they arrive. History from before the start is
+    /// not counted. Reports go to stderr every `opts.interval`; with
+    /// `opts.max_lag`, `sync_stalled` returns when the sync stalls, so
+    /// that `mn` exits and a supervisor restarts it.
+    pub(crate) fn with_sync_health(mut self, opts: HealthOptions) -> Self {
+        let health = Arc::new(SyncHealth::new());
+        let started = now_millis();
+
+        let ages = health.clone();
+        if !opts.interval.is_zero() {
+            self.inner
+                .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>| {
+                    let ages = ages.clone();
+                    async move {
+                        let Ok(Some(ts)) = ev.get_field::<u64>("origin_server_ts") else {
+                            return;
+                        };
+                        if ts < started {
+                            return;
+                        }
+                        let age = now_millis().saturating_sub(ts);
+                        ages.ages.lock().unwrap().push(age);
+                    }
+                });
+        }
+
+        let reporter = health.clone();
+        tokio::spawn(async move {
+            let tick = match (opts.max_lag, opts.interval.is_zero()) {
+                (Some(max_lag), true) => (max_lag / 4).min(LAG_CHECK),
+                (Some(max_lag), false) => (max_lag / 4).min(LAG_CHECK).min(opts.interval),
+                (None, false) => opts.interval,
+                (None, true) => return,
+            };
+            let tick = tick.max(Duration::from_millis(100));
+            let mut ticks = interval(tick);
+            let mut last_report = Instant::now();
+            loop {
+                ticks.tick().await;
+                let since_sync = reporter.since_last_sync();
+                if let Some(max_lag) = opts.max_lag {
+                    if since_sync > max_lag {
+                        eprintln!(
+                            "error: no successful sync for {}",
+                            humantime::format_duration(Duration::from_secs(since_sync.as_secs()))
+                        );
+                        reporter.stalled.notify_one();
+                        return;
+                    }
+                }
+                // Ticks may come a little early; round to the nearest one.
+                if opts.interval.is_zero() || last_report.elapsed() + tick / 2 < opts.interval {
+                    continue;
+                }
+                let mut ages = std::mem::take(&mut *reporter.ages.lock().unwrap());
+                eprintln!("{}", describe(since_sync, &mut ages, last_report.elapsed()));
+                last_report = Instant::now();
+            }
+        });
+
+        self.sync_health = Some(health);
+        self
+    }
+
+    /// Wait until the sync stalled for longer than the `max_lag` of
+    /// `with_sync_health`; forever without one.
+    pub(crate) async fn sync_stalled(&self) {
+        match self.sync_health {
+            Some(ref health) => health.stalled.notified().await,
+            None => std::future::pending().await,
+        }
+    }
+}
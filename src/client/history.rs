@@ -0,0 +1,210 @@
+use std::collections::BTreeMap;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::room::MessagesOptions;
+use matrix_sdk::ruma::{EventId, RoomId};
+use serde_json::Value;
+
+use crate::outputs::StateChange;
+
+fn millis(t: SystemTime) -> u64 {
+    t.duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+fn field<'a>(content: Option<&'a Value>, key: &str) -> Option<&'a str> {
+    content.and_then(|c| c.get(key)).and_then(Value::as_str)
+}
+
+fn describe(value: Option<&str>) -> String {
+    match value {
+        Some(v) => format!("{:?}", v),
+        None => String::from("unset"),
+    }
+}
+
+fn summarize_power_levels(before: Option<&Value>, after: Option<&Value>) -> String {
+    let empty = Value::Null;
+    let before = before.unwrap_or(&empty);
+    let after = after.unwrap_or(&empty);
+    let mut out = vec![];
+
+    let users = |v: &Value| {
+        v.get("users")
+            .and_then(Value::as_object)
+            .cloned()
+            .unwrap_or_default()
+    };
+    let (old_users, new_users) = (users(before), users(after));
+    let mut user_ids: Vec<&String> = old_users.keys().chain(new_users.keys()).collect();
+    user_ids.sort();
+    user_ids.dedup();
+    for user_id in user_ids {
+        let (old, new) = (old_users.get(user_id), new_users.get(user_id));
+        if old != new {
+            out.push(format!(
+                "{}: {} -> {}",
+                user_id,
+                old.map_or(String::from("default"), Value::to_string),
+                new.map_or(String::from("default"), Value::to_string)
+            ));
+        }
+    }
+
+    for key in [
+        "ban",
+        "kick",
+        "redact",
+        "invite",
+        "events_default",
+        "state_default",
+        "users_default",
+        "events",
+        "notifications",
+    ] {
+        let (old, new) = (before.get(key), after.get(key));
+        if old != new {
+            out.push(format!(
+                "{}: {} -> {}",
+                key,
+                old.map_or(String::from("default"), Value::to_string),
+                new.map_or(String::from("default"), Value::to_string)
+            ));
+        }
+    }
+
+    format!("power levels changed: {}", out.join(", "))
+}
+
+fn summarize(
+    event_type: &str,
+    state_key: &str,
+    before: Option<&Value>,
+    after: Option<&Value>,
+) -> String {
+    let change = |key: &str| {
+        format!(
+            "{} -> {}",
+            describe(field(before, key)),
+            describe(field(after, key))
+        )
+    };
+
+    match event_type {
+        "m.room.member" => format!("{}: membership {}", state_key, change("membership")),
+        "m.room.power_levels" => summarize_power_levels(before, after),
+        "m.room.name" => format!("name: {}", change("name")),
+        "m.room.topic" => format!("topic: {}", change("topic")),
+        "m.room.avatar" => format!("avatar: {}", change("url")),
+        "m.room.join_rules" => format!("join rule: {}", change("join_rule")),
+        "m.room.history_visibility" => {
+            format!("history visibility: {}", change("history_visibility"))
+        }
+        "m.room.canonical_alias" => format!("canonical alias: {}", change("alias")),
+        _ => format!("{} ({}) changed", event_type, state_key),
+    }
+}
+
+impl super::Client {
+    async fn event_ts(&self, room_id: &RoomId, event_id: &EventId) -> anyhow::Result<u64> {
+        let room = self.get_joined_room(room_id)?;
+        let event = room.event(event_id).await?;
+        Ok(event
+            .event
+            .get_field::<u64>("origin_server_ts")?
+            .unwrap_or(0))
+    }
+
+    /// Reconstruct the state changes of a room within a time window by
+    /// paginating the timeline backwards.
+    async fn state_changes_between(
+        &self,
+        room_id: &RoomId,
+        from_ts: u64,
+        to_ts: u64,
+    ) -> anyhow::Result<Vec<StateChange>> {
+        let room = self.get_joined_room(room_id)?;
+        // (type, state_key) -> (content before the window, content after)
+        let mut changes: BTreeMap<(String, String), (Option<Value>, Option<Value>)> =
+            BTreeMap::new();
+        let mut from = None;
+
+        'paginate: loop {
+            let mut options = MessagesOptions::backward();
+            options.from = from;
+            options.limit = 100u32.into();
+            let msgs = room.messages(options).await?;
+
+            for event in msgs.chunk {
+                let event = event.event.deserialize_as::<Value>()?;
+                let ts = event
+                    .get("origin_server_ts")
+                    .and_then(Value::as_u64)
+                    .unwrap_or(0);
+                if ts < from_ts {
+                    break 'paginate;
+                }
+                if ts > to_ts {
+                    continue;
+                }
+                let Some(state_key) = event.get("state_key").and_then(Value::as_str) else {
+                    continue;
+                };
+                let event_type = event
+                    .get("type")
+                    .and_then(Value::as_str)
+                    .unwrap_or_default();
+                let prev = event.pointer("/unsigned/prev_content").cloned();
+                let content = event.get("content").cloned();
+
+                // Walking backwards: the first event seen is the newest one.
+                changes
+                    .entry((event_type.to_string(), state_key.to_string()))
+                    .and_modify(|e| e.0 = prev.clone())
+                    .or_insert((prev, content));
+            }
+
+            match msgs.end {
+                Some(end) => from = Some(end),
+                None => break,
+            }
+        }
+
+        Ok(changes
+            .into_iter()
+            .filter(|(_, (before, after))| before != after)
+            .map(|((event_type, state_key), (before, after))| StateChange {
+                summary: summarize(&event_type, &state_key, before.as_ref(), after.as_ref()),
+                event_type,
+                state_key,
+                before,
+                after,
+            })
+            .collect())
+    }
+
+    /// State changes of the last `since`.
+    pub(crate) async fn state_diff_since(
+        &self,
+        room_id: &RoomId,
+        since: Duration,
+    ) -> anyhow::Result<Vec<StateChange>> {
+        let now = SystemTime::now();
+        let from_ts = millis(now - since);
+        self.state_changes_between(room_id, from_ts, millis(now))
+            .await
+    }
+
+    /// State changes after `from` up to and including `to`.
+    pub(crate) async fn state_diff_between(
+        &self,
+        room_id: &RoomId,
+        from: &EventId,
+        to: &EventId,
+    ) -> anyhow::Result<Vec<StateChange>> {
+        let from_ts = self.event_ts(room_id, from).await? + 1;
+        let to_ts = self.event_ts(room_id, to).await?;
+        self.state_changes_between(room_id, from_ts, to_ts).await
+    }
+}
@@ -0,0 +1,93 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+
+use matrix_sdk::ruma::OwnedMxcUri;
+use serde::Deserialize;
+use serde_json::{json, Value};
+
+use super::CRATE_NAME;
+use crate::format::escape;
+
+// Per-message profiles as used by bridges (MSC4144).
+const PROFILE_KEY: &str = "com.beeper.per_message_profile";
+
+/// The sender shown for messages of one subsystem using a shared account.
+#[derive(Clone, Debug, Deserialize)]
+pub(crate) struct Identity {
+    #[serde(skip)]
+    pub(crate) id: String,
+    pub(crate) displayname: String,
+    pub(crate) avatar_url: Option<OwnedMxcUri>,
+}
+
+/// Named identities from `$XDG_CONFIG_HOME/mnotify/identities.yaml`.
+fn load_identities() -> anyhow::Result<BTreeMap<String, Identity>> {
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+    let Some(path) = xdg_dirs.find_config_file("identities.yaml") else {
+        return Ok(BTreeMap::new());
+    };
+    match fs::read_to_string(path) {
+        Ok(raw) => Ok(serde_yaml::from_str(&raw)?),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+impl Identity {
+    /// Look up `name` in the configured identities; unknown names are
+    /// used as display name.
+    pub(crate) fn resolve(name: &str, avatar_url: Option<OwnedMxcUri>) -> anyhow::Result<Self> {
+        let mut identity = match load_identities()?.remove(name) {
+            Some(identity) => identity,
+            None => Identity {
+                id: String::new(),
+                displayname: name.to_string(),
+                avatar_url: None,
+            },
+        };
+        identity.id = name.to_string();
+        if avatar_url.is_some() {
+            identity.avatar_url = avatar_url;
+        }
+        Ok(identity)
+    }
+
+    /// Attach the profile to a message content and prefix the body with
+    /// a fallback label for clients without support.
+    pub(crate) fn apply(&self, content: &mut Value) {
+        let Some(map) = content.as_object_mut() else {
+            return;
+        };
+
+        let mut profile = json!({
+            "id": self.id,
+            "displayname": self.displayname,
+            "has_fallback": true,
+        });
+        if let Some(ref avatar_url) = self.avatar_url {
+            profile["avatar_url"] = json!(avatar_url);
+        }
+
+        let body = map.get("body").and_then(Value::as_str).unwrap_or("");
+        let formatted = match map.get("formatted_body").and_then(Value::as_str) {
+            Some(html) => html.to_string(),
+            None => escape(body).replace('\n', "<br>"),
+        };
+        let label = format!(
+            "<strong data-mx-profile-fallback>{}: </strong>",
+            escape(&self.displayname)
+        );
+        // Keep the reply fallback in front.
+        let formatted = match formatted.split_once("</mx-reply>") {
+            Some((reply, rest)) => format!("{}</mx-reply>{}{}", reply, label, rest),
+            None => format!("{}{}", label, formatted),
+        };
+
+        let body = format!("{}: {}", self.displayname, body);
+        map.insert(String::from("body"), json!(body));
+        map.insert(String::from("format"), json!("org.matrix.custom.html"));
+        map.insert(String::from("formatted_body"), json!(formatted));
+        map.insert(String::from(PROFILE_KEY), profile);
+    }
+}
@@ -0,0 +1,277 @@
+use anyhow::{anyhow, bail};
+use clap::ValueEnum;
+use futures::StreamExt;
+use matrix_sdk::ruma::api::client::uiaa::{self, AuthData, UserIdentifier};
+use matrix_sdk::ruma::{OwnedRoomId, OwnedUserId};
+
+use super::builder::transport;
+use super::login::{describe_login_flows, discover_homeserver, login_flows};
+use super::session::Meta;
+use crate::outputs::InitSummary;
+use crate::terminal;
+
+/// How `init` logs in.
+#[derive(Clone, Copy, Debug, PartialEq, ValueEnum)]
+pub(crate) enum LoginMethod {
+    /// Log in with the account password
+    Password,
+    /// Log in with the OAuth 2.0 device authorization grant
+    Oauth,
+}
+
+impl LoginMethod {
+    fn name(self) -> &'static str {
+        match self {
+            Self::Password => "password",
+            Self::Oauth => "oauth",
+        }
+    }
+}
+
+/// The answers of `init`; what is missing is asked on the terminal and
+/// skipped or refused without one.
+#[derive(Debug)]
+pub(crate) struct InitOptions {
+    pub(crate) user_id: Option<OwnedUserId>,
+    pub(crate) device_name: String,
+    pub(crate) method: Option<LoginMethod>,
+    pub(crate) password: Option<String>,
+    /// Bootstrap cross-signing for the account if it has none
+    pub(crate) cross_signing: Option<bool>,
+    /// Create a key backup on the server if there is none
+    pub(crate) backup: Option<bool>,
+    pub(crate) default_room: Option<OwnedRoomId>,
+    pub(crate) user_agent_suffix: Option<String>,
+    pub(crate) request_tag: Option<String>,
+}
+
+fn ask_user_id() -> anyhow::Result<OwnedUserId> {
+    loop {
+        let Some(answer) = terminal::ask("user id, e.g. @alice:example.org")? else {
+            bail!("a user id is required without a terminal");
+        };
+        match OwnedUserId::try_from(answer.as_str()) {
+            Ok(user_id) => return Ok(user_id),
+            Err(e) => eprintln!("invalid user id: {}", e),
+        }
+    }
+}
+
+/// Ask a yes or no question unless `answer` is given; no without a
+/// terminal.
+async fn decide(answer: Option<bool>, question: &str) -> anyhow::Result<bool> {
+    match answer {
+        Some(answer) => Ok(answer),
+        None if terminal::interactive() => terminal::confirm(question).await,
+        None => Ok(false),
+    }
+}
+
+impl super::Client {
+    /// Bootstrap cross-signing if the account has none; the server may
+    /// want the password again to upload the keys.
+    async fn bootstrap_cross_signing(&self, password: Option<&str>) -> anyhow::Result<()> {
+        let encryption = self.inner.encryption();
+        let Err(e) = encryption.bootstrap_cross_signing_if_needed(None).await else {
+            return Ok(());
+        };
+        let (Some(response), Some(password)) = (e.as_uiaa_response(), password) else {
+            return Err(e.into());
+        };
+        let mut auth = uiaa::Password::new(
+            UserIdentifier::UserIdOrLocalpart(self.user_id.to_string()),
+            password.to_string(),
+        );
+        auth.session = response.session.clone();
+        encryption
+            .bootstrap_cross_signing_if_needed(Some(AuthData::Password(auth)))
+            .await?;
+        Ok(())
+    }
+
+    /// Create a key backup unless the server has one; returns whether it
+    /// was created.
+    async fn ensure_backup(&self) -> anyhow::Result<bool> {
+        let backups = self.inner.encryption().backups();
+        if backups.exists_on_server().await? {
+            return Ok(false);
+        }
+        backups.create().await?;
+        Ok(true)
+    }
+
+    fn choose_default_room(&self) -> anyhow::Result<Option<OwnedRoomId>> {
+        let mut rooms: Vec<(String, OwnedRoomId)> = self
+            .inner
+            .joined_rooms()
+            .into_iter()
+            .map(|room| (room.name().unwrap_or_default(), room.room_id().to_owned()))
+            .collect();
+        if rooms.is_empty() {
+            return Ok(None);
+        }
+        rooms.sort();
+        let options: Vec<String> = rooms
+            .iter()
+            .map(|(name, room_id)| match name.as_str() {
+                "" => room_id.to_string(),
+                name => format!("{} ({})", name, room_id),
+            })
+            .collect();
+        let chosen = terminal::choose("default room, empty for none", &options)?;
+        Ok(chosen.map(|n| rooms[n].1.clone()))
+    }
+}
+
+/// Set up an account: discover its homeserver, log in with one of the
+/// methods it offers, optionally set up cross-signing and a key backup,
+/// and pick the room `send` uses by default. Every step is asked on the
+/// terminal unless given in `opts`; progress goes to stderr.
+pub(crate) async fn init(opts: InitOptions) -> anyhow::Result<InitSummary> {
+    if Meta::exists()? {
+        let meta = Meta::load()?;
+        bail!("already set up for {}; log out first", meta.user_id);
+    }
+
+    let user_id = match opts.user_id {
+        Some(user_id) => user_id,
+        None => ask_user_id()?,
+    };
+
+    let http = transport(
+        opts.user_agent_suffix.as_deref(),
+        opts.request_tag.as_deref(),
+    )?;
+    let homeserver = discover_homeserver(&http, user_id.server_name()).await?;
+    let flows = login_flows(&http, &homeserver).await?;
+    eprintln!("{}\n", describe_login_flows(&flows));
+
+    let offered: Vec<LoginMethod> = [
+        (flows.password, LoginMethod::Password),
+        (flows.oauth_issuer.is_some(), LoginMethod::Oauth),
+    ]
+    .into_iter()
+    .filter_map(|(offered, method)| offered.then_some(method))
+    .collect();
+    let method = match (opts.method, offered.as_slice()) {
+        (_, []) => bail!("{} offers neither password nor OAuth login", homeserver),
+        (Some(method), _) if !offered.contains(&method) => {
+            bail!("{} does not offer {} login", homeserver, method.name())
+        }
+        (Some(method), _) => method,
+        (None, [method]) => *method,
+        (None, _) if opts.password.is_some() => LoginMethod::Password,
+        (None, _) => {
+            let names: Vec<String> = offered.iter().map(|m| m.name().to_string()).collect();
+            let chosen = terminal::choose("login method", &names)?;
+            chosen
+                .map(|n| offered[n])
+                .ok_or_else(|| anyhow!("--method is required without a terminal"))?
+        }
+    };
+
+    let client = super::Client::builder()
+        .user_id(user_id.clone())
+        .device_name(opts.device_name.clone())
+        .user_agent_suffix(opts.user_agent_suffix.clone())
+        .request_tag(opts.request_tag.clone())
+        .build()
+        .await?;
+    let mut password = None;
+    let oauth = match method {
+        LoginMethod::Oauth => Some(client.login_oauth(false).await?),
+        LoginMethod::Password => {
+            let pw = match opts.password {
+                Some(pw) => pw,
+                None => terminal::read_password()?,
+            };
+            if let Err(e) = client.login_password(&pw).await {
+                bail!("login failed: {}", e);
+            }
+            password = Some(pw);
+            None
+        }
+    };
+    let mut meta = Meta {
+        user_id: user_id.clone(),
+        device_name: Some(opts.device_name),
+        oauth,
+        default_room: None,
+        archive: false,
+    };
+    meta.dump()?;
+    drop(client);
+
+    // Open the session again, with sync, to know the joined rooms.
+    let client = super::Client::builder()
+        .load_meta()?
+        .user_agent_suffix(opts.user_agent_suffix)
+        .request_tag(opts.request_tag)
+        .build()
+        .await?
+        .ensure_login()?;
+    if let Some(ref ss) = client.sliding_sync {
+        Box::pin(ss.sync()).next().await;
+    }
+
+    let mut warnings = vec![];
+    let cross_signing = decide(opts.cross_signing, "set up cross-signing").await?;
+    if cross_signing {
+        if let Err(e) = client.bootstrap_cross_signing(password.as_deref()).await {
+            warnings.push(format!("cross-signing: {}", e));
+        }
+    }
+    let backup = match decide(opts.backup, "create a key backup").await? {
+        false => None,
+        true => match client.ensure_backup().await {
+            Ok(true) => Some("created"),
+            Ok(false) => Some("exists"),
+            Err(e) => {
+                warnings.push(format!("key backup: {}", e));
+                None
+            }
+        },
+    };
+
+    let default_room = match opts.default_room {
+        Some(room_id) => {
+            if client.inner.get_room(&room_id).is_none() {
+                warnings.push(format!("default room {} is not joined", room_id));
+            }
+            Some(room_id)
+        }
+        None => client.choose_default_room()?,
+    };
+    meta.default_room = default_room.clone();
+    meta.dump()?;
+
+    for warning in &warnings {
+        eprintln!("warning: {}", warning);
+    }
+
+    Ok(InitSummary {
+        user_id: user_id.to_string(),
+        homeserver,
+        method: method.name(),
+        device_id: client.device_id().map(|d| d.to_string()),
+        cross_signing,
+        backup,
+        default_room: default_room.map(|r| r.to_string()),
+        warnings,
+    })
+}
+
+/// Commands to try after `init`, for humans.
+pub(crate) fn next_steps(summary: &InitSummary) -> String {
+    let send = match summary.default_room {
+        Some(_) => String::from("mn send \"hello\""),
+        None => String::from("mn send -r '!room:example.org' \"hello\""),
+    };
+    [
+        "next:",
+        &format!("  {:<44} send a message", send),
+        &format!("  {:<44} follow the joined rooms", "mn sync"),
+        &format!("  {:<44} check the encryption keys", "mn keys hygiene"),
+    ]
+    .join("\n")
+}
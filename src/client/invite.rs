@@ -0,0 +1,123 @@
+use std::collections::BTreeMap;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use futures::StreamExt;
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{OwnedUserId, RoomId};
+use serde_json::Value;
+
+use crate::outputs::{InviteeJoin, JoinState, JoinWait};
+
+/// The state of an invitee with `membership`; a leave after the invite
+/// is a decline, also if the invite was withdrawn.
+fn join_state(membership: Option<&str>) -> JoinState {
+    match membership {
+        Some("join") => JoinState::Joined,
+        Some("leave" | "ban") => JoinState::Declined,
+        _ => JoinState::Pending,
+    }
+}
+
+impl super::Client {
+    /// Sync `room_id` until every one of `users` joined or declined the
+    /// invite, or `timeout` passed; the others are reported as pending.
+    pub(crate) async fn wait_for_joins(
+        &self,
+        room_id: &RoomId,
+        users: &[OwnedUserId],
+        timeout: Duration,
+    ) -> anyhow::Result<JoinWait> {
+        let Some(ref ss) = self.sliding_sync else {
+            anyhow::bail!("waiting for joins requires sliding sync");
+        };
+        let states: Arc<Mutex<BTreeMap<String, JoinState>>> = Arc::new(Mutex::new(
+            users
+                .iter()
+                .map(|u| (u.to_string(), JoinState::Pending))
+                .collect(),
+        ));
+        let handle = {
+            let states = states.clone();
+            let room_id = room_id.to_string();
+            self.inner
+                .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                    let states = states.clone();
+                    let in_room = room.room_id().as_str() == room_id;
+                    async move {
+                        let Ok(event) = ev.deserialize_as::<Value>() else {
+                            return;
+                        };
+                        if !in_room
+                            || event.get("type").and_then(Value::as_str) != Some("m.room.member")
+                        {
+                            return;
+                        }
+                        let Some(user_id) = event.get("state_key").and_then(Value::as_str) else {
+                            return;
+                        };
+                        let membership =
+                            event.pointer("/content/membership").and_then(Value::as_str);
+                        if let Some(state) = states.lock().unwrap().get_mut(user_id) {
+                            *state = join_state(membership);
+                        }
+                    }
+                })
+        };
+        self.subscribe(room_id.to_owned());
+
+        // Invitees may have answered before the handler was added.
+        for user_id in users {
+            let member = self
+                .get_state(room_id, "m.room.member", user_id.as_str())
+                .await?;
+            let membership = member
+                .as_ref()
+                .and_then(|m| m.get("membership"))
+                .and_then(Value::as_str);
+            let mut states = states.lock().unwrap();
+            if let Some(state @ JoinState::Pending) = states.get_mut(user_id.as_str()) {
+                *state = join_state(membership);
+            }
+        }
+
+        let settled = || {
+            states
+                .lock()
+                .unwrap()
+                .values()
+                .all(|s| *s != JoinState::Pending)
+        };
+        let deadline = Instant::now() + timeout;
+        let mut sync_stream = Box::pin(ss.sync());
+        let result = loop {
+            if settled() {
+                break Ok(());
+            }
+            let left = deadline.saturating_duration_since(Instant::now());
+            match tokio::time::timeout(left, sync_stream.next()).await {
+                Ok(Some(Ok(_))) => {}
+                Ok(Some(Err(e))) => break Err(e),
+                Ok(None) | Err(_) => break Ok(()),
+            }
+        };
+        self.inner.remove_event_handler(handle);
+        result?;
+
+        let invitees = states
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|(user_id, state)| InviteeJoin {
+                user_id: user_id.clone(),
+                state: *state,
+            })
+            .collect();
+        Ok(JoinWait {
+            room_id: room_id.to_string(),
+            invitees,
+        })
+    }
+}
@@ -0,0 +1,328 @@
+use std::collections::HashSet;
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::room::member::{
+    MembershipState, StrippedRoomMemberEvent, SyncRoomMemberEvent,
+};
+use matrix_sdk::ruma::events::space::child::SyncSpaceChildEvent;
+use matrix_sdk::ruma::{OwnedRoomId, OwnedServerName, OwnedUserId, RoomId, RoomOrAliasId, UserId};
+use serde_json::Value;
+use tokio::sync::Notify;
+use tracing::{info, warn};
+
+use super::session::{autojoined_path, write_atomic};
+use crate::outputs::{JoinOutcome, SpacePolicySummary};
+
+#[derive(Debug, Default)]
+pub(crate) struct AutojoinOptions {
+    /// Leave rooms where this user is not a member
+    pub(crate) require_member: Option<OwnedUserId>,
+    /// Only stay in rooms which are children of this space
+    pub(crate) space: Option<OwnedRoomId>,
+}
+
+/// The rooms joined by autojoin, kept next to the session so that the
+/// policies still apply to them after a restart.
+struct Autojoined {
+    path: PathBuf,
+    rooms: HashSet<OwnedRoomId>,
+}
+
+impl Autojoined {
+    fn load(user_id: &UserId) -> anyhow::Result<Self> {
+        let path = autojoined_path(user_id)?;
+        let rooms = match fs::read_to_string(&path) {
+            Ok(raw) => serde_json::from_str(&raw)?,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => HashSet::new(),
+            Err(e) => return Err(e.into()),
+        };
+        Ok(Self { path, rooms })
+    }
+
+    fn persist(&self) {
+        let result = serde_json::to_vec(&self.rooms)
+            .map_err(anyhow::Error::from)
+            .and_then(|raw| write_atomic(&self.path, &raw, 0o600));
+        if let Err(e) = result {
+            warn!("persisting {} failed: {}", self.path.display(), e);
+        }
+    }
+
+    fn insert(&mut self, room_id: &RoomId) {
+        if self.rooms.insert(room_id.to_owned()) {
+            self.persist();
+        }
+    }
+
+    fn remove(&mut self, room_id: &RoomId) {
+        if self.rooms.remove(room_id) {
+            self.persist();
+        }
+    }
+}
+
+fn print_json(value: &impl serde::Serialize) {
+    if let Ok(out) = serde_json::to_string(value) {
+        println!("{}", out);
+    }
+}
+
+impl super::Client {
+    async fn is_joined_member(&self, room_id: &RoomId, user_id: &UserId) -> anyhow::Result<bool> {
+        let member = self
+            .get_state(room_id, "m.room.member", user_id.as_str())
+            .await?;
+        let membership = member
+            .as_ref()
+            .and_then(|m| m.get("membership"))
+            .and_then(Value::as_str);
+        Ok(membership == Some("join"))
+    }
+
+    /// Join a room; if `require_member` is set and that user is not a
+    /// joined member of the room, leave the room again immediately.
+    pub(crate) async fn join_guarded(
+        &self,
+        room: &RoomOrAliasId,
+        via: &[OwnedServerName],
+        require_member: Option<&UserId>,
+    ) -> anyhow::Result<JoinOutcome> {
+        let joined_room = self.inner.join_room_by_id_or_alias(room, via).await?;
+        let room_id = joined_room.room_id();
+
+        let mut outcome = JoinOutcome {
+            kind: "join",
+            room_id: room_id.to_string(),
+            inviter: None,
+            joined: true,
+            reason: None,
+        };
+
+        let Some(required) = require_member else {
+            info!("joined {}", room_id);
+            return Ok(outcome);
+        };
+
+        if self.is_joined_member(room_id, required).await? {
+            info!(
+                "joined {}; required member {} is present",
+                room_id, required
+            );
+            return Ok(outcome);
+        }
+
+        warn!(
+            "leaving {} again; required member {} is not present",
+            room_id, required
+        );
+        joined_room.leave().await?;
+        outcome.joined = false;
+        outcome.reason = Some(format!("required member {} is not present", required));
+        Ok(outcome)
+    }
+
+    async fn space_room_ids(&self, space_id: &RoomId) -> anyhow::Result<HashSet<OwnedRoomId>> {
+        let rooms = self.space_hierarchy(space_id).await?;
+        Ok(rooms.into_iter().map(|r| r.room_id).collect())
+    }
+
+    /// Leave autojoined rooms which are no longer part of `space_id`.
+    async fn enforce_space_policy(
+        &self,
+        space_id: &RoomId,
+        autojoined: &Mutex<Autojoined>,
+    ) -> anyhow::Result<SpacePolicySummary> {
+        let allowed = self.space_room_ids(space_id).await?;
+        let rooms: Vec<OwnedRoomId> = autojoined.lock().unwrap().rooms.iter().cloned().collect();
+        let mut summary = SpacePolicySummary {
+            kind: "space_policy",
+            space_id: space_id.to_string(),
+            checked: rooms.len(),
+            left: vec![],
+        };
+
+        for room_id in rooms {
+            if allowed.contains(&room_id) {
+                continue;
+            }
+            if let Some(room) = self.inner.get_room(&room_id) {
+                info!("leaving {}; it is not part of {}", room_id, space_id);
+                room.leave().await?;
+            }
+            autojoined.lock().unwrap().remove(&room_id);
+            summary.left.push(room_id.to_string());
+        }
+
+        Ok(summary)
+    }
+
+    /// Leave the autojoined room if `ev` is the required member leaving
+    /// it, and forget rooms which we left.
+    async fn on_autojoined_member(
+        &self,
+        ev: &SyncRoomMemberEvent,
+        room: &Room,
+        require_member: Option<&UserId>,
+        autojoined: &Mutex<Autojoined>,
+    ) {
+        if !autojoined.lock().unwrap().rooms.contains(room.room_id()) {
+            return;
+        }
+        let joined = *ev.membership() == MembershipState::Join;
+        if ev.state_key() == &self.user_id {
+            if !joined {
+                autojoined.lock().unwrap().remove(room.room_id());
+            }
+            return;
+        }
+        if joined || require_member.map_or(true, |r| *r != **ev.state_key()) {
+            return;
+        }
+
+        warn!(
+            "leaving {}; required member {} is not present any more",
+            room.room_id(),
+            ev.state_key()
+        );
+        let mut outcome = JoinOutcome {
+            kind: "autojoin",
+            room_id: room.room_id().to_string(),
+            inviter: None,
+            joined: false,
+            reason: Some(format!("required member {} left", ev.state_key())),
+        };
+        match room.leave().await {
+            Ok(()) => autojoined.lock().unwrap().remove(room.room_id()),
+            Err(e) => {
+                warn!("leaving {} failed: {}", room.room_id(), e);
+                outcome.joined = true;
+            }
+        }
+        print_json(&outcome);
+    }
+
+    /// Accept all invites during sync and print the outcome as NDJSON.
+    /// Autojoined rooms are left again when the required member leaves,
+    /// or when they are removed from the space.
+    pub(crate) fn add_autojoin_handler(&self, opts: AutojoinOptions) -> anyhow::Result<()> {
+        let autojoined = Arc::new(Mutex::new(Autojoined::load(&self.user_id)?));
+
+        if let Some(ref space_id) = opts.space {
+            // Changes of the children arrive in bursts, e.g. during the
+            // initial sync; the permit of the notify coalesces them.
+            let changed = Arc::new(Notify::new());
+            // Rooms may have been removed while we were not running.
+            changed.notify_one();
+
+            let this = self.clone();
+            let policy_space = space_id.clone();
+            let autojoined = autojoined.clone();
+            let notified = changed.clone();
+            tokio::spawn(async move {
+                loop {
+                    notified.notified().await;
+                    match this.enforce_space_policy(&policy_space, &autojoined).await {
+                        Ok(summary) => print_json(&summary),
+                        Err(e) => warn!("enforcing space policy failed: {}", e),
+                    }
+                }
+            });
+
+            let space_id = space_id.clone();
+            self.inner
+                .add_event_handler(move |_: SyncSpaceChildEvent, room: Room| {
+                    if *room.room_id() == *space_id {
+                        changed.notify_one();
+                    }
+                    async {}
+                });
+        }
+
+        let this = self.clone();
+        let require_member = opts.require_member.clone();
+        let members = autojoined.clone();
+        self.inner
+            .add_event_handler(move |ev: SyncRoomMemberEvent, room: Room| {
+                let this = this.clone();
+                let require_member = require_member.clone();
+                let autojoined = members.clone();
+                async move {
+                    this.on_autojoined_member(&ev, &room, require_member.as_deref(), &autojoined)
+                        .await;
+                }
+            });
+
+        let this = self.clone();
+        let opts = Arc::new(opts);
+        self.inner
+            .add_event_handler(move |ev: StrippedRoomMemberEvent, room: Room| {
+                let this = this.clone();
+                let opts = opts.clone();
+                let autojoined = autojoined.clone();
+                async move {
+                    if ev.state_key != this.user_id
+                        || ev.content.membership != MembershipState::Invite
+                    {
+                        return;
+                    }
+                    info!("invited to {} by {}", room.room_id(), ev.sender);
+
+                    if let Some(ref space_id) = opts.space {
+                        let allowed = match this.space_room_ids(space_id).await {
+                            Ok(rooms) => rooms.contains(room.room_id()),
+                            Err(e) => {
+                                warn!("fetching hierarchy of {} failed: {}", space_id, e);
+                                false
+                            }
+                        };
+                        if !allowed {
+                            warn!(
+                                "rejecting invite to {}; it is not part of {}",
+                                room.room_id(),
+                                space_id
+                            );
+                            if let Err(e) = room.leave().await {
+                                warn!("rejecting invite failed: {}", e);
+                            }
+                            print_json(&JoinOutcome {
+                                kind: "autojoin",
+                                room_id: room.room_id().to_string(),
+                                inviter: Some(ev.sender.to_string()),
+                                joined: false,
+                                reason: Some(format!("room is not part of {}", space_id)),
+                            });
+                            return;
+                        }
+                    }
+
+                    let mut outcome = match this
+                        .join_guarded(room.room_id().into(), &[], opts.require_member.as_deref())
+                        .await
+                    {
+                        Ok(outcome) => outcome,
+                        Err(e) => {
+                            warn!("autojoin {} failed: {}", room.room_id(), e);
+                            JoinOutcome {
+                                kind: "join",
+                                room_id: room.room_id().to_string(),
+                                inviter: None,
+                                joined: false,
+                                reason: Some(e.to_string()),
+                            }
+                        }
+                    };
+                    outcome.kind = "autojoin";
+                    outcome.inviter = Some(ev.sender.to_string());
+                    if outcome.joined {
+                        autojoined.lock().unwrap().insert(room.room_id());
+                    }
+                    print_json(&outcome);
+                }
+            });
+        Ok(())
+    }
+}
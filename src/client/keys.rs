@@ -0,0 +1,367 @@
+use std::collections::BTreeSet;
+use std::env;
+use std::fs;
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::path::Path;
+
+use anyhow::{anyhow, bail};
+use futures::StreamExt;
+use matrix_sdk::ruma::{CanonicalJsonValue, OwnedUserId};
+use matrix_sdk::RoomMemberships;
+use matrix_sdk_crypto::vodozemac::{Ed25519PublicKey, Ed25519Signature};
+use reqwest::Method;
+use serde_json::{json, Map, Value};
+
+use crate::outputs::{
+    BackupSignature, BackupVerification, KeyExport, KeyHygiene, KeyImport, StaleDeviceList,
+};
+use crate::terminal;
+
+const CURVE25519_BACKUP: &str = "m.megolm_backup.v1.curve25519-aes-sha2";
+// Symmetric backups, which the server announces as unstable feature.
+const SYMMETRIC_BACKUP_FEATURE: &str = "org.matrix.msc3270";
+
+/// The signed representation of a JSON object, i.e. its canonical JSON
+/// without `signatures` and `unsigned`.
+pub(super) fn signed_bytes(object: &Value) -> anyhow::Result<Vec<u8>> {
+    let mut object = object.clone();
+    if let Some(map) = object.as_object_mut() {
+        map.remove("signatures");
+        map.remove("unsigned");
+    }
+    let canonical = CanonicalJsonValue::try_from(object)?;
+    Ok(canonical.to_string().into_bytes())
+}
+
+/// What `key_hygiene` checks for.
+#[derive(Debug)]
+pub(crate) struct HygieneOptions {
+    /// Warn if fewer signed one-time keys are left on the server
+    pub(crate) min_one_time_keys: u64,
+    /// Sync once more if below, so that new one-time keys are uploaded
+    pub(crate) replenish: bool,
+}
+
+/// The passphrase of a key export from `passphrase`, `$MN_KEYS_PASSPHRASE`
+/// or the terminal, in this order. New passphrases are asked twice.
+pub(crate) fn export_passphrase(passphrase: Option<String>, new: bool) -> anyhow::Result<String> {
+    if let Some(passphrase) = passphrase {
+        return Ok(passphrase);
+    }
+    if let Ok(passphrase) = env::var("MN_KEYS_PASSPHRASE") {
+        return Ok(passphrase);
+    }
+    if !terminal::interactive() {
+        bail!("no passphrase; set MN_KEYS_PASSPHRASE or pass --passphrase");
+    }
+    let passphrase = rpassword::prompt_password("key export passphrase: ")?;
+    if new && rpassword::prompt_password("repeat passphrase: ")? != passphrase {
+        bail!("the passphrases do not match");
+    }
+    Ok(passphrase)
+}
+
+pub(super) fn verify(key: &Ed25519PublicKey, message: &[u8], signature: &str) -> bool {
+    match Ed25519Signature::from_base64(signature) {
+        Ok(signature) => key.verify(message, &signature).is_ok(),
+        Err(_) => false,
+    }
+}
+
+impl super::Client {
+    /// Check the signatures of the current key backup version against our
+    /// cross-signing master key and our devices.
+    pub(crate) async fn verify_key_backup(&self) -> anyhow::Result<BackupVerification> {
+        let backup = self
+            .api_get("_matrix/client/v3/room_keys/version", &[])
+            .await?;
+        let Some(algorithm) = backup.get("algorithm").and_then(Value::as_str) else {
+            bail!("no key backup found");
+        };
+        let auth_data = backup.get("auth_data").cloned().unwrap_or_default();
+        let message = signed_bytes(&auth_data)?;
+
+        let encryption = self.inner.encryption();
+        let identity = encryption.get_user_identity(&self.user_id).await?;
+        let master_key = identity
+            .as_ref()
+            .and_then(|i| i.master_key().get_first_key());
+        let master_trusted = identity.as_ref().is_some_and(|i| i.is_verified());
+        let devices = encryption.get_user_devices(&self.user_id).await?;
+        let own_device_id = self.inner.device_id().map(|d| d.to_owned());
+
+        let mut signatures = vec![];
+        let own_signatures = auth_data
+            .get("signatures")
+            .and_then(|s| s.get(self.user_id.as_str()))
+            .and_then(Value::as_object)
+            .cloned()
+            .unwrap_or_default();
+
+        for (key_id, signature) in own_signatures {
+            let signature = signature.as_str().unwrap_or("");
+            let key_name = key_id.strip_prefix("ed25519:").unwrap_or(&key_id);
+            let mut entry = BackupSignature {
+                user_id: self.user_id.to_string(),
+                key_id: key_id.clone(),
+                signer: "unknown",
+                valid: false,
+                trusted: false,
+            };
+
+            if let Some(key) = master_key.filter(|k| k.to_base64() == key_name) {
+                entry.signer = "master_key";
+                entry.valid = verify(&key, &message, signature);
+                entry.trusted = entry.valid && master_trusted;
+            } else if let Some(device) = devices
+                .devices()
+                .find(|d| d.device_id().as_str() == key_name)
+            {
+                entry.signer = "device";
+                if let Some(key) = device.ed25519_key() {
+                    entry.valid = verify(&key, &message, signature);
+                }
+                let is_own = own_device_id.as_deref() == Some(device.device_id());
+                entry.trusted = entry.valid && (is_own || device.is_verified());
+            }
+
+            signatures.push(entry);
+        }
+
+        let mut warnings = vec![];
+        if algorithm == CURVE25519_BACKUP {
+            let versions = self.api_get("_matrix/client/versions", &[]).await?;
+            let symmetric = versions
+                .pointer(&format!("/unstable_features/{}", SYMMETRIC_BACKUP_FEATURE))
+                .and_then(Value::as_bool)
+                .unwrap_or(false);
+            if symmetric {
+                warnings.push(format!(
+                    "{} is deprecated; the server supports symmetric backups ({})",
+                    algorithm, SYMMETRIC_BACKUP_FEATURE
+                ));
+            }
+        }
+        if !master_trusted {
+            warnings.push(String::from(
+                "our cross-signing identity is not verified on this device",
+            ));
+        }
+
+        Ok(BackupVerification {
+            version: backup
+                .get("version")
+                .and_then(Value::as_str)
+                .map(String::from),
+            algorithm: algorithm.to_string(),
+            trusted: signatures.iter().any(|s| s.trusted),
+            signatures,
+            warnings,
+        })
+    }
+
+    /// The signed curve25519 one-time keys the server has left for us; an
+    /// empty upload returns the counts.
+    async fn one_time_key_count(&self) -> anyhow::Result<u64> {
+        let resp = self
+            .api_request(
+                Method::POST,
+                "_matrix/client/v3/keys/upload",
+                &[],
+                Some(&json!({})),
+            )
+            .await?;
+        Ok(resp
+            .pointer("/one_time_key_counts/signed_curve25519")
+            .and_then(Value::as_u64)
+            .unwrap_or(0))
+    }
+
+    /// Remote members of encrypted rooms whose devices on the server differ
+    /// from the ones we know; messages to them miss or waste keys until
+    /// their device list is queried again.
+    async fn stale_device_lists(&self) -> anyhow::Result<Vec<StaleDeviceList>> {
+        let mut users: BTreeSet<OwnedUserId> = BTreeSet::new();
+        for room in self.inner.joined_rooms() {
+            if !room.is_encrypted().await? {
+                continue;
+            }
+            for member in room
+                .members(RoomMemberships::JOIN | RoomMemberships::INVITE)
+                .await?
+            {
+                if *member.user_id() != *self.user_id {
+                    users.insert(member.user_id().to_owned());
+                }
+            }
+        }
+        if users.is_empty() {
+            return Ok(vec![]);
+        }
+
+        let query: Map<String, Value> = users.iter().map(|u| (u.to_string(), json!([]))).collect();
+        let resp = self
+            .api_request(
+                Method::POST,
+                "_matrix/client/v3/keys/query",
+                &[],
+                Some(&json!({ "device_keys": query })),
+            )
+            .await?;
+
+        let encryption = self.inner.encryption();
+        let mut stale = vec![];
+        for user_id in users {
+            // Users of unreachable servers are listed in `failures`.
+            let Some(remote) = resp
+                .get("device_keys")
+                .and_then(|k| k.get(user_id.as_str()))
+                .and_then(Value::as_object)
+            else {
+                continue;
+            };
+            let remote: BTreeSet<String> = remote.keys().cloned().collect();
+            let local: BTreeSet<String> = encryption
+                .get_user_devices(&user_id)
+                .await?
+                .devices()
+                .map(|d| d.device_id().to_string())
+                .collect();
+            let missing: Vec<String> = remote.difference(&local).cloned().collect();
+            let removed: Vec<String> = local.difference(&remote).cloned().collect();
+            if !missing.is_empty() || !removed.is_empty() {
+                stale.push(StaleDeviceList {
+                    user_id: user_id.to_string(),
+                    missing,
+                    removed,
+                });
+            }
+        }
+        Ok(stale)
+    }
+
+    /// Report the E2EE health of the account: one-time keys left on the
+    /// server, own devices without cross-signing signature and remote
+    /// device lists which are out of date.
+    pub(crate) async fn key_hygiene(&self, opts: &HygieneOptions) -> anyhow::Result<KeyHygiene> {
+        let mut warnings = vec![];
+        let mut one_time_keys = self.one_time_key_count().await?;
+        let mut replenished = false;
+        if one_time_keys < opts.min_one_time_keys && opts.replenish {
+            // The crypto machine tops up the keys after a sync reported
+            // the low count to it.
+            if let Some(ref ss) = self.sliding_sync {
+                let mut sync_stream = Box::pin(ss.sync());
+                if let Some(Err(e)) = sync_stream.next().await {
+                    return Err(e.into());
+                }
+            }
+            let count = self.one_time_key_count().await?;
+            replenished = count > one_time_keys;
+            one_time_keys = count;
+        }
+        if one_time_keys < opts.min_one_time_keys {
+            warnings.push(format!(
+                "only {} one-time keys left on the server",
+                one_time_keys
+            ));
+        }
+
+        let encryption = self.inner.encryption();
+        let mut unsigned_devices = vec![];
+        if encryption.get_user_identity(&self.user_id).await?.is_none() {
+            warnings.push(String::from("the account has no cross-signing identity"));
+        } else {
+            for device in encryption.get_user_devices(&self.user_id).await?.devices() {
+                if !device.is_cross_signed_by_owner() {
+                    unsigned_devices.push(device.device_id().to_string());
+                }
+            }
+            if !unsigned_devices.is_empty() {
+                warnings.push(format!(
+                    "{} devices are not cross-signed: {}",
+                    unsigned_devices.len(),
+                    unsigned_devices.join(", ")
+                ));
+            }
+        }
+
+        let stale_device_lists = self.stale_device_lists().await?;
+        if !stale_device_lists.is_empty() {
+            warnings.push(format!(
+                "the device lists of {} users are out of date",
+                stale_device_lists.len()
+            ));
+        }
+
+        Ok(KeyHygiene {
+            one_time_keys,
+            replenished,
+            unsigned_devices,
+            stale_device_lists,
+            warnings,
+        })
+    }
+
+    /// Write all inbound group sessions to `path` in the key export format
+    /// of the spec, as Element reads and writes it; the file is only
+    /// readable by us.
+    pub(crate) async fn export_keys(
+        &self,
+        path: &Path,
+        passphrase: &str,
+    ) -> anyhow::Result<KeyExport> {
+        // The SDK writes into the file as it is, so it cannot be read by
+        // others at any point.
+        let existed = path.try_exists()?;
+        let file = fs::OpenOptions::new()
+            .write(true)
+            .create(true)
+            .truncate(true)
+            .mode(0o600)
+            .open(path)?;
+        file.set_permissions(fs::Permissions::from_mode(0o600))?;
+        drop(file);
+
+        let mut sessions = 0;
+        let result = self
+            .inner
+            .encryption()
+            .export_room_keys(path.to_path_buf(), passphrase, |_| {
+                sessions += 1;
+                true
+            })
+            .await;
+        if let Err(e) = result {
+            if !existed {
+                let _ = fs::remove_file(path);
+            }
+            return Err(e.into());
+        }
+        Ok(KeyExport {
+            path: path.display().to_string(),
+            sessions,
+        })
+    }
+
+    /// Import the sessions of a key export into the crypto store. Sessions
+    /// we have in a better state, i.e. known from an earlier message
+    /// index, are kept.
+    pub(crate) async fn import_keys(
+        &self,
+        path: &Path,
+        passphrase: &str,
+    ) -> anyhow::Result<KeyImport> {
+        let result = self
+            .inner
+            .encryption()
+            .import_room_keys(path.to_path_buf(), passphrase)
+            .await
+            .map_err(|e| anyhow!("importing {}: {}", path.display(), e))?;
+        Ok(KeyImport {
+            imported: result.imported_count,
+            total: result.total_count,
+            rooms: result.keys.keys().map(|r| r.to_string()).collect(),
+        })
+    }
+}
@@ -0,0 +1,240 @@
+use std::fmt;
+use std::future::Future;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::anyhow;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use tokio::time::{interval, sleep};
+use tracing::warn;
+
+use super::follow::Interrupted;
+use crate::exit::{self, ExitCode};
+use crate::outputs::LockStatus;
+
+/// Prefix of the global account data type holding the lease of a lock.
+const LOCK_TYPE_PREFIX: &str = "io.github.mnotify.lock.";
+/// A lease which is not renewed within this time is free again, e.g.
+/// after a crash.
+const LEASE_TTL: Duration = Duration::from_secs(120);
+/// How often a held lease is extended.
+const RENEW_INTERVAL: Duration = Duration::from_secs(30);
+/// Time for concurrent leases of other hosts to arrive before ours is
+/// checked again.
+const CLAIM_SETTLE: Duration = Duration::from_secs(3);
+
+/// An advisory lease on a named lock of the account, written to global
+/// account data. Holders take it over only once it expired.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+struct Lease {
+    /// Random id telling our lease apart from a later one of the same host
+    id: String,
+    holder: String,
+    hostname: String,
+    device_id: String,
+    /// Unix timestamps in seconds
+    acquired_at: u64,
+    expires_at: u64,
+}
+
+/// A lease we hold.
+pub(crate) struct Lock {
+    name: String,
+    lease: Lease,
+}
+
+/// The lock is held by someone else.
+#[derive(Debug)]
+pub(crate) struct Held {
+    name: String,
+    lease: Lease,
+}
+
+impl fmt::Display for Held {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let until = UNIX_EPOCH + Duration::from_secs(self.lease.expires_at);
+        write!(
+            f,
+            "lock {} is held by {} on {} (device {}) until {}",
+            self.name,
+            self.lease.holder,
+            self.lease.hostname,
+            self.lease.device_id,
+            humantime::format_rfc3339_seconds(until)
+        )
+    }
+}
+
+impl std::error::Error for Held {}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn lock_type(name: &str) -> String {
+    format!("{}{}", LOCK_TYPE_PREFIX, name)
+}
+
+fn lease_id() -> anyhow::Result<String> {
+    let mut buf = [0u8; 8];
+    getrandom::getrandom(&mut buf).map_err(|e| anyhow!("random: {}", e))?;
+    Ok(buf.iter().map(|b| format!("{:02x}", b)).collect())
+}
+
+fn status(name: &str, lease: Option<&Lease>) -> LockStatus {
+    LockStatus {
+        name: name.to_string(),
+        held: lease.is_some_and(|l| l.expires_at > now_secs()),
+        holder: lease.map(|l| l.holder.clone()),
+        hostname: lease.map(|l| l.hostname.clone()),
+        device_id: lease.map(|l| l.device_id.clone()),
+        acquired_at: lease.map(|l| l.acquired_at),
+        expires_at: lease.map(|l| l.expires_at),
+    }
+}
+
+impl super::Client {
+    async fn lease(&self, name: &str) -> anyhow::Result<Option<Lease>> {
+        match self.get_global_account_data(&lock_type(name)).await? {
+            // An empty object is what remains after releasing a lease.
+            Some(Value::Object(o)) if o.is_empty() => Ok(None),
+            Some(content) => Ok(Some(serde_json::from_value(content)?)),
+            None => Ok(None),
+        }
+    }
+
+    async fn put_lease(&self, name: &str, lease: &Lease) -> anyhow::Result<()> {
+        self.put_global_account_data(&lock_type(name), &serde_json::to_value(lease)?)
+            .await
+    }
+
+    /// Take the lease of lock `name`, unless another one has not expired.
+    pub(crate) async fn acquire_lock(&self, name: &str) -> anyhow::Result<Result<Lock, Held>> {
+        if let Some(lease) = self.lease(name).await? {
+            if lease.expires_at > now_secs() {
+                let name = name.to_string();
+                return Ok(Err(Held { name, lease }));
+            }
+        }
+
+        let now = now_secs();
+        let lease = Lease {
+            id: lease_id()?,
+            holder: std::env::var("USER").unwrap_or_else(|_| self.user_id.to_string()),
+            hostname: gethostname::gethostname().to_string_lossy().into_owned(),
+            device_id: self
+                .inner
+                .device_id()
+                .map(|d| d.to_string())
+                .unwrap_or_default(),
+            acquired_at: now,
+            expires_at: now + LEASE_TTL.as_secs(),
+        };
+        self.put_lease(name, &lease).await?;
+        // Of two hosts arriving at the same time, the last write wins.
+        sleep(CLAIM_SETTLE).await;
+        let name = name.to_string();
+        match self.lease(&name).await? {
+            Some(current) if current.id == lease.id => Ok(Ok(Lock { name, lease })),
+            Some(lease) => Ok(Err(Held { name, lease })),
+            None => Err(anyhow!("lock {} was broken while acquiring it", name)),
+        }
+    }
+
+    /// Extend our lease; returns false if it was broken or taken over,
+    /// which is not taken back.
+    async fn renew_lock(&self, lock: &mut Lock) -> anyhow::Result<bool> {
+        match self.lease(&lock.name).await? {
+            Some(current) if current.id == lock.lease.id => {}
+            Some(current) => {
+                eprintln!(
+                    "error: lock {} was taken over by {} on {}",
+                    lock.name, current.holder, current.hostname
+                );
+                return Ok(false);
+            }
+            None => {
+                eprintln!("error: lock {} was broken", lock.name);
+                return Ok(false);
+            }
+        }
+        lock.lease.expires_at = now_secs() + LEASE_TTL.as_secs();
+        self.put_lease(&lock.name, &lock.lease).await?;
+        Ok(true)
+    }
+
+    /// Release our lease; one taken over by someone else is left alone.
+    async fn release_lock(&self, lock: &Lock) -> anyhow::Result<()> {
+        if self.lease(&lock.name).await?.as_ref() != Some(&lock.lease) {
+            return Ok(());
+        }
+        // Account data cannot be deleted.
+        self.put_global_account_data(&lock_type(&lock.name), &json!({}))
+            .await
+    }
+
+    /// Run `work` while renewing `lock`, and release it afterwards. If the
+    /// lock is lost, `work` is cancelled so that it does not run besides
+    /// the new holder, and it ends with `exit::HELD`. With
+    /// `interruptible`, Ctrl-C cancels it too and ends with `Interrupted`.
+    pub(crate) async fn while_locked(
+        &self,
+        mut lock: Lock,
+        work: impl Future<Output = anyhow::Result<()>>,
+        interruptible: bool,
+    ) -> anyhow::Result<()> {
+        tokio::pin!(work);
+        let interrupt = async {
+            if interruptible {
+                tokio::signal::ctrl_c().await
+            } else {
+                std::future::pending().await
+            }
+        };
+        tokio::pin!(interrupt);
+        let mut renew = interval(RENEW_INTERVAL);
+        // The first tick is immediate; the lease is fresh.
+        renew.tick().await;
+
+        let result = loop {
+            tokio::select! {
+                result = &mut work => break result,
+                _ = renew.tick() => match self.renew_lock(&mut lock).await {
+                    Ok(true) => {}
+                    // Not ours to release any more.
+                    Ok(false) => return Err(ExitCode(exit::HELD).into()),
+                    // Others may take it once it expired.
+                    Err(e) if lock.lease.expires_at <= now_secs() + RENEW_INTERVAL.as_secs() => {
+                        eprintln!("error: lock {} could not be renewed: {}", lock.name, e);
+                        break Err(ExitCode(exit::HELD).into());
+                    }
+                    Err(e) => warn!("renewing lock {}: {}", lock.name, e),
+                },
+                _ = &mut interrupt => break Err(Interrupted.into()),
+            }
+        };
+
+        if let Err(e) = self.release_lock(&lock).await {
+            warn!("releasing lock {}: {}", lock.name, e);
+        }
+        result
+    }
+
+    pub(crate) async fn lock_status(&self, name: &str) -> anyhow::Result<LockStatus> {
+        Ok(status(name, self.lease(name).await?.as_ref()))
+    }
+
+    /// Remove the lease of lock `name`, e.g. of a crashed holder; returns
+    /// the status before.
+    pub(crate) async fn break_lock(&self, name: &str) -> anyhow::Result<LockStatus> {
+        let lease = self.lease(name).await?;
+        if lease.is_some() {
+            self.put_global_account_data(&lock_type(name), &json!({}))
+                .await?;
+        }
+        Ok(status(name, lease.as_ref()))
+    }
+}
@@ -1,4 +1,43 @@
 use anyhow::{self, bail};
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::ServerName;
+use reqwest::StatusCode;
+use serde_json::{json, Value};
+
+use super::api::ApiError;
+use crate::outputs::{IdentityProvider, LoginFlow, LoginFlows};
+
+/// The homeserver does not know the access token (anymore).
+pub(crate) struct UnknownToken {
+    pub(crate) soft_logout: bool,
+}
+
+/// Check if `err` was caused by an invalidated access token.
+pub(crate) fn unknown_token(err: &anyhow::Error) -> Option<UnknownToken> {
+    if let Some(e) = err.downcast_ref::<ApiError>() {
+        if e.errcode == "M_UNKNOWN_TOKEN" {
+            return Some(UnknownToken {
+                soft_logout: e.soft_logout,
+            });
+        }
+        return None;
+    }
+
+    let kind = if let Some(e) = err.downcast_ref::<matrix_sdk::Error>() {
+        e.client_api_error_kind()
+    } else if let Some(e) = err.downcast_ref::<matrix_sdk::HttpError>() {
+        e.client_api_error_kind()
+    } else {
+        None
+    };
+
+    match kind {
+        Some(ErrorKind::UnknownToken { soft_logout }) => Some(UnknownToken {
+            soft_logout: *soft_logout,
+        }),
+        _ => None,
+    }
+}
 
 impl super::Client {
     pub(crate) fn ensure_login(self) -> anyhow::Result<Self> {
@@ -13,9 +52,173 @@ impl super::Client {
             .matrix_auth()
             .login_username(&self.user_id, password)
             .initial_device_display_name(&self.device_name)
+            .request_refresh_token()
             .send()
             .await?;
 
         self.persist_session()
     }
+
+    /// Try to obtain a new access token with the stored refresh token.
+    /// Returns `false` if there is no refresh token.
+    pub(crate) async fn refresh_session(&self) -> anyhow::Result<bool> {
+        if let Some(oauth) = super::oauth::stored_meta() {
+            return self.refresh_oauth_session(&oauth).await;
+        }
+
+        let auth = self.inner.matrix_auth();
+        if auth.refresh_token().is_none() {
+            return Ok(false);
+        }
+
+        auth.refresh_access_token().await?;
+        self.persist_session()?;
+        Ok(true)
+    }
+}
+
+/// The client API base url of `server_name` as announced in
+/// `.well-known/matrix/client`.
+pub(crate) async fn discover_homeserver(
+    http: &reqwest::Client,
+    server_name: &ServerName,
+) -> anyhow::Result<String> {
+    let url = format!("https://{}/.well-known/matrix/client", server_name);
+    let base_url = match http.get(url).send().await {
+        Ok(resp) if resp.status().is_success() => resp.json::<Value>().await.ok().and_then(|v| {
+            v.pointer("/m.homeserver/base_url")
+                .and_then(Value::as_str)
+                .map(String::from)
+        }),
+        _ => None,
+    };
+    Ok(base_url.unwrap_or_else(|| format!("https://{}", server_name)))
+}
+
+/// Probe how users can log in to and register at `homeserver`, without
+/// any credentials.
+pub(crate) async fn login_flows(
+    http: &reqwest::Client,
+    homeserver: &str,
+) -> anyhow::Result<LoginFlows> {
+    let homeserver = homeserver.trim_end_matches('/');
+
+    let url = format!("{}/_matrix/client/v3/login", homeserver);
+    let resp: Value = http
+        .get(url)
+        .send()
+        .await?
+        .error_for_status()?
+        .json()
+        .await?;
+    let flows: Vec<LoginFlow> = resp
+        .get("flows")
+        .and_then(Value::as_array)
+        .into_iter()
+        .flatten()
+        .map(|flow| LoginFlow {
+            kind: flow
+                .get("type")
+                .and_then(Value::as_str)
+                .unwrap_or_default()
+                .to_string(),
+            identity_providers: flow
+                .get("identity_providers")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+                .map(|idp| IdentityProvider {
+                    id: idp
+                        .get("id")
+                        .and_then(Value::as_str)
+                        .unwrap_or_default()
+                        .to_string(),
+                    name: idp
+                        .get("name")
+                        .and_then(Value::as_str)
+                        .unwrap_or_default()
+                        .to_string(),
+                })
+                .collect(),
+        })
+        .collect();
+
+    // An empty registration request answers with the required stages,
+    // or is refused if registration is disabled.
+    let url = format!("{}/_matrix/client/v3/register", homeserver);
+    let resp = http.post(url).json(&json!({})).send().await?;
+    let registration_stages = match resp.status() {
+        StatusCode::UNAUTHORIZED => {
+            let body: Value = resp.json().await?;
+            let mut stages: Vec<String> = body
+                .get("flows")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+                .filter_map(|f| f.get("stages").and_then(Value::as_array))
+                .flatten()
+                .filter_map(Value::as_str)
+                .map(String::from)
+                .collect();
+            stages.sort();
+            stages.dedup();
+            Some(stages)
+        }
+        _ => None,
+    };
+
+    let url = format!(
+        "{}/_matrix/client/unstable/org.matrix.msc2965/auth_issuer",
+        homeserver
+    );
+    let oauth_issuer = match http.get(url).send().await {
+        Ok(resp) if resp.status().is_success() => resp
+            .json::<Value>()
+            .await
+            .ok()
+            .and_then(|v| v.get("issuer").and_then(Value::as_str).map(String::from)),
+        _ => None,
+    };
+
+    Ok(LoginFlows {
+        homeserver: homeserver.to_string(),
+        password: flows.iter().any(|f| f.kind == "m.login.password"),
+        sso: flows.iter().any(|f| f.kind == "m.login.sso"),
+        token: flows.iter().any(|f| f.kind == "m.login.token"),
+        registration_open: registration_stages.is_some(),
+        registration_stages: registration_stages.unwrap_or_default(),
+        // Refresh tokens are only known to be issued via OAuth 2.0; for
+        // the other flows the server only tells after a login.
+        refresh_tokens: oauth_issuer.as_ref().map(|_| true),
+        oauth_issuer,
+        flows,
+    })
+}
+
+/// A summary of `flows` for humans.
+pub(crate) fn describe_login_flows(flows: &LoginFlows) -> String {
+    let yes_no = |b: bool| if b { "yes" } else { "no" };
+    let mut out = format!("homeserver:    {}\n", flows.homeserver);
+    out += &format!("password:      {}\n", yes_no(flows.password));
+    out += &format!("sso:           {}\n", yes_no(flows.sso));
+    for idp in flows.flows.iter().flat_map(|f| &f.identity_providers) {
+        out += &format!("  - {} ({})\n", idp.name, idp.id);
+    }
+    out += &format!("token:         {}\n", yes_no(flows.token));
+    if let Some(ref issuer) = flows.oauth_issuer {
+        out += &format!("oauth issuer:  {}\n", issuer);
+    }
+    out += &format!("registration:  {}", yes_no(flows.registration_open));
+    if !flows.registration_stages.is_empty() {
+        out += &format!(" ({})", flows.registration_stages.join(", "));
+    }
+    out += "\n";
+    out += &format!(
+        "refresh token: {}",
+        match flows.refresh_tokens {
+            Some(b) => yes_no(b),
+            None => "unknown",
+        }
+    );
+    out
 }
@@ -0,0 +1,175 @@
+use anyhow::bail;
+use matrix_sdk::room::MessagesOptions;
+use serde_json::Value;
+
+use super::api::ApiError;
+use super::synapse::admin_v1;
+use crate::outputs::{MediaItem, MediaUsage, UrlPreview};
+
+const TOP_ITEMS: usize = 10;
+
+fn usage_from_items(source: &'static str, mut items: Vec<MediaItem>) -> MediaUsage {
+    items.sort_by(|a, b| b.size.cmp(&a.size));
+    let total_bytes = items.iter().map(|i| i.size).sum();
+    let count = items.len();
+    items.truncate(TOP_ITEMS);
+
+    MediaUsage {
+        source,
+        total_bytes,
+        count,
+        largest: items,
+    }
+}
+
+impl super::Client {
+    /// Ask the homeserver to scrape `url` and return its OpenGraph data.
+    pub(crate) async fn preview_url(&self, url: &str) -> anyhow::Result<UrlPreview> {
+        let query = [("url", url.to_string())];
+        let og = match self.api_get("_matrix/media/v3/preview_url", &query).await {
+            Ok(og) => og,
+            Err(e) => match e.downcast_ref::<ApiError>() {
+                Some(api_err) if api_err.errcode == "M_UNKNOWN" => {
+                    bail!(
+                        "the homeserver refused to preview {}; url previews might be disabled: {}",
+                        url,
+                        api_err
+                    )
+                }
+                _ => return Err(e),
+            },
+        };
+
+        let field = |key: &str| og.get(key).and_then(Value::as_str).map(String::from);
+
+        Ok(UrlPreview {
+            url: url.to_string(),
+            title: field("og:title"),
+            description: field("og:description"),
+            image: field("og:image"),
+            og,
+        })
+    }
+
+    /// Media statistics of the synapse admin API; requires a server admin.
+    async fn media_usage_admin(&self) -> anyhow::Result<MediaUsage> {
+        let path = format!("{}/users/{}/media", admin_v1(), self.user_id);
+        let server = self.user_id.server_name();
+        let mut items = vec![];
+        let mut from = 0;
+
+        loop {
+            let query = [("from", from.to_string()), ("limit", String::from("500"))];
+            let resp = self.api_get(&path, &query).await?;
+
+            for media in resp
+                .get("media")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+            {
+                let Some(media_id) = media.get("media_id").and_then(Value::as_str) else {
+                    continue;
+                };
+                items.push(MediaItem {
+                    mxc_uri: format!("mxc://{}/{}", server, media_id),
+                    size: media
+                        .get("media_length")
+                        .and_then(Value::as_u64)
+                        .unwrap_or(0),
+                    name: media
+                        .get("upload_name")
+                        .and_then(Value::as_str)
+                        .map(String::from),
+                    room_id: None,
+                    event_id: None,
+                });
+            }
+
+            match resp.get("next_token").and_then(Value::as_u64) {
+                Some(next) => from = next,
+                None => break,
+            }
+        }
+
+        Ok(usage_from_items("synapse_admin", items))
+    }
+
+    /// Sum up the sizes of all media events we sent to joined rooms.
+    async fn media_usage_scan(&self) -> anyhow::Result<MediaUsage> {
+        let rooms = self.inner.joined_rooms();
+        let total = rooms.len();
+        let mut items = vec![];
+
+        for (n, room) in rooms.into_iter().enumerate() {
+            eprint!("\rscanning room {}/{}", n + 1, total);
+            let mut from = None;
+
+            loop {
+                let mut options = MessagesOptions::backward();
+                options.from = from;
+                options.limit = 100u32.into();
+                let msgs = room.messages(options).await?;
+
+                for event in msgs.chunk {
+                    let event = event.event.deserialize_as::<Value>()?;
+                    if event.get("sender").and_then(Value::as_str) != Some(self.user_id.as_str()) {
+                        continue;
+                    }
+                    let content = event.get("content").cloned().unwrap_or_default();
+                    let Some(mxc_uri) = content
+                        .get("url")
+                        .or_else(|| content.pointer("/file/url"))
+                        .and_then(Value::as_str)
+                    else {
+                        continue;
+                    };
+                    items.push(MediaItem {
+                        mxc_uri: mxc_uri.to_string(),
+                        size: content
+                            .pointer("/info/size")
+                            .and_then(Value::as_u64)
+                            .unwrap_or(0),
+                        name: content
+                            .get("body")
+                            .and_then(Value::as_str)
+                            .map(String::from),
+                        room_id: Some(room.room_id().to_string()),
+                        event_id: event
+                            .get("event_id")
+                            .and_then(Value::as_str)
+                            .map(String::from),
+                    });
+                }
+
+                match msgs.end {
+                    Some(end) => from = Some(end),
+                    None => break,
+                }
+            }
+        }
+        eprintln!();
+
+        Ok(usage_from_items("scan", items))
+    }
+
+    /// Report our media usage; uses the synapse admin API if possible and
+    /// falls back to scanning the joined rooms if `scan` is set.
+    pub(crate) async fn media_usage(&self, scan: bool) -> anyhow::Result<MediaUsage> {
+        match self.media_usage_admin().await {
+            Ok(usage) => Ok(usage),
+            Err(e) => {
+                if e.downcast_ref::<ApiError>().is_none() {
+                    return Err(e);
+                }
+                if !scan {
+                    bail!(
+                        "the synapse admin API is not available ({}); use --scan to scan the joined rooms",
+                        e
+                    );
+                }
+                self.media_usage_scan().await
+            }
+        }
+    }
+}
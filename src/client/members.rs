@@ -0,0 +1,181 @@
+use std::collections::BTreeSet;
+
+use matrix_sdk::ruma::api::client::membership::invite_user::{self, v3::InvitationRecipient};
+use matrix_sdk::ruma::api::client::membership::kick_user;
+use matrix_sdk::ruma::{OwnedUserId, RoomId, UserId};
+use matrix_sdk::{RoomMember, RoomMemberships};
+
+use super::batch::{with_retries, Cancel};
+use crate::outputs::{MemberMatch, MemberSyncAction};
+
+#[derive(Debug, Default)]
+pub(crate) struct MemberSyncOptions {
+    /// Kick members which are not in the reference room
+    pub(crate) remove_extra: bool,
+    /// Never kicked, e.g. bots and admins
+    pub(crate) keep: Vec<OwnedUserId>,
+    /// Apply the plan; only print it otherwise
+    pub(crate) apply: bool,
+    /// Only these users, e.g. the failures of a previous run
+    pub(crate) only: Option<BTreeSet<String>>,
+}
+
+fn member_match(member: &RoomMember, exact: bool) -> MemberMatch {
+    MemberMatch {
+        user_id: member.user_id().to_string(),
+        display_name: member.display_name().map(String::from),
+        avatar_url: member.avatar_url().map(|u| u.to_string()),
+        membership: member.membership().to_string(),
+        exact,
+        ambiguous: member.name_ambiguous(),
+    }
+}
+
+impl super::Client {
+    /// Resolve `query` in a room: a user id yields the member state of
+    /// that user, anything else the members whose display name contains
+    /// the query, ignoring case, exact matches first. The member list is
+    /// only fetched once and then kept in the state store.
+    pub(crate) async fn find_members(
+        &self,
+        room_id: &RoomId,
+        query: &str,
+    ) -> anyhow::Result<Vec<MemberMatch>> {
+        let room = self.get_joined_room(room_id)?;
+
+        if let Ok(user_id) = UserId::parse(query) {
+            return Ok(room
+                .get_member(&user_id)
+                .await?
+                .map(|m| member_match(&m, true))
+                .into_iter()
+                .collect());
+        }
+
+        let needle = query.to_lowercase();
+        let mut matches: Vec<MemberMatch> = room
+            .members(RoomMemberships::JOIN | RoomMemberships::INVITE)
+            .await?
+            .iter()
+            .filter_map(|m| {
+                let name = m.display_name()?.to_lowercase();
+                name.contains(&needle)
+                    .then(|| member_match(m, name == needle))
+            })
+            .collect();
+        matches.sort_by(|a, b| {
+            b.exact
+                .cmp(&a.exact)
+                .then_with(|| a.display_name.cmp(&b.display_name))
+                .then_with(|| a.user_id.cmp(&b.user_id))
+        });
+        Ok(matches)
+    }
+
+    async fn member_ids(
+        &self,
+        room_id: &RoomId,
+        memberships: RoomMemberships,
+    ) -> anyhow::Result<BTreeSet<OwnedUserId>> {
+        let room = self.get_joined_room(room_id)?;
+        Ok(room
+            .members(memberships)
+            .await?
+            .iter()
+            .map(|m| m.user_id().to_owned())
+            .collect())
+    }
+
+    /// Make the members of `room_id` equal to the joined members of
+    /// `reference`, a room or a space: missing members are invited and,
+    /// with `remove_extra`, members not in the reference are kicked. On
+    /// `cancel` the remaining changes fail as interrupted, so that they
+    /// are in the report for `--retry-from`.
+    pub(crate) async fn sync_members(
+        &self,
+        room_id: &RoomId,
+        reference: &RoomId,
+        opts: &MemberSyncOptions,
+        cancel: &Cancel,
+    ) -> anyhow::Result<Vec<MemberSyncAction>> {
+        let wanted = self.member_ids(reference, RoomMemberships::JOIN).await?;
+        let invited_or_joined = self
+            .member_ids(room_id, RoomMemberships::JOIN | RoomMemberships::INVITE)
+            .await?;
+
+        let mut plan = vec![];
+        for user_id in wanted.difference(&invited_or_joined) {
+            plan.push(MemberSyncAction {
+                user_id: user_id.to_string(),
+                action: "invite",
+                applied: false,
+                error: None,
+                errcode: None,
+                retryable: None,
+            });
+        }
+        if opts.remove_extra {
+            for user_id in invited_or_joined.difference(&wanted) {
+                if *user_id == self.user_id || opts.keep.contains(user_id) {
+                    continue;
+                }
+                plan.push(MemberSyncAction {
+                    user_id: user_id.to_string(),
+                    action: "kick",
+                    applied: false,
+                    error: None,
+                    errcode: None,
+                    retryable: None,
+                });
+            }
+        }
+
+        if let Some(ref only) = opts.only {
+            plan.retain(|entry| only.contains(&entry.user_id));
+        }
+        if !opts.apply {
+            return Ok(plan);
+        }
+
+        // Rate limits are retried; permanent rejections are reported and
+        // the remaining changes are still applied.
+        for entry in plan.iter_mut() {
+            if cancel.requested() {
+                entry.error = Some(String::from("interrupted"));
+                entry.retryable = Some(true);
+                continue;
+            }
+            let user_id = OwnedUserId::try_from(entry.user_id.as_str())?;
+            let action = entry.action;
+            let result = with_retries(|| async {
+                match action {
+                    "invite" => {
+                        let recipient = InvitationRecipient::UserId {
+                            user_id: user_id.clone(),
+                        };
+                        let request = invite_user::v3::Request::new(room_id.to_owned(), recipient);
+                        self.inner.send(request, None).await?;
+                    }
+                    _ => {
+                        let mut request =
+                            kick_user::v3::Request::new(room_id.to_owned(), user_id.clone());
+                        request.reason = Some(format!("not a member of {}", reference));
+                        self.inner.send(request, None).await?;
+                    }
+                }
+                Ok::<_, anyhow::Error>(())
+            })
+            .await;
+            match result {
+                Ok(()) => entry.applied = true,
+                Err(e) => {
+                    entry.error = Some(e.error);
+                    entry.errcode = e.errcode;
+                    entry.retryable = Some(e.retryable);
+                }
+            }
+        }
+
+        Ok(plan)
+    }
+}
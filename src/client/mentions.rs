@@ -0,0 +1,123 @@
+use matrix_sdk::ruma::api::client::profile::get_display_name;
+use matrix_sdk::ruma::{OwnedUserId, UserId};
+use serde_json::{json, Value};
+use tracing::warn;
+
+use crate::format::escape;
+
+/// Users and the room pinged by sent messages, as pills in front of the
+/// body and in `m.mentions`.
+#[derive(Clone, Debug)]
+pub(crate) struct Mentions {
+    /// Each user with the text of its pill
+    pub(crate) users: Vec<(OwnedUserId, String)>,
+    pub(crate) room: bool,
+}
+
+impl Mentions {
+    /// Put the pills in front of a message content and list the users in
+    /// `m.mentions`, so that clients notify them.
+    pub(crate) fn apply(&self, content: &mut Value) {
+        let Some(map) = content.as_object_mut() else {
+            return;
+        };
+
+        let mut plain: Vec<String> = vec![];
+        let mut html: Vec<String> = vec![];
+        if self.room {
+            plain.push(String::from("@room"));
+            html.push(String::from("@room"));
+        }
+        for (user_id, name) in &self.users {
+            plain.push(name.clone());
+            html.push(format!(
+                "<a href=\"https://matrix.to/#/{}\">{}</a>",
+                escape(user_id.as_str()),
+                escape(name)
+            ));
+        }
+        if plain.is_empty() {
+            return;
+        }
+
+        let body = map.get("body").and_then(Value::as_str).unwrap_or("");
+        let formatted = match map.get("formatted_body").and_then(Value::as_str) {
+            Some(html) => html.to_string(),
+            None => escape(body).replace('\n', "<br>"),
+        };
+        let label = format!("{}: ", html.join(", "));
+        // Keep the reply fallbacks in front.
+        let formatted = match formatted.split_once("</mx-reply>") {
+            Some((reply, rest)) => format!("{}</mx-reply>{}{}", reply, label, rest),
+            None => format!("{}{}", label, formatted),
+        };
+        let label = format!("{}: ", plain.join(", "));
+        let body = match body.split_once("\n\n") {
+            Some((reply, rest)) if body.starts_with("> <") => {
+                format!("{}\n\n{}{}", reply, label, rest)
+            }
+            _ => format!("{}{}", label, body),
+        };
+
+        let mut mentions = match map.remove("m.mentions") {
+            Some(Value::Object(mentions)) => mentions,
+            _ => Default::default(),
+        };
+        let mut user_ids: Vec<Value> = mentions
+            .get("user_ids")
+            .and_then(Value::as_array)
+            .cloned()
+            .unwrap_or_default();
+        for (user_id, _) in &self.users {
+            let user_id = json!(user_id);
+            if !user_ids.contains(&user_id) {
+                user_ids.push(user_id);
+            }
+        }
+        if !user_ids.is_empty() {
+            mentions.insert(String::from("user_ids"), Value::from(user_ids));
+        }
+        if self.room {
+            mentions.insert(String::from("room"), json!(true));
+        }
+
+        map.insert(String::from("body"), json!(body));
+        map.insert(String::from("format"), json!("org.matrix.custom.html"));
+        map.insert(String::from("formatted_body"), json!(formatted));
+        map.insert(String::from("m.mentions"), Value::Object(mentions));
+    }
+}
+
+impl super::Client {
+    /// The display name of `user_id` from its profile, or from the fixture
+    /// previewed to; the user id if it has none or the profile cannot be
+    /// read.
+    async fn pill_text(&self, user_id: &UserId) -> String {
+        if let Some(ref fixture) = self.fixture {
+            return fixture
+                .display_name(user_id)
+                .unwrap_or(user_id.as_str())
+                .to_string();
+        }
+        let request = get_display_name::v3::Request::new(user_id.to_owned());
+        match self.inner.send(request, None).await {
+            Ok(resp) => resp.displayname.unwrap_or_else(|| user_id.to_string()),
+            Err(e) => {
+                warn!("display name of {}: {}", user_id, e);
+                user_id.to_string()
+            }
+        }
+    }
+
+    /// Mentions of `users`, with their display names as pill text.
+    pub(crate) async fn resolve_mentions(&self, users: &[OwnedUserId], room: bool) -> Mentions {
+        let mut resolved = vec![];
+        for user_id in users {
+            resolved.push((user_id.clone(), self.pill_text(user_id).await));
+        }
+        Mentions {
+            users: resolved,
+            room,
+        }
+    }
+}
@@ -0,0 +1,369 @@
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs::{self, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use matrix_sdk::media::{MediaFormat, MediaRequest};
+use matrix_sdk::room::{MessagesOptions, Room};
+use matrix_sdk::ruma::events::room::MediaSource;
+use matrix_sdk::ruma::{OwnedMxcUri, OwnedServerName};
+use serde_json::{json, Value};
+use tokio::time::sleep;
+
+use super::batch::{with_retries, Cancel};
+use super::follow::Interrupted;
+use crate::outputs::{MediaMapping, MediaMigration, MediaRewrite};
+
+/// How `migrate_media` moves the media of an old homeserver.
+#[derive(Debug)]
+pub(crate) struct MigrateOptions {
+    /// Server name of the old homeserver
+    pub(crate) from: OwnedServerName,
+    /// Old and new mxc uris as NDJSON; media listed is not uploaded again
+    pub(crate) mapping: PathBuf,
+    /// Pause between two uploads and between two edits
+    pub(crate) pace: Duration,
+    /// Edit our messages to reference the new uris
+    pub(crate) rewrite_events: bool,
+    /// Rewritten events, one per line; skipped when resuming
+    pub(crate) progress: Option<PathBuf>,
+}
+
+/// A message of ours which references media of the old homeserver.
+struct OwnEvent {
+    room: Room,
+    event_id: String,
+    content: Value,
+}
+
+/// Collect the uris starting with `prefix` anywhere in `value`, with the
+/// mimetype given for them. Encrypted files have none in the clear and
+/// are uploaded as they are, so their keys and hashes stay valid.
+fn collect_uris(value: &Value, prefix: &str, uris: &mut BTreeMap<String, Option<String>>) {
+    match value {
+        Value::String(s) if s.starts_with(prefix) => {
+            uris.entry(s.clone()).or_insert(None);
+        }
+        Value::Array(values) => {
+            for value in values {
+                collect_uris(value, prefix, uris);
+            }
+        }
+        Value::Object(object) => {
+            for value in object.values() {
+                collect_uris(value, prefix, uris);
+            }
+            for (key, pointer) in [
+                ("url", "/info/mimetype"),
+                ("thumbnail_url", "/thumbnail_info/mimetype"),
+            ] {
+                let uri = object.get(key).and_then(Value::as_str);
+                let mimetype = value.pointer(pointer).and_then(Value::as_str);
+                if let (Some(uri), Some(mimetype)) = (uri, mimetype) {
+                    if uri.starts_with(prefix) {
+                        uris.insert(uri.to_string(), Some(mimetype.to_string()));
+                    }
+                }
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Replace the uris of `mapping` anywhere in `value`.
+fn replace_uris(value: &mut Value, mapping: &BTreeMap<String, String>) {
+    match value {
+        Value::String(s) => {
+            if let Some(new) = mapping.get(s.as_str()) {
+                *s = new.clone();
+            }
+        }
+        Value::Array(values) => values.iter_mut().for_each(|v| replace_uris(v, mapping)),
+        Value::Object(object) => object.values_mut().for_each(|v| replace_uris(v, mapping)),
+        _ => {}
+    }
+}
+
+fn load_mapping(path: &Path) -> anyhow::Result<BTreeMap<String, String>> {
+    let raw = match fs::read_to_string(path) {
+        Ok(raw) => raw,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(BTreeMap::new()),
+        Err(e) => return Err(e.into()),
+    };
+    let mut mapping = BTreeMap::new();
+    for line in raw.lines().filter(|l| !l.trim().is_empty()) {
+        let entry: MediaMapping = serde_json::from_str(line)?;
+        mapping.insert(entry.old, entry.new);
+    }
+    Ok(mapping)
+}
+
+impl super::Client {
+    /// Scan the joined rooms for media of the old homeserver; returns the
+    /// uris with their mimetype and our messages which reference them.
+    async fn scan_old_media(
+        &self,
+        prefix: &str,
+    ) -> anyhow::Result<(BTreeMap<String, Option<String>>, Vec<OwnEvent>)> {
+        let rooms = self.inner.joined_rooms();
+        let total = rooms.len();
+        let mut uris = BTreeMap::new();
+        let mut own = vec![];
+        // Newest contents of our edited messages, which are paginated
+        // before the originals.
+        let mut edited: HashMap<String, Value> = HashMap::new();
+
+        for (n, room) in rooms.into_iter().enumerate() {
+            eprint!("\rscanning room {}/{}", n + 1, total);
+            let mut from = None;
+
+            loop {
+                let mut options = MessagesOptions::backward();
+                options.from = from;
+                options.limit = 100u32.into();
+                let msgs = room.messages(options).await?;
+
+                for event in msgs.chunk {
+                    let event = event.event.deserialize_as::<Value>()?;
+                    let Some(content) = event.get("content") else {
+                        continue;
+                    };
+                    let mut found = BTreeMap::new();
+                    collect_uris(content, prefix, &mut found);
+                    for (uri, mimetype) in found {
+                        let entry = uris.entry(uri).or_insert(None);
+                        if mimetype.is_some() {
+                            *entry = mimetype;
+                        }
+                    }
+
+                    let ours =
+                        event.get("sender").and_then(Value::as_str) == Some(self.user_id.as_str());
+                    let message =
+                        event.get("type").and_then(Value::as_str) == Some("m.room.message");
+                    let Some(event_id) = event.get("event_id").and_then(Value::as_str) else {
+                        continue;
+                    };
+                    if !ours || !message {
+                        continue;
+                    }
+                    // Edits are superseded by the one sent for the original,
+                    // which starts from the newest edit to keep its text.
+                    if content
+                        .pointer("/m.relates_to/rel_type")
+                        .and_then(Value::as_str)
+                        == Some("m.replace")
+                    {
+                        let original = content.pointer("/m.relates_to/event_id");
+                        let new_content = content.get("m.new_content");
+                        if let (Some(Value::String(original)), Some(new_content)) =
+                            (original, new_content)
+                        {
+                            edited
+                                .entry(original.clone())
+                                .or_insert_with(|| new_content.clone());
+                        }
+                        continue;
+                    }
+                    let content = edited.remove(event_id).unwrap_or_else(|| content.clone());
+                    let mut found = BTreeMap::new();
+                    collect_uris(&content, prefix, &mut found);
+                    if !found.is_empty() {
+                        own.push(OwnEvent {
+                            room: room.clone(),
+                            event_id: event_id.to_string(),
+                            content,
+                        });
+                    }
+                }
+
+                match msgs.end {
+                    Some(end) => from = Some(end),
+                    None => break,
+                }
+            }
+        }
+        eprintln!();
+
+        Ok((uris, own))
+    }
+
+    /// Download `uri` from the old homeserver through ours and upload it
+    /// again; returns the new uri.
+    async fn reupload(&self, uri: &str, mimetype: Option<&str>) -> anyhow::Result<String> {
+        let request = MediaRequest {
+            source: MediaSource::Plain(OwnedMxcUri::from(uri)),
+            format: MediaFormat::File,
+        };
+        let data = self
+            .inner
+            .media()
+            .get_media_content(&request, false)
+            .await?;
+        let content_type = mimetype
+            .and_then(|m| m.parse().ok())
+            .unwrap_or(mime::APPLICATION_OCTET_STREAM);
+        let resp = self.inner.media().upload(&content_type, data).await?;
+        Ok(resp.content_uri.to_string())
+    }
+
+    /// Replace `event` with a copy referencing the migrated media.
+    async fn rewrite_event(
+        &self,
+        event: &OwnEvent,
+        mapping: &BTreeMap<String, String>,
+    ) -> anyhow::Result<String> {
+        let mut new_content = event.content.clone();
+        if let Some(object) = new_content.as_object_mut() {
+            object.remove("m.relates_to");
+        }
+        replace_uris(&mut new_content, mapping);
+        let mut content = new_content.clone();
+        content["m.new_content"] = new_content;
+        content["m.relates_to"] = json!({
+            "rel_type": "m.replace",
+            "event_id": event.event_id,
+        });
+        let resp = event.room.send_raw("m.room.message", content).await?;
+        Ok(resp.event_id.to_string())
+    }
+
+    /// Re-upload the media of `opts.from` which is referenced in the joined
+    /// rooms, pausing between files, and optionally edit our messages to
+    /// reference the new uris. The mapping and progress files make runs
+    /// resumable. Every file and edit is printed as NDJSON; returns the
+    /// number of failures. On `cancel` it stops before the next file or
+    /// edit with `Interrupted`.
+    pub(crate) async fn migrate_media(
+        &self,
+        opts: &MigrateOptions,
+        cancel: &Cancel,
+    ) -> anyhow::Result<usize> {
+        let prefix = format!("mxc://{}/", opts.from);
+        let mut mapping = load_mapping(&opts.mapping)?;
+        let mut mapping_file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&opts.mapping)?;
+        let (uris, own) = self.scan_old_media(&prefix).await?;
+        if cancel.requested() {
+            return Err(Interrupted.into());
+        }
+        let mut failures = 0;
+
+        let mut first = true;
+        for (old, mimetype) in &uris {
+            if mapping.contains_key(old) {
+                continue;
+            }
+            if cancel.requested() {
+                let migrated = uris.keys().filter(|u| mapping.contains_key(*u)).count();
+                eprintln!(
+                    "migrated {} of {} media files with {} failures; run again to resume",
+                    migrated,
+                    uris.len(),
+                    failures
+                );
+                return Err(Interrupted.into());
+            }
+            if !first {
+                sleep(opts.pace).await;
+            }
+            first = false;
+
+            let result = with_retries(|| self.reupload(old, mimetype.as_deref())).await;
+            let migration = match result {
+                Ok(new) => {
+                    let entry = MediaMapping {
+                        old: old.clone(),
+                        new: new.clone(),
+                    };
+                    writeln!(mapping_file, "{}", serde_json::to_string(&entry)?)?;
+                    mapping.insert(old.clone(), new.clone());
+                    MediaMigration {
+                        old: old.clone(),
+                        new: Some(new),
+                        errcode: None,
+                        error: None,
+                    }
+                }
+                Err(e) => {
+                    failures += 1;
+                    MediaMigration {
+                        old: old.clone(),
+                        new: None,
+                        errcode: e.errcode,
+                        error: Some(e.error),
+                    }
+                }
+            };
+            println!("{}", serde_json::to_string(&migration)?);
+        }
+
+        if !opts.rewrite_events {
+            return Ok(failures);
+        }
+        let done: HashSet<String> = match opts.progress {
+            Some(ref path) if path.exists() => fs::read_to_string(path)?
+                .lines()
+                .map(String::from)
+                .collect(),
+            _ => HashSet::new(),
+        };
+        let mut progress = match opts.progress {
+            Some(ref path) => Some(OpenOptions::new().create(true).append(true).open(path)?),
+            None => None,
+        };
+
+        let mut first = true;
+        let pending = own.iter().filter(|e| !done.contains(&e.event_id)).count();
+        let mut rewritten = 0;
+        for event in &own {
+            if done.contains(&event.event_id) {
+                continue;
+            }
+            if cancel.requested() {
+                eprintln!(
+                    "rewrote {} of {} events with {} failures; run again to resume",
+                    rewritten, pending, failures
+                );
+                return Err(Interrupted.into());
+            }
+            let mut missing = BTreeMap::new();
+            collect_uris(&event.content, &prefix, &mut missing);
+            missing.retain(|uri, _| !mapping.contains_key(uri));
+
+            let (edit_event_id, error) = if !missing.is_empty() {
+                let missing: Vec<&str> = missing.keys().map(String::as_str).collect();
+                (None, Some(format!("not migrated: {}", missing.join(", "))))
+            } else {
+                if !first {
+                    sleep(opts.pace).await;
+                }
+                first = false;
+                match with_retries(|| self.rewrite_event(event, &mapping)).await {
+                    Ok(edit_event_id) => (Some(edit_event_id), None),
+                    Err(e) => (None, Some(e.error)),
+                }
+            };
+            if error.is_some() {
+                failures += 1;
+            } else {
+                rewritten += 1;
+                if let Some(ref mut file) = progress {
+                    writeln!(file, "{}", event.event_id)?;
+                }
+            }
+            let rewrite = MediaRewrite {
+                room_id: event.room.room_id().to_string(),
+                event_id: event.event_id.clone(),
+                edit_event_id,
+                error,
+            };
+            println!("{}", serde_json::to_string(&rewrite)?);
+        }
+
+        Ok(failures)
+    }
+}
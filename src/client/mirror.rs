@@ -0,0 +1,436 @@
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::sync::Arc;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::bail;
+use matrix_sdk::media::{MediaFormat, MediaRequest};
+use matrix_sdk::room::Room;
+use matrix_sdk::ruma::events::room::MediaSource;
+use matrix_sdk::ruma::events::AnySyncTimelineEvent;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{EventId, OwnedEventId, OwnedRoomId, UserId};
+use serde_json::{json, Map, Value};
+use tokio::sync::Mutex;
+use tracing::warn;
+
+use crate::format::escape;
+use crate::outputs::MirroredEvent;
+
+/// Content key marking mirrored events; such events are never mirrored
+/// again, which prevents loops between two mirrors.
+const MARKER: &str = "io.github.mnotify.mirror";
+/// Room account data of the destination room mapping source to
+/// destination event ids.
+const MAPPING_TYPE: &str = "io.github.mnotify.mirror";
+
+/// Mappings kept in the account data; at about 100 bytes each, the event
+/// stays well below the 64 KiB limit of events.
+const MAX_MAPPINGS: usize = 500;
+
+const MEDIA_TYPES: [&str; 4] = ["m.image", "m.file", "m.audio", "m.video"];
+
+#[derive(Clone, Debug)]
+pub(crate) struct MirrorOptions {
+    pub(crate) from: OwnedRoomId,
+    pub(crate) to: OwnedRoomId,
+    /// Prepended to the sender attribution
+    pub(crate) prefix: Option<String>,
+    /// Upload media to our homeserver instead of linking the original
+    pub(crate) reupload_media: bool,
+}
+
+/// Source event id to destination event id of the newest mirrored
+/// messages. Older ones are forgotten; replies, edits and redactions of
+/// them are not mirrored anymore.
+#[derive(Debug, Default)]
+struct Mapping {
+    events: HashMap<String, String>,
+    order: VecDeque<String>,
+}
+
+impl Mapping {
+    /// The mapping of the account data content, stored oldest first.
+    fn from_content(content: &Value) -> anyhow::Result<Self> {
+        let mut mapping = Self::default();
+        match content.get("events") {
+            Some(events @ Value::Array(_)) => {
+                let pairs: Vec<(String, String)> = serde_json::from_value(events.clone())?;
+                for (source, dest) in pairs {
+                    mapping.insert(source, dest);
+                }
+            }
+            // Stored without an order by earlier versions.
+            Some(events @ Value::Object(_)) => {
+                let events: BTreeMap<String, String> = serde_json::from_value(events.clone())?;
+                for (source, dest) in events {
+                    mapping.insert(source, dest);
+                }
+            }
+            _ => {}
+        }
+        Ok(mapping)
+    }
+
+    fn to_content(&self) -> Value {
+        let pairs: Vec<(&String, &String)> = self
+            .order
+            .iter()
+            .filter_map(|source| self.events.get(source).map(|dest| (source, dest)))
+            .collect();
+        json!({ "events": pairs })
+    }
+
+    fn get(&self, source: &str) -> Option<&String> {
+        self.events.get(source)
+    }
+
+    fn insert(&mut self, source: String, dest: String) {
+        if self.events.insert(source.clone(), dest).is_none() {
+            self.order.push_back(source);
+        }
+        while self.order.len() > MAX_MAPPINGS {
+            if let Some(old) = self.order.pop_front() {
+                self.events.remove(&old);
+            }
+        }
+    }
+}
+
+struct Mirror {
+    opts: MirrorOptions,
+    source: Room,
+    dest: Room,
+    events: Mutex<Mapping>,
+}
+
+impl super::Client {
+    /// The display name of `user_id` in `room`, falling back to the id.
+    async fn sender_name(&self, room: &Room, user_id: &UserId) -> String {
+        match room.get_member_no_sync(user_id).await {
+            Ok(Some(member)) => member
+                .display_name()
+                .unwrap_or(user_id.as_str())
+                .to_string(),
+            _ => user_id.to_string(),
+        }
+    }
+
+    async fn reupload(&self, content: &mut Map<String, Value>) -> anyhow::Result<()> {
+        let source: MediaSource = match (content.get("url"), content.get("file")) {
+            (Some(url), _) => MediaSource::Plain(serde_json::from_value(url.clone())?),
+            (None, Some(file)) => MediaSource::Encrypted(serde_json::from_value(file.clone())?),
+            (None, None) => return Ok(()),
+        };
+        let mimetype = content
+            .get("info")
+            .and_then(|i| i.get("mimetype"))
+            .and_then(Value::as_str)
+            .unwrap_or("application/octet-stream")
+            .parse::<mime::Mime>()?;
+
+        let request = MediaRequest {
+            source,
+            format: MediaFormat::File,
+        };
+        let data = self
+            .inner
+            .media()
+            .get_media_content(&request, false)
+            .await?;
+        let resp = self.inner.media().upload(&mimetype, data).await?;
+
+        content.remove("file");
+        content.insert(String::from("url"), json!(resp.content_uri));
+        // The thumbnail would still point to the source.
+        if let Some(Value::Object(info)) = content.get_mut("info") {
+            info.remove("thumbnail_url");
+            info.remove("thumbnail_file");
+        }
+        Ok(())
+    }
+
+    /// Rewrite a message content of the source room for the destination:
+    /// attribute the sender, map the relations and mark it as mirrored.
+    async fn mirror_content(
+        &self,
+        mirror: &Mirror,
+        sender: &UserId,
+        source_event_id: &str,
+        mut content: Map<String, Value>,
+    ) -> anyhow::Result<Map<String, Value>> {
+        let name = self.sender_name(&mirror.source, sender).await;
+        let label = match mirror.opts.prefix {
+            Some(ref prefix) => format!("{} {}", prefix, name),
+            None => name,
+        };
+
+        let msgtype = content.get("msgtype").and_then(Value::as_str).unwrap_or("");
+        if MEDIA_TYPES.contains(&msgtype) {
+            // The body becomes the caption; keep the file name.
+            if !content.contains_key("filename") {
+                if let Some(body) = content.get("body").cloned() {
+                    content.insert(String::from("filename"), body);
+                }
+            }
+            if mirror.opts.reupload_media {
+                self.reupload(&mut content).await?;
+            }
+        }
+
+        let body = content.get("body").and_then(Value::as_str).unwrap_or("");
+        let body = format!("{}: {}", label, body);
+        let html = match content.get("formatted_body").and_then(Value::as_str) {
+            Some(html) => html.to_string(),
+            None => escape(content.get("body").and_then(Value::as_str).unwrap_or("")),
+        };
+        let html = format!("<strong>{}</strong>: {}", escape(&label), html);
+        content.insert(String::from("body"), Value::from(body));
+        content.insert(String::from("format"), json!("org.matrix.custom.html"));
+        content.insert(String::from("formatted_body"), Value::from(html));
+
+        // Replies to mirrored events point to their copies; others are
+        // dropped since the original is not visible in the destination.
+        let reply_to = content
+            .get("m.relates_to")
+            .and_then(|r| r.pointer("/m.in_reply_to/event_id"))
+            .and_then(Value::as_str)
+            .map(String::from);
+        content.remove("m.relates_to");
+        if let Some(reply_to) = reply_to {
+            if let Some(mapped) = mirror.events.lock().await.get(&reply_to) {
+                content.insert(
+                    String::from("m.relates_to"),
+                    json!({ "m.in_reply_to": { "event_id": mapped } }),
+                );
+            }
+        }
+        // Mentions of the source room must not notify anyone again.
+        content.remove("m.mentions");
+
+        content.insert(
+            String::from(MARKER),
+            json!({ "room_id": mirror.opts.from, "event_id": source_event_id }),
+        );
+        Ok(content)
+    }
+
+    async fn remember(
+        &self,
+        mirror: &Mirror,
+        source: &str,
+        dest: &OwnedEventId,
+    ) -> anyhow::Result<()> {
+        let mut events = mirror.events.lock().await;
+        events.insert(source.to_string(), dest.to_string());
+        let content = events.to_content();
+        self.put_room_account_data(&mirror.opts.to, MAPPING_TYPE, &content)
+            .await
+    }
+
+    async fn mirror_event(
+        &self,
+        mirror: &Mirror,
+        event: Value,
+    ) -> anyhow::Result<Option<MirroredEvent>> {
+        let field = |key: &str| event.get(key).and_then(Value::as_str).map(String::from);
+        let (Some(event_type), Some(event_id), Some(sender)) =
+            (field("type"), field("event_id"), field("sender"))
+        else {
+            return Ok(None);
+        };
+        let sender = UserId::parse(sender)?;
+
+        match event_type.as_str() {
+            "m.room.message" => {
+                let Some(Value::Object(content)) = event.get("content").cloned() else {
+                    return Ok(None);
+                };
+                if content.contains_key(MARKER) {
+                    return Ok(None);
+                }
+
+                let edited = content
+                    .get("m.relates_to")
+                    .filter(|r| r.get("rel_type").and_then(Value::as_str) == Some("m.replace"))
+                    .and_then(|r| r.get("event_id"))
+                    .and_then(Value::as_str)
+                    .map(String::from);
+
+                let (kind, content) = match edited {
+                    Some(original) => {
+                        let Some(target) = mirror.events.lock().await.get(&original).cloned()
+                        else {
+                            return Ok(None);
+                        };
+                        let new_content = match content.get("m.new_content") {
+                            Some(Value::Object(c)) => c.clone(),
+                            _ => return Ok(None),
+                        };
+                        let new_content = self
+                            .mirror_content(mirror, &sender, &event_id, new_content)
+                            .await?;
+                        let mut content = new_content.clone();
+                        let body = content.get("body").and_then(Value::as_str).unwrap_or("");
+                        content.insert(String::from("body"), Value::from(format!("* {}", body)));
+                        content.insert(String::from("m.new_content"), Value::Object(new_content));
+                        content.insert(
+                            String::from("m.relates_to"),
+                            json!({ "rel_type": "m.replace", "event_id": target }),
+                        );
+                        ("edit", content)
+                    }
+                    None => (
+                        "message",
+                        self.mirror_content(mirror, &sender, &event_id, content)
+                            .await?,
+                    ),
+                };
+
+                let resp = mirror
+                    .dest
+                    .send_raw("m.room.message", Value::Object(content))
+                    .await?;
+                if kind == "message" {
+                    self.remember(mirror, &event_id, &resp.event_id).await?;
+                }
+                Ok(Some(MirroredEvent {
+                    kind,
+                    source_event_id: event_id,
+                    event_id: resp.event_id.to_string(),
+                }))
+            }
+            "m.room.redaction" => {
+                // Room version 11 moved `redacts` into the content.
+                let redacts = field("redacts").or_else(|| {
+                    event
+                        .pointer("/content/redacts")
+                        .and_then(Value::as_str)
+                        .map(String::from)
+                });
+                let Some(redacts) = redacts else {
+                    return Ok(None);
+                };
+                let Some(target) = mirror.events.lock().await.get(&redacts).cloned() else {
+                    return Ok(None);
+                };
+                let reason = event.pointer("/content/reason").and_then(Value::as_str);
+                let target = EventId::parse(&target)?;
+                let resp = mirror.dest.redact(&target, reason, None).await?;
+                Ok(Some(MirroredEvent {
+                    kind: "redaction",
+                    source_event_id: event_id,
+                    event_id: resp.event_id.to_string(),
+                }))
+            }
+            _ => Ok(None),
+        }
+    }
+
+    /// Re-post the messages of one room into another as they arrive,
+    /// including edits and redactions of already mirrored messages.
+    pub(crate) async fn mirror(&self, opts: MirrorOptions) -> anyhow::Result<()> {
+        if opts.from == opts.to {
+            bail!("cannot mirror {} into itself", opts.from);
+        }
+        let source = self.get_joined_room(&opts.from)?;
+        let dest = self.get_joined_room(&opts.to)?;
+
+        let events = match self.get_room_account_data(&opts.to, MAPPING_TYPE).await? {
+            Some(content) => Mapping::from_content(&content)?,
+            None => Mapping::default(),
+        };
+        let started = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_millis() as u64)
+            .unwrap_or(0);
+
+        let mirror = Arc::new(Mirror {
+            opts,
+            source,
+            dest,
+            events: Mutex::new(events),
+        });
+
+        let this = self.clone();
+        let handler_mirror = mirror.clone();
+        self.inner
+            .add_event_handler(move |ev: Raw<AnySyncTimelineEvent>, room: Room| {
+                let this = this.clone();
+                let mirror = handler_mirror.clone();
+                async move {
+                    if room.room_id().as_str() != mirror.opts.from.as_str() {
+                        return;
+                    }
+                    // Never mirror our own posts, and skip the history
+                    // delivered by the initial sync.
+                    if matches!(ev.get_field::<String>("sender"), Ok(Some(s)) if s == this.user_id.as_str())
+                    {
+                        return;
+                    }
+                    if ev.get_field::<u64>("origin_server_ts").ok().flatten() < Some(started) {
+                        return;
+                    }
+                    let Ok(event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    match this.mirror_event(&mirror, event).await {
+                        Ok(Some(mirrored)) => {
+                            if let Ok(out) = serde_json::to_string(&mirrored) {
+                                println!("{}", out);
+                            }
+                        }
+                        Ok(None) => {}
+                        Err(e) => warn!("mirroring event failed: {}", e),
+                    }
+                }
+            });
+
+        self.subscribe(mirror.opts.from.clone());
+        self.sync_forever().await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn forgets_the_oldest_mappings() {
+        let mut mapping = Mapping::default();
+        for i in 0..MAX_MAPPINGS + 2 {
+            mapping.insert(format!("$s{}", i), format!("$d{}", i));
+        }
+        assert_eq!(mapping.events.len(), MAX_MAPPINGS);
+        assert!(mapping.get("$s0").is_none());
+        assert!(mapping.get("$s1").is_none());
+        assert_eq!(mapping.get("$s2").unwrap(), "$d2");
+
+        // Mapping an event again keeps its place.
+        mapping.insert(String::from("$s2"), String::from("$other"));
+        mapping.insert(String::from("$new"), String::from("$d"));
+        assert!(mapping.get("$s2").is_none());
+        assert_eq!(mapping.order.len(), MAX_MAPPINGS);
+    }
+
+    #[test]
+    fn stores_oldest_first() {
+        let mut mapping = Mapping::default();
+        mapping.insert(String::from("$b"), String::from("$1"));
+        mapping.insert(String::from("$a"), String::from("$2"));
+        let content = mapping.to_content();
+        assert_eq!(content, json!({"events": [["$b", "$1"], ["$a", "$2"]]}));
+
+        let mapping = Mapping::from_content(&content).unwrap();
+        assert_eq!(mapping.order, ["$b", "$a"]);
+        assert_eq!(mapping.get("$a").unwrap(), "$2");
+    }
+
+    #[test]
+    fn reads_unordered_mappings() {
+        let content = json!({"events": {"$a": "$1", "$b": "$2"}});
+        let mapping = Mapping::from_content(&content).unwrap();
+        assert_eq!(mapping.get("$b").unwrap(), "$2");
+        assert_eq!(mapping.order.len(), 2);
+        assert!(Mapping::from_content(&json!({})).unwrap().events.is_empty());
+    }
+}
@@ -1,17 +1,74 @@
+use std::collections::HashMap;
 use std::ops::Deref;
+use std::sync::{Arc, Mutex};
 
-use matrix_sdk::ruma::{OwnedDeviceId, OwnedUserId};
+use matrix_sdk::ruma::{
+    OwnedDeviceId, OwnedRoomAliasId, OwnedRoomId, OwnedTransactionId, OwnedUserId, RoomId,
+};
 use matrix_sdk::{Client as MatrixClient, SlidingSync};
 use serde::Serialize;
 
 use crate::CRATE_NAME;
 
+pub mod ack;
+pub mod alias;
+pub mod api;
+pub mod approve;
+pub mod archive;
+pub mod audit;
+pub mod batch;
+pub mod bridge;
 pub mod builder;
+pub mod cache;
+pub mod calls;
+pub mod config;
+pub mod cursor;
+pub mod decrypt;
+pub mod dedupe;
+pub mod direct;
+pub mod download;
+pub mod ephemeral;
+pub mod extremities;
+pub mod follow;
+pub mod health;
+pub mod history;
+pub mod identity;
+pub mod init;
+pub mod invite;
+pub mod join;
+pub mod keys;
+pub mod lock;
 pub mod login;
+pub mod media;
+pub mod members;
+pub mod mentions;
+pub mod migrate;
+pub mod mirror;
+pub mod oauth;
+pub mod oversize;
+pub mod power;
+pub mod publish;
+pub mod push;
+pub mod react;
 pub mod room;
 pub mod sas;
+pub mod schedule;
 pub mod session;
+pub mod signing;
+pub mod snapshot;
+pub mod space;
+pub mod spec;
+pub mod spool;
+pub mod state;
+pub mod stats;
+pub mod stream;
+pub mod synapse;
 pub mod sync;
+pub mod todevice;
+pub mod tombstone;
+pub mod triage;
+pub mod vault;
+pub mod whois;
 
 // Copy of the ruma Response type; the origninal type does not
 // implement Serialize.
@@ -26,9 +83,35 @@ pub(crate) struct WhoamiResponse {
 #[derive(Clone)]
 pub(crate) struct Client {
     inner: MatrixClient,
+    /// Shared with `inner`, see `builder::transport`
+    http: reqwest::Client,
     user_id: OwnedUserId,
     device_name: String,
     pub sliding_sync: Option<SlidingSync>,
+    /// Sender profile attached to sent messages
+    identity: Option<identity::Identity>,
+    /// Users and the room pinged by sent messages
+    mentions: Option<mentions::Mentions>,
+    /// Print messages instead of sending them
+    preview: bool,
+    /// Snapshot of the room previewed to, instead of the joined room
+    fixture: Option<Arc<snapshot::RoomFixture>>,
+    /// Suppress messages identical to recently sent ones
+    dedupe: Option<dedupe::Dedupe>,
+    /// Add friendly senders to events of bridge ghost users
+    bridges: Option<bridge::BridgeSenders>,
+    /// What happens to messages too large for one event
+    oversize: oversize::Oversize,
+    /// Updated by the sync loop for `--max-lag` and health reports
+    sync_health: Option<Arc<health::SyncHealth>>,
+    /// Arrival times and `ts_suspect` of synced events
+    skew: crate::skew::Skew,
+    /// Transaction id of the next message, instead of a random one
+    txn_id: Option<OwnedTransactionId>,
+    /// Send messages unencrypted, also to encrypted rooms
+    plaintext: bool,
+    /// Room ids of the aliases resolved for room arguments
+    aliases: Arc<Mutex<HashMap<OwnedRoomAliasId, OwnedRoomId>>>,
 }
 
 impl Client {
@@ -36,6 +119,64 @@ impl Client {
         builder::ClientBuilder::default()
     }
 
+    pub(crate) fn with_identity(mut self, identity: identity::Identity) -> Self {
+        self.identity = Some(identity);
+        self
+    }
+
+    pub(crate) fn with_mentions(mut self, mentions: mentions::Mentions) -> Self {
+        self.mentions = Some(mentions);
+        self
+    }
+
+    pub(crate) fn with_preview(mut self) -> Self {
+        self.preview = true;
+        self
+    }
+
+    /// Preview against the room of `fixture`; the client need not be
+    /// connected then.
+    pub(crate) fn with_fixture(mut self, fixture: snapshot::RoomFixture) -> Self {
+        self.preview = true;
+        self.fixture = Some(Arc::new(fixture));
+        self
+    }
+
+    /// The room of the fixture previewed to, if any.
+    pub(crate) fn fixture_room(&self) -> Option<&RoomId> {
+        self.fixture.as_deref().map(|f| &*f.room_id)
+    }
+
+    pub(crate) fn with_plaintext(mut self) -> Self {
+        self.plaintext = true;
+        self
+    }
+
+    pub(crate) fn with_dedupe(mut self, dedupe: dedupe::Dedupe) -> Self {
+        self.dedupe = Some(dedupe);
+        self
+    }
+
+    pub(crate) fn with_oversize(mut self, oversize: oversize::Oversize) -> Self {
+        self.oversize = oversize;
+        self
+    }
+
+    pub(crate) fn with_transaction_id(mut self, txn_id: OwnedTransactionId) -> Self {
+        self.txn_id = Some(txn_id);
+        self
+    }
+
+    pub(crate) fn with_bridge_senders(mut self, bridges: bridge::BridgeSenders) -> Self {
+        self.bridges = Some(bridges);
+        self
+    }
+
+    pub(crate) fn with_skew(mut self, skew: crate::skew::Skew) -> Self {
+        self.skew = skew;
+        self
+    }
+
     pub(crate) async fn connect(&self) -> anyhow::Result<()> {
         if let Ok(Some(session)) = session::load_session(&self.user_id) {
             self.inner.matrix_auth().restore_session(session).await?;
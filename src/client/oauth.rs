@@ -0,0 +1,250 @@
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, bail};
+use matrix_sdk::matrix_auth::{MatrixSession, MatrixSessionTokens};
+use matrix_sdk::ruma::DeviceId;
+use matrix_sdk::SessionMeta;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use tokio::time::sleep;
+
+use super::session::Meta;
+use crate::CRATE_NAME;
+
+const DEVICE_CODE_GRANT: &str = "urn:ietf:params:oauth:grant-type:device_code";
+const API_SCOPE: &str = "urn:matrix:org.matrix.msc2967.client:api:*";
+const DEVICE_SCOPE: &str = "urn:matrix:org.matrix.msc2967.client:device:";
+const ADMIN_SCOPE: &str = "urn:synapse:admin:*";
+
+/// The OAuth 2.0 client of this login, stored in meta.json to refresh
+/// the access token.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+pub(crate) struct OAuthMeta {
+    pub(crate) issuer: String,
+    pub(crate) client_id: String,
+    pub(crate) token_endpoint: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct TokenResponse {
+    access_token: String,
+    refresh_token: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct DeviceAuthorization {
+    device_code: String,
+    user_code: String,
+    verification_uri: String,
+    verification_uri_complete: Option<String>,
+    expires_in: u64,
+    interval: Option<u64>,
+}
+
+// Errors defined by RFC 6749 and RFC 8628.
+#[derive(Debug, Deserialize)]
+struct OAuthError {
+    error: String,
+    error_description: Option<String>,
+}
+
+async fn post_form(
+    http: &reqwest::Client,
+    url: &str,
+    form: &[(&str, &str)],
+) -> anyhow::Result<Result<Value, OAuthError>> {
+    let resp = http.post(url).form(form).send().await?;
+    if resp.status().is_success() {
+        return Ok(Ok(resp.json().await?));
+    }
+    let status = resp.status();
+    let raw = resp.bytes().await?;
+    match serde_json::from_slice::<OAuthError>(&raw) {
+        Ok(e) => Ok(Err(e)),
+        Err(_) => bail!("{} failed: HTTP {}", url, status),
+    }
+}
+
+fn describe(e: &OAuthError) -> String {
+    match e.error_description {
+        Some(ref description) => format!("{}: {}", e.error, description),
+        None => e.error.clone(),
+    }
+}
+
+impl super::Client {
+    /// The issuer of the authentication service, if the homeserver
+    /// delegates authentication (MSC2965).
+    async fn auth_issuer(&self, http: &reqwest::Client) -> anyhow::Result<String> {
+        let homeserver = self.inner.homeserver();
+        let url = format!(
+            "{}_matrix/client/unstable/org.matrix.msc2965/auth_issuer",
+            homeserver
+        );
+        let resp = http.get(url).send().await?;
+        if resp.status().is_success() {
+            let body: Value = resp.json().await?;
+            if let Some(issuer) = body.get("issuer").and_then(Value::as_str) {
+                return Ok(issuer.to_string());
+            }
+        }
+
+        let url = format!(
+            "https://{}/.well-known/matrix/client",
+            self.user_id.server_name()
+        );
+        let well_known: Value = http.get(url).send().await?.json().await?;
+        well_known
+            .pointer("/org.matrix.msc2965.authentication/issuer")
+            .and_then(Value::as_str)
+            .map(String::from)
+            .ok_or_else(|| anyhow!("the homeserver does not announce an OAuth 2.0 issuer"))
+    }
+
+    /// Log in with the OAuth 2.0 device authorization grant; the user
+    /// confirms the login in a browser, possibly on another device.
+    pub(crate) async fn login_oauth(&self, admin: bool) -> anyhow::Result<OAuthMeta> {
+        let http = self.http_client();
+        let issuer = self.auth_issuer(&http).await?;
+        let discovery_url = format!(
+            "{}/.well-known/openid-configuration",
+            issuer.trim_end_matches('/')
+        );
+        let discovery: Value = http.get(discovery_url).send().await?.json().await?;
+        let endpoint = |key: &str| {
+            discovery
+                .get(key)
+                .and_then(Value::as_str)
+                .map(String::from)
+                .ok_or_else(|| anyhow!("the issuer {} has no {}", issuer, key))
+        };
+        let registration_endpoint = endpoint("registration_endpoint")?;
+        let device_endpoint = endpoint("device_authorization_endpoint")?;
+        let token_endpoint = endpoint("token_endpoint")?;
+
+        // Native clients register dynamically (MSC2966).
+        let metadata = json!({
+            "client_name": CRATE_NAME,
+            "client_uri": "https://github.com/rumpelsepp/mnotify",
+            "application_type": "native",
+            "grant_types": [DEVICE_CODE_GRANT, "refresh_token"],
+            "response_types": [],
+            "token_endpoint_auth_method": "none",
+        });
+        let registration: Value = http
+            .post(&registration_endpoint)
+            .json(&metadata)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await?;
+        let client_id = registration
+            .get("client_id")
+            .and_then(Value::as_str)
+            .ok_or_else(|| anyhow!("client registration returned no client_id"))?
+            .to_string();
+
+        let device_id = DeviceId::new();
+        let mut scope = format!("openid {} {}{}", API_SCOPE, DEVICE_SCOPE, device_id);
+        if admin {
+            scope = format!("{} {}", scope, ADMIN_SCOPE);
+        }
+
+        let authorization = post_form(
+            &http,
+            &device_endpoint,
+            &[("client_id", client_id.as_str()), ("scope", scope.as_str())],
+        )
+        .await?
+        .map_err(|e| anyhow!("device authorization failed: {}", describe(&e)))?;
+        let authorization: DeviceAuthorization = serde_json::from_value(authorization)?;
+
+        match authorization.verification_uri_complete {
+            Some(ref uri) => eprintln!("open {} to confirm the login", uri),
+            None => eprintln!(
+                "open {} and enter the code {}",
+                authorization.verification_uri, authorization.user_code
+            ),
+        }
+
+        let deadline = Instant::now() + Duration::from_secs(authorization.expires_in);
+        let mut interval = Duration::from_secs(authorization.interval.unwrap_or(5));
+        let tokens = loop {
+            if Instant::now() > deadline {
+                bail!("the device code expired before the login was confirmed");
+            }
+            sleep(interval).await;
+
+            let form = [
+                ("grant_type", DEVICE_CODE_GRANT),
+                ("device_code", authorization.device_code.as_str()),
+                ("client_id", client_id.as_str()),
+            ];
+            match post_form(&http, &token_endpoint, &form).await? {
+                Ok(tokens) => break serde_json::from_value::<TokenResponse>(tokens)?,
+                Err(e) if e.error == "authorization_pending" => {}
+                Err(e) if e.error == "slow_down" => interval += Duration::from_secs(5),
+                Err(e) => bail!("login failed: {}", describe(&e)),
+            }
+        };
+
+        let session = MatrixSession {
+            meta: SessionMeta {
+                user_id: self.user_id.clone(),
+                device_id,
+            },
+            tokens: MatrixSessionTokens {
+                access_token: tokens.access_token,
+                refresh_token: tokens.refresh_token,
+            },
+        };
+        self.inner.matrix_auth().restore_session(session).await?;
+
+        let whoami = self.inner.whoami().await?;
+        if whoami.user_id != self.user_id {
+            bail!(
+                "logged in as {} instead of {}",
+                whoami.user_id,
+                self.user_id
+            );
+        }
+        self.persist_session()?;
+
+        Ok(OAuthMeta {
+            issuer,
+            client_id,
+            token_endpoint,
+        })
+    }
+
+    /// Refresh the access token at the token endpoint of the issuer.
+    pub(crate) async fn refresh_oauth_session(&self, oauth: &OAuthMeta) -> anyhow::Result<bool> {
+        let auth = self.inner.matrix_auth();
+        let Some(refresh_token) = auth.refresh_token() else {
+            return Ok(false);
+        };
+
+        let form = [
+            ("grant_type", "refresh_token"),
+            ("refresh_token", refresh_token.as_str()),
+            ("client_id", oauth.client_id.as_str()),
+        ];
+        let tokens = post_form(&self.http_client(), &oauth.token_endpoint, &form)
+            .await?
+            .map_err(|e| anyhow!("refreshing the access token failed: {}", describe(&e)))?;
+        let tokens: TokenResponse = serde_json::from_value(tokens)?;
+
+        auth.set_session_tokens(MatrixSessionTokens {
+            access_token: tokens.access_token,
+            refresh_token: tokens.refresh_token.or(Some(refresh_token)),
+        });
+        self.persist_session()?;
+        Ok(true)
+    }
+}
+
+/// The OAuth 2.0 client of the current login, if any.
+pub(crate) fn stored_meta() -> Option<OAuthMeta> {
+    Meta::load().ok().and_then(|m| m.oauth)
+}
@@ -0,0 +1,196 @@
+use anyhow::bail;
+use clap::ValueEnum;
+use matrix_sdk::attachment::AttachmentConfig;
+use matrix_sdk::ruma::OwnedEventId;
+use serde_json::Value;
+
+use super::room::Target;
+
+/// Events may have at most 64 KiB; the content gets this much of it, the
+/// rest is left for the envelope with sender, hashes and signatures.
+const MAX_CONTENT: usize = 60 * 1024;
+
+/// File name of messages sent with `Oversize::Upload`.
+const UPLOAD_NAME: &str = "message.txt";
+
+/// Lines and characters of an uploaded message quoted in its summary.
+const SUMMARY_LINES: usize = 5;
+const SUMMARY_CHARS: usize = 500;
+
+/// What happens to messages too large for one event.
+#[derive(Clone, Copy, Debug, Default, PartialEq, ValueEnum)]
+pub(crate) enum Oversize {
+    /// Fail with the measured size
+    #[default]
+    Error,
+    /// Send the body in several messages
+    Split,
+    /// Upload the body as text file after a summary
+    Upload,
+}
+
+/// Bytes of `c` in a JSON string, as serde_json escapes it.
+fn json_len(c: char) -> usize {
+    match c {
+        '"' | '\\' | '\n' | '\r' | '\t' | '\u{8}' | '\u{c}' => 2,
+        c if (c as u32) < 0x20 => 6,
+        c => c.len_utf8(),
+    }
+}
+
+/// Split `body` into parts of at most `budget` bytes when JSON encoded;
+/// at line ends where that does not leave parts mostly empty, and never
+/// inside a character.
+fn split_body(body: &str, budget: usize) -> Vec<&str> {
+    let mut parts = vec![];
+    let mut rest = body;
+    while !rest.is_empty() {
+        let mut len = 0;
+        let mut end = rest.len();
+        let mut line_end = None;
+        for (i, c) in rest.char_indices() {
+            if len + json_len(c) > budget {
+                end = i;
+                break;
+            }
+            len += json_len(c);
+            if c == '\n' {
+                line_end = Some(i + 1);
+            }
+        }
+        if end < rest.len() {
+            if let Some(line_end) = line_end.filter(|&n| n > end / 2) {
+                end = line_end;
+            }
+        }
+        let (part, tail) = rest.split_at(end);
+        parts.push(part.strip_suffix('\n').unwrap_or(part));
+        rest = tail;
+    }
+    parts
+}
+
+/// `content` with the plain `body` only, without its html version.
+fn plain_content(content: &Value, body: &str) -> Value {
+    let mut content = content.clone();
+    if let Some(object) = content.as_object_mut() {
+        object.remove("format");
+        object.remove("formatted_body");
+        object.insert(String::from("body"), Value::from(body));
+    }
+    content
+}
+
+fn json_size(content: &Value) -> anyhow::Result<usize> {
+    Ok(serde_json::to_vec(content)?.len())
+}
+
+impl super::Client {
+    /// The most bytes of JSON a message content to `room` may have.
+    /// Encrypted contents grow by a third as base64 ciphertext.
+    pub(super) async fn content_limit(&self, room: &Target) -> anyhow::Result<usize> {
+        if room.is_encrypted().await? {
+            Ok(MAX_CONTENT / 4 * 3)
+        } else {
+            Ok(MAX_CONTENT)
+        }
+    }
+
+    /// Handle a message content which exceeds `limit` with its `size`;
+    /// `content` is without the sender profile yet. Returns the event id
+    /// of the last message sent.
+    pub(super) async fn post_oversized(
+        &self,
+        room: &Target,
+        content: Value,
+        size: usize,
+        limit: usize,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        match self.oversize {
+            Oversize::Error => bail!(
+                "the message has {} bytes of JSON, more than the {} bytes an event may have; \
+                 use --split or --overflow upload",
+                size,
+                limit
+            ),
+            Oversize::Split => self.post_split(room, content, limit).await,
+            Oversize::Upload => self.post_upload(room, content).await,
+        }
+    }
+
+    /// Send the body of `content` in as many messages as needed. The html
+    /// version is dropped, as splitting it could break its markup.
+    async fn post_split(
+        &self,
+        room: &Target,
+        content: Value,
+        limit: usize,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let body = content
+            .get("body")
+            .and_then(Value::as_str)
+            .unwrap_or("")
+            .to_string();
+        let measure = |body: &str| json_size(&self.with_profile(plain_content(&content, body)));
+
+        // The profile repeats the body in its html fallback; scale the
+        // budget by what the body costs in the content which is sent.
+        let overhead = measure("")?;
+        let encoded: usize = body.chars().map(json_len).sum();
+        let cost = measure(&body)?.saturating_sub(overhead).max(1);
+        let budget = limit.saturating_sub(overhead) * encoded / cost;
+        if budget < 64 {
+            bail!("the message leaves no room for its body in an event");
+        }
+
+        let mut event_id = None;
+        for part in split_body(&body, budget) {
+            let part = self.with_profile(plain_content(&content, part));
+            let size = json_size(&part)?;
+            if size > limit {
+                bail!("a part of the split message still has {} bytes", size);
+            }
+            event_id = self.post_content(room, part).await?;
+        }
+        Ok(event_id)
+    }
+
+    /// Upload the body of `content` as text file, sent after a summary of
+    /// its first lines; the attachment is sent without sender profile.
+    async fn post_upload(
+        &self,
+        room: &Target,
+        content: Value,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let body = content
+            .get("body")
+            .and_then(Value::as_str)
+            .unwrap_or("")
+            .to_string();
+        let mut summary: String = body
+            .lines()
+            .take(SUMMARY_LINES)
+            .collect::<Vec<_>>()
+            .join("\n")
+            .chars()
+            .take(SUMMARY_CHARS)
+            .collect();
+        summary.push_str(&format!("\n… ({} bytes, see {})", body.len(), UPLOAD_NAME));
+        let summary = self.with_profile(plain_content(&content, &summary));
+        self.post_content(room, summary).await?;
+        if self.preview {
+            return Ok(None);
+        }
+
+        let resp = room
+            .joined()?
+            .send_attachment(
+                UPLOAD_NAME,
+                &mime::TEXT_PLAIN_UTF_8,
+                body.into_bytes(),
+                AttachmentConfig::default(),
+            )
+            .await?;
+        Ok(Some(resp.event_id))
+    }
+}
@@ -0,0 +1,171 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+
+use anyhow::{anyhow, bail};
+use matrix_sdk::ruma::RoomId;
+use serde_json::{json, Map, Value};
+
+use super::CRATE_NAME;
+use crate::outputs::{PowerChange, PowerPresetSummary};
+
+const ADMIN_LEVEL: i64 = 100;
+
+// Defaults of the spec for keys missing in m.room.power_levels.
+fn default_level(key: &str) -> Option<Value> {
+    match key {
+        "ban" | "kick" | "redact" | "state_default" => Some(json!(50)),
+        "events_default" | "invite" | "users_default" => Some(json!(0)),
+        _ => None,
+    }
+}
+
+/// Named partial m.room.power_levels contents from
+/// `$XDG_CONFIG_HOME/mnotify/power-presets.yaml`.
+fn load_presets() -> anyhow::Result<BTreeMap<String, Map<String, Value>>> {
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+    let Some(path) = xdg_dirs.find_config_file("power-presets.yaml") else {
+        return Ok(BTreeMap::new());
+    };
+    match fs::read_to_string(path) {
+        Ok(raw) => Ok(serde_yaml::from_str(&raw)?),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// A validated preset of partial m.room.power_levels content.
+pub(crate) struct PowerPreset {
+    name: String,
+    levels: Map<String, Value>,
+}
+
+impl PowerPreset {
+    /// Load the preset `name` and check that all its levels are integers.
+    pub(crate) fn load(name: &str) -> anyhow::Result<Self> {
+        let levels = load_presets()?
+            .remove(name)
+            .ok_or_else(|| anyhow!("no power level preset named {}", name))?;
+        for (key, value) in &levels {
+            let nested = matches!(key.as_str(), "events" | "notifications" | "users");
+            let valid = match value {
+                Value::Object(levels) if nested => levels.values().all(|v| v.is_i64()),
+                value => !nested && value.is_i64(),
+            };
+            if !valid {
+                bail!(
+                    "power level preset {}: {} must be {}",
+                    name,
+                    key,
+                    if nested {
+                        "a map of integer levels"
+                    } else {
+                        "an integer level"
+                    }
+                );
+            }
+        }
+        Ok(Self {
+            name: name.to_string(),
+            levels,
+        })
+    }
+
+    /// Fail if applying the preset to a room created by `user_id` would
+    /// demote them below admin, before the room is created.
+    pub(crate) fn check_new_room(&self, user_id: &str) -> anyhow::Result<()> {
+        let mut content = Map::new();
+        content.insert(String::from("users"), json!({ user_id: ADMIN_LEVEL }));
+        merge(&mut content, &self.levels);
+        let after = user_level(&content, user_id);
+        if after < ADMIN_LEVEL {
+            bail!(
+                "preset {} would lower our power level in the new room to {}",
+                self.name,
+                after
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Merge `preset` into `content`; nested objects like `events` and
+/// `users` are merged key by key. Returns the changed keys.
+fn merge(content: &mut Map<String, Value>, preset: &Map<String, Value>) -> Vec<PowerChange> {
+    let mut changes = vec![];
+    for (key, value) in preset {
+        match (content.get_mut(key), value) {
+            (Some(Value::Object(current)), Value::Object(nested)) => {
+                for mut change in merge(current, nested) {
+                    change.key = format!("{}.{}", key, change.key);
+                    changes.push(change);
+                }
+            }
+            (current, value) => {
+                let before = current
+                    .cloned()
+                    .or_else(|| default_level(key))
+                    .unwrap_or(Value::Null);
+                if &before != value {
+                    changes.push(PowerChange {
+                        key: key.clone(),
+                        before,
+                        after: value.clone(),
+                    });
+                    content.insert(key.clone(), value.clone());
+                }
+            }
+        }
+    }
+    changes
+}
+
+fn user_level(content: &Map<String, Value>, user_id: &str) -> i64 {
+    content
+        .get("users")
+        .and_then(|u| u.get(user_id))
+        .or_else(|| content.get("users_default"))
+        .and_then(Value::as_i64)
+        .unwrap_or(0)
+}
+
+impl super::Client {
+    /// Apply the power level preset to a room. Refuses to demote ourselves
+    /// below admin unless `force` is set.
+    pub(crate) async fn apply_power_preset(
+        &self,
+        room_id: &RoomId,
+        preset: &PowerPreset,
+        force: bool,
+    ) -> anyhow::Result<PowerPresetSummary> {
+        let name = &preset.name;
+        let mut content = match self.get_state(room_id, "m.room.power_levels", "").await? {
+            Some(Value::Object(content)) => content,
+            _ => Map::new(),
+        };
+        let before = user_level(&content, self.user_id.as_str());
+        let changes = merge(&mut content, &preset.levels);
+        let after = user_level(&content, self.user_id.as_str());
+
+        if before >= ADMIN_LEVEL && after < ADMIN_LEVEL && !force {
+            bail!(
+                "preset {} would lower our power level in {} from {} to {}; use --force",
+                name,
+                room_id,
+                before,
+                after
+            );
+        }
+
+        if !changes.is_empty() {
+            self.put_state(room_id, "m.room.power_levels", "", &Value::Object(content))
+                .await?;
+        }
+
+        Ok(PowerPresetSummary {
+            room_id: room_id.to_string(),
+            preset: name.to_string(),
+            changes,
+        })
+    }
+}
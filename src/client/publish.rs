@@ -0,0 +1,375 @@
+use std::collections::BTreeSet;
+
+use anyhow::bail;
+use matrix_sdk::ruma::api::client::directory::set_room_visibility;
+use matrix_sdk::ruma::api::client::room::Visibility;
+use matrix_sdk::ruma::api::client::space::SpaceHierarchyRoomsChunk;
+use matrix_sdk::ruma::events::room::message::RoomMessageEventContent;
+use matrix_sdk::ruma::{OwnedEventId, OwnedRoomId, RoomId};
+use serde_json::{json, Value};
+
+use crate::format;
+use crate::outputs::PublishStep;
+
+/// Join rules `--children-join-rule` and `--join-rule` accept.
+pub(crate) const JOIN_RULES: [&str; 5] = [
+    "public",
+    "restricted",
+    "knock",
+    "knock_restricted",
+    "invite",
+];
+
+/// How `publish_space` opens a space.
+#[derive(Debug)]
+pub(crate) struct PublishOptions {
+    /// Children whose join rule is changed; all direct children if empty
+    pub(crate) children: Vec<OwnedRoomId>,
+    pub(crate) children_join_rule: Option<String>,
+    /// Room the index of the children is posted and pinned in
+    pub(crate) index_room: Option<OwnedRoomId>,
+    pub(crate) continue_on_error: bool,
+}
+
+/// How `unpublish_space` closes a space again.
+#[derive(Debug)]
+pub(crate) struct UnpublishOptions {
+    pub(crate) join_rule: String,
+    /// Join rule of the children which are public now
+    pub(crate) children_join_rule: String,
+    /// Room whose pinned messages of ours are unpinned
+    pub(crate) unpin_room: Option<OwnedRoomId>,
+    pub(crate) continue_on_error: bool,
+}
+
+/// A direct child of a space, from its m.space.child event.
+struct Child {
+    room_id: OwnedRoomId,
+    via: Vec<String>,
+    order: Option<String>,
+    suggested: bool,
+    ts: u64,
+}
+
+/// The direct children of the space in the first chunk of `hierarchy`,
+/// in the order of the spec: by `order`, then by the time they were
+/// added.
+fn direct_children(hierarchy: &[SpaceHierarchyRoomsChunk]) -> Vec<Child> {
+    let mut children: Vec<Child> = hierarchy
+        .first()
+        .into_iter()
+        .flat_map(|space| &space.children_state)
+        .filter_map(|raw| {
+            let event = raw.deserialize_as::<Value>().ok()?;
+            let room_id = event.get("state_key")?.as_str()?.parse().ok()?;
+            let content = event.get("content")?;
+            let via: Vec<String> = content
+                .get("via")?
+                .as_array()?
+                .iter()
+                .filter_map(|v| v.as_str().map(String::from))
+                .collect();
+            // Children without via are removed.
+            if via.is_empty() {
+                return None;
+            }
+            let order = content
+                .get("order")
+                .and_then(Value::as_str)
+                .filter(|o| o.len() <= 50 && o.chars().all(|c| (' '..='~').contains(&c)))
+                .map(String::from);
+            Some(Child {
+                room_id,
+                via,
+                order,
+                suggested: content.get("suggested").and_then(Value::as_bool) == Some(true),
+                ts: event
+                    .get("origin_server_ts")
+                    .and_then(Value::as_u64)
+                    .unwrap_or(0),
+            })
+        })
+        .collect();
+    children.sort_by(|a, b| {
+        let key = |c: &Child| (c.order.is_none(), c.order.clone(), c.ts, c.room_id.clone());
+        key(a).cmp(&key(b))
+    });
+    children
+}
+
+/// The content of m.room.join_rules; restricted rules allow the members
+/// of `space_id`.
+fn join_rule_content(join_rule: &str, space_id: &RoomId) -> Value {
+    match join_rule {
+        "restricted" | "knock_restricted" => json!({
+            "join_rule": join_rule,
+            "allow": [{ "type": "m.room_membership", "room_id": space_id }],
+        }),
+        _ => json!({ "join_rule": join_rule }),
+    }
+}
+
+/// A matrix.to link of a room, by alias if it has one.
+fn room_link(chunk: &SpaceHierarchyRoomsChunk, via: &[String]) -> String {
+    match chunk.canonical_alias {
+        Some(ref alias) => format!("https://matrix.to/#/{}", alias),
+        None => {
+            let via: Vec<String> = via.iter().map(|v| format!("via={}", v)).collect();
+            format!("https://matrix.to/#/{}?{}", chunk.room_id, via.join("&"))
+        }
+    }
+}
+
+/// A markdown index of the children of a space; suggested rooms first.
+/// The names and topics come from the rooms, so they are escaped.
+fn index_message(hierarchy: &[SpaceHierarchyRoomsChunk], children: &[Child]) -> String {
+    let space_name = hierarchy
+        .first()
+        .and_then(|space| space.name.clone())
+        .unwrap_or_else(|| String::from("the space"));
+    let mut out = format!("**Welcome to {}!**\n", format::escape_markdown(&space_name));
+
+    for (title, suggested) in [("Start here", true), ("Rooms", false)] {
+        let lines: Vec<String> = children
+            .iter()
+            .filter(|c| c.suggested == suggested)
+            .filter_map(|c| {
+                let chunk = hierarchy.iter().find(|r| r.room_id == c.room_id)?;
+                let name = chunk.name.clone().unwrap_or_else(|| c.room_id.to_string());
+                let mut line = format!(
+                    "- [{}]({})",
+                    format::escape_markdown(&name),
+                    room_link(chunk, &c.via)
+                );
+                if let Some(ref topic) = chunk.topic {
+                    let topic = topic.lines().next().unwrap_or("");
+                    line += &format!(": {}", format::escape_markdown(topic));
+                }
+                Some(line)
+            })
+            .collect();
+        if !lines.is_empty() {
+            out += &format!("\n{}:\n\n{}\n", title, lines.join("\n"));
+        }
+    }
+    out
+}
+
+/// Record the outcome of a step; returns whether to go on.
+fn record(
+    steps: &mut Vec<PublishStep>,
+    step: &'static str,
+    room_id: &RoomId,
+    result: anyhow::Result<Option<String>>,
+    continue_on_error: bool,
+) -> bool {
+    let (detail, error) = match result {
+        Ok(detail) => (detail, None),
+        Err(e) => (None, Some(e.to_string())),
+    };
+    let ok = error.is_none();
+    steps.push(PublishStep {
+        step,
+        room_id: room_id.to_string(),
+        detail,
+        error,
+    });
+    ok || continue_on_error
+}
+
+impl super::Client {
+    async fn set_directory_visibility(
+        &self,
+        room_id: &RoomId,
+        visibility: Visibility,
+    ) -> anyhow::Result<Option<String>> {
+        let detail = visibility.as_str().to_string();
+        let request = set_room_visibility::v3::Request::new(room_id.to_owned(), visibility);
+        self.inner.send(request, None).await?;
+        Ok(Some(detail))
+    }
+
+    async fn set_join_rule(
+        &self,
+        room_id: &RoomId,
+        join_rule: &str,
+        space_id: &RoomId,
+    ) -> anyhow::Result<Option<String>> {
+        let content = join_rule_content(join_rule, space_id);
+        self.put_state(room_id, "m.room.join_rules", "", &content)
+            .await?;
+        Ok(Some(join_rule.to_string()))
+    }
+
+    /// Post the markdown `body` to `room_id` and add it to the pinned
+    /// events. HTML in it is escaped.
+    async fn post_pinned(&self, room_id: &RoomId, body: &str) -> anyhow::Result<OwnedEventId> {
+        let room = self.get_joined_room(room_id)?;
+        let content = match format::markdown(body) {
+            Some(f) => RoomMessageEventContent::text_html(f.plain, f.html),
+            None => RoomMessageEventContent::text_plain(body),
+        };
+        let resp = room.send(content).await?;
+        let mut pinned = self
+            .get_state(room_id, "m.room.pinned_events", "")
+            .await?
+            .and_then(|c| c.get("pinned").and_then(Value::as_array).cloned())
+            .unwrap_or_default();
+        pinned.push(Value::from(resp.event_id.as_str()));
+        self.put_state(
+            room_id,
+            "m.room.pinned_events",
+            "",
+            &json!({ "pinned": pinned }),
+        )
+        .await?;
+        Ok(resp.event_id)
+    }
+
+    /// Unpin the pinned messages of `room_id` which we sent; returns how
+    /// many.
+    async fn unpin_own(&self, room_id: &RoomId) -> anyhow::Result<usize> {
+        let room = self.get_joined_room(room_id)?;
+        let pinned = self
+            .get_state(room_id, "m.room.pinned_events", "")
+            .await?
+            .and_then(|c| c.get("pinned").and_then(Value::as_array).cloned())
+            .unwrap_or_default();
+        let mut keep = vec![];
+        for event_id in &pinned {
+            let ours = match event_id.as_str().map(OwnedEventId::try_from) {
+                Some(Ok(event_id)) => match room.event(&event_id).await {
+                    Ok(event) => {
+                        event.event.get_field::<String>("sender")?.as_deref()
+                            == Some(self.user_id.as_str())
+                    }
+                    Err(_) => false,
+                },
+                _ => false,
+            };
+            if !ours {
+                keep.push(event_id.clone());
+            }
+        }
+        let unpinned = pinned.len() - keep.len();
+        if unpinned > 0 {
+            self.put_state(
+                room_id,
+                "m.room.pinned_events",
+                "",
+                &json!({ "pinned": keep }),
+            )
+            .await?;
+        }
+        Ok(unpinned)
+    }
+
+    /// Open a space to the public in a fixed sequence: make its join rule
+    /// public and list it in the room directory, change the join rule of
+    /// its children and post a pinned index of them. Stops at the first
+    /// failed step unless `opts.continue_on_error`; returns every step.
+    pub(crate) async fn publish_space(
+        &self,
+        space_id: &RoomId,
+        opts: &PublishOptions,
+    ) -> anyhow::Result<Vec<PublishStep>> {
+        let hierarchy = self.space_hierarchy(space_id).await?;
+        let children = direct_children(&hierarchy);
+        let known: BTreeSet<OwnedRoomId> = children.iter().map(|c| c.room_id.clone()).collect();
+        if let Some(room_id) = opts.children.iter().find(|r| !known.contains(*r)) {
+            bail!("{} is not a child of {}", room_id, space_id);
+        }
+        let keep_going = opts.continue_on_error;
+        let mut steps = vec![];
+
+        let result = self.set_join_rule(space_id, "public", space_id).await;
+        if !record(&mut steps, "join_rule", space_id, result, keep_going) {
+            return Ok(steps);
+        }
+        let result = self
+            .set_directory_visibility(space_id, Visibility::Public)
+            .await;
+        if !record(&mut steps, "directory", space_id, result, keep_going) {
+            return Ok(steps);
+        }
+
+        if let Some(ref join_rule) = opts.children_join_rule {
+            for child in &children {
+                if !opts.children.is_empty() && !opts.children.contains(&child.room_id) {
+                    continue;
+                }
+                let result = self
+                    .set_join_rule(&child.room_id, join_rule, space_id)
+                    .await;
+                if !record(&mut steps, "join_rule", &child.room_id, result, keep_going) {
+                    return Ok(steps);
+                }
+            }
+        }
+
+        if let Some(ref room_id) = opts.index_room {
+            let body = index_message(&hierarchy, &children);
+            let result = self
+                .post_pinned(room_id, &body)
+                .await
+                .map(|event_id| Some(event_id.to_string()));
+            record(&mut steps, "index_message", room_id, result, keep_going);
+        }
+
+        Ok(steps)
+    }
+
+    /// Undo `publish_space`: remove the space from the room directory,
+    /// restrict its join rule and that of its public children, and unpin
+    /// our messages of `opts.unpin_room`.
+    pub(crate) async fn unpublish_space(
+        &self,
+        space_id: &RoomId,
+        opts: &UnpublishOptions,
+    ) -> anyhow::Result<Vec<PublishStep>> {
+        let hierarchy = self.space_hierarchy(space_id).await?;
+        let children = direct_children(&hierarchy);
+        let keep_going = opts.continue_on_error;
+        let mut steps = vec![];
+
+        // Hide the space first; that matters most in an emergency.
+        let result = self
+            .set_directory_visibility(space_id, Visibility::Private)
+            .await;
+        if !record(&mut steps, "directory", space_id, result, keep_going) {
+            return Ok(steps);
+        }
+        let result = self
+            .set_join_rule(space_id, &opts.join_rule, space_id)
+            .await;
+        if !record(&mut steps, "join_rule", space_id, result, keep_going) {
+            return Ok(steps);
+        }
+
+        for child in &children {
+            let public = hierarchy
+                .iter()
+                .find(|r| r.room_id == child.room_id)
+                .is_some_and(|r| r.join_rule.as_str() == "public");
+            if !public {
+                continue;
+            }
+            let result = self
+                .set_join_rule(&child.room_id, &opts.children_join_rule, space_id)
+                .await;
+            if !record(&mut steps, "join_rule", &child.room_id, result, keep_going) {
+                return Ok(steps);
+            }
+        }
+
+        if let Some(ref room_id) = opts.unpin_room {
+            let result = self
+                .unpin_own(room_id)
+                .await
+                .map(|n| Some(format!("{} unpinned", n)));
+            record(&mut steps, "unpin", room_id, result, keep_going);
+        }
+
+        Ok(steps)
+    }
+}
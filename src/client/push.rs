@@ -0,0 +1,200 @@
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::bail;
+use reqwest::Method;
+use serde_json::{json, Value};
+use tokio::time::sleep;
+
+use super::synapse::admin_v1;
+use crate::outputs::{GatewayHealth, PushTest, PusherCheck};
+
+const POLL_INTERVAL: Duration = Duration::from_secs(2);
+
+fn field(value: &Value, key: &str) -> Option<String> {
+    value.get(key).and_then(Value::as_str).map(String::from)
+}
+
+fn pusher_check(pusher: &Value) -> PusherCheck {
+    PusherCheck {
+        app_id: field(pusher, "app_id").unwrap_or_default(),
+        app_display_name: field(pusher, "app_display_name"),
+        device_display_name: field(pusher, "device_display_name"),
+        kind: field(pusher, "kind").unwrap_or_default(),
+        url: pusher
+            .pointer("/data/url")
+            .and_then(Value::as_str)
+            .map(String::from),
+        accepted: None,
+        error: None,
+    }
+}
+
+impl super::Client {
+    /// Send `pusher` a notification for `event_id` straight through its
+    /// push gateway, as the homeserver does for `event_id_only` pushers.
+    async fn probe_pusher(&self, pusher: &Value, room_id: &str, event_id: &str) -> PusherCheck {
+        let mut check = pusher_check(pusher);
+        // Email pushers are served by the homeserver itself.
+        let Some(url) = check.url.clone() else {
+            return check;
+        };
+        let pushkey = field(pusher, "pushkey").unwrap_or_default();
+        let mut data = pusher.get("data").cloned().unwrap_or_else(|| json!({}));
+        if let Some(data) = data.as_object_mut() {
+            data.remove("url");
+        }
+        let notification = json!({
+            "notification": {
+                "event_id": event_id,
+                "room_id": room_id,
+                "prio": "high",
+                "counts": {"unread": 1},
+                "devices": [{
+                    "app_id": check.app_id,
+                    "pushkey": pushkey,
+                    "data": data,
+                }],
+            }
+        });
+
+        let resp = match self
+            .http_client()
+            .post(&url)
+            .json(&notification)
+            .send()
+            .await
+        {
+            Ok(resp) => resp,
+            Err(e) => {
+                check.error = Some(e.to_string());
+                return check;
+            }
+        };
+        let status = resp.status();
+        match resp.json::<Value>().await {
+            Ok(body) if status.is_success() => {
+                let rejected = body
+                    .get("rejected")
+                    .and_then(Value::as_array)
+                    .is_some_and(|r| r.iter().any(|k| k.as_str() == Some(pushkey.as_str())));
+                check.accepted = Some(!rejected);
+                if rejected {
+                    check.error = Some(String::from("the gateway rejected the pushkey"));
+                }
+            }
+            Ok(_) | Err(_) => check.error = Some(format!("the gateway answered HTTP {}", status)),
+        }
+        check
+    }
+
+    async fn gateway_health(&self, url: &str) -> GatewayHealth {
+        let url = format!("{}/health", url.trim_end_matches('/'));
+        match self.http_client().get(&url).send().await {
+            Ok(resp) => GatewayHealth {
+                status: Some(resp.status().as_u16()),
+                ok: resp.status().is_success(),
+                error: None,
+                url,
+            },
+            Err(e) => GatewayHealth {
+                status: None,
+                ok: false,
+                error: Some(e.to_string()),
+                url,
+            },
+        }
+    }
+
+    /// Trigger a push to our own pushers and check every step. Our own
+    /// messages never notify us, so the test message is a server notice,
+    /// for which Synapse creates the server notices room on first use;
+    /// this requires a server admin. The notice must show up in
+    /// /notifications flagged to notify within `timeout`, after which every
+    /// http pusher is sent a notification through its gateway directly.
+    pub(crate) async fn test_push(
+        &self,
+        gateway_url: Option<&str>,
+        timeout: Duration,
+    ) -> anyhow::Result<PushTest> {
+        let pushers = self.api_get("_matrix/client/v3/pushers", &[]).await?;
+        let pushers = pushers
+            .get("pushers")
+            .and_then(Value::as_array)
+            .cloned()
+            .unwrap_or_default();
+        if pushers.is_empty() {
+            bail!("no pushers are registered for {}", self.user_id);
+        }
+
+        let nonce = SystemTime::now().duration_since(UNIX_EPOCH)?.as_millis();
+        let body = json!({
+            "user_id": self.user_id,
+            "content": {"msgtype": "m.text", "body": format!("mn push test {}", nonce)},
+        });
+        let path = format!("{}/send_server_notice", admin_v1());
+        let sent = match self.api_request(Method::POST, &path, &[], Some(&body)).await {
+            Ok(sent) => sent,
+            Err(e) => bail!(
+                "sending the test notice failed; it requires a synapse admin with server notices enabled: {}",
+                e
+            ),
+        };
+        let Some(event_id) = field(&sent, "event_id") else {
+            bail!("the homeserver returned no event id for the test notice");
+        };
+
+        let started = Instant::now();
+        let notification = loop {
+            let resp = self
+                .api_get(
+                    "_matrix/client/v3/notifications",
+                    &[("limit", String::from("20"))],
+                )
+                .await?;
+            let found = resp
+                .get("notifications")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+                .find(|n| {
+                    n.pointer("/event/event_id").and_then(Value::as_str) == Some(event_id.as_str())
+                })
+                .cloned();
+            if found.is_some() || started.elapsed() >= timeout {
+                break found;
+            }
+            sleep(POLL_INTERVAL).await;
+        };
+        let delay_ms = started.elapsed().as_millis() as u64;
+
+        let room_id = notification.as_ref().and_then(|n| field(n, "room_id"));
+        let actions = notification
+            .as_ref()
+            .and_then(|n| n.get("actions").and_then(Value::as_array).cloned())
+            .unwrap_or_default();
+        let flagged = actions.iter().any(|a| a.as_str() == Some("notify"));
+
+        // Without a notification the gateways have nothing to deliver.
+        let mut checks = vec![];
+        for pusher in &pushers {
+            checks.push(match (flagged, room_id.as_deref()) {
+                (true, Some(room_id)) => self.probe_pusher(pusher, room_id, &event_id).await,
+                _ => pusher_check(pusher),
+            });
+        }
+        let gateway = match gateway_url {
+            Some(url) => Some(self.gateway_health(url).await),
+            None => None,
+        };
+
+        Ok(PushTest {
+            room_id,
+            event_id,
+            flagged,
+            actions,
+            delay_ms: notification.is_some().then_some(delay_ms),
+            pushers: checks,
+            gateway,
+        })
+    }
+}
@@ -0,0 +1,94 @@
+use matrix_sdk::ruma::api::client::relations::get_relating_events_with_rel_type;
+use matrix_sdk::ruma::events::relation::RelationType;
+use matrix_sdk::ruma::{EventId, OwnedEventId, RoomId};
+use serde_json::{json, Value};
+
+use crate::outputs::SentReaction;
+
+/// Synapse rejects a second reaction with the same key by the same user.
+const DUPLICATE_ANNOTATION: &str = "M_DUPLICATE_ANNOTATION";
+
+impl super::Client {
+    /// Our reaction with `key` to `event_id`, if not redacted.
+    async fn own_reaction(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        key: &str,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let mut from = None;
+
+        loop {
+            let mut request = get_relating_events_with_rel_type::v1::Request::new(
+                room_id.to_owned(),
+                event_id.to_owned(),
+                RelationType::Annotation,
+            );
+            request.from = from;
+            let resp = self.inner.send(request, None).await?;
+
+            for raw in resp.chunk {
+                let event = raw.deserialize_as::<Value>()?;
+                if event.get("sender").and_then(Value::as_str) != Some(self.user_id.as_str()) {
+                    continue;
+                }
+                if event
+                    .pointer("/content/m.relates_to/key")
+                    .and_then(Value::as_str)
+                    != Some(key)
+                {
+                    continue;
+                }
+                if let Some(id) = event.get("event_id").and_then(Value::as_str) {
+                    return Ok(Some(EventId::parse(id)?));
+                }
+            }
+
+            from = resp.next_batch;
+            if from.is_none() {
+                return Ok(None);
+            }
+        }
+    }
+
+    /// React to `event_id` with `key`. Reacting again with the same key is
+    /// not an error; the earlier reaction is returned as duplicate.
+    pub(crate) async fn send_reaction(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        key: &str,
+    ) -> anyhow::Result<SentReaction> {
+        let room = self.get_joined_room(room_id)?;
+        let reaction = |reaction: Option<OwnedEventId>, duplicate| SentReaction {
+            room_id: room_id.to_string(),
+            event_id: reaction.map(|e| e.to_string()),
+            relates_to: event_id.to_string(),
+            key: key.to_string(),
+            duplicate,
+        };
+
+        // Not every homeserver rejects duplicates, so look first.
+        if let Some(existing) = self.own_reaction(room_id, event_id, key).await? {
+            return Ok(reaction(Some(existing), true));
+        }
+        let content = json!({
+            "m.relates_to": {
+                "rel_type": "m.annotation",
+                "event_id": event_id,
+                "key": key,
+            }
+        });
+        match room.send_raw("m.reaction", content).await {
+            Ok(resp) => Ok(reaction(Some(resp.event_id), false)),
+            Err(e)
+                if e.client_api_error_kind()
+                    .is_some_and(|kind| kind.to_string() == DUPLICATE_ANNOTATION) =>
+            {
+                let existing = self.own_reaction(room_id, event_id, key).await?;
+                Ok(reaction(existing, true))
+            }
+            Err(e) => Err(e.into()),
+        }
+    }
+}
@@ -1,17 +1,134 @@
+use std::collections::HashSet;
 use std::fs;
+use std::io::{self, Read};
 use std::path::Path;
+use std::sync::Arc;
+use std::time::Duration;
 
 use anyhow::{anyhow, bail};
-use matrix_sdk::attachment::AttachmentConfig;
+use futures::{stream, StreamExt};
+use is_terminal::IsTerminal;
+use matrix_sdk::attachment::{AttachmentConfig, AttachmentInfo, BaseImageInfo};
+use matrix_sdk::deserialized_responses::TimelineEvent;
 use matrix_sdk::room::{self, Messages, MessagesOptions, Room};
+use matrix_sdk::ruma::api::client::message::send_message_event;
+use matrix_sdk::ruma::api::client::relations::get_relating_events_with_rel_type;
+use matrix_sdk::ruma::events::relation::{InReplyTo, RelationType, Thread};
 use matrix_sdk::ruma::events::room::message::{
     AddMentions, EmoteMessageEventContent, MessageType, RoomMessageEventContent,
 };
-use matrix_sdk::ruma::events::room::message::{ForwardThread, RoomMessageEvent};
-use matrix_sdk::ruma::OwnedEventId;
-use matrix_sdk::ruma::{OwnedMxcUri, RoomId};
-use matrix_sdk::RoomMemberships;
+use matrix_sdk::ruma::events::room::message::{ForwardThread, Relation, RoomMessageEvent};
+use matrix_sdk::ruma::events::MessageLikeEventType;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{EventId, OwnedEventId, OwnedRoomId, TransactionId};
+use matrix_sdk::ruma::{OwnedMxcUri, RoomId, UInt};
+use matrix_sdk::{RoomMemberships, RoomState};
 use serde_json::value::RawValue;
+use serde_json::{json, Value};
+use tracing::warn;
+
+use super::batch::with_retries;
+use super::cache::{CachedRoom, RoomCache};
+use super::snapshot::RoomFixture;
+use crate::format::{self, Formatted};
+use crate::outputs::{MessagePreview, Redaction};
+use crate::render;
+
+/// The room a message is posted to: a joined one, or the fixture of
+/// `send --preview --fixture`, which has no events and cannot be sent to.
+pub(super) enum Target {
+    Joined(Room),
+    Fixture(Arc<RoomFixture>),
+}
+
+impl Target {
+    pub(super) fn room_id(&self) -> &RoomId {
+        match self {
+            Target::Joined(room) => room.room_id(),
+            Target::Fixture(fixture) => &fixture.room_id,
+        }
+    }
+
+    pub(super) async fn is_encrypted(&self) -> anyhow::Result<bool> {
+        match self {
+            Target::Joined(room) => Ok(room.is_encrypted().await?),
+            Target::Fixture(fixture) => Ok(fixture.encrypted),
+        }
+    }
+
+    async fn event(&self, event_id: &EventId) -> anyhow::Result<TimelineEvent> {
+        match self {
+            Target::Joined(room) => Ok(room.event(event_id).await?),
+            Target::Fixture(_) => bail!("the fixture has no events"),
+        }
+    }
+
+    /// The joined room, to send to.
+    pub(super) fn joined(&self) -> anyhow::Result<&Room> {
+        match self {
+            Target::Joined(room) => Ok(room),
+            Target::Fixture(fixture) => bail!("cannot send to the fixture of {}", fixture.room_id),
+        }
+    }
+}
+
+/// A text or notice content; with `markdown` the body is rendered into
+/// formatted_body and kept as plain fallback.
+fn message_content(body: &str, markdown: bool, notice: bool) -> RoomMessageEventContent {
+    let formatted = markdown.then(|| format::markdown(body)).flatten();
+    match (formatted, notice) {
+        (Some(f), true) => RoomMessageEventContent::notice_html(f.plain, f.html),
+        (Some(f), false) => RoomMessageEventContent::text_html(f.plain, f.html),
+        (None, true) => RoomMessageEventContent::notice_plain(body),
+        (None, false) => RoomMessageEventContent::text_plain(body),
+    }
+}
+
+/// Make `content` a reply to `event_id` with the quoted fallback of the
+/// original message. If that cannot be fetched, e.g. because it is
+/// redacted or not a message, the reply only has the relation.
+async fn reply_content(
+    room: &Target,
+    event_id: &EventId,
+    content: RoomMessageEventContent,
+) -> RoomMessageEventContent {
+    let original = match room.event(event_id).await {
+        Ok(event) => event
+            .event
+            .deserialize_as::<RoomMessageEvent>()
+            .map_err(anyhow::Error::from)
+            .and_then(|e| {
+                e.as_original()
+                    .cloned()
+                    .ok_or_else(|| anyhow!("the event is redacted"))
+            }),
+        Err(e) => Err(e),
+    };
+    match original {
+        Ok(original) => content.make_reply_to(&original, ForwardThread::Yes, AddMentions::No),
+        Err(e) => {
+            warn!("replying to {} without quote: {}", event_id, e);
+            let mut content = content;
+            content.relates_to = Some(Relation::Reply {
+                in_reply_to: InReplyTo::new(event_id.to_owned()),
+            });
+            content
+        }
+    }
+}
+
+/// The dimensions and size of an image; fails if `data` cannot be decoded.
+pub(super) fn image_info(data: &[u8]) -> anyhow::Result<BaseImageInfo> {
+    let image = image::io::Reader::new(io::Cursor::new(data))
+        .with_guessed_format()?
+        .decode()?;
+    Ok(BaseImageInfo {
+        height: Some(UInt::from(image.height())),
+        width: Some(UInt::from(image.width())),
+        size: UInt::new(data.len() as u64),
+        blurhash: None,
+    })
+}
 
 impl super::Client {
     pub(crate) fn get_joined_room(
@@ -23,14 +140,99 @@ impl super::Client {
             .ok_or_else(|| anyhow!("no such room: {}", room_id.as_ref()))
     }
 
+    /// The room to post a message to; the fixture in its place if there
+    /// is one.
+    fn target(&self, room_id: impl AsRef<RoomId>) -> anyhow::Result<Target> {
+        match self.fixture {
+            Some(ref fixture) if *fixture.room_id == *room_id.as_ref() => {
+                Ok(Target::Fixture(fixture.clone()))
+            }
+            Some(ref fixture) => bail!(
+                "the fixture is of {}, not of {}",
+                fixture.room_id,
+                room_id.as_ref()
+            ),
+            None => Ok(Target::Joined(self.get_joined_room(room_id)?)),
+        }
+    }
+
+    /// A message content with the profile of the current identity.
+    pub(super) fn with_profile(&self, mut content: Value) -> Value {
+        if let Some(ref identity) = self.identity {
+            identity.apply(&mut content);
+        }
+        content
+    }
+
+    /// Send a message content as the current identity, with the pills of
+    /// the mentions. In preview mode the content is printed instead; no
+    /// event id is returned then. Duplicates within the dedupe window fail
+    /// with `Duplicate`, and contents too large for an event are handled
+    /// by `post_oversized`.
+    async fn post_message(
+        &self,
+        room: &Target,
+        mut content: Value,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        if let Some(ref mentions) = self.mentions {
+            mentions.apply(&mut content);
+        }
+        let profiled = self.with_profile(content.clone());
+        let body = profiled
+            .get("body")
+            .and_then(Value::as_str)
+            .unwrap_or("")
+            .to_string();
+        if let Some(ref dedupe) = self.dedupe {
+            if let Some(duplicate) = self.find_duplicate(room, &body, dedupe).await? {
+                return Err(duplicate.into());
+            }
+        }
+        let size = serde_json::to_vec(&profiled)?.len();
+        let limit = self.content_limit(room).await?;
+        let event_id = if size > limit {
+            self.post_oversized(room, content, size, limit).await?
+        } else {
+            self.post_content(room, profiled).await?
+        };
+        if let (Some(dedupe), false) = (&self.dedupe, self.preview) {
+            self.remember_sent(room.room_id(), &body, dedupe)?;
+        }
+        Ok(event_id)
+    }
+
+    /// Send a message content as it is, or print it in preview mode.
+    pub(super) async fn post_content(
+        &self,
+        room: &Target,
+        content: Value,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        if self.preview {
+            print_preview(room.room_id(), content)?;
+            return Ok(None);
+        }
+        let room = room.joined()?;
+        if self.plaintext {
+            return Ok(Some(
+                self.send_plaintext(room, "m.room.message", content).await?,
+            ));
+        }
+        let request = room.send_raw("m.room.message", content);
+        let resp = match self.txn_id {
+            Some(ref txn_id) => request.with_transaction_id(txn_id).await?,
+            None => request.await?,
+        };
+        Ok(Some(resp.event_id))
+    }
+
     pub(crate) async fn send_message_raw(
         &self,
         room_id: impl AsRef<RoomId>,
         content: RoomMessageEventContent,
-    ) -> anyhow::Result<()> {
-        let room = self.get_joined_room(room_id)?;
-        room.send(content).await?;
-        Ok(())
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let room = self.target(room_id)?;
+        self.post_message(&room, serde_json::to_value(&content)?)
+            .await
     }
 
     pub(crate) async fn send_message(
@@ -38,13 +240,23 @@ impl super::Client {
         room: impl AsRef<RoomId>,
         body: &str,
         markdown: bool,
-    ) -> anyhow::Result<()> {
-        let content = if markdown {
-            RoomMessageEventContent::text_markdown(body)
-        } else {
-            RoomMessageEventContent::text_plain(body)
-        };
-        self.send_message_raw(room, content).await
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        self.send_message_raw(room, message_content(body, markdown, false))
+            .await
+    }
+
+    /// Send a message like `send_message`, but with a custom msgtype.
+    pub(crate) async fn send_message_type(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        body: &str,
+        markdown: bool,
+        msgtype: &str,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let mut content = serde_json::to_value(message_content(body, markdown, false))?;
+        content["msgtype"] = Value::from(msgtype);
+        let room = self.target(room_id)?;
+        self.post_message(&room, content).await
     }
 
     pub(crate) async fn send_message_reply(
@@ -53,18 +265,208 @@ impl super::Client {
         event_id: &OwnedEventId,
         body: &str,
         markdown: bool,
-    ) -> anyhow::Result<()> {
+        notice: bool,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let room = self.target(&room_id)?;
+        let content = reply_content(&room, event_id, message_content(body, markdown, notice)).await;
+        self.send_message_raw(room_id, content).await
+    }
+
+    /// The latest event in the thread of `root`; the root itself if the
+    /// thread has no events yet.
+    async fn latest_in_thread(
+        &self,
+        room_id: &RoomId,
+        root: &EventId,
+    ) -> anyhow::Result<OwnedEventId> {
+        let mut request = get_relating_events_with_rel_type::v1::Request::new(
+            room_id.to_owned(),
+            root.to_owned(),
+            RelationType::Thread,
+        );
+        request.limit = Some(1u32.into());
+        let resp = self.inner.send(request, None).await?;
+        match resp.chunk.first() {
+            Some(raw) => match raw.get_field::<OwnedEventId>("event_id")? {
+                Some(event_id) => Ok(event_id),
+                None => bail!("thread event without event_id"),
+            },
+            None => Ok(root.to_owned()),
+        }
+    }
+
+    /// Make `content` part of the thread of `root`. A reply within the
+    /// thread quotes `reply_to`; other messages fall back to a reply to the
+    /// latest event of the thread, which clients without threads show; the
+    /// root itself for a fixture.
+    async fn thread_content(
+        &self,
+        room: &Target,
+        root: &EventId,
+        reply_to: Option<&EventId>,
+        content: RoomMessageEventContent,
+    ) -> anyhow::Result<RoomMessageEventContent> {
+        let (mut content, thread) = match reply_to {
+            Some(event_id) => (
+                reply_content(room, event_id, content).await,
+                Thread::reply(root.to_owned(), event_id.to_owned()),
+            ),
+            None => {
+                let latest = match room {
+                    Target::Joined(room) => self.latest_in_thread(room.room_id(), root).await?,
+                    Target::Fixture(_) => root.to_owned(),
+                };
+                (content, Thread::plain(root.to_owned(), latest))
+            }
+        };
+        content.relates_to = Some(Relation::Thread(thread));
+        Ok(content)
+    }
+
+    /// Send a text or notice to the thread of `root`, optionally as reply
+    /// to an event within it.
+    pub(crate) async fn send_message_thread(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        root: &EventId,
+        reply_to: Option<&EventId>,
+        body: &str,
+        markdown: bool,
+        notice: bool,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let room = self.target(&room_id)?;
+        let content = message_content(body, markdown, notice);
+        let content = self.thread_content(&room, root, reply_to, content).await?;
+        self.send_message_raw(room_id, content).await
+    }
+
+    /// Replace the body of our message `event_id`; clients show the
+    /// original as edited. The fallback body starts with `* `.
+    pub(crate) async fn send_edit(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        event_id: &EventId,
+        body: &str,
+        markdown: bool,
+        notice: bool,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let room = self.target(room_id)?;
+        if let Ok(original) = room.event(event_id).await {
+            let sender = original.event.get_field::<String>("sender")?;
+            if sender.as_deref() != Some(self.user_id.as_str()) {
+                bail!("cannot edit {}; it was not sent by us", event_id);
+            }
+        }
+
+        let new_content = serde_json::to_value(message_content(body, markdown, notice))?;
+        let mut content = new_content.clone();
+        for key in ["body", "formatted_body"] {
+            if let Some(text) = content.get(key).and_then(Value::as_str) {
+                content[key] = Value::from(format!("* {}", text));
+            }
+        }
+        content["m.new_content"] = new_content;
+        content["m.relates_to"] = json!({ "rel_type": "m.replace", "event_id": event_id });
+        self.post_message(&room, content).await
+    }
+
+    /// Send a complete m.room.message content object as is; only the
+    /// msgtype is filled in if missing.
+    pub(crate) async fn send_content(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        mut content: Value,
+        notice: bool,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let Some(object) = content.as_object_mut() else {
+            bail!("message content must be a JSON object");
+        };
+        if !object.get("body").is_some_and(Value::is_string) {
+            bail!("message content has no string body");
+        }
+        match object.get("msgtype") {
+            None => {
+                let msgtype = if notice { "m.notice" } else { "m.text" };
+                object.insert(String::from("msgtype"), Value::from(msgtype));
+            }
+            Some(Value::String(_)) => {}
+            Some(_) => bail!("msgtype must be a string"),
+        }
+        if object.contains_key("format")
+            && !object.get("formatted_body").is_some_and(Value::is_string)
+        {
+            bail!("message content has a format but no string formatted_body");
+        }
+
+        let room = self.target(room_id)?;
+        self.post_message(&room, content).await
+    }
+
+    /// Send `content` verbatim as an event of `event_type`, or as state
+    /// event with `state_key`; no profile, dedupe or size handling applies.
+    pub(crate) async fn send_raw_event(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        event_type: &str,
+        state_key: Option<&str>,
+        content: Value,
+    ) -> anyhow::Result<OwnedEventId> {
         let room = self.get_joined_room(&room_id)?;
-        let timeline_event = room.event(event_id).await?;
-        let event_content = timeline_event.event.deserialize_as::<RoomMessageEvent>()?;
-        let original_message = event_content.as_original().unwrap();
+        match state_key {
+            Some(state_key) => {
+                self.put_state(room.room_id(), event_type, state_key, &content)
+                    .await
+            }
+            None if self.plaintext => self.send_plaintext(&room, event_type, content).await,
+            None => Ok(room.send_raw(event_type, content).await?.event_id),
+        }
+    }
 
-        let content = if markdown {
-            RoomMessageEventContent::text_markdown(body)
+    /// Send a message-like event unencrypted, also to an encrypted room.
+    async fn send_plaintext(
+        &self,
+        room: &Room,
+        event_type: &str,
+        content: Value,
+    ) -> anyhow::Result<OwnedEventId> {
+        if room.is_encrypted().await? {
+            warn!(
+                "sending unencrypted to the encrypted room {}",
+                room.room_id()
+            );
+        }
+        let request = send_message_event::v3::Request::new_raw(
+            room.room_id().to_owned(),
+            self.txn_id.clone().unwrap_or_else(TransactionId::new),
+            MessageLikeEventType::from(event_type),
+            Raw::new(&content)?.cast(),
+        );
+        Ok(self.inner.send(request, None).await?.event_id)
+    }
+
+    /// Send a preformatted html body, optionally as notice, reply or in a
+    /// thread.
+    pub(crate) async fn send_formatted(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        body: &Formatted,
+        notice: bool,
+        reply_to: Option<&OwnedEventId>,
+        thread: Option<&OwnedEventId>,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let mut content = if notice {
+            RoomMessageEventContent::notice_html(&body.plain, &body.html)
         } else {
-            RoomMessageEventContent::text_plain(body)
+            RoomMessageEventContent::text_html(&body.plain, &body.html)
+        };
+
+        let room = self.target(&room_id)?;
+        if let Some(root) = thread {
+            let reply_to = reply_to.map(|e| &**e);
+            content = self.thread_content(&room, root, reply_to, content).await?;
+        } else if let Some(event_id) = reply_to {
+            content = reply_content(&room, event_id, content).await;
         }
-        .make_reply_to(original_message, ForwardThread::Yes, AddMentions::No);
 
         self.send_message_raw(room_id, content).await
     }
@@ -74,13 +476,9 @@ impl super::Client {
         room_id: impl AsRef<RoomId>,
         body: &str,
         markdown: bool,
-    ) -> anyhow::Result<()> {
-        let event = if markdown {
-            RoomMessageEventContent::notice_markdown(body)
-        } else {
-            RoomMessageEventContent::notice_plain(body)
-        };
-        self.send_message_raw(room_id, event).await
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        self.send_message_raw(room_id, message_content(body, markdown, true))
+            .await
     }
 
     pub(crate) async fn send_emote(
@@ -88,35 +486,115 @@ impl super::Client {
         room_id: impl AsRef<RoomId>,
         body: &str,
         markdown: bool,
-    ) -> anyhow::Result<()> {
-        let content = if markdown {
-            EmoteMessageEventContent::markdown(body)
-        } else {
-            EmoteMessageEventContent::plain(body)
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let content = match markdown.then(|| format::markdown(body)).flatten() {
+            Some(f) => EmoteMessageEventContent::html(f.plain, f.html),
+            None => EmoteMessageEventContent::plain(body),
         };
         let msgtype = MessageType::Emote(content);
         let content = RoomMessageEventContent::new(msgtype);
         self.send_message_raw(room_id, content).await
     }
 
+    /// Upload a file and send it as m.image, m.audio, m.video or m.file,
+    /// depending on its mimetype. `-` reads the file from stdin; `name`
+    /// replaces the file name in the body. Images get their dimensions
+    /// and, with `thumbnail`, a thumbnail; images which cannot be decoded
+    /// are sent as m.file.
     pub(crate) async fn send_attachment(
         &self,
         room_id: impl AsRef<RoomId>,
         path: impl AsRef<Path>,
-    ) -> anyhow::Result<()> {
+        name: Option<&str>,
+        thumbnail: bool,
+    ) -> anyhow::Result<OwnedEventId> {
         let path = path.as_ref();
-        let Some(file_name) = path.file_name().map(|s| s.to_str().unwrap()) else {
-            bail!("invalid file: {:?}", path);
+        let stdin = path == Path::new("-");
+        let file_name = match (name, stdin) {
+            (Some(name), _) => name,
+            (None, true) => "stdin",
+            (None, false) => match path.file_name().and_then(|s| s.to_str()) {
+                Some(file_name) => file_name,
+                None => bail!("invalid file: {:?}", path),
+            },
         };
 
+        if self.preview {
+            bail!("attachments cannot be previewed");
+        }
         let room = self.get_joined_room(room_id)?;
-        let data = fs::read(path)?;
-        let config = AttachmentConfig::default().generate_thumbnail(None);
-        let content_type = crate::mime::guess_mime(path)?;
+        let (data, content_type) = if stdin {
+            let mut data = vec![];
+            io::stdin().read_to_end(&mut data)?;
+            let content_type = crate::mime::guess_mime_stdin(&data, file_name)?;
+            (data, content_type)
+        } else {
+            (fs::read(path)?, crate::mime::guess_mime(path)?)
+        };
 
-        room.send_attachment(file_name, &content_type, data, config)
+        let (config, content_type) = if content_type.type_() == mime::IMAGE {
+            match image_info(&data) {
+                Ok(info) => {
+                    // Clients reserve the space of the image before loading it.
+                    let config = AttachmentConfig::default().info(AttachmentInfo::Image(info));
+                    let config = if thumbnail {
+                        config.generate_thumbnail(None)
+                    } else {
+                        config
+                    };
+                    (config, content_type)
+                }
+                Err(e) => {
+                    warn!(
+                        "{} cannot be decoded as image, sending it as file: {}",
+                        file_name, e
+                    );
+                    (AttachmentConfig::default(), mime::APPLICATION_OCTET_STREAM)
+                }
+            }
+        } else {
+            (AttachmentConfig::default(), content_type)
+        };
+
+        let resp = room
+            .send_attachment(file_name, &content_type, data, config)
             .await?;
-        Ok(())
+        Ok(resp.event_id)
+    }
+
+    /// Redact `event_ids` one after another, retrying rate limits; a
+    /// failure does not stop the others.
+    pub(crate) async fn redact_events(
+        &self,
+        room_id: impl AsRef<RoomId>,
+        event_ids: &[OwnedEventId],
+        reason: Option<&str>,
+    ) -> anyhow::Result<Vec<Redaction>> {
+        let room = self.get_joined_room(room_id)?;
+        let mut redactions = vec![];
+        for event_id in event_ids {
+            let result = with_retries(|| async {
+                Ok::<_, anyhow::Error>(room.redact(event_id, reason, None).await?)
+            })
+            .await;
+            redactions.push(match result {
+                Ok(resp) => Redaction {
+                    event_id: event_id.to_string(),
+                    redaction_event_id: Some(resp.event_id.to_string()),
+                    errcode: None,
+                    error: None,
+                    retryable: false,
+                },
+                Err(e) => Redaction {
+                    event_id: event_id.to_string(),
+                    redaction_event_id: None,
+                    errcode: e.errcode,
+                    error: Some(e.error),
+                    retryable: e.retryable,
+                },
+            });
+        }
+        Ok(redactions)
     }
 
     pub(crate) fn mxc_to_http(&self, mxc: OwnedMxcUri) -> String {
@@ -135,27 +613,45 @@ impl super::Client {
         &self,
         room: Room,
         _query_avatars: bool,
-        _query_members: bool,
-    ) -> anyhow::Result<crate::outputs::Room> {
+        query_members: bool,
+        cached: Option<CachedRoom>,
+    ) -> anyhow::Result<(crate::outputs::Room, CachedRoom)> {
         //let room_avatar = room.avatar(matrix_sdk::media::MediaFormat::File).await?;
 
-        let mut opts = MessagesOptions::backward();
-        opts.limit = (1).try_into().unwrap();
-        let msgs = room.messages(opts).await?;
+        let joined = room.state() == RoomState::Joined;
+        let cached = match cached {
+            Some(cached) => cached,
+            // The timeline of invited and left rooms cannot be requested;
+            // neither can the encryption state of most of them.
+            None if !joined => CachedRoom::new(room.is_encrypted().await.unwrap_or(false), vec![]),
+            None => {
+                let mut opts = MessagesOptions::backward();
+                opts.limit = (1).try_into().unwrap();
+                let msgs = room.messages(opts).await?;
 
-        let events: Vec<Box<RawValue>> = msgs
-            .chunk
-            .into_iter()
-            .map(|e| e.event.into_json())
-            .rev()
-            .collect();
+                let events: Vec<Box<RawValue>> = msgs
+                    .chunk
+                    .into_iter()
+                    .map(|e| e.event.into_json())
+                    .rev()
+                    .collect();
+                CachedRoom::new(room.is_encrypted().await?, events)
+            }
+        };
 
         let mut room_out = crate::outputs::Room {
             name: room.name(),
             topic: room.topic(),
             display_name: room.display_name().await?.to_string(),
             room_id: room.room_id().to_string(),
-            is_encrypted: room.is_encrypted().await?,
+            state: match room.state() {
+                RoomState::Joined => "joined",
+                RoomState::Invited => "invited",
+                _ => "left",
+            },
+            canonical_alias: room.canonical_alias().map(|a| a.to_string()),
+            joined_members: room.joined_members_count(),
+            is_encrypted: cached.is_encrypted,
             is_direct: room.is_direct().await?,
             is_tombstoned: room.is_tombstoned(),
             is_public: room.is_public(),
@@ -170,36 +666,234 @@ impl super::Client {
             matrix_to_uri: room.matrix_to_permalink().await?.to_string(),
             unread_notifications: room.unread_notification_counts(),
             members: None,
-            events,
+            events: cached.events.clone(),
         };
 
-        let mut members_out = Vec::new();
-        for member in room.members(RoomMemberships::empty()).await? {
-            let avatar = match member.avatar_url() {
-                Some(uri) => self.mxc_to_http(OwnedMxcUri::from(uri)),
-                None => String::from(""),
-            };
-            members_out.push(crate::outputs::RoomMember {
-                avatar,
-                name: member.name().to_string(),
-                display_name: member.display_name().map(|s| s.to_string()),
-                user_id: member.user_id().to_string(),
+        if query_members && joined {
+            let mut members_out = Vec::new();
+            for member in room.members(RoomMemberships::empty()).await? {
+                let avatar = match member.avatar_url() {
+                    Some(uri) => self.mxc_to_http(OwnedMxcUri::from(uri)),
+                    None => String::from(""),
+                };
+                members_out.push(crate::outputs::RoomMember {
+                    avatar,
+                    name: member.name().to_string(),
+                    display_name: member.display_name().map(|s| s.to_string()),
+                    user_id: member.user_id().to_string(),
+                })
+            }
+            room_out.members = Some(members_out);
+        }
+
+        Ok((room_out, cached))
+    }
+
+    /// Query all rooms, also invited and left ones, with up to `jobs`
+    /// requests in flight; the parts of joined rooms which need requests
+    /// are cached for `cache_ttl`.
+    pub(crate) async fn list_rooms(
+        &self,
+        query_avatars: bool,
+        query_members: bool,
+        jobs: usize,
+        cache_ttl: Duration,
+    ) -> anyhow::Result<Vec<crate::outputs::Room>> {
+        let mut cache = RoomCache::load(self, cache_ttl)?;
+        let rooms = self.inner.rooms();
+        let room_ids: Vec<String> = rooms.iter().map(|r| r.room_id().to_string()).collect();
+
+        let results: Vec<_> = stream::iter(rooms)
+            .map(|room| {
+                let cached = cache.get(room.room_id().as_str());
+                self.query_room(room, query_avatars, query_members, cached)
             })
+            .buffered(jobs.max(1))
+            .collect()
+            .await;
+
+        let mut out = vec![];
+        cache.retain(&room_ids);
+        for res in results {
+            let (room, cached) = res?;
+            if room.state == "joined" {
+                cache.insert(room.room_id.clone(), cached);
+            }
+            out.push(room);
         }
+        cache.persist()?;
 
-        room_out.members = Some(members_out);
+        Ok(out)
+    }
 
-        Ok(room_out)
+    /// An event of a joined room as it came from the server.
+    pub(crate) async fn room_event(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+    ) -> anyhow::Result<Box<RawValue>> {
+        let room = self.get_joined_room(room_id)?;
+        Ok(room.event(event_id).await?.event.into_json())
     }
 
     pub(crate) async fn messages(
         &self,
         room_id: impl AsRef<RoomId>,
         limit: u64,
+        from: Option<String>,
     ) -> anyhow::Result<Messages> {
         let room = self.get_joined_room(room_id)?;
         let mut options = MessagesOptions::backward();
         options.limit = limit.try_into()?;
+        options.from = from;
         room.messages(options).await.map_err(|e| anyhow!(e))
     }
+
+    /// Paginate backwards in a room we might not be in; world-readable
+    /// rooms are peeked, others are joined.
+    async fn messages_of(
+        &self,
+        room_id: &RoomId,
+        limit: u64,
+        from: Option<String>,
+    ) -> anyhow::Result<(Vec<Box<RawValue>>, Option<String>)> {
+        if self.inner.get_room(room_id).map(|r| r.state()) != Some(RoomState::Joined) {
+            let mut query = vec![("dir", String::from("b")), ("limit", limit.to_string())];
+            if let Some(ref from) = from {
+                query.push(("from", from.clone()));
+            }
+            let path = format!("_matrix/client/v3/rooms/{}/messages", room_id);
+            match self.api_get(&path, &query).await {
+                Ok(resp) => {
+                    let chunk = match resp.get("chunk") {
+                        Some(chunk) => serde_json::from_value(chunk.clone())?,
+                        None => vec![],
+                    };
+                    let end = resp.get("end").and_then(Value::as_str).map(String::from);
+                    return Ok((chunk, end));
+                }
+                Err(e) => {
+                    tracing::info!("cannot peek into {}: {}; joining", room_id, e);
+                    self.inner.join_room_by_id(room_id).await?;
+                }
+            }
+        }
+
+        let msgs = self.messages(room_id, limit, from).await?;
+        let events = msgs
+            .chunk
+            .into_iter()
+            .map(|e| e.event.into_json())
+            .collect();
+        Ok((events, msgs.end))
+    }
+
+    /// Like `messages`, but continue in the predecessor room after the
+    /// creation event of an upgraded room is reached.
+    pub(crate) async fn messages_following_predecessors(
+        &self,
+        room_id: &RoomId,
+        limit: u64,
+        from: Option<String>,
+    ) -> anyhow::Result<FollowedMessages> {
+        let mut room_id = room_id.to_owned();
+        let mut from = from;
+        let mut visited = HashSet::from([room_id.clone()]);
+        let mut out = FollowedMessages {
+            events: vec![],
+            end: None,
+            room_id: room_id.clone(),
+            start_reached: false,
+            gap: None,
+        };
+
+        while (out.events.len() as u64) < limit {
+            let remaining = limit - out.events.len() as u64;
+            let (events, end) = match self.messages_of(&room_id, remaining, from.take()).await {
+                Ok(page) => page,
+                // Only predecessors may be inaccessible.
+                Err(e) if visited.len() > 1 => {
+                    out.gap = Some(format!(
+                        "history continues in {}, which is not accessible: {}",
+                        room_id, e
+                    ));
+                    break;
+                }
+                Err(e) => return Err(e),
+            };
+            for event in events {
+                out.events.push(with_room_id(event, &room_id)?);
+            }
+            out.room_id = room_id.clone();
+            if end.is_some() {
+                out.end = end.clone();
+                from = end;
+                continue;
+            }
+
+            out.end = None;
+            let predecessor = self
+                .get_state(&room_id, "m.room.create", "")
+                .await?
+                .and_then(|c| {
+                    c.pointer("/predecessor/room_id")
+                        .and_then(Value::as_str)
+                        .map(String::from)
+                });
+            let Some(predecessor) = predecessor else {
+                out.start_reached = true;
+                break;
+            };
+            room_id = RoomId::parse(predecessor)?;
+            if !visited.insert(room_id.clone()) {
+                bail!("the predecessors of {} form a loop", out.room_id);
+            }
+            // Without more events, the next page starts at the newest
+            // event of the predecessor.
+            out.room_id = room_id.clone();
+        }
+
+        Ok(out)
+    }
+}
+
+/// Events of several room generations, newest first.
+pub(crate) struct FollowedMessages {
+    pub(crate) events: Vec<Box<RawValue>>,
+    pub(crate) end: Option<String>,
+    /// The room which `end` belongs to
+    pub(crate) room_id: OwnedRoomId,
+    pub(crate) start_reached: bool,
+    /// Set if a predecessor room could not be read
+    pub(crate) gap: Option<String>,
+}
+
+/// Print a message content as it would be sent, followed by the styled
+/// rendering on terminals.
+fn print_preview(room_id: &RoomId, content: Value) -> anyhow::Result<()> {
+    let preview = MessagePreview {
+        room_id: room_id.to_string(),
+        event_type: "m.room.message",
+        text: render::message_text(&content, false, false),
+        content,
+    };
+    println!("{}", serde_json::to_string(&preview)?);
+    if io::stdout().is_terminal() {
+        if let Some(text) = render::message_text(&preview.content, false, true) {
+            println!("{}", text);
+        }
+    }
+    Ok(())
+}
+
+// Decrypted events do not necessarily carry their room id.
+fn with_room_id(event: Box<RawValue>, room_id: &RoomId) -> anyhow::Result<Box<RawValue>> {
+    let mut value: Value = serde_json::from_str(event.get())?;
+    match value.as_object_mut() {
+        Some(object) if !object.contains_key("room_id") => {
+            object.insert(String::from("room_id"), Value::from(room_id.as_str()));
+            Ok(serde_json::value::to_raw_value(&value)?)
+        }
+        _ => Ok(event),
+    }
 }
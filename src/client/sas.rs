@@ -1,61 +1,145 @@
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
 use futures::stream::StreamExt;
+use matrix_sdk::ruma::{DeviceId, OwnedDeviceId, OwnedUserId, UserId};
 use matrix_sdk::Client as MatrixClient;
 use matrix_sdk::{
-    encryption::verification::{format_emojis, SasState, SasVerification, Verification},
+    encryption::verification::{
+        format_emojis, SasState, SasVerification, Verification, VerificationRequest,
+        VerificationRequestState,
+    },
     ruma::events::{
         key::verification::{
-            request::ToDeviceKeyVerificationRequestEvent,
-            start::{OriginalSyncKeyVerificationStartEvent, ToDeviceKeyVerificationStartEvent},
+            request::ToDeviceKeyVerificationRequestEvent, start::ToDeviceKeyVerificationStartEvent,
         },
         room::message::{MessageType, OriginalSyncRoomMessageEvent},
     },
 };
 
+use tokio::sync::mpsc;
+use tracing::{info, warn};
+
+use crate::outputs::VerificationResult;
 use crate::terminal;
 
-async fn sas_verification_handler(sas: SasVerification) {
+/// Which verification `mn verify` runs.
+#[derive(Debug)]
+pub(crate) struct VerifyOptions {
+    /// Request a verification of this user; `None` waits for a request
+    pub(crate) user_id: Option<OwnedUserId>,
+    /// Only this device of the user, e.g. one of our own others
+    pub(crate) device_id: Option<OwnedDeviceId>,
+    /// Give up if the handshake is not finished by then
+    pub(crate) timeout: Duration,
+}
+
+/// What is cancelled if the other side does not answer in time.
+#[derive(Clone)]
+enum InFlight {
+    Request(VerificationRequest),
+    Sas(SasVerification),
+}
+
+/// Compare the short auth string with the user on the terminal and
+/// confirm it on a match.
+async fn sas_verification_handler(sas: SasVerification) -> anyhow::Result<VerificationResult> {
+    let other_user_id = sas.other_device().user_id().to_owned();
+    let other_device_id = sas.other_device().device_id().to_owned();
+
+    eprintln!("Starting verification with {other_user_id} {other_device_id}");
+
+    // The side which started only waits for the accept.
+    if !sas.we_started() {
+        sas.accept().await?;
+    }
+
+    let mut stream = sas.changes();
+    let mut reason = None;
+    while let Some(state) = stream.next().await {
+        match state {
+            SasState::KeysExchanged { emojis, decimals } => {
+                match emojis {
+                    Some(emojis) => {
+                        eprintln!("Confirm that the emojis match!");
+                        eprintln!("{}", format_emojis(emojis.emojis));
+                    }
+                    None => eprintln!("Confirm that the numbers match!"),
+                }
+                eprintln!("{} {} {}", decimals.0, decimals.1, decimals.2);
+
+                if terminal::confirm("confirm").await? {
+                    sas.confirm().await?;
+                } else {
+                    sas.mismatch().await?;
+                }
+            }
+            SasState::Done { .. } => {
+                eprintln!("successfully verified device {other_user_id} {other_device_id}");
+                break;
+            }
+            SasState::Cancelled(cancel_info) => {
+                eprintln!(
+                    "verification has been cancelled, reason: {}",
+                    cancel_info.reason()
+                );
+                reason = Some(cancel_info.reason().to_string());
+                break;
+            }
+            SasState::Started { .. } | SasState::Accepted { .. } | SasState::Confirmed => (),
+        }
+    }
+
+    Ok(VerificationResult {
+        user_id: Some(other_user_id.to_string()),
+        device_id: Some(other_device_id.to_string()),
+        verified: sas.is_done(),
+        reason,
+        timed_out: false,
+    })
+}
+
+// Non-interactive variant of sas_verification_handler: the emojis are only
+// logged and confirmed after `delay`; the human compares them on their side.
+async fn auto_sas_verification_handler(sas: SasVerification, delay: Duration) {
     let other_user_id = sas.other_device().user_id();
     let other_device_id = sas.other_device().device_id();
 
-    println!("Starting verification with {other_user_id} {other_device_id}");
+    info!("starting verification with {other_user_id} {other_device_id}");
 
-    // print_devices(sas.other_device().user_id(), &client).await;
-    sas.accept().await.unwrap();
+    if let Err(e) = sas.accept().await {
+        warn!("accepting verification failed: {}", e);
+        return;
+    }
 
     let mut stream = sas.changes();
 
     while let Some(state) = stream.next().await {
         match state {
-            SasState::KeysExchanged {
-                emojis,
-                decimals: _,
-            } => {
-                println!("Confirm that the emojis match!");
-                println!("{}", format_emojis(emojis.unwrap().emojis));
-
+            SasState::KeysExchanged { emojis, .. } => {
+                if let Some(emojis) = emojis {
+                    info!(
+                        "emojis for {other_user_id} {other_device_id}: {}",
+                        format_emojis(emojis.emojis)
+                    );
+                }
                 let sas = sas.clone();
                 tokio::spawn(async move {
-                    if terminal::confirm("confirm").await.unwrap() {
-                        sas.confirm().await.unwrap();
-                    } else {
-                        sas.cancel().await.unwrap();
+                    tokio::time::sleep(delay).await;
+                    if let Err(e) = sas.confirm().await {
+                        warn!("confirming verification failed: {}", e);
                     }
                 });
             }
             SasState::Done { .. } => {
-                println!(
-                    "successfully verified device {} {}",
-                    other_user_id, other_device_id,
-                );
-
+                info!("successfully verified device {other_user_id} {other_device_id}");
                 break;
             }
             SasState::Cancelled(cancel_info) => {
-                println!(
+                warn!(
                     "verification has been cancelled, reason: {}",
                     cancel_info.reason()
                 );
-
                 break;
             }
             SasState::Started { .. } | SasState::Accepted { .. } | SasState::Confirmed => (),
@@ -64,66 +148,235 @@ async fn sas_verification_handler(sas: SasVerification) {
 }
 
 impl super::Client {
-    pub(crate) async fn set_sas_handlers(&self) -> anyhow::Result<()> {
-        self.inner.add_event_handler(
-            |ev: ToDeviceKeyVerificationRequestEvent, client: MatrixClient| async move {
-                let request = client
-                    .encryption()
-                    .get_verification_request(&ev.sender, &ev.content.transaction_id)
-                    .await
-                    .expect("Request object wasn't created");
-
-                request
-                    .accept()
-                    .await
-                    .expect("Can't accept verification request");
-            },
-        );
+    /// Accept verification requests from `allowed` users without interaction
+    /// and reject everybody else.
+    pub(crate) fn set_auto_verify_handlers(&self, allowed: Vec<OwnedUserId>, delay: Duration) {
+        let allowed = Arc::new(allowed);
 
+        let allowed_requests = allowed.clone();
         self.inner.add_event_handler(
-            |ev: ToDeviceKeyVerificationStartEvent, client: MatrixClient| async move {
-                if let Some(Verification::SasV1(sas)) = client
-                    .encryption()
-                    .get_verification(&ev.sender, ev.content.transaction_id.as_str())
-                    .await
-                {
-                    tokio::spawn(sas_verification_handler(sas));
-                }
-            },
-        );
-
-        self.inner.add_event_handler(
-            |ev: OriginalSyncRoomMessageEvent, client: MatrixClient| async move {
-                if let MessageType::VerificationRequest(_) = &ev.content.msgtype {
+            move |ev: ToDeviceKeyVerificationRequestEvent, client: MatrixClient| {
+                let allowed = allowed_requests.clone();
+                async move {
                     let Some(request) = client
                         .encryption()
-                        .get_verification_request(&ev.sender, &ev.event_id)
+                        .get_verification_request(&ev.sender, &ev.content.transaction_id)
                         .await
                     else {
-                        tracing::warn!("creating verification request failed");
+                        warn!("creating verification request failed");
                         return;
                     };
 
-                    let Ok(()) = request.accept().await else {
-                        tracing::warn!("can't accept verification request");
-                        return;
+                    let res = if allowed.contains(&ev.sender) {
+                        info!("accepting verification request from {}", ev.sender);
+                        request.accept().await
+                    } else {
+                        warn!("rejecting verification request from {}", ev.sender);
+                        request.cancel().await
                     };
+                    if let Err(e) = res {
+                        warn!("handling verification request failed: {}", e);
+                    }
                 }
             },
         );
 
         self.inner.add_event_handler(
-            |ev: OriginalSyncKeyVerificationStartEvent, client: MatrixClient| async move {
-                if let Some(Verification::SasV1(sas)) = client
-                    .encryption()
-                    .get_verification(&ev.sender, ev.content.relates_to.event_id.as_str())
-                    .await
-                {
-                    tokio::spawn(sas_verification_handler(sas));
+            move |ev: ToDeviceKeyVerificationStartEvent, client: MatrixClient| {
+                let allowed = allowed.clone();
+                async move {
+                    if !allowed.contains(&ev.sender) {
+                        return;
+                    }
+                    if let Some(Verification::SasV1(sas)) = client
+                        .encryption()
+                        .get_verification(&ev.sender, ev.content.transaction_id.as_str())
+                        .await
+                    {
+                        tokio::spawn(auto_sas_verification_handler(sas, delay));
+                    }
                 }
             },
         );
+    }
+
+    /// Accept the first verification request of anybody, to-device or in
+    /// a room, and return its SAS once the other side started it.
+    async fn incoming_sas(
+        &self,
+        in_flight: &Mutex<Option<InFlight>>,
+    ) -> anyhow::Result<SasVerification> {
+        let (tx, mut rx) = mpsc::unbounded_channel::<VerificationRequest>();
 
-        Ok(())
+        let requests = tx.clone();
+        let to_device = self.inner.add_event_handler(
+            move |ev: ToDeviceKeyVerificationRequestEvent, client: MatrixClient| {
+                let requests = requests.clone();
+                async move {
+                    match client
+                        .encryption()
+                        .get_verification_request(&ev.sender, &ev.content.transaction_id)
+                        .await
+                    {
+                        Some(request) => {
+                            let _ = requests.send(request);
+                        }
+                        None => warn!("creating verification request failed"),
+                    }
+                }
+            },
+        );
+        let in_room = self.inner.add_event_handler(
+            move |ev: OriginalSyncRoomMessageEvent, client: MatrixClient| {
+                let requests = tx.clone();
+                async move {
+                    let MessageType::VerificationRequest(_) = &ev.content.msgtype else {
+                        return;
+                    };
+                    match client
+                        .encryption()
+                        .get_verification_request(&ev.sender, &ev.event_id)
+                        .await
+                    {
+                        Some(request) => {
+                            let _ = requests.send(request);
+                        }
+                        None => warn!("creating verification request failed"),
+                    }
+                }
+            },
+        );
+
+        eprintln!("waiting for a verification request");
+        let request = rx.recv().await;
+        self.inner.remove_event_handler(to_device);
+        self.inner.remove_event_handler(in_room);
+        let Some(request) = request else {
+            anyhow::bail!("no verification request arrived");
+        };
+        *in_flight.lock().unwrap() = Some(InFlight::Request(request.clone()));
+        request.accept().await?;
+        self.await_sas(&request, false).await
+    }
+
+    /// Request a verification of `user_id`, i.e. of all its devices
+    /// through its cross-signing identity, or of `device_id` only.
+    async fn outgoing_sas(
+        &self,
+        user_id: &UserId,
+        device_id: Option<&DeviceId>,
+        in_flight: &Mutex<Option<InFlight>>,
+    ) -> anyhow::Result<SasVerification> {
+        let enc = self.inner.encryption();
+        let request = match device_id {
+            Some(device_id) => {
+                let Some(device) = enc.get_device(user_id, device_id).await? else {
+                    anyhow::bail!("unknown device {} of {}", device_id, user_id);
+                };
+                device.request_verification().await?
+            }
+            None => {
+                let Some(identity) = enc.get_user_identity(user_id).await? else {
+                    anyhow::bail!(
+                        "{} has no cross-signing identity; verify a single device with --device",
+                        user_id
+                    );
+                };
+                identity.request_verification().await?
+            }
+        };
+        *in_flight.lock().unwrap() = Some(InFlight::Request(request.clone()));
+        eprintln!("waiting for {} to accept the verification", user_id);
+        self.await_sas(&request, true).await
+    }
+
+    /// The SAS of `request`; started by us once the other side is ready
+    /// if `start`, otherwise we wait for the other side to start it.
+    async fn await_sas(
+        &self,
+        request: &VerificationRequest,
+        start: bool,
+    ) -> anyhow::Result<SasVerification> {
+        let mut changes = request.changes();
+        while let Some(state) = changes.next().await {
+            match state {
+                VerificationRequestState::Ready { .. } if start => {
+                    if let Some(sas) = request.start_sas().await? {
+                        return Ok(sas);
+                    }
+                    anyhow::bail!("the other device does not support SAS verification");
+                }
+                VerificationRequestState::Transitioned { verification, .. } => {
+                    let Verification::SasV1(sas) = verification else {
+                        anyhow::bail!("the other device started a verification other than SAS");
+                    };
+                    return Ok(sas);
+                }
+                VerificationRequestState::Cancelled(cancel_info) => {
+                    anyhow::bail!(
+                        "verification has been cancelled, reason: {}",
+                        cancel_info.reason()
+                    );
+                }
+                _ => {}
+            }
+        }
+        anyhow::bail!("verification request ended")
+    }
+
+    /// Run an interactive SAS verification, initiated by us with
+    /// `opts.user_id` or else by the other side. A sync loop runs while
+    /// the handshake is in flight; after `opts.timeout` it is cancelled.
+    pub(crate) async fn verify(&self, opts: &VerifyOptions) -> anyhow::Result<VerificationResult> {
+        // Other users only trust our device once it is cross-signed.
+        if let Err(e) = self
+            .inner
+            .encryption()
+            .bootstrap_cross_signing_if_needed(None)
+            .await
+        {
+            warn!("bootstrapping cross-signing failed: {}", e);
+        }
+
+        let in_flight = Mutex::new(None);
+        let handshake = async {
+            let sas = match opts.user_id {
+                Some(ref user_id) => {
+                    self.outgoing_sas(user_id, opts.device_id.as_deref(), &in_flight)
+                        .await?
+                }
+                None => self.incoming_sas(&in_flight).await?,
+            };
+            *in_flight.lock().unwrap() = Some(InFlight::Sas(sas.clone()));
+            sas_verification_handler(sas).await
+        };
+
+        let result = tokio::select! {
+            result = tokio::time::timeout(opts.timeout, handshake) => result,
+            result = self.sync_forever() => {
+                result?;
+                anyhow::bail!("sync ended");
+            }
+        };
+        if let Ok(result) = result {
+            return result;
+        }
+
+        let pending = in_flight.lock().unwrap().clone();
+        let cancelled = match pending {
+            Some(InFlight::Request(request)) => request.cancel().await,
+            Some(InFlight::Sas(sas)) => sas.cancel().await,
+            None => Ok(()),
+        };
+        if let Err(e) = cancelled {
+            warn!("cancelling verification failed: {}", e);
+        }
+        Ok(VerificationResult {
+            user_id: opts.user_id.as_ref().map(|u| u.to_string()),
+            device_id: opts.device_id.as_ref().map(|d| d.to_string()),
+            verified: false,
+            reason: Some(String::from("the other side did not answer in time")),
+            timed_out: true,
+        })
     }
 }
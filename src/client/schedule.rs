@@ -0,0 +1,290 @@
+use std::collections::BTreeMap;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::bail;
+use matrix_sdk::ruma::api::client::config::{get_global_account_data, set_global_account_data};
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::events::GlobalAccountDataEventType;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::OwnedRoomId;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use tracing::{info, warn};
+
+use crate::cron::Cron;
+use crate::outputs::{ScheduleEntry, ScheduleSent};
+
+/// Global account data type holding the schedules by id.
+const SCHEDULES_TYPE: &str = "io.github.mnotify.schedules";
+/// Prefix of the per-schedule account data type recording the last run.
+const RUN_TYPE_PREFIX: &str = "io.github.mnotify.schedule_run.";
+/// Time for concurrent claims of other hosts to arrive before ours is
+/// checked again.
+const CLAIM_SETTLE: Duration = Duration::from_secs(3);
+
+/// The schedules by id. Each change bumps the revision, so that of two
+/// concurrent changes only one is applied.
+#[derive(Debug, Default, Deserialize, Serialize)]
+struct Schedules {
+    revision: u64,
+    schedules: BTreeMap<String, Schedule>,
+}
+
+/// A recurring message.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+pub(crate) struct Schedule {
+    pub(crate) cron: String,
+    pub(crate) room_id: OwnedRoomId,
+    pub(crate) message: String,
+    #[serde(default)]
+    pub(crate) notice: bool,
+    #[serde(default)]
+    pub(crate) markdown: bool,
+    /// Unix timestamp in seconds; no run before it is due
+    pub(crate) created_at: u64,
+}
+
+/// The last run of a schedule. Hosts claim a run by writing it and only
+/// send if their claim is still in place after `CLAIM_SETTLE`.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+struct ScheduleRun {
+    /// Unix timestamp in seconds of the cron minute which was sent
+    last_run: u64,
+    /// Device id of the host which sent it
+    claimed_by: String,
+    revision: u64,
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn run_type(id: &str) -> String {
+    format!("{}{}", RUN_TYPE_PREFIX, id)
+}
+
+/// The revision of account data content; 0 if it was never written or
+/// was reset to an empty object.
+fn revision(content: Option<&Value>) -> u64 {
+    content
+        .and_then(|c| c.get("revision"))
+        .and_then(Value::as_u64)
+        .unwrap_or(0)
+}
+
+impl super::Client {
+    pub(super) async fn get_global_account_data(
+        &self,
+        event_type: &str,
+    ) -> anyhow::Result<Option<Value>> {
+        let request = get_global_account_data::v3::Request::new(
+            self.user_id.clone(),
+            GlobalAccountDataEventType::from(event_type),
+        );
+        match self.inner.send(request, None).await {
+            Ok(resp) => Ok(Some(resp.account_data.deserialize_as::<Value>()?)),
+            Err(e) if matches!(e.client_api_error_kind(), Some(ErrorKind::NotFound)) => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    pub(super) async fn put_global_account_data(
+        &self,
+        event_type: &str,
+        content: &Value,
+    ) -> anyhow::Result<()> {
+        let request = set_global_account_data::v3::Request::new_raw(
+            self.user_id.clone(),
+            GlobalAccountDataEventType::from(event_type),
+            Raw::new(content)?.cast(),
+        );
+        self.inner.send(request, None).await?;
+        Ok(())
+    }
+
+    /// Write `content` if the revision of `event_type` is still
+    /// `expected`; false if another host changed it first. Account data
+    /// has no compare-and-swap, so the revision is compared right before
+    /// writing and our write is checked again after `CLAIM_SETTLE`.
+    async fn swap_global_account_data(
+        &self,
+        event_type: &str,
+        expected: u64,
+        content: &Value,
+    ) -> anyhow::Result<bool> {
+        let current = self.get_global_account_data(event_type).await?;
+        if revision(current.as_ref()) != expected {
+            return Ok(false);
+        }
+        self.put_global_account_data(event_type, content).await?;
+        tokio::time::sleep(CLAIM_SETTLE).await;
+        let current = self.get_global_account_data(event_type).await?;
+        Ok(current.as_ref() == Some(content))
+    }
+
+    async fn schedules(&self) -> anyhow::Result<Schedules> {
+        match self.get_global_account_data(SCHEDULES_TYPE).await? {
+            // Schedules written before revisions were added.
+            Some(content) if content.get("schedules").is_none() => Ok(Schedules {
+                revision: 0,
+                schedules: serde_json::from_value(content)?,
+            }),
+            Some(content) => Ok(serde_json::from_value(content)?),
+            None => Ok(Schedules::default()),
+        }
+    }
+
+    /// Write the changed `schedules` with the next revision.
+    async fn put_schedules(&self, mut schedules: Schedules) -> anyhow::Result<()> {
+        let expected = schedules.revision;
+        schedules.revision += 1;
+        let content = serde_json::to_value(&schedules)?;
+        if !self
+            .swap_global_account_data(SCHEDULES_TYPE, expected, &content)
+            .await?
+        {
+            bail!("the schedules were changed concurrently; try again");
+        }
+        Ok(())
+    }
+
+    async fn schedule_run(&self, id: &str) -> anyhow::Result<Option<ScheduleRun>> {
+        match self.get_global_account_data(&run_type(id)).await? {
+            // An empty object is what remains after removing a schedule.
+            Some(Value::Object(o)) if o.is_empty() => Ok(None),
+            Some(content) => Ok(Some(serde_json::from_value(content)?)),
+            None => Ok(None),
+        }
+    }
+
+    pub(crate) async fn add_schedule(&self, id: &str, schedule: Schedule) -> anyhow::Result<()> {
+        Cron::parse(&schedule.cron)?;
+        self.get_joined_room(&schedule.room_id)?;
+        let mut schedules = self.schedules().await?;
+        if schedules.schedules.contains_key(id) {
+            bail!("schedule {} exists; remove it first", id);
+        }
+        schedules.schedules.insert(id.to_string(), schedule);
+        self.put_schedules(schedules).await
+    }
+
+    pub(crate) async fn remove_schedule(&self, id: &str) -> anyhow::Result<()> {
+        let mut schedules = self.schedules().await?;
+        if schedules.schedules.remove(id).is_none() {
+            bail!("no such schedule: {}", id);
+        }
+        self.put_schedules(schedules).await?;
+        // Account data cannot be deleted.
+        self.put_global_account_data(&run_type(id), &json!({}))
+            .await
+    }
+
+    pub(crate) async fn list_schedules(&self) -> anyhow::Result<Vec<ScheduleEntry>> {
+        let mut entries = vec![];
+        for (id, schedule) in self.schedules().await?.schedules {
+            let run = self.schedule_run(&id).await?;
+            entries.push(ScheduleEntry {
+                last_run: run.as_ref().map(|r| r.last_run),
+                last_run_by: run.map(|r| r.claimed_by),
+                id,
+                cron: schedule.cron,
+                room_id: schedule.room_id.to_string(),
+                message: schedule.message,
+            });
+        }
+        Ok(entries)
+    }
+
+    /// Claim the run of `slot`; false if another host claimed it or the
+    /// run changed since `previous` was read.
+    async fn claim_run(
+        &self,
+        id: &str,
+        previous: Option<&ScheduleRun>,
+        slot: u64,
+    ) -> anyhow::Result<bool> {
+        let device_id = self
+            .inner
+            .device_id()
+            .map(|d| d.to_string())
+            .unwrap_or_default();
+        let expected = previous.map_or(0, |r| r.revision);
+        let claim = ScheduleRun {
+            last_run: slot,
+            claimed_by: device_id,
+            revision: expected + 1,
+        };
+        self.swap_global_account_data(&run_type(id), expected, &serde_json::to_value(&claim)?)
+            .await
+    }
+
+    /// Send the due messages once; each is printed as NDJSON.
+    async fn run_due_schedules(&self) -> anyhow::Result<()> {
+        let now = now_secs();
+        for (id, schedule) in self.schedules().await?.schedules {
+            let cron = match Cron::parse(&schedule.cron) {
+                Ok(cron) => cron,
+                Err(e) => {
+                    warn!("skipping schedule {}: {}", id, e);
+                    continue;
+                }
+            };
+            let run = self.schedule_run(&id).await?;
+            let after = run
+                .as_ref()
+                .map_or(schedule.created_at, |r| r.last_run.max(schedule.created_at));
+            let Some(slot) = cron.latest_due(after, now) else {
+                continue;
+            };
+            if !self.claim_run(&id, run.as_ref(), slot).await? {
+                info!("schedule {} was run by another host", id);
+                continue;
+            }
+
+            let result = match (schedule.notice, schedule.markdown) {
+                (true, markdown) => {
+                    self.send_notice(&schedule.room_id, &schedule.message, markdown)
+                        .await
+                }
+                (false, markdown) => {
+                    self.send_message(&schedule.room_id, &schedule.message, markdown)
+                        .await
+                }
+            };
+            let (event_id, error) = match result {
+                Ok(event_id) => (event_id.map(|e| e.to_string()), None),
+                Err(e) => {
+                    warn!("sending schedule {} failed: {}", id, e);
+                    (None, Some(e.to_string()))
+                }
+            };
+            let sent = ScheduleSent {
+                id,
+                room_id: schedule.room_id.to_string(),
+                slot,
+                event_id,
+                error,
+            };
+            println!("{}", serde_json::to_string(&sent)?);
+        }
+        Ok(())
+    }
+
+    /// Send due messages every minute, or only once for hosts which run
+    /// `mn schedule run --once` from cron themselves. Runs are recorded in
+    /// the account data, so several hosts may run schedules concurrently.
+    pub(crate) async fn run_schedules(&self, once: bool) -> anyhow::Result<()> {
+        loop {
+            self.run_due_schedules().await?;
+            if once {
+                return Ok(());
+            }
+            let now = SystemTime::now().duration_since(UNIX_EPOCH)?;
+            let next_minute = 60 - now.as_secs() % 60;
+            tokio::time::sleep(Duration::from_secs(next_minute)).await;
+        }
+    }
+}
@@ -1,15 +1,18 @@
 use std::env;
 use std::fs;
-use std::io;
-use std::os::unix::fs::PermissionsExt;
+use std::io::{self, Write};
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
 use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
 
 use anyhow::bail;
 use matrix_sdk::matrix_auth::MatrixSession;
-use matrix_sdk::ruma::{OwnedUserId, UserId};
+use matrix_sdk::ruma::{OwnedRoomId, OwnedUserId, UserId};
 use serde::{Deserialize, Serialize};
-use tracing::error;
+use tracing::{error, warn};
 
+use super::oauth::OAuthMeta;
+use super::vault;
 use super::CRATE_NAME;
 
 pub(crate) fn session_json_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
@@ -26,6 +29,127 @@ pub(crate) fn state_db_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathB
     Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("state.sqlite"))?)
 }
 
+pub(crate) fn archive_db_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("archive.sqlite"))?)
+}
+
+pub(crate) fn room_cache_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("rooms.json"))?)
+}
+
+pub(crate) fn sent_cache_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("sent.json"))?)
+}
+
+pub(crate) fn user_agents_cache_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("user_agents.json"))?)
+}
+
+pub(crate) fn hook_positions_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("hook_positions.json"))?)
+}
+
+pub(crate) fn autojoined_path(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.place_state_file(Path::new(&user_id.to_string()).join("autojoined.json"))?)
+}
+
+/// Write `data` to a temporary file next to `path` and rename it, so
+/// that readers never see a partially written file.
+pub(crate) fn write_atomic(path: impl AsRef<Path>, data: &[u8], mode: u32) -> anyhow::Result<()> {
+    let path = path.as_ref();
+    let mut tmp = path.as_os_str().to_owned();
+    tmp.push(".tmp");
+    let tmp = PathBuf::from(tmp);
+
+    // Created with the mode, so that it is never readable by others
+    // under a lax umask.
+    let mut file = fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(mode)
+        .open(&tmp)?;
+    file.set_permissions(fs::Permissions::from_mode(mode))?;
+    file.write_all(data)?;
+    drop(file);
+    if let Err(e) = fs::rename(&tmp, path) {
+        let _ = fs::remove_file(&tmp);
+        return Err(e.into());
+    }
+    Ok(())
+}
+
+/// A lock file next to a state file, held by concurrent `mn` processes
+/// while they read, modify and write it. It is removed on drop.
+pub(crate) struct FileLock {
+    path: PathBuf,
+}
+
+impl FileLock {
+    /// Waited for a lock file before giving up.
+    const WAIT: Duration = Duration::from_secs(10);
+    /// A lock file older than this is left over from a crash.
+    const STALE: Duration = Duration::from_secs(60);
+
+    pub(crate) fn acquire(path: impl AsRef<Path>) -> anyhow::Result<Self> {
+        let mut lock = path.as_ref().as_os_str().to_owned();
+        lock.push(".lock");
+        let path = PathBuf::from(lock);
+
+        let started = SystemTime::now();
+        loop {
+            match fs::OpenOptions::new()
+                .write(true)
+                .create_new(true)
+                .mode(0o600)
+                .open(&path)
+            {
+                Ok(_) => return Ok(Self { path }),
+                Err(e) if e.kind() == io::ErrorKind::AlreadyExists => {}
+                Err(e) => return Err(e.into()),
+            }
+            let age = fs::metadata(&path)
+                .and_then(|m| m.modified())
+                .ok()
+                .and_then(|m| m.elapsed().ok());
+            if age.is_some_and(|age| age > Self::STALE) {
+                let _ = fs::remove_file(&path);
+                continue;
+            }
+            if started.elapsed().unwrap_or_default() > Self::WAIT {
+                bail!("{} is held by another process", path.display());
+            }
+            std::thread::sleep(Duration::from_millis(50));
+        }
+    }
+}
+
+impl Drop for FileLock {
+    fn drop(&mut self) {
+        if let Err(e) = fs::remove_file(&self.path) {
+            warn!("removing {}: {}", self.path.display(), e);
+        }
+    }
+}
+
 fn load_session_json(path: impl AsRef<Path>) -> anyhow::Result<Option<MatrixSession>> {
     let raw = fs::read_to_string(path)?;
     // TODO: Handle None case.
@@ -40,6 +164,9 @@ fn load_session_keyring(user_id: impl AsRef<UserId>) -> anyhow::Result<Option<Ma
 }
 
 pub(crate) fn load_session(user_id: impl AsRef<UserId>) -> anyhow::Result<Option<MatrixSession>> {
+    if vault::is_encrypted()? {
+        return Ok(serde_json::from_value(vault::get("session")?)?);
+    }
     if env::var("MN_NO_KEYRING").is_ok() {
         load_session_json(session_json_path(user_id)?)
     } else {
@@ -53,16 +180,7 @@ fn persist_session_json(path: impl AsRef<Path>, session: &MatrixSession) -> anyh
         out.push('\n');
     }
 
-    fs::write(&path, &out)?;
-
-    let mut perms = fs::metadata(&path)?.permissions();
-
-    let mode = 0o600;
-    if perms.mode() != mode {
-        perms.set_mode(mode);
-    }
-
-    Ok(())
+    write_atomic(path, out.as_bytes(), 0o600)
 }
 
 fn persist_session_keyring(
@@ -78,6 +196,9 @@ pub(crate) fn persist_session(
     user_id: impl AsRef<UserId>,
     session: &MatrixSession,
 ) -> anyhow::Result<()> {
+    if vault::is_encrypted()? {
+        return vault::set("session", serde_json::to_value(session)?);
+    }
     if env::var("MN_NO_KEYRING").is_ok() {
         persist_session_json(session_json_path(user_id)?, session)
     } else {
@@ -96,7 +217,9 @@ fn delete_session_keyring(user_id: impl AsRef<UserId>) -> anyhow::Result<()> {
     Ok(())
 }
 
-pub(crate) fn delete_session(user_id: impl AsRef<UserId>) -> anyhow::Result<()> {
+/// Delete the session of meta.json, i.e. not the one of an encrypted
+/// config.
+pub(super) fn delete_plain_session(user_id: impl AsRef<UserId>) -> anyhow::Result<()> {
     if env::var("MN_NO_KEYRING").is_ok() {
         delete_session_json(session_json_path(user_id)?)
     } else {
@@ -104,6 +227,13 @@ pub(crate) fn delete_session(user_id: impl AsRef<UserId>) -> anyhow::Result<()>
     }
 }
 
+pub(crate) fn delete_session(user_id: impl AsRef<UserId>) -> anyhow::Result<()> {
+    if vault::is_encrypted()? {
+        return vault::set("session", serde_json::Value::Null);
+    }
+    delete_plain_session(user_id)
+}
+
 pub(crate) fn meta_path() -> io::Result<PathBuf> {
     match env::var("MN_META_FILE") {
         Ok(path) => Ok(path.into()),
@@ -131,7 +261,16 @@ impl super::Client {
         if let Err(e) = self.delete_state_store() {
             error!("delete state store: {}", e);
         }
-        if let Err(e) = fs::remove_file(meta_path()?) {
+        if let Err(e) = fs::remove_file(room_cache_path(&self.user_id)?) {
+            if e.kind() != io::ErrorKind::NotFound {
+                error!("delete room cache: {}", e);
+            }
+        }
+        if vault::is_encrypted()? {
+            if let Err(e) = vault::delete() {
+                error!("delete encrypted config: {}", e);
+            }
+        } else if let Err(e) = fs::remove_file(meta_path()?) {
             error!("delete meta.json: {}", e);
         }
         Ok(())
@@ -152,14 +291,26 @@ impl super::Client {
 pub(crate) struct Meta {
     pub(crate) user_id: OwnedUserId,
     pub(crate) device_name: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) oauth: Option<OAuthMeta>,
+    /// Room messages are sent to without --room-id
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) default_room: Option<OwnedRoomId>,
+    /// Whether the sync loop writes the events into the archive
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub(crate) archive: bool,
 }
 
 impl Meta {
     pub(crate) fn exists() -> io::Result<bool> {
-        meta_path()?.try_exists()
+        Ok(meta_path()?.try_exists()? || vault::is_encrypted()?)
     }
 
+    /// Read meta.json, or the meta of the encrypted config.
     pub(crate) fn load() -> anyhow::Result<Self> {
+        if vault::is_encrypted()? {
+            return Ok(serde_json::from_value(vault::get("meta")?)?);
+        }
         let raw = fs::read_to_string(meta_path()?)?;
         if raw.is_empty() {
             bail!("empty file");
@@ -169,11 +320,13 @@ impl Meta {
     }
 
     pub(crate) fn dump(&self) -> anyhow::Result<()> {
+        if vault::is_encrypted()? {
+            return vault::set("meta", serde_json::to_value(self)?);
+        }
         let mut raw = serde_json::to_string(&self)?;
         if !raw.ends_with('\n') {
             raw += "\n";
         }
-        fs::write(meta_path()?, raw)?;
-        Ok(())
+        write_atomic(meta_path()?, raw.as_bytes(), 0o644)
     }
 }
@@ -0,0 +1,289 @@
+use std::fs;
+use std::path::Path;
+
+use anyhow::{anyhow, bail};
+use base64::engine::general_purpose::{STANDARD_NO_PAD, URL_SAFE_NO_PAD};
+use base64::Engine;
+use matrix_sdk::ruma::api::client::room::get_room_event;
+use matrix_sdk::ruma::canonical_json::redact;
+use matrix_sdk::ruma::{CanonicalJsonObject, CanonicalJsonValue, EventId, RoomId, RoomVersionId};
+use matrix_sdk_crypto::vodozemac::{Ed25519PublicKey, Ed25519SecretKey};
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::keys::{signed_bytes, verify};
+use crate::outputs::{EventSignature, EventVerification, HashCheck};
+
+/// A synapse signing key file, e.g. `ed25519 a_abcd <base64 seed>`.
+pub(crate) struct SigningKey {
+    pub(crate) origin: String,
+    key_id: String,
+    secret: Ed25519SecretKey,
+}
+
+impl SigningKey {
+    pub(crate) fn load(origin: &str, path: impl AsRef<Path>) -> anyhow::Result<Self> {
+        let raw = fs::read_to_string(path)?;
+        let mut fields = raw.split_whitespace();
+        let (Some("ed25519"), Some(version), Some(seed)) =
+            (fields.next(), fields.next(), fields.next())
+        else {
+            bail!("invalid signing key file; expected `ed25519 <version> <seed>`");
+        };
+        let seed: [u8; 32] = STANDARD_NO_PAD
+            .decode(seed.trim_end_matches('='))?
+            .try_into()
+            .map_err(|_| anyhow!("the signing key seed must be 32 bytes"))?;
+
+        Ok(Self {
+            origin: origin.to_string(),
+            key_id: format!("ed25519:{}", version),
+            secret: Ed25519SecretKey::from_slice(&seed),
+        })
+    }
+
+    /// The X-Matrix authorization header of a federation request.
+    fn authorization(&self, method: &str, uri: &str, destination: &str) -> anyhow::Result<String> {
+        let request = json!({
+            "method": method,
+            "uri": uri,
+            "origin": self.origin,
+            "destination": destination,
+        });
+        let signature = self.secret.sign(&signed_bytes(&request)?);
+        Ok(format!(
+            "X-Matrix origin=\"{}\",destination=\"{}\",key=\"{}\",sig=\"{}\"",
+            self.origin,
+            destination,
+            self.key_id,
+            signature.to_base64()
+        ))
+    }
+}
+
+fn sha256(data: &[u8]) -> Vec<u8> {
+    Sha256::digest(data).to_vec()
+}
+
+fn canonical_object(value: &Value) -> anyhow::Result<CanonicalJsonObject> {
+    match CanonicalJsonValue::try_from(value.clone())? {
+        CanonicalJsonValue::Object(object) => Ok(object),
+        _ => bail!("event is not a JSON object"),
+    }
+}
+
+// The characters of event ids which have to be escaped in paths.
+fn escape_path(s: &str) -> String {
+    s.replace('%', "%25")
+        .replace('/', "%2F")
+        .replace('+', "%2B")
+        .replace('$', "%24")
+}
+
+impl super::Client {
+    /// Resolve the federation base url of `server_name` via
+    /// `.well-known/matrix/server`; SRV records are not supported.
+    async fn federation_url(&self, server_name: &str) -> anyhow::Result<String> {
+        let http = self.http_client();
+        let url = format!("https://{}/.well-known/matrix/server", server_name);
+        let delegated = match http.get(url).send().await {
+            Ok(resp) if resp.status().is_success() => resp
+                .json::<Value>()
+                .await
+                .ok()
+                .and_then(|v| v.get("m.server").and_then(Value::as_str).map(String::from)),
+            _ => None,
+        };
+        let host = delegated.unwrap_or_else(|| server_name.to_string());
+        if host.contains(':') {
+            Ok(format!("https://{}", host))
+        } else {
+            Ok(format!("https://{}:8448", host))
+        }
+    }
+
+    async fn server_keys(&self, server_name: &str) -> anyhow::Result<Value> {
+        let base = self.federation_url(server_name).await?;
+        let url = format!("{}/_matrix/key/v2/server", base);
+        Ok(self
+            .http_client()
+            .get(url)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await?)
+    }
+
+    async fn federation_event(
+        &self,
+        event_id: &EventId,
+        key: &SigningKey,
+    ) -> anyhow::Result<Value> {
+        // Our own homeserver has every event of the rooms we are in.
+        let destination = self.user_id.server_name().to_string();
+        let uri = format!(
+            "/_matrix/federation/v1/event/{}",
+            escape_path(event_id.as_str())
+        );
+        let base = self.federation_url(&destination).await?;
+        let authorization = key.authorization("GET", &uri, &destination)?;
+
+        let resp: Value = self
+            .http_client()
+            .get(format!("{}{}", base, uri))
+            .header("Authorization", authorization)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await?;
+        resp.pointer("/pdus/0")
+            .cloned()
+            .ok_or_else(|| anyhow!("{} returned no pdu", destination))
+    }
+
+    /// Recompute the hashes of an event and check the signatures of the
+    /// servers which signed it.
+    pub(crate) async fn verify_event(
+        &self,
+        room_id: &RoomId,
+        event_id: &EventId,
+        federation: Option<&SigningKey>,
+    ) -> anyhow::Result<EventVerification> {
+        let (source, event) = match federation {
+            Some(key) => ("federation", self.federation_event(event_id, key).await?),
+            None => {
+                let request =
+                    get_room_event::v3::Request::new(room_id.to_owned(), event_id.to_owned());
+                let resp = self.inner.send(request, None).await?;
+                ("client", resp.event.deserialize_as::<Value>()?)
+            }
+        };
+
+        let room_version = self
+            .get_state(room_id, "m.room.create", "")
+            .await?
+            .and_then(|c| {
+                c.get("room_version")
+                    .and_then(Value::as_str)
+                    .map(String::from)
+            })
+            .unwrap_or_else(|| String::from("1"));
+        let version = RoomVersionId::try_from(room_version.as_str())?;
+
+        let mut object = canonical_object(&event)?;
+        object.remove("unsigned");
+        // Without them, e.g. from the client API, nothing can be checked.
+        let complete = object.contains_key("hashes") && object.contains_key("signatures");
+        // Only room versions 1 and 2 include the event id in the event.
+        if !matches!(version, RoomVersionId::V1 | RoomVersionId::V2) {
+            object.remove("event_id");
+        }
+        let canonical_json = CanonicalJsonValue::Object(object.clone()).to_string();
+
+        // Content hash: everything but signatures and hashes.
+        let mut content = object.clone();
+        content.remove("signatures");
+        let expected = content
+            .remove("hashes")
+            .and_then(|h| match h {
+                CanonicalJsonValue::Object(mut h) => h.remove("sha256"),
+                _ => None,
+            })
+            .and_then(|h| match h {
+                CanonicalJsonValue::String(h) => Some(h),
+                _ => None,
+            });
+        let computed = STANDARD_NO_PAD.encode(sha256(
+            CanonicalJsonValue::Object(content).to_string().as_bytes(),
+        ));
+        let content_hash = HashCheck {
+            valid: expected.as_deref().map(|e| e == computed),
+            expected,
+            computed,
+        };
+
+        let mut redacted = redact(object.clone(), &version, None)?;
+        let signatures = redacted.remove("signatures");
+        let signed = CanonicalJsonValue::Object(redacted).to_string();
+
+        // Reference hash: the event id of room versions 3 and later.
+        let reference = sha256(signed.as_bytes());
+        let reference_hash = match version {
+            RoomVersionId::V1 | RoomVersionId::V2 => None,
+            RoomVersionId::V3 => Some(format!("${}", STANDARD_NO_PAD.encode(reference))),
+            _ => Some(format!("${}", URL_SAFE_NO_PAD.encode(reference))),
+        };
+        let reference_hash = reference_hash.map(|computed| HashCheck {
+            valid: complete.then(|| computed == event_id.as_str()),
+            expected: Some(event_id.to_string()),
+            computed,
+        });
+
+        let mut checks = vec![];
+        let signatures = match signatures {
+            Some(signatures) => serde_json::to_value(signatures)?,
+            None => Value::Null,
+        };
+        for (server, keys) in signatures.as_object().into_iter().flatten() {
+            let server_keys = self.server_keys(server).await;
+            for (key_id, signature) in keys.as_object().into_iter().flatten() {
+                let mut check = EventSignature {
+                    server: server.clone(),
+                    key_id: key_id.clone(),
+                    valid: None,
+                    error: None,
+                };
+                let key = match server_keys {
+                    Ok(ref server_keys) => server_keys
+                        .pointer(&format!("/verify_keys/{}/key", key_id))
+                        .or_else(|| {
+                            server_keys.pointer(&format!("/old_verify_keys/{}/key", key_id))
+                        })
+                        .and_then(Value::as_str),
+                    Err(ref e) => {
+                        check.error = Some(format!("cannot fetch server keys: {}", e));
+                        None
+                    }
+                };
+                match key.map(Ed25519PublicKey::from_base64) {
+                    Some(Ok(key)) => {
+                        let signature = signature.as_str().unwrap_or("");
+                        check.valid = Some(verify(&key, signed.as_bytes(), signature));
+                    }
+                    Some(Err(e)) => check.error = Some(format!("invalid server key: {}", e)),
+                    None if check.error.is_none() => {
+                        check.error = Some(String::from("unknown key"));
+                    }
+                    None => {}
+                }
+                checks.push(check);
+            }
+        }
+
+        let mut results = vec![content_hash.valid];
+        results.extend(reference_hash.iter().map(|h| h.valid));
+        results.extend(checks.iter().map(|s| s.valid));
+        let verdict = if !complete || checks.is_empty() {
+            "unverifiable"
+        } else if results.contains(&Some(false)) {
+            "invalid"
+        } else if results.contains(&None) {
+            "unverifiable"
+        } else {
+            "valid"
+        };
+
+        Ok(EventVerification {
+            event_id: event_id.to_string(),
+            room_version,
+            source,
+            verdict,
+            canonical_json,
+            content_hash,
+            reference_hash,
+            signatures: checks,
+        })
+    }
+}
@@ -0,0 +1,297 @@
+use std::collections::BTreeMap;
+use std::fs::File;
+use std::io::{self, BufRead, BufReader, BufWriter, Write};
+use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, bail};
+use flate2::read::MultiGzDecoder;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use matrix_sdk::ruma::{OwnedRoomId, RoomId, UserId};
+use matrix_sdk::RoomMemberships;
+use serde::Serialize;
+use serde_json::Value;
+
+use crate::outputs::{SnapshotChange, SnapshotDiff, SnapshotHeader, SnapshotMember};
+
+/// Version of the snapshot format.
+const FORMAT_VERSION: u64 = 1;
+
+/// State events recorded besides the members.
+const KEY_STATE: &[&str] = &[
+    "m.room.create",
+    "m.room.name",
+    "m.room.topic",
+    "m.room.canonical_alias",
+    "m.room.join_rules",
+    "m.room.history_visibility",
+    "m.room.guest_access",
+    "m.room.encryption",
+    "m.room.power_levels",
+    "m.room.server_acl",
+    "m.room.tombstone",
+];
+
+/// Gzip streams start with these bytes.
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+fn write_line(out: &mut impl Write, value: &impl Serialize) -> anyhow::Result<()> {
+    serde_json::to_writer(&mut *out, value)?;
+    out.write_all(b"\n")?;
+    Ok(())
+}
+
+fn write_lines<W: Write>(
+    mut out: W,
+    header: &SnapshotHeader,
+    members: &[SnapshotMember],
+) -> anyhow::Result<W> {
+    write_line(&mut out, header)?;
+    for member in members {
+        write_line(&mut out, member)?;
+    }
+    Ok(out)
+}
+
+impl super::Client {
+    /// Write a snapshot of the members of a room with their display names
+    /// and power levels, and of its key state events, to `path` or stdout.
+    /// The snapshot is NDJSON: a header line with the state followed by one
+    /// line per member, so that large rooms are written and read
+    /// incrementally. Returns the number of members.
+    pub(crate) async fn snapshot_room(
+        &self,
+        room_id: &RoomId,
+        path: Option<&Path>,
+        gzip: bool,
+    ) -> anyhow::Result<usize> {
+        let room = self.get_joined_room(room_id)?;
+
+        let mut state = BTreeMap::new();
+        for event_type in KEY_STATE {
+            if let Some(content) = self.get_state(room_id, event_type, "").await? {
+                state.insert(event_type.to_string(), content);
+            }
+        }
+        let header = SnapshotHeader {
+            version: FORMAT_VERSION,
+            room_id: room_id.to_string(),
+            taken_at: now_millis(),
+            state,
+        };
+
+        let mut members: Vec<SnapshotMember> = room
+            .members(RoomMemberships::all())
+            .await?
+            .iter()
+            .map(|m| SnapshotMember {
+                user_id: m.user_id().to_string(),
+                display_name: m.display_name().map(String::from),
+                membership: m.membership().to_string(),
+                power_level: m.power_level(),
+            })
+            .collect();
+        members.sort_by(|a, b| a.user_id.cmp(&b.user_id));
+
+        let out: Box<dyn Write> = match path {
+            Some(path) => Box::new(File::create(path)?),
+            None => Box::new(io::stdout()),
+        };
+        let out = BufWriter::new(out);
+        if gzip {
+            let encoder = GzEncoder::new(out, Compression::default());
+            write_lines(encoder, &header, &members)?.finish()?.flush()?;
+        } else {
+            write_lines(out, &header, &members)?.flush()?;
+        }
+        Ok(members.len())
+    }
+}
+
+/// Read a snapshot written by `snapshot_room`; gzip compressed snapshots
+/// are detected by their magic bytes.
+fn read_snapshot(
+    path: &Path,
+) -> anyhow::Result<(SnapshotHeader, BTreeMap<String, SnapshotMember>)> {
+    let mut file = BufReader::new(File::open(path)?);
+    let gzip = file.fill_buf()?.starts_with(&GZIP_MAGIC);
+    let reader: Box<dyn BufRead> = if gzip {
+        Box::new(BufReader::new(MultiGzDecoder::new(file)))
+    } else {
+        Box::new(file)
+    };
+
+    let mut lines = reader.lines();
+    let header = lines
+        .next()
+        .ok_or_else(|| anyhow!("{}: empty snapshot", path.display()))??;
+    let header: SnapshotHeader = serde_json::from_str(&header)
+        .map_err(|e| anyhow!("{}: invalid header: {}", path.display(), e))?;
+    if header.version != FORMAT_VERSION {
+        bail!(
+            "{}: unsupported snapshot version {}",
+            path.display(),
+            header.version
+        );
+    }
+
+    let mut members = BTreeMap::new();
+    for (n, line) in lines.enumerate() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let member: SnapshotMember = serde_json::from_str(&line)
+            .map_err(|e| anyhow!("{}:{}: {}", path.display(), n + 2, e))?;
+        members.insert(member.user_id.clone(), member);
+    }
+    Ok((header, members))
+}
+
+/// A room as recorded by a snapshot, to which `send --preview --fixture`
+/// posts without a session or server.
+#[derive(Debug)]
+pub(crate) struct RoomFixture {
+    pub(crate) room_id: OwnedRoomId,
+    pub(crate) encrypted: bool,
+    members: BTreeMap<String, SnapshotMember>,
+}
+
+impl RoomFixture {
+    pub(crate) fn load(path: &Path) -> anyhow::Result<Self> {
+        let (header, members) = read_snapshot(path)?;
+        Ok(Self {
+            room_id: RoomId::parse(&header.room_id)?,
+            encrypted: header.state.contains_key("m.room.encryption"),
+            members,
+        })
+    }
+
+    /// The display name of `user_id` in the room, if it has one.
+    pub(crate) fn display_name(&self, user_id: &UserId) -> Option<&str> {
+        self.members.get(user_id.as_str())?.display_name.as_deref()
+    }
+}
+
+fn is_joined(member: Option<&SnapshotMember>) -> bool {
+    member.is_some_and(|m| m.membership == "join")
+}
+
+/// Compare two snapshots of the same room.
+pub(crate) fn diff_snapshots(old: &Path, new: &Path) -> anyhow::Result<SnapshotDiff> {
+    let (old_header, old_members) = read_snapshot(old)?;
+    let (new_header, new_members) = read_snapshot(new)?;
+    if old_header.room_id != new_header.room_id {
+        bail!(
+            "the snapshots are of different rooms: {} and {}",
+            old_header.room_id,
+            new_header.room_id
+        );
+    }
+
+    let mut diff = SnapshotDiff {
+        room_id: new_header.room_id.clone(),
+        old_taken_at: old_header.taken_at,
+        new_taken_at: new_header.taken_at,
+        joined: vec![],
+        left: vec![],
+        renamed: vec![],
+        power_changed: vec![],
+        state_changed: vec![],
+    };
+
+    let mut user_ids: Vec<&String> = old_members.keys().chain(new_members.keys()).collect();
+    user_ids.sort();
+    user_ids.dedup();
+    for user_id in user_ids {
+        let before = old_members.get(user_id);
+        let after = new_members.get(user_id);
+        match (is_joined(before), is_joined(after)) {
+            (false, true) => diff.joined.push(user_id.clone()),
+            (true, false) => diff.left.push(user_id.clone()),
+            _ => {}
+        }
+        let (Some(before), Some(after)) = (before, after) else {
+            continue;
+        };
+        if before.display_name != after.display_name {
+            diff.renamed.push(SnapshotChange {
+                user_id: user_id.clone(),
+                before: Value::from(before.display_name.clone()),
+                after: Value::from(after.display_name.clone()),
+            });
+        }
+        if before.power_level != after.power_level {
+            diff.power_changed.push(SnapshotChange {
+                user_id: user_id.clone(),
+                before: Value::from(before.power_level),
+                after: Value::from(after.power_level),
+            });
+        }
+    }
+
+    let mut event_types: Vec<&String> = old_header
+        .state
+        .keys()
+        .chain(new_header.state.keys())
+        .collect();
+    event_types.sort();
+    event_types.dedup();
+    for event_type in event_types {
+        if old_header.state.get(event_type) != new_header.state.get(event_type) {
+            diff.state_changed.push(event_type.clone());
+        }
+    }
+
+    Ok(diff)
+}
+
+fn display(value: &Value) -> String {
+    match value {
+        Value::String(s) => s.clone(),
+        Value::Null => String::from("(none)"),
+        other => other.to_string(),
+    }
+}
+
+/// The diff as readable lines, e.g. for mails to compliance.
+pub(crate) fn describe_diff(diff: &SnapshotDiff) -> String {
+    let mut lines = vec![];
+    for user_id in &diff.joined {
+        lines.push(format!("+ {} joined", user_id));
+    }
+    for user_id in &diff.left {
+        lines.push(format!("- {} left", user_id));
+    }
+    for change in &diff.renamed {
+        lines.push(format!(
+            "~ {} renamed: {} -> {}",
+            change.user_id,
+            display(&change.before),
+            display(&change.after)
+        ));
+    }
+    for change in &diff.power_changed {
+        lines.push(format!(
+            "~ {} power level: {} -> {}",
+            change.user_id,
+            display(&change.before),
+            display(&change.after)
+        ));
+    }
+    for event_type in &diff.state_changed {
+        lines.push(format!("~ {} changed", event_type));
+    }
+    if lines.is_empty() {
+        lines.push(String::from("no changes"));
+    }
+    lines.join("\n")
+}
@@ -0,0 +1,301 @@
+use std::collections::BTreeMap;
+
+use matrix_sdk::ruma::api::client::membership::invite_user::{self, v3::InvitationRecipient};
+use matrix_sdk::ruma::api::client::membership::kick_user;
+use matrix_sdk::ruma::api::client::space::{get_hierarchy, SpaceHierarchyRoomsChunk};
+use matrix_sdk::ruma::{RoomId, UserId};
+use serde_json::Value;
+
+use super::batch::with_retries;
+use crate::outputs::{PowerAuditRoom, SpaceAccessRoom};
+
+// Power level defaults as defined by the spec, used if a key is absent.
+fn power_level_default(key: &str) -> Option<i64> {
+    match key {
+        "ban" | "kick" | "redact" | "state_default" => Some(50),
+        "invite" | "events_default" | "users_default" => Some(0),
+        _ => None,
+    }
+}
+
+/// Compare `actual` power levels with `policy`; only keys present in
+/// `policy` are checked.
+fn policy_violations(policy: &Value, actual: &Value) -> Vec<String> {
+    let mut out = vec![];
+    let Some(policy) = policy.as_object() else {
+        return out;
+    };
+
+    for (key, expected) in policy {
+        if let Value::Object(map) = expected {
+            for (sub, expected) in map {
+                let got = actual.get(key).and_then(|v| v.get(sub));
+                if got != Some(expected) {
+                    out.push(format!(
+                        "{}.{}: expected {}, got {}",
+                        key,
+                        sub,
+                        expected,
+                        got.map_or(String::from("unset"), Value::to_string)
+                    ));
+                }
+            }
+            continue;
+        }
+
+        let got = actual
+            .get(key)
+            .cloned()
+            .or_else(|| power_level_default(key).map(Value::from));
+        if got.as_ref() != Some(expected) {
+            out.push(format!(
+                "{}: expected {}, got {}",
+                key,
+                expected,
+                got.map_or(String::from("unset"), |v| v.to_string())
+            ));
+        }
+    }
+
+    out
+}
+
+impl super::Client {
+    /// Walk the hierarchy of a space, including the space itself.
+    pub(crate) async fn space_hierarchy(
+        &self,
+        space_id: &RoomId,
+    ) -> anyhow::Result<Vec<SpaceHierarchyRoomsChunk>> {
+        let mut rooms = vec![];
+        let mut from = None;
+
+        loop {
+            let mut request = get_hierarchy::v1::Request::new(space_id.to_owned());
+            request.from = from;
+            let resp = self.inner.send(request, None).await?;
+            rooms.extend(resp.rooms);
+
+            from = resp.next_batch;
+            if from.is_none() {
+                break;
+            }
+        }
+
+        Ok(rooms)
+    }
+
+    /// Report privileged users and power level problems of all rooms in a space.
+    pub(crate) async fn power_audit(
+        &self,
+        space_id: &RoomId,
+        policy: Option<&Value>,
+    ) -> anyhow::Result<Vec<PowerAuditRoom>> {
+        let mut out = vec![];
+
+        for chunk in self.space_hierarchy(space_id).await? {
+            let room_id = chunk.room_id;
+            let mut report = PowerAuditRoom {
+                room_id: room_id.to_string(),
+                name: chunk.name,
+                privileged: BTreeMap::new(),
+                findings: vec![],
+            };
+
+            let power_levels = match self.get_state(&room_id, "m.room.power_levels", "").await {
+                Ok(Some(content)) => content,
+                Ok(None) => Value::Null,
+                Err(e) => {
+                    report
+                        .findings
+                        .push(format!("cannot read power levels: {}", e));
+                    out.push(report);
+                    continue;
+                }
+            };
+
+            let users = power_levels
+                .get("users")
+                .and_then(Value::as_object)
+                .cloned()
+                .unwrap_or_default();
+
+            let mut joined_admins = vec![];
+            let mut departed_admins = vec![];
+            // Admins whose membership could not be read may still be joined.
+            let mut unknown_admins = 0;
+            for (user_id, level) in users {
+                let Some(level) = level.as_i64() else {
+                    continue;
+                };
+                if level < 50 {
+                    continue;
+                }
+                if level >= 100 {
+                    match self.get_state(&room_id, "m.room.member", &user_id).await {
+                        Ok(member) => {
+                            let membership = member
+                                .as_ref()
+                                .and_then(|m| m.get("membership"))
+                                .and_then(Value::as_str);
+                            if membership == Some("join") {
+                                joined_admins.push(user_id.clone());
+                            } else {
+                                departed_admins.push(user_id.clone());
+                            }
+                        }
+                        Err(e) => {
+                            unknown_admins += 1;
+                            report
+                                .findings
+                                .push(format!("cannot read the membership of {}: {}", user_id, e));
+                        }
+                    }
+                }
+                report.privileged.insert(user_id, level);
+            }
+
+            if joined_admins.is_empty() && unknown_admins == 0 && !departed_admins.is_empty() {
+                report.findings.push(format!(
+                    "no joined admin left; departed admins: {}",
+                    departed_admins.join(", ")
+                ));
+            }
+
+            if let Some(policy) = policy {
+                report
+                    .findings
+                    .extend(policy_violations(policy, &power_levels));
+            }
+
+            out.push(report);
+        }
+
+        Ok(out)
+    }
+
+    async fn membership(
+        &self,
+        room_id: &RoomId,
+        user_id: &UserId,
+    ) -> anyhow::Result<Option<String>> {
+        let member = self
+            .get_state(room_id, "m.room.member", user_id.as_str())
+            .await?;
+        Ok(member
+            .as_ref()
+            .and_then(|m| m.get("membership"))
+            .and_then(Value::as_str)
+            .map(String::from))
+    }
+
+    /// Invite `user_id` to a space and to every child room which cannot be
+    /// joined through the space membership. Rate limited requests are
+    /// retried; other failures are reported per room.
+    pub(crate) async fn grant_space_access(
+        &self,
+        space_id: &RoomId,
+        user_id: &UserId,
+    ) -> anyhow::Result<Vec<SpaceAccessRoom>> {
+        let mut out = vec![];
+
+        for chunk in self.space_hierarchy(space_id).await? {
+            let room_id = chunk.room_id;
+            let join_rule = chunk.join_rule.as_str().to_string();
+            let mut report = SpaceAccessRoom {
+                room_id: room_id.to_string(),
+                name: chunk.name,
+                join_rule: join_rule.clone(),
+                action: "invited",
+                error: None,
+            };
+
+            let membership = match with_retries(|| self.membership(&room_id, user_id)).await {
+                Ok(membership) => membership,
+                Err(e) => {
+                    report.action = "failed";
+                    report.error = Some(e.error);
+                    out.push(report);
+                    continue;
+                }
+            };
+
+            if matches!(membership.as_deref(), Some("join" | "invite")) {
+                report.action = "already_member";
+            } else if room_id.as_str() != space_id.as_str() {
+                match join_rule.as_str() {
+                    // Members of the space can join on their own.
+                    "restricted" | "knock_restricted" => report.action = "joinable",
+                    "public" => report.action = "public",
+                    _ => {}
+                }
+            }
+
+            if report.action == "invited" {
+                let result = with_retries(|| async {
+                    let recipient = InvitationRecipient::UserId {
+                        user_id: user_id.to_owned(),
+                    };
+                    let request = invite_user::v3::Request::new(room_id.clone(), recipient);
+                    Ok::<_, anyhow::Error>(self.inner.send(request, None).await?)
+                })
+                .await;
+                if let Err(e) = result {
+                    report.action = "failed";
+                    report.error = Some(e.error);
+                }
+            }
+
+            out.push(report);
+        }
+
+        Ok(out)
+    }
+
+    /// Kick `user_id` from a space and all of its child rooms, retrying
+    /// rate limited requests like `grant_space_access`.
+    pub(crate) async fn revoke_space_access(
+        &self,
+        space_id: &RoomId,
+        user_id: &UserId,
+        reason: Option<&str>,
+    ) -> anyhow::Result<Vec<SpaceAccessRoom>> {
+        let mut out = vec![];
+
+        for chunk in self.space_hierarchy(space_id).await? {
+            let room_id = chunk.room_id;
+            let mut report = SpaceAccessRoom {
+                room_id: room_id.to_string(),
+                name: chunk.name,
+                join_rule: chunk.join_rule.as_str().to_string(),
+                action: "kicked",
+                error: None,
+            };
+
+            match with_retries(|| self.membership(&room_id, user_id)).await {
+                // Kicking also rescinds pending invites and knocks.
+                Ok(Some(m)) if matches!(m.as_str(), "join" | "invite" | "knock") => {
+                    let result = with_retries(|| async {
+                        let mut request =
+                            kick_user::v3::Request::new(room_id.clone(), user_id.to_owned());
+                        request.reason = reason.map(String::from);
+                        Ok::<_, anyhow::Error>(self.inner.send(request, None).await?)
+                    })
+                    .await;
+                    if let Err(e) = result {
+                        report.action = "failed";
+                        report.error = Some(e.error);
+                    }
+                }
+                Ok(_) => report.action = "not_member",
+                Err(e) => {
+                    report.action = "failed";
+                    report.error = Some(e.error);
+                }
+            }
+
+            out.push(report);
+        }
+
+        Ok(out)
+    }
+}
@@ -0,0 +1,390 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+use anyhow::bail;
+
+use matrix_sdk::ruma::api::client::alias::create_alias;
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::api::client::membership::invite_user::{self, v3::InvitationRecipient};
+use matrix_sdk::ruma::api::client::room::create_room;
+use matrix_sdk::ruma::events::room::message::RoomMessageEventContent;
+use matrix_sdk::ruma::{OwnedRoomId, OwnedUserId, RoomAliasId, RoomId};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use tracing::warn;
+
+use crate::email::{Invitation, SmtpConfig};
+use crate::outputs::RoomSpecSummary;
+
+/// Someone to invite; people without a matrix account are invited by email.
+#[derive(Clone, Debug)]
+pub(crate) enum Invitee {
+    User(OwnedUserId),
+    Email(String),
+}
+
+impl FromStr for Invitee {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        if s.starts_with('@') {
+            return Ok(Self::User(s.try_into()?));
+        }
+        if s.contains('@') {
+            return Ok(Self::Email(s.to_string()));
+        }
+        bail!(
+            "invalid invitee: {}; neither a matrix id nor an email address",
+            s
+        )
+    }
+}
+
+/// Declarative description of a room, usually read from a YAML file.
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub(crate) struct RoomSpec {
+    pub(crate) name: Option<String>,
+    pub(crate) topic: Option<String>,
+    /// Localpart of the canonical alias
+    pub(crate) alias: Option<String>,
+    pub(crate) avatar: Option<PathBuf>,
+    #[serde(default)]
+    pub(crate) encryption: bool,
+    pub(crate) join_rule: Option<String>,
+    #[serde(default)]
+    pub(crate) power_levels: BTreeMap<OwnedUserId, i64>,
+    /// Matrix ids or email addresses
+    #[serde(default)]
+    pub(crate) invite: Vec<String>,
+    pub(crate) parent: Option<OwnedRoomId>,
+    pub(crate) welcome_message: Option<String>,
+}
+
+impl RoomSpec {
+    pub(crate) fn load(path: impl AsRef<Path>) -> anyhow::Result<Self> {
+        let raw = fs::read_to_string(path)?;
+        Ok(serde_yaml::from_str(&raw)?)
+    }
+
+    pub(crate) fn invitees(&self) -> anyhow::Result<Vec<Invitee>> {
+        self.invite.iter().map(|s| s.parse()).collect()
+    }
+
+    fn invited_users(&self) -> anyhow::Result<Vec<OwnedUserId>> {
+        Ok(self
+            .invitees()?
+            .into_iter()
+            .filter_map(|i| match i {
+                Invitee::User(user_id) => Some(user_id),
+                Invitee::Email(_) => None,
+            })
+            .collect())
+    }
+}
+
+/// Whether the creation failed because the alias is taken.
+fn room_in_use(e: &anyhow::Error) -> bool {
+    let kind = if let Some(e) = e.downcast_ref::<matrix_sdk::Error>() {
+        e.client_api_error_kind()
+    } else if let Some(e) = e.downcast_ref::<matrix_sdk::HttpError>() {
+        e.client_api_error_kind()
+    } else {
+        None
+    };
+    matches!(kind, Some(ErrorKind::RoomInUse))
+}
+
+impl super::Client {
+    /// Create a room as described by `spec`.
+    /// Email invitees get a matrix.to link via `smtp`.
+    pub(crate) async fn create_room_from_spec(
+        &self,
+        spec: &RoomSpec,
+        smtp: Option<&SmtpConfig>,
+    ) -> anyhow::Result<RoomSpecSummary> {
+        let emails: Vec<String> = spec
+            .invitees()?
+            .into_iter()
+            .filter_map(|i| match i {
+                Invitee::Email(email) => Some(email),
+                Invitee::User(_) => None,
+            })
+            .collect();
+        if !emails.is_empty() && smtp.is_none() {
+            bail!("email invitees require --smtp-url");
+        }
+
+        let mut request = create_room::v3::Request::new();
+        request.name = spec.name.clone();
+        request.topic = spec.topic.clone();
+        request.room_alias_name = spec.alias.clone();
+        request.invite = spec.invited_users()?;
+        let mut invited: Vec<String> = request.invite.iter().map(|u| u.to_string()).collect();
+
+        let room = self.inner.create_room(request).await?;
+        // The invitees of the request are members already and skipped.
+        let mut summary = self.apply_spec(room.room_id(), spec).await?;
+        invited.append(&mut summary.invited);
+        summary.invited = invited;
+        summary.created = true;
+
+        if let Some(smtp) = smtp {
+            let target = match spec.alias {
+                Some(ref alias) => format!("#{}:{}", alias, self.user_id.server_name()),
+                None => room.room_id().to_string(),
+            };
+            let link = format!("https://matrix.to/#/{}", target);
+            let invitation = Invitation {
+                inviter: self.user_id.as_str(),
+                room: spec.name.as_deref().unwrap_or(&target),
+                link: &link,
+            };
+            for email in emails {
+                match smtp.send_invitation(&email, &invitation).await {
+                    Ok(()) => summary.emailed.push(email),
+                    Err(e) => {
+                        warn!("sending invitation to {} failed: {}", email, e);
+                        summary.failed.push(email);
+                    }
+                }
+            }
+        }
+
+        Ok(summary)
+    }
+
+    /// Like `create_room_from_spec`, but if the alias of the spec is taken,
+    /// e.g. by a concurrent run, the room it points to is returned with
+    /// `existed` set. The existing room is left as it is.
+    pub(crate) async fn find_or_create_room(
+        &self,
+        spec: &RoomSpec,
+        smtp: Option<&SmtpConfig>,
+    ) -> anyhow::Result<RoomSpecSummary> {
+        let Some(ref alias) = spec.alias else {
+            bail!("finding an existing room requires an alias");
+        };
+        // Checking for the alias first would race with other runs; the
+        // server creates the room and its alias atomically.
+        match self.create_room_from_spec(spec, smtp).await {
+            Err(e) if room_in_use(&e) => {
+                let alias =
+                    RoomAliasId::parse(format!("#{}:{}", alias, self.user_id.server_name()))?;
+                let resp = self.resolve_room_alias(&alias).await?;
+                Ok(RoomSpecSummary {
+                    room_id: resp.room_id.to_string(),
+                    created: false,
+                    existed: true,
+                    changes: vec![],
+                    invited: vec![],
+                    emailed: vec![],
+                    failed: vec![],
+                })
+            }
+            result => result,
+        }
+    }
+
+    /// Apply `spec` to an existing room; state which already matches the
+    /// spec is left untouched. Email invitations are only sent with a new
+    /// room, as nothing records who got one; email invitees are reported
+    /// as `failed`.
+    pub(crate) async fn reconcile_room(
+        &self,
+        room_id: &RoomId,
+        spec: &RoomSpec,
+    ) -> anyhow::Result<RoomSpecSummary> {
+        let mut summary = self.apply_spec(room_id, spec).await?;
+        for invitee in spec.invitees()? {
+            if let Invitee::Email(email) = invitee {
+                warn!("not inviting {} by email to an existing room", email);
+                summary.failed.push(email);
+            }
+        }
+        Ok(summary)
+    }
+
+    /// Bring the state and the matrix invitees of `room_id` in line with
+    /// `spec`.
+    async fn apply_spec(
+        &self,
+        room_id: &RoomId,
+        spec: &RoomSpec,
+    ) -> anyhow::Result<RoomSpecSummary> {
+        let mut changes = vec![];
+        let mut invited = vec![];
+        let server = self.user_id.server_name();
+
+        if let Some(ref name) = spec.name {
+            if self.state_field(room_id, "m.room.name", "", "name").await? != Some(name.clone()) {
+                self.put_state(room_id, "m.room.name", "", &json!({ "name": name }))
+                    .await?;
+                changes.push(String::from("name"));
+            }
+        }
+
+        if let Some(ref topic) = spec.topic {
+            if self
+                .state_field(room_id, "m.room.topic", "", "topic")
+                .await?
+                != Some(topic.clone())
+            {
+                self.put_state(room_id, "m.room.topic", "", &json!({ "topic": topic }))
+                    .await?;
+                changes.push(String::from("topic"));
+            }
+        }
+
+        if let Some(ref alias) = spec.alias {
+            let alias = RoomAliasId::parse(format!("#{}:{}", alias, server))?;
+            let current = self
+                .state_field(room_id, "m.room.canonical_alias", "", "alias")
+                .await?;
+            if current.as_deref() != Some(alias.as_str()) {
+                if self.resolve_room_alias(&alias).await.is_err() {
+                    let request = create_alias::v3::Request::new(alias.clone(), room_id.to_owned());
+                    self.inner.send(request, None).await?;
+                }
+                self.put_state(
+                    room_id,
+                    "m.room.canonical_alias",
+                    "",
+                    &json!({ "alias": alias }),
+                )
+                .await?;
+                changes.push(String::from("alias"));
+            }
+        }
+
+        if let Some(ref path) = spec.avatar {
+            // We cannot compare a local file with the uploaded one;
+            // only set the avatar if there is none yet.
+            if self
+                .state_field(room_id, "m.room.avatar", "", "url")
+                .await?
+                .is_none()
+            {
+                let content = self.upload_avatar(path).await?;
+                self.put_state(room_id, "m.room.avatar", "", &content)
+                    .await?;
+                changes.push(String::from("avatar"));
+            }
+        }
+
+        if spec.encryption
+            && self
+                .get_state(room_id, "m.room.encryption", "")
+                .await?
+                .is_none()
+        {
+            let content = json!({ "algorithm": "m.megolm.v1.aes-sha2" });
+            self.put_state(room_id, "m.room.encryption", "", &content)
+                .await?;
+            changes.push(String::from("encryption"));
+        }
+
+        if let Some(ref join_rule) = spec.join_rule {
+            let current = self
+                .state_field(room_id, "m.room.join_rules", "", "join_rule")
+                .await?;
+            if current.as_ref() != Some(join_rule) {
+                let content = json!({ "join_rule": join_rule });
+                self.put_state(room_id, "m.room.join_rules", "", &content)
+                    .await?;
+                changes.push(String::from("join_rule"));
+            }
+        }
+
+        if !spec.power_levels.is_empty() {
+            let mut content = self
+                .get_state(room_id, "m.room.power_levels", "")
+                .await?
+                .unwrap_or_else(|| json!({}));
+            let mut changed = false;
+            for (user_id, level) in &spec.power_levels {
+                let current = content
+                    .pointer(&format!("/users/{}", user_id))
+                    .and_then(Value::as_i64);
+                if current != Some(*level) {
+                    content["users"][user_id.as_str()] = json!(level);
+                    changed = true;
+                }
+            }
+            if changed {
+                self.put_state(room_id, "m.room.power_levels", "", &content)
+                    .await?;
+                changes.push(String::from("power_levels"));
+            }
+        }
+
+        for user_id in &spec.invited_users()? {
+            let membership = self
+                .state_field(room_id, "m.room.member", user_id.as_str(), "membership")
+                .await?;
+            if matches!(membership.as_deref(), Some("join") | Some("invite")) {
+                continue;
+            }
+            let recipient = InvitationRecipient::UserId {
+                user_id: user_id.clone(),
+            };
+            let request = invite_user::v3::Request::new(room_id.to_owned(), recipient);
+            self.inner.send(request, None).await?;
+            changes.push(format!("invite {}", user_id));
+            invited.push(user_id.to_string());
+        }
+
+        if let Some(ref parent) = spec.parent {
+            let via = json!({ "via": [server] });
+            if self
+                .get_state(parent, "m.space.child", room_id.as_str())
+                .await?
+                .is_none()
+            {
+                self.put_state(parent, "m.space.child", room_id.as_str(), &via)
+                    .await?;
+                changes.push(String::from("space child"));
+            }
+            if self
+                .get_state(room_id, "m.space.parent", parent.as_str())
+                .await?
+                .is_none()
+            {
+                let content = json!({ "via": [server], "canonical": true });
+                self.put_state(room_id, "m.space.parent", parent.as_str(), &content)
+                    .await?;
+                changes.push(String::from("space parent"));
+            }
+        }
+
+        if let Some(ref message) = spec.welcome_message {
+            let pinned = self
+                .get_state(room_id, "m.room.pinned_events", "")
+                .await?
+                .and_then(|c| c.get("pinned").and_then(Value::as_array).cloned())
+                .unwrap_or_default();
+            if pinned.is_empty() {
+                let room = self.get_joined_room(room_id)?;
+                let resp = room
+                    .send(RoomMessageEventContent::text_markdown(message))
+                    .await?;
+                let content = json!({ "pinned": [resp.event_id] });
+                self.put_state(room_id, "m.room.pinned_events", "", &content)
+                    .await?;
+                changes.push(String::from("welcome message"));
+            }
+        }
+
+        Ok(RoomSpecSummary {
+            room_id: room_id.to_string(),
+            created: false,
+            existed: false,
+            changes,
+            invited,
+            emailed: vec![],
+            failed: vec![],
+        })
+    }
+}
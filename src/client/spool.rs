@@ -0,0 +1,173 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::ruma::{OwnedTransactionId, TransactionId, UserId};
+use matrix_sdk::ClientBuildError;
+use serde::{Deserialize, Serialize};
+
+use super::batch;
+use super::session::write_atomic;
+use super::CRATE_NAME;
+use crate::outputs::SpoolFlush;
+use crate::room_arg::RoomArg;
+
+/// A message which could not be sent, waiting in the spool.
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct SpoolEntry {
+    /// Aliases are resolved when the entry is sent
+    pub(crate) room_id: RoomArg,
+    pub(crate) body: String,
+    pub(crate) markdown: bool,
+    pub(crate) notice: bool,
+    pub(crate) emote: bool,
+    pub(crate) msgtype: Option<String>,
+    /// Milliseconds since the epoch
+    pub(crate) created_at: u64,
+    /// Sent with every attempt, so that the homeserver drops repeats of
+    /// an attempt which succeeded before a crash
+    pub(crate) txn_id: OwnedTransactionId,
+}
+
+impl SpoolEntry {
+    pub(crate) fn new(
+        room_id: RoomArg,
+        body: String,
+        markdown: bool,
+        notice: bool,
+        emote: bool,
+        msgtype: Option<String>,
+    ) -> Self {
+        Self {
+            room_id,
+            body,
+            markdown,
+            notice,
+            emote,
+            msgtype,
+            created_at: now_millis(),
+            txn_id: TransactionId::new(),
+        }
+    }
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+pub(crate) fn spool_dir(user_id: impl AsRef<UserId>) -> anyhow::Result<PathBuf> {
+    let user_id = user_id.as_ref();
+    let xdg_dirs = xdg::BaseDirectories::with_prefix(CRATE_NAME)?;
+
+    Ok(xdg_dirs.create_state_directory(Path::new(&user_id.to_string()).join("spool"))?)
+}
+
+/// Whether sending may succeed later: the homeserver could not be
+/// reached or failed itself.
+pub(crate) fn unreachable(e: &anyhow::Error) -> bool {
+    if let Some(e) = e.downcast_ref::<ClientBuildError>() {
+        return matches!(
+            e,
+            ClientBuildError::Http(_) | ClientBuildError::AutoDiscovery(_)
+        );
+    }
+    batch::is_retryable(e)
+}
+
+/// Add `entry` to the spool of `user_id`. Every entry is a file of its
+/// own, written atomically; the names sort in the order of spooling.
+pub(crate) fn spool(user_id: impl AsRef<UserId>, entry: &SpoolEntry) -> anyhow::Result<PathBuf> {
+    let name = format!("{:016}-{}.json", entry.created_at, entry.txn_id);
+    let path = spool_dir(user_id)?.join(name);
+    write_atomic(&path, &serde_json::to_vec(entry)?, 0o600)?;
+    Ok(path)
+}
+
+/// The spooled entries of `dir`, oldest first.
+fn spooled(dir: &Path) -> anyhow::Result<Vec<PathBuf>> {
+    let mut paths = vec![];
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.extension().is_some_and(|e| e == "json") {
+            paths.push(path);
+        }
+    }
+    paths.sort();
+    Ok(paths)
+}
+
+impl super::Client {
+    /// Add `entry` to the spool of this account.
+    pub(crate) fn spool_message(&self, entry: &SpoolEntry) -> anyhow::Result<PathBuf> {
+        spool(&self.user_id, entry)
+    }
+
+    async fn send_spooled(&self, entry: &SpoolEntry) -> anyhow::Result<()> {
+        let client = self.clone().with_transaction_id(entry.txn_id.clone());
+        let room_id = self.resolve_room(&entry.room_id).await?;
+        let body = entry.body.as_str();
+        if entry.notice {
+            client.send_notice(&room_id, body, entry.markdown).await?;
+        } else if entry.emote {
+            client.send_emote(&room_id, body, entry.markdown).await?;
+        } else if let Some(ref msgtype) = entry.msgtype {
+            client
+                .send_message_type(&room_id, body, entry.markdown, msgtype)
+                .await?;
+        } else {
+            client.send_message(&room_id, body, entry.markdown).await?;
+        }
+        Ok(())
+    }
+
+    /// Send the spooled messages in order and remove those sent. Entries
+    /// older than `max_age` are discarded unsent, those the homeserver
+    /// rejects are renamed to `.failed` and kept. Flushing stops at the
+    /// first entry which fails to send for being unreachable, so that the
+    /// order is kept.
+    pub(crate) async fn flush_spool(
+        &self,
+        max_age: Option<Duration>,
+    ) -> anyhow::Result<SpoolFlush> {
+        let dir = spool_dir(&self.user_id)?;
+        let paths = spooled(&dir)?;
+        let mut flush = SpoolFlush {
+            sent: 0,
+            discarded: 0,
+            failed: 0,
+            remaining: 0,
+            error: None,
+        };
+
+        for (n, path) in paths.iter().enumerate() {
+            let entry: SpoolEntry = serde_json::from_str(&fs::read_to_string(path)?)?;
+            let age = Duration::from_millis(now_millis().saturating_sub(entry.created_at));
+            if max_age.is_some_and(|max_age| age > max_age) {
+                fs::remove_file(path)?;
+                flush.discarded += 1;
+                continue;
+            }
+            match self.send_spooled(&entry).await {
+                Ok(()) => {
+                    fs::remove_file(path)?;
+                    flush.sent += 1;
+                }
+                Err(e) if unreachable(&e) => {
+                    flush.remaining = paths.len() - n;
+                    flush.error = Some(e.to_string());
+                    break;
+                }
+                Err(e) => {
+                    eprintln!("spooled message to {} failed: {}", entry.room_id, e);
+                    fs::rename(path, path.with_extension("failed"))?;
+                    flush.failed += 1;
+                }
+            }
+        }
+
+        Ok(flush)
+    }
+}
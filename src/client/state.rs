@@ -0,0 +1,143 @@
+use std::fs;
+use std::path::Path;
+
+use anyhow::{anyhow, bail};
+use matrix_sdk::ruma::api::client::error::ErrorKind;
+use matrix_sdk::ruma::api::client::state::{get_state_events_for_key, send_state_event};
+use matrix_sdk::ruma::events::StateEventType;
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::{OwnedEventId, RoomId};
+use serde_json::{json, Value};
+
+use super::room::image_info;
+use crate::outputs::RoomInfo;
+
+impl super::Client {
+    /// Fetch the content of a state event from the homeserver.
+    /// Returns `None` if the room has no such state.
+    pub(crate) async fn get_state(
+        &self,
+        room_id: &RoomId,
+        event_type: &str,
+        state_key: &str,
+    ) -> anyhow::Result<Option<Value>> {
+        let request = get_state_events_for_key::v3::Request::new(
+            room_id.to_owned(),
+            StateEventType::from(event_type),
+            state_key.to_owned(),
+        );
+
+        match self.inner.send(request, None).await {
+            Ok(resp) => Ok(Some(resp.content.deserialize_as::<Value>()?)),
+            Err(e) if matches!(e.client_api_error_kind(), Some(ErrorKind::NotFound)) => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    pub(crate) async fn put_state(
+        &self,
+        room_id: &RoomId,
+        event_type: &str,
+        state_key: &str,
+        content: &Value,
+    ) -> anyhow::Result<OwnedEventId> {
+        let request = send_state_event::v3::Request::new_raw(
+            room_id.to_owned(),
+            StateEventType::from(event_type),
+            state_key.to_owned(),
+            Raw::new(content)?.cast(),
+        );
+
+        Ok(self.inner.send(request, None).await?.event_id)
+    }
+
+    /// A string field of a state event's content, if the state exists.
+    pub(super) async fn state_field(
+        &self,
+        room_id: &RoomId,
+        event_type: &str,
+        state_key: &str,
+        field: &str,
+    ) -> anyhow::Result<Option<String>> {
+        let content = self.get_state(room_id, event_type, state_key).await?;
+        Ok(content.and_then(|c| c.get(field).and_then(Value::as_str).map(String::from)))
+    }
+
+    /// Upload the image at `path` and return the m.room.avatar content
+    /// referencing it. Other files are rejected before the upload, as are
+    /// images we cannot decode for their dimensions.
+    pub(super) async fn upload_avatar(&self, path: &Path) -> anyhow::Result<Value> {
+        let content_type = crate::mime::guess_mime(path)?;
+        if content_type.type_() != mime::IMAGE {
+            bail!("{} is not an image: {}", path.display(), content_type);
+        }
+        let data = fs::read(path)?;
+        let info = image_info(&data)
+            .map_err(|e| anyhow!("cannot read image {}: {}", path.display(), e))?;
+        let resp = self.inner.media().upload(&content_type, data).await?;
+        Ok(json!({
+            "url": resp.content_uri,
+            "info": {
+                "mimetype": content_type.essence_str(),
+                "size": info.size,
+                "w": info.width,
+                "h": info.height,
+            },
+        }))
+    }
+
+    /// Name, topic, canonical alias, avatar and joined members of
+    /// `room_id`, as the server has them; empty values count as none.
+    pub(crate) async fn room_info(&self, room_id: &RoomId) -> anyhow::Result<RoomInfo> {
+        let text = |event_type: &'static str, field: &'static str| async move {
+            let value = self.state_field(room_id, event_type, "", field).await?;
+            anyhow::Ok(value.filter(|v| !v.is_empty()))
+        };
+        let members = self
+            .api_get(
+                &format!("_matrix/client/v3/rooms/{}/joined_members", room_id),
+                &[],
+            )
+            .await?;
+        Ok(RoomInfo {
+            room_id: room_id.to_string(),
+            name: text("m.room.name", "name").await?,
+            topic: text("m.room.topic", "topic").await?,
+            canonical_alias: text("m.room.canonical_alias", "alias").await?,
+            avatar_url: text("m.room.avatar", "url").await?,
+            joined_members: members
+                .get("joined")
+                .and_then(Value::as_object)
+                .map_or(0, |joined| joined.len() as u64),
+        })
+    }
+
+    /// Set the name, the topic and the avatar image of `room_id` which are
+    /// given; an empty string or path clears them.
+    pub(crate) async fn set_room_profile(
+        &self,
+        room_id: &RoomId,
+        name: Option<&str>,
+        topic: Option<&str>,
+        avatar: Option<&Path>,
+    ) -> anyhow::Result<()> {
+        if let Some(name) = name {
+            self.put_state(room_id, "m.room.name", "", &json!({ "name": name }))
+                .await?;
+        }
+        if let Some(topic) = topic {
+            self.put_state(room_id, "m.room.topic", "", &json!({ "topic": topic }))
+                .await?;
+        }
+        if let Some(path) = avatar {
+            let content = if path.as_os_str().is_empty() {
+                json!({})
+            } else {
+                self.upload_avatar(path).await?
+            };
+            self.put_state(room_id, "m.room.avatar", "", &content)
+                .await?;
+        }
+        Ok(())
+    }
+}
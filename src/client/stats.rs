@@ -0,0 +1,198 @@
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use serde_json::Value;
+use tracing::warn;
+
+use super::synapse::{admin_v1, admin_v2};
+use crate::outputs::{StatsMetric, StatsReport, StatsSnapshot};
+use crate::table::sparkline;
+
+const DAY: Duration = Duration::from_secs(24 * 60 * 60);
+const MONTH: Duration = Duration::from_secs(30 * 24 * 60 * 60);
+/// Snapshots drawn in a sparkline; older ones are left out.
+const SPARK_POINTS: usize = 30;
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// The change of one count between the first and the last snapshot.
+fn metric(name: &'static str, bytes: bool, values: &[u64]) -> Option<StatsMetric> {
+    let (first, last) = (*values.first()?, *values.last()?);
+    let delta = last as i64 - first as i64;
+    let percent = (first > 0).then(|| delta as f64 * 100.0 / first as f64);
+    let spark = &values[values.len().saturating_sub(SPARK_POINTS)..];
+    Some(StatsMetric {
+        name,
+        bytes,
+        first,
+        last,
+        delta,
+        percent,
+        sparkline: sparkline(spark),
+    })
+}
+
+/// Growth of the snapshots in `path` taken within `since`, oldest first.
+/// Counts a server did not expose are left out of their metric.
+pub(crate) fn report(path: &Path, since: Duration) -> anyhow::Result<StatsReport> {
+    let cutoff = now_ms().saturating_sub(since.as_millis() as u64) / 1000;
+    let mut snapshots = vec![];
+    for (n, line) in fs::read_to_string(path)?.lines().enumerate() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        match serde_json::from_str::<StatsSnapshot>(line) {
+            Ok(snapshot) if snapshot.ts >= cutoff => snapshots.push(snapshot),
+            Ok(_) => {}
+            Err(e) => warn!("{}:{}: {}", path.display(), n + 1, e),
+        }
+    }
+    snapshots.sort_by_key(|s| s.ts);
+
+    let counts = |f: fn(&StatsSnapshot) -> Option<u64>| -> Vec<u64> {
+        snapshots.iter().filter_map(f).collect()
+    };
+    let metrics = [
+        metric("users", false, &counts(|s| Some(s.users))),
+        metric("active_daily", false, &counts(|s| s.active_daily)),
+        metric("active_monthly", false, &counts(|s| s.active_monthly)),
+        metric("rooms", false, &counts(|s| Some(s.rooms))),
+        metric("media_bytes", true, &counts(|s| Some(s.media_bytes))),
+        metric("media_count", false, &counts(|s| Some(s.media_count))),
+    ]
+    .into_iter()
+    .flatten()
+    .collect();
+
+    Ok(StatsReport {
+        snapshots: snapshots.len(),
+        from: snapshots.first().map(|s| s.ts),
+        to: snapshots.last().map(|s| s.ts),
+        metrics,
+    })
+}
+
+impl super::Client {
+    /// Number of local users and of those seen within a day and a month;
+    /// the latter are `None` if the user list has no last_seen_ts, as on
+    /// synapse before 1.84.
+    async fn user_counts(&self) -> anyhow::Result<(u64, Option<u64>, Option<u64>)> {
+        let path = format!("{}/users", admin_v2());
+        let now = now_ms();
+        let (mut users, mut daily, mut monthly) = (0, 0, 0);
+        let mut exposed = true;
+        let mut from: Option<String> = None;
+
+        loop {
+            let mut query = vec![
+                ("limit", String::from("1000")),
+                ("deactivated", String::from("false")),
+                ("guests", String::from("false")),
+            ];
+            if let Some(ref from) = from {
+                query.push(("from", from.clone()));
+            }
+            let resp = self.api_get(&path, &query).await?;
+            for user in resp
+                .get("users")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+            {
+                users += 1;
+                match user.get("last_seen_ts") {
+                    Some(Value::Number(ts)) => {
+                        let age = now.saturating_sub(ts.as_u64().unwrap_or(0));
+                        daily += u64::from(age < DAY.as_millis() as u64);
+                        monthly += u64::from(age < MONTH.as_millis() as u64);
+                    }
+                    // Never connected.
+                    Some(Value::Null) => {}
+                    _ => exposed = false,
+                }
+            }
+
+            from = match resp.get("next_token") {
+                Some(Value::String(token)) => Some(token.clone()),
+                Some(Value::Number(token)) => Some(token.to_string()),
+                _ => None,
+            };
+            if from.is_none() {
+                break;
+            }
+        }
+
+        if !exposed {
+            return Ok((users, None, None));
+        }
+        Ok((users, Some(daily), Some(monthly)))
+    }
+
+    /// Size and number of the media uploaded by local users.
+    async fn media_counts(&self) -> anyhow::Result<(u64, u64)> {
+        let path = format!("{}/statistics/users/media", admin_v1());
+        let (mut bytes, mut count) = (0, 0);
+        let mut from = 0;
+
+        loop {
+            let query = [("from", from.to_string()), ("limit", String::from("500"))];
+            let resp = self.api_get(&path, &query).await?;
+            for user in resp
+                .get("users")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+            {
+                let field = |key: &str| user.get(key).and_then(Value::as_u64).unwrap_or(0);
+                bytes += field("media_length");
+                count += field("media_count");
+            }
+            match resp.get("next_token").and_then(Value::as_u64) {
+                Some(next) => from = next,
+                None => break,
+            }
+        }
+        Ok((bytes, count))
+    }
+
+    /// Point-in-time counts of the homeserver from the admin API.
+    pub(crate) async fn stats_snapshot(&self) -> anyhow::Result<StatsSnapshot> {
+        let (users, active_daily, active_monthly) = self.user_counts().await?;
+        let rooms = self
+            .api_get(
+                &format!("{}/rooms", admin_v1()),
+                &[("limit", String::from("1"))],
+            )
+            .await?
+            .get("total_rooms")
+            .and_then(Value::as_u64)
+            .unwrap_or(0);
+        let (media_bytes, media_count) = self.media_counts().await?;
+
+        Ok(StatsSnapshot {
+            ts: now_ms() / 1000,
+            server: self.user_id.server_name().to_string(),
+            users,
+            active_daily,
+            active_monthly,
+            rooms,
+            media_bytes,
+            media_count,
+        })
+    }
+
+    /// Take a snapshot and append it to the NDJSON file `path`.
+    pub(crate) async fn append_stats_snapshot(&self, path: &Path) -> anyhow::Result<StatsSnapshot> {
+        let snapshot = self.stats_snapshot().await?;
+        let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+        writeln!(file, "{}", serde_json::to_string(&snapshot)?)?;
+        Ok(snapshot)
+    }
+}
@@ -0,0 +1,136 @@
+use std::time::Duration;
+
+use anyhow::bail;
+use matrix_sdk::ruma::{OwnedEventId, RoomId};
+use tokio::io::{stdin, AsyncBufReadExt, BufReader};
+use tokio::time::{sleep_until, Instant};
+use tracing::warn;
+
+use super::batch::with_retries;
+use super::dedupe::Duplicate;
+use crate::outputs::SentMessage;
+
+/// How `stream_stdin` turns lines into messages.
+#[derive(Debug)]
+pub(crate) struct StreamOptions {
+    /// Send the lines arriving within this time after the first one as
+    /// one message; every line on its own if none
+    pub(crate) batch_interval: Option<Duration>,
+    pub(crate) markdown: bool,
+    pub(crate) notice: bool,
+}
+
+impl super::Client {
+    /// Send `lines` as one message. Rate limits and server errors are
+    /// waited out for as long as it takes, so that no line is dropped;
+    /// duplicates are skipped.
+    async fn send_lines(
+        &self,
+        room_id: &RoomId,
+        lines: &[String],
+        opts: &StreamOptions,
+    ) -> anyhow::Result<Option<OwnedEventId>> {
+        let body = lines.join("\n");
+        loop {
+            let result = with_retries(|| async {
+                let sent = if opts.notice {
+                    self.send_notice(room_id, &body, opts.markdown).await
+                } else {
+                    self.send_message(room_id, &body, opts.markdown).await
+                };
+                match sent {
+                    Ok(event_id) => Ok(Ok(event_id)),
+                    Err(e) => match e.downcast::<Duplicate>() {
+                        Ok(duplicate) => Ok(Err(duplicate)),
+                        Err(e) => Err(e),
+                    },
+                }
+            })
+            .await;
+            match result {
+                Ok(Ok(event_id)) => return Ok(event_id),
+                Ok(Err(duplicate)) => {
+                    eprintln!("{}", duplicate);
+                    return Ok(None);
+                }
+                Err(e) if e.retryable => warn!("{}; trying again", e.error),
+                Err(e) => bail!("{}", e.error),
+            }
+        }
+    }
+
+    async fn send_stream_message(
+        &self,
+        room_id: &RoomId,
+        lines: &[String],
+        opts: &StreamOptions,
+    ) -> anyhow::Result<()> {
+        if let Some(event_id) = self.send_lines(room_id, lines, opts).await? {
+            let sent = SentMessage {
+                room_id: room_id.to_string(),
+                event_id: event_id.to_string(),
+            };
+            println!("{}", serde_json::to_string(&sent)?);
+        }
+        Ok(())
+    }
+
+    /// Send every non-empty line of stdin as it arrives until EOF, each
+    /// on its own or coalesced by `opts.batch_interval`, printing the sent
+    /// messages as NDJSON. Ctrl-C sends the pending lines first; returns
+    /// whether it was pressed.
+    pub(crate) async fn stream_stdin(
+        &self,
+        room_id: &RoomId,
+        opts: &StreamOptions,
+    ) -> anyhow::Result<bool> {
+        let mut lines = BufReader::new(stdin()).lines();
+        let mut pending: Vec<String> = vec![];
+        let mut deadline = None;
+        let interrupt = tokio::signal::ctrl_c();
+        tokio::pin!(interrupt);
+        let mut interrupted = false;
+
+        loop {
+            let flush = async {
+                match deadline {
+                    Some(deadline) => sleep_until(deadline).await,
+                    None => std::future::pending().await,
+                }
+            };
+            tokio::select! {
+                line = lines.next_line() => {
+                    let Some(line) = line? else {
+                        break;
+                    };
+                    if line.trim().is_empty() {
+                        continue;
+                    }
+                    match opts.batch_interval {
+                        Some(interval) => {
+                            if pending.is_empty() {
+                                deadline = Some(Instant::now() + interval);
+                            }
+                            pending.push(line);
+                        }
+                        None => self.send_stream_message(room_id, &[line], opts).await?,
+                    }
+                }
+                _ = flush => {
+                    self.send_stream_message(room_id, &pending, opts).await?;
+                    pending.clear();
+                    deadline = None;
+                }
+                _ = &mut interrupt => {
+                    interrupted = true;
+                    break;
+                }
+            }
+        }
+
+        if !pending.is_empty() {
+            self.send_stream_message(room_id, &pending, opts).await?;
+        }
+        Ok(interrupted)
+    }
+}
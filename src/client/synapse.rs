@@ -0,0 +1,342 @@
+use std::collections::HashSet;
+use std::env;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use reqwest::Method;
+use serde_json::{json, Value};
+use tokio::time::sleep;
+
+use super::batch::{with_retries, Cancel, ItemError};
+use crate::outputs::InactiveUser;
+
+fn admin_base() -> String {
+    let base = env::var("MN_ADMIN_API_PATH").unwrap_or_else(|_| String::from("_synapse/admin"));
+    base.trim_matches('/').to_string()
+}
+
+/// Base path of the v1 admin API; reverse proxies in front of synapse
+/// sometimes expose it elsewhere.
+pub(super) fn admin_v1() -> String {
+    format!("{}/v1", admin_base())
+}
+
+pub(super) fn admin_v2() -> String {
+    format!("{}/v2", admin_base())
+}
+
+/// Actions applied to the users found by `inactive_users`.
+#[derive(Debug, Default)]
+pub(crate) struct UserActions {
+    pub(crate) deactivate: bool,
+    /// Body of a server notice sent to every user
+    pub(crate) notice: Option<String>,
+    /// Pause between two users
+    pub(crate) pace: Duration,
+    /// Users already processed, one per line; skipped when resuming
+    pub(crate) progress: Option<PathBuf>,
+    /// CSV file the actions are appended to
+    pub(crate) report: Option<PathBuf>,
+}
+
+impl UserActions {
+    pub(crate) fn is_empty(&self) -> bool {
+        !self.deactivate && self.notice.is_none()
+    }
+}
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+// The most recent connection of any session of any device.
+fn whois_last_seen(whois: &Value) -> Option<u64> {
+    whois
+        .get("devices")
+        .and_then(Value::as_object)
+        .into_iter()
+        .flat_map(|devices| devices.values())
+        .filter_map(|d| d.get("sessions").and_then(Value::as_array))
+        .flatten()
+        .filter_map(|s| s.get("connections").and_then(Value::as_array))
+        .flatten()
+        .filter_map(|c| c.get("last_seen").and_then(Value::as_u64))
+        .max()
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct RoomListOptions {
+    pub(crate) search_term: Option<String>,
+    pub(crate) order_by: Option<String>,
+    pub(crate) backwards: bool,
+    pub(crate) limit: u64,
+    pub(crate) min_members: Option<u64>,
+    pub(crate) max_members: Option<u64>,
+}
+
+impl RoomListOptions {
+    fn matches(&self, room: &Value) -> bool {
+        let members = room
+            .get("joined_members")
+            .and_then(Value::as_u64)
+            .unwrap_or(0);
+
+        if let Some(min) = self.min_members {
+            if members < min {
+                return false;
+            }
+        }
+        if let Some(max) = self.max_members {
+            if members > max {
+                return false;
+            }
+        }
+        true
+    }
+}
+
+impl super::Client {
+    /// Page through the synapse room list; `f` is called for every room
+    /// that passes the client side filters as soon as its page arrives.
+    pub(crate) async fn synapse_rooms(
+        &self,
+        opts: &RoomListOptions,
+        mut f: impl FnMut(&Value) -> anyhow::Result<()>,
+    ) -> anyhow::Result<()> {
+        let path = format!("{}/rooms", admin_v1());
+        let mut from: Option<u64> = None;
+        let mut pages = 0;
+        let mut fetched = 0;
+
+        loop {
+            let mut query = vec![
+                ("limit", opts.limit.to_string()),
+                ("dir", String::from(if opts.backwards { "b" } else { "f" })),
+            ];
+            if let Some(ref term) = opts.search_term {
+                query.push(("search_term", term.clone()));
+            }
+            if let Some(ref order_by) = opts.order_by {
+                query.push(("order_by", order_by.clone()));
+            }
+            if let Some(from) = from {
+                query.push(("from", from.to_string()));
+            }
+
+            let resp = self.api_get(&path, &query).await?;
+            let rooms = resp
+                .get("rooms")
+                .and_then(Value::as_array)
+                .cloned()
+                .unwrap_or_default();
+
+            pages += 1;
+            fetched += rooms.len();
+
+            for room in rooms.iter().filter(|r| opts.matches(r)) {
+                f(room)?;
+            }
+
+            from = resp.get("next_batch").and_then(Value::as_u64);
+
+            if pages > 1 || from.is_some() {
+                let total = resp.get("total_rooms").and_then(Value::as_u64).unwrap_or(0);
+                eprint!("\rpage {}: fetched {}/{} rooms", pages, fetched, total);
+            }
+
+            if from.is_none() {
+                break;
+            }
+        }
+
+        if pages > 1 {
+            eprintln!();
+        }
+
+        Ok(())
+    }
+
+    /// Users without any activity within `inactive`; deactivated users are
+    /// skipped. The last activity is taken from the user list or, on older
+    /// synapse versions, from the whois API.
+    pub(crate) async fn inactive_users(
+        &self,
+        inactive: Duration,
+        limit: u64,
+    ) -> anyhow::Result<Vec<InactiveUser>> {
+        let path = format!("{}/users", admin_v2());
+        let cutoff = now_ms().saturating_sub(inactive.as_millis() as u64);
+        let mut users = vec![];
+        let mut from: Option<String> = None;
+
+        loop {
+            let mut query = vec![
+                ("limit", limit.to_string()),
+                ("deactivated", String::from("false")),
+            ];
+            if let Some(ref from) = from {
+                query.push(("from", from.clone()));
+            }
+
+            let resp = self.api_get(&path, &query).await?;
+            users.extend(
+                resp.get("users")
+                    .and_then(Value::as_array)
+                    .cloned()
+                    .unwrap_or_default(),
+            );
+
+            let total = resp.get("total").and_then(Value::as_u64).unwrap_or(0);
+            eprint!("\rfetched {}/{} users", users.len(), total);
+
+            // next_token is a string in recent synapse versions.
+            from = match resp.get("next_token") {
+                Some(Value::String(token)) => Some(token.clone()),
+                Some(Value::Number(token)) => Some(token.to_string()),
+                _ => None,
+            };
+            if from.is_none() {
+                break;
+            }
+        }
+        eprintln!();
+
+        let mut found = vec![];
+        for (i, user) in users.iter().enumerate() {
+            if user.get("deactivated").and_then(Value::as_bool) == Some(true) {
+                continue;
+            }
+            let Some(user_id) = user.get("name").and_then(Value::as_str) else {
+                continue;
+            };
+
+            let last_seen_ts = match user.get("last_seen_ts").and_then(Value::as_u64) {
+                Some(ts) => Some(ts),
+                None => {
+                    let whois = self
+                        .api_get(&format!("{}/whois/{}", admin_v1(), user_id), &[])
+                        .await?;
+                    whois_last_seen(&whois)
+                }
+            };
+            let creation_ts = user.get("creation_ts").and_then(Value::as_u64);
+            eprint!("\rchecked {}/{} users", i + 1, users.len());
+
+            // Accounts which never connected count from their creation.
+            if last_seen_ts.or(creation_ts).unwrap_or(0) >= cutoff {
+                continue;
+            }
+            found.push(InactiveUser {
+                user_id: user_id.to_string(),
+                last_seen_ts,
+                creation_ts,
+                actions: vec![],
+                error: None,
+            });
+        }
+        eprintln!();
+
+        Ok(found)
+    }
+
+    /// Each action is retried on its own, so that a notice is not sent
+    /// twice when the deactivation is rate limited.
+    async fn apply_user_actions(
+        &self,
+        user: &mut InactiveUser,
+        actions: &UserActions,
+    ) -> Result<(), ItemError> {
+        if let Some(ref body) = actions.notice {
+            let path = format!("{}/send_server_notice", admin_v1());
+            let body = json!({
+                "user_id": user.user_id,
+                "content": {"msgtype": "m.text", "body": body},
+            });
+            with_retries(|| self.api_request(Method::POST, &path, &[], Some(&body))).await?;
+            user.actions.push("notice");
+        }
+        if actions.deactivate {
+            let path = format!("{}/deactivate/{}", admin_v1(), user.user_id);
+            let body = json!({"erase": false});
+            with_retries(|| self.api_request(Method::POST, &path, &[], Some(&body))).await?;
+            user.actions.push("deactivate");
+        }
+        Ok(())
+    }
+
+    /// Apply `actions` to `users`, pausing between users. Users listed in
+    /// the progress file are skipped; every action is logged to the report.
+    /// On `cancel` the remaining users are marked as interrupted.
+    pub(crate) async fn act_on_users(
+        &self,
+        users: &mut [InactiveUser],
+        actions: &UserActions,
+        cancel: &Cancel,
+    ) -> anyhow::Result<()> {
+        let done: HashSet<String> = match actions.progress {
+            Some(ref path) if path.exists() => fs::read_to_string(path)?
+                .lines()
+                .map(String::from)
+                .collect(),
+            _ => HashSet::new(),
+        };
+        let mut progress = match actions.progress {
+            Some(ref path) => Some(OpenOptions::new().create(true).append(true).open(path)?),
+            None => None,
+        };
+        let mut report = match actions.report {
+            Some(ref path) => {
+                let exists = path.exists();
+                let file = OpenOptions::new().create(true).append(true).open(path)?;
+                let mut writer = csv::Writer::from_writer(file);
+                if !exists {
+                    writer.write_record(["time", "user_id", "last_seen_ts", "actions", "error"])?;
+                }
+                Some(writer)
+            }
+            None => None,
+        };
+
+        let mut first = true;
+        for user in users.iter_mut() {
+            if done.contains(&user.user_id) {
+                user.actions.push("skipped");
+                continue;
+            }
+            if cancel.requested() {
+                user.actions.push("interrupted");
+                continue;
+            }
+            if !first {
+                sleep(actions.pace).await;
+            }
+            first = false;
+
+            if let Err(e) = self.apply_user_actions(user, actions).await {
+                user.error = Some(e.error);
+            }
+            if let Some(ref mut writer) = report {
+                let time = humantime::format_rfc3339_seconds(SystemTime::now()).to_string();
+                let last_seen = user.last_seen_ts.map(|t| t.to_string()).unwrap_or_default();
+                writer.write_record([
+                    time.as_str(),
+                    user.user_id.as_str(),
+                    last_seen.as_str(),
+                    user.actions.join(" ").as_str(),
+                    user.error.as_deref().unwrap_or(""),
+                ])?;
+                writer.flush()?;
+            }
+            if let (Some(file), None) = (progress.as_mut(), &user.error) {
+                writeln!(file, "{}", user.user_id)?;
+            }
+        }
+
+        Ok(())
+    }
+}
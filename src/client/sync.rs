@@ -1,30 +1,39 @@
 use std::{
     fmt::Debug,
-    fs::File,
-    io::{Cursor, Read, Write},
+    fs::{self, File},
+    io::{Cursor, ErrorKind, Read, Write},
+    os::unix::fs::{DirBuilderExt, FileTypeExt, PermissionsExt},
     path::Path,
     time::Duration,
 };
 
+use anyhow::bail;
+
 use futures::StreamExt;
 use matrix_sdk::{
+    deserialized_responses::EncryptionInfo,
     ruma::{
         api::client::sync::sync_events::v4::RoomSubscription,
         events::{room::EncryptedFile, AnySyncMessageLikeEvent, AnySyncTimelineEvent},
-        OwnedEventId, OwnedMxcUri, OwnedRoomId, UInt,
+        serde::Raw,
+        OwnedEventId, OwnedMxcUri, OwnedRoomId, OwnedUserId, UInt,
     },
-    RoomMemberships,
+    Room, RoomMemberships,
 };
 use matrix_sdk_crypto::{AttachmentDecryptor, MediaEncryptionInfo};
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 use serde_json::Value;
 use tokio::{
     io::{self, AsyncWriteExt, Interest},
     net::{UnixListener, UnixStream},
+    sync::broadcast,
     sync::watch::{self, Receiver, Sender},
     time::sleep,
 };
 
+use super::decrypt::mark_decrypted;
+use crate::filter::Filter;
+
 #[derive(Deserialize, Debug)]
 enum SocketCommand {
     #[serde(alias = "send")]
@@ -37,6 +46,85 @@ enum SocketCommand {
     File { room_id: OwnedRoomId, path: String },
     #[serde(alias = "subscribe")]
     Subscribe { room_id: OwnedRoomId },
+    /// Switch this connection to single events matching the filter.
+    #[serde(alias = "filter")]
+    Filter(EventFilter),
+}
+
+/// Every non-empty list has to match; empty lists match everything.
+#[derive(Clone, Debug, Default, Deserialize)]
+pub(crate) struct EventFilter {
+    #[serde(default)]
+    rooms: Vec<OwnedRoomId>,
+    #[serde(default)]
+    types: Vec<String>,
+    #[serde(default)]
+    senders: Vec<OwnedUserId>,
+}
+
+impl EventFilter {
+    fn matches(&self, event: &SocketEvent) -> bool {
+        let field = |key: &str| event.event.get(key).and_then(Value::as_str).unwrap_or("");
+
+        (self.rooms.is_empty() || self.rooms.contains(&event.room_id))
+            && (self.types.is_empty() || self.types.iter().any(|t| t == field("type")))
+            && (self.senders.is_empty()
+                || self.senders.iter().any(|s| s.as_str() == field("sender")))
+    }
+}
+
+#[derive(Clone, Debug, Serialize)]
+pub(crate) struct SocketEvent {
+    room_id: OwnedRoomId,
+    event: Value,
+}
+
+pub(crate) const SOCKET_PATH: &str = "/tmp/mnotify.sock";
+// Events buffered per connection before slow consumers miss events.
+const EVENT_BUFFER: usize = 1024;
+
+/// Remove the socket at `path` if it was left behind by an earlier run;
+/// a file which is no socket or one still served is left alone.
+fn remove_stale_socket(path: &Path) -> anyhow::Result<()> {
+    let meta = match fs::symlink_metadata(path) {
+        Ok(meta) => meta,
+        Err(e) if e.kind() == ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e.into()),
+    };
+    if !meta.file_type().is_socket() {
+        bail!("{} exists and is not a socket", path.display());
+    }
+    match std::os::unix::net::UnixStream::connect(path) {
+        Ok(_) => bail!("socket {} is served by another process", path.display()),
+        Err(e) if e.kind() == ErrorKind::ConnectionRefused => Ok(fs::remove_file(path)?),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// Bind the socket at `path`, accessible to our user only. It is bound
+/// in a private directory and moved into place once its mode is set, so
+/// that nobody can connect in between.
+fn bind_socket(path: &Path) -> anyhow::Result<UnixListener> {
+    remove_stale_socket(path)?;
+
+    let mut dir = path.as_os_str().to_owned();
+    dir.push(".tmp");
+    let dir = Path::new(&dir);
+    // Left behind by a crash; fails unless it is ours.
+    let _ = fs::remove_file(dir.join("socket"));
+    let _ = fs::remove_dir(dir);
+    fs::DirBuilder::new().mode(0o700).create(dir)?;
+    let tmp = dir.join("socket");
+    let bound = UnixListener::bind(&tmp)
+        .map_err(anyhow::Error::from)
+        .and_then(|listener| {
+            fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+            fs::rename(&tmp, path)?;
+            Ok(listener)
+        });
+    let _ = fs::remove_file(&tmp);
+    fs::remove_dir(dir)?;
+    bound
 }
 
 impl super::Client {
@@ -59,7 +147,12 @@ impl super::Client {
             "{}_matrix/media/v3/download/{}/{}?width=50&height=50&method=scale",
             homeserver, server, id,
         );
-        let ciphertext = reqwest::get(url).await.expect("Failed to download file...");
+        let ciphertext = self
+            .http_client()
+            .get(url)
+            .send()
+            .await
+            .expect("Failed to download file...");
         let ciphertext = ciphertext.bytes().await.unwrap().to_vec();
         let mut cursor = Cursor::new(ciphertext);
         let info: MediaEncryptionInfo = file.into();
@@ -111,44 +204,57 @@ impl super::Client {
             } => {
                 match reply_to {
                     Some(event_id) => {
-                        self.send_message_reply(room_id, &event_id, &message, true)
+                        self.send_message_reply(room_id, &event_id, &message, true, false)
                             .await?
                     }
                     None => self.send_message(room_id, &message, true).await?,
                 };
             }
             SocketCommand::File { room_id, path } => {
-                self.send_attachment(room_id, path).await?;
+                self.send_attachment(room_id, path, None, true).await?;
             }
             SocketCommand::Subscribe { room_id } => {
                 self.subscribe(room_id);
             }
+            SocketCommand::Filter(_) => {}
         }
         Ok(())
     }
 
-    pub(crate) async fn socket_command(&self, data: &[u8]) -> anyhow::Result<()> {
+    /// Dispatch the commands in `data`; a filter command is returned, as
+    /// it only applies to the connection it was received on.
+    pub(crate) async fn socket_command(&self, data: &[u8]) -> anyhow::Result<Option<EventFilter>> {
+        let mut filter = None;
         let iter = &mut data.split(|b| b.eq(&b'\n'));
         loop {
             let Some(data) = iter.next() else {
                 break;
             };
+            if data.is_empty() {
+                continue;
+            }
             let self_clone = self.clone();
             let c = serde_json::from_slice::<SocketCommand>(&data)?;
+            if let SocketCommand::Filter(f) = c {
+                filter = Some(f);
+                continue;
+            }
             tokio::spawn(async move {
                 let _r = self_clone.socket_command_matcher(c).await;
             });
         }
-        Ok(())
+        Ok(filter)
     }
 
     pub(crate) async fn handle_client(
         &self,
         mut r: Receiver<Vec<u8>>,
+        mut events: broadcast::Receiver<SocketEvent>,
         mut s: UnixStream,
     ) -> anyhow::Result<()> {
         let self_clone = self.clone();
         tokio::spawn(async move {
+            let mut filter: Option<EventFilter> = None;
             loop {
                 let ready = s
                     .ready(Interest::READABLE | Interest::WRITABLE)
@@ -163,7 +269,11 @@ impl super::Client {
                             if n == 0 {
                                 break;
                             }
-                            Some(self_clone.socket_command(&data[0..n]).await);
+                            match self_clone.socket_command(&data[0..n]).await {
+                                Ok(Some(f)) => filter = Some(f),
+                                Ok(None) => {}
+                                Err(e) => eprintln!("invalid socket command: {}", e),
+                            }
                         }
                         Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => {
                             continue;
@@ -172,6 +282,27 @@ impl super::Client {
                     }
                 }
                 if ready.is_writable() {
+                    if let Some(ref filter) = filter {
+                        match events.try_recv() {
+                            Ok(event) if filter.matches(&event) => {
+                                let mut json = serde_json::to_vec(&event).unwrap();
+                                json.push(b'\n');
+                                if s.write_all(&json).await.is_err() {
+                                    break;
+                                }
+                            }
+                            Ok(_) => {}
+                            Err(broadcast::error::TryRecvError::Empty) => {
+                                sleep(Duration::from_millis(100)).await;
+                            }
+                            Err(broadcast::error::TryRecvError::Lagged(n)) => {
+                                eprintln!("socket consumer too slow; skipped {} events", n);
+                            }
+                            Err(broadcast::error::TryRecvError::Closed) => break,
+                        }
+                        continue;
+                    }
+
                     let changed = r.has_changed();
                     if changed.is_err() {
                         break;
@@ -197,17 +328,16 @@ impl super::Client {
         Ok(())
     }
 
-    pub(crate) async fn handle_connections(&self, r: Receiver<Vec<u8>>) -> anyhow::Result<()> {
-        let path = Path::new("/tmp/mnotify.sock");
-        if path.exists() && std::fs::remove_file(path).is_err() {
-            eprintln!("Socket is still open!");
-            return Ok(());
-        }
-        let listener = UnixListener::bind(path).unwrap();
+    pub(crate) async fn handle_connections(
+        &self,
+        r: Receiver<Vec<u8>>,
+        events: broadcast::Sender<SocketEvent>,
+        listener: UnixListener,
+    ) -> anyhow::Result<()> {
         loop {
             match listener.accept().await {
                 Ok((s, _addr)) => {
-                    Some(self.handle_client(r.clone(), s).await);
+                    Some(self.handle_client(r.clone(), events.subscribe(), s).await);
                 }
                 Err(_e) => { /* connection failed */ }
             }
@@ -223,7 +353,19 @@ impl super::Client {
             };
             let sync = ss.sync();
             let mut sync_stream = Box::pin(sync);
-            while let Some(Ok(_response)) = sync_stream.next().await {
+            while let Some(response) = sync_stream.next().await {
+                if let Err(e) = response {
+                    let e = anyhow::Error::from(e);
+                    // Retrying is pointless; the session is gone.
+                    if super::login::unknown_token(&e).is_some() {
+                        return Err(e);
+                    }
+                    eprintln!("sync failed: {}", e);
+                    break;
+                }
+                if let Some(ref health) = self.sync_health {
+                    health.synced();
+                }
                 let mut output = vec![];
                 let rooms = ss.get_all_rooms().await;
                 for room in rooms {
@@ -312,11 +454,93 @@ impl super::Client {
             eprintln!("Sync stream ended");
         }
     }
-    pub(crate) async fn socket(&self) -> anyhow::Result<()> {
+    /// Run one round of the sync loop, e.g. to learn the joined rooms
+    /// before sending.
+    pub(crate) async fn sync_once(&self) -> anyhow::Result<()> {
+        let Some(ref ss) = self.sliding_sync else {
+            return Ok(());
+        };
+        let mut sync_stream = Box::pin(ss.sync());
+        if let Some(response) = sync_stream.next().await {
+            response?;
+        }
+        Ok(())
+    }
+
+    /// Drive the sync loop for the event handlers; restarts the stream
+    /// after errors unless the session is gone.
+    pub(crate) async fn sync_forever(&self) -> anyhow::Result<()> {
+        let Some(ref ss) = self.sliding_sync else {
+            panic!("no sliding sync");
+        };
+        loop {
+            let mut sync_stream = Box::pin(ss.sync());
+            while let Some(response) = sync_stream.next().await {
+                if let Err(e) = response {
+                    let e = anyhow::Error::from(e);
+                    if super::login::unknown_token(&e).is_some() {
+                        return Err(e);
+                    }
+                    eprintln!("sync failed: {}", e);
+                    break;
+                }
+                if let Some(ref health) = self.sync_health {
+                    health.synced();
+                }
+            }
+            sleep(Duration::from_secs(1)).await;
+        }
+    }
+
+    /// Forward the timeline events passing `filter` to the filtered
+    /// socket connections.
+    fn add_socket_event_handler(
+        &self,
+        events: broadcast::Sender<SocketEvent>,
+        filter: Option<Filter>,
+    ) {
+        let this = self.clone();
+        let filter = filter.map(|f| f.with_ts_source(self.skew.source));
+        self.inner.add_event_handler(
+            move |ev: Raw<AnySyncTimelineEvent>, room: Room, encryption: Option<EncryptionInfo>| {
+                let this = this.clone();
+                let events = events.clone();
+                let filter = filter.clone();
+                async move {
+                    let Ok(mut event) = ev.deserialize_as::<Value>() else {
+                        return;
+                    };
+                    mark_decrypted(&mut event, encryption.is_some());
+                    this.skew.annotate(&mut event);
+                    if let Some(ref filter) = filter {
+                        if !filter.matches(room.room_id().as_str(), &event) {
+                            return;
+                        }
+                    }
+                    this.attribute_event(&room, &mut event).await;
+                    // Sending only fails without connected consumers.
+                    let _ = events.send(SocketEvent {
+                        room_id: room.room_id().to_owned(),
+                        event,
+                    });
+                }
+            },
+        );
+    }
+
+    pub(crate) async fn socket(
+        &self,
+        path: impl AsRef<Path>,
+        filter: Option<Filter>,
+    ) -> anyhow::Result<()> {
         let (s, r) = watch::channel::<Vec<u8>>(vec![]);
+        let (events, _) = broadcast::channel::<SocketEvent>(EVENT_BUFFER);
+        self.add_socket_event_handler(events.clone(), filter);
+
+        let listener = bind_socket(path.as_ref())?;
         let self_clone = self.clone();
         tokio::spawn(async move {
-            Some(self_clone.handle_connections(r).await);
+            Some(self_clone.handle_connections(r, events, listener).await);
         });
         self.handle_stream(s).await?;
         Ok(())
@@ -0,0 +1,117 @@
+use std::collections::BTreeMap;
+
+use matrix_sdk::ruma::api::client::to_device::send_event_to_device;
+use matrix_sdk::ruma::events::{AnyToDeviceEvent, AnyToDeviceEventContent, ToDeviceEventType};
+use matrix_sdk::ruma::serde::Raw;
+use matrix_sdk::ruma::to_device::DeviceIdOrAllDevices;
+use matrix_sdk::ruma::{DeviceId, TransactionId, UserId};
+use serde_json::Value;
+use tracing::warn;
+
+use crate::hook::{self, Outcome};
+
+type DeviceMessages = BTreeMap<DeviceIdOrAllDevices, Raw<AnyToDeviceEventContent>>;
+
+impl super::Client {
+    async fn send_to_device_raw(
+        &self,
+        user_id: &UserId,
+        event_type: &str,
+        messages: DeviceMessages,
+    ) -> anyhow::Result<()> {
+        if messages.is_empty() {
+            return Ok(());
+        }
+
+        let request = send_event_to_device::v3::Request::new_raw(
+            ToDeviceEventType::from(event_type),
+            TransactionId::new(),
+            BTreeMap::from([(user_id.to_owned(), messages)]),
+        );
+        self.inner.send(request, None).await?;
+        Ok(())
+    }
+
+    /// Send a to-device message; olm encrypted for every device with an
+    /// established session, plaintext for the rest.
+    /// If `device_id` is `None`, all devices of `user_id` are addressed.
+    pub(crate) async fn send_to_device(
+        &self,
+        user_id: &UserId,
+        device_id: Option<&DeviceId>,
+        event_type: &str,
+        content: &Value,
+    ) -> anyhow::Result<()> {
+        let plaintext = Raw::new(content)?.cast::<AnyToDeviceEventContent>();
+        let devices = self.inner.encryption().get_user_devices(user_id).await?;
+
+        let mut encrypted = DeviceMessages::new();
+        let mut plain = DeviceMessages::new();
+
+        for device in devices.devices() {
+            if device_id.is_some_and(|id| id != device.device_id()) {
+                continue;
+            }
+            let target = DeviceIdOrAllDevices::DeviceId(device.device_id().to_owned());
+            match device.encrypt_event_raw(event_type, content).await {
+                Ok(raw) => {
+                    encrypted.insert(target, raw);
+                }
+                Err(e) => {
+                    warn!(
+                        "cannot encrypt for device {}: {}; sending plaintext",
+                        device.device_id(),
+                        e
+                    );
+                    plain.insert(target, plaintext.clone());
+                }
+            }
+        }
+
+        if encrypted.is_empty() && plain.is_empty() {
+            warn!("no known devices of {}; sending plaintext", user_id);
+            let target = match device_id {
+                Some(id) => DeviceIdOrAllDevices::DeviceId(id.to_owned()),
+                None => DeviceIdOrAllDevices::AllDevices,
+            };
+            plain.insert(target, plaintext);
+        }
+
+        self.send_to_device_raw(user_id, "m.room.encrypted", encrypted)
+            .await?;
+        self.send_to_device_raw(user_id, event_type, plain).await
+    }
+
+    /// Run `cmd` for every received to-device event of type `event_type`.
+    /// The event is passed as JSON on stdin.
+    pub(crate) fn add_to_device_hook(
+        &self,
+        event_type: String,
+        cmd: String,
+        limiter: hook::Limiter,
+    ) {
+        self.inner
+            .add_event_handler(move |ev: Raw<AnyToDeviceEvent>| {
+                let event_type = event_type.clone();
+                let cmd = cmd.clone();
+                let limiter = limiter.clone();
+                async move {
+                    match ev.get_field::<String>("type") {
+                        Ok(Some(t)) if t == event_type => {}
+                        _ => return,
+                    }
+                    let run = limiter.clone();
+                    let task = async move {
+                        match run.exec(&cmd, ev.json().get().as_bytes()).await {
+                            Outcome::Exited(status) if !status.success() => {
+                                warn!("to-device hook failed: {}", status)
+                            }
+                            Outcome::Failed(e) => warn!("to-device hook failed: {}", e),
+                            _ => {}
+                        }
+                    };
+                    limiter.dispatch(task).await;
+                }
+            });
+    }
+}
@@ -0,0 +1,103 @@
+use anyhow::bail;
+use matrix_sdk::ruma::events::room::message::RoomMessageEventContent;
+use matrix_sdk::ruma::RoomId;
+use serde_json::{json, Value};
+
+use crate::outputs::TombstoneSummary;
+
+pub(crate) struct TombstoneOptions {
+    /// Final message, pinned before the room is retired
+    pub(crate) message: Option<String>,
+    pub(crate) invite_only: bool,
+    /// Replace an existing tombstone
+    pub(crate) force: bool,
+}
+
+impl super::Client {
+    /// Retire `room_id` in favor of the existing room `successor`.
+    pub(crate) async fn tombstone_room(
+        &self,
+        room_id: &RoomId,
+        successor: &RoomId,
+        opts: &TombstoneOptions,
+    ) -> anyhow::Result<TombstoneSummary> {
+        if room_id == successor {
+            bail!("a room cannot be its own successor");
+        }
+        if let Some(existing) = self.get_state(room_id, "m.room.tombstone", "").await? {
+            let replacement = existing
+                .get("replacement_room")
+                .and_then(Value::as_str)
+                .unwrap_or("");
+            if !opts.force {
+                bail!(
+                    "{} already has a tombstone pointing to {}; use --force to replace it",
+                    room_id,
+                    replacement
+                );
+            }
+        }
+
+        let mut changes = vec![];
+        let mut message_event_id = None;
+
+        if let Some(ref message) = opts.message {
+            let room = self.get_joined_room(room_id)?;
+            let resp = room
+                .send(RoomMessageEventContent::text_markdown(message))
+                .await?;
+
+            let mut pinned = self
+                .get_state(room_id, "m.room.pinned_events", "")
+                .await?
+                .and_then(|c| c.get("pinned").and_then(Value::as_array).cloned())
+                .unwrap_or_default();
+            pinned.push(json!(resp.event_id));
+            self.put_state(
+                room_id,
+                "m.room.pinned_events",
+                "",
+                &json!({ "pinned": pinned }),
+            )
+            .await?;
+
+            changes.push(String::from("final message"));
+            message_event_id = Some(resp.event_id.to_string());
+        }
+
+        if opts.invite_only {
+            let join_rule = self
+                .get_state(room_id, "m.room.join_rules", "")
+                .await?
+                .and_then(|c| c.get("join_rule").and_then(Value::as_str).map(String::from));
+            if join_rule.as_deref() != Some("invite") {
+                self.put_state(
+                    room_id,
+                    "m.room.join_rules",
+                    "",
+                    &json!({ "join_rule": "invite" }),
+                )
+                .await?;
+                changes.push(String::from("join rule"));
+            }
+        }
+
+        let body = opts
+            .message
+            .clone()
+            .unwrap_or_else(|| String::from("This room has been replaced"));
+        let content = json!({ "body": body, "replacement_room": successor });
+        let event_id = self
+            .put_state(room_id, "m.room.tombstone", "", &content)
+            .await?;
+        changes.push(String::from("tombstone"));
+
+        Ok(TombstoneSummary {
+            room_id: room_id.to_string(),
+            successor: successor.to_string(),
+            event_id: event_id.to_string(),
+            message_event_id,
+            changes,
+        })
+    }
+}
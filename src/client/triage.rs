@@ -0,0 +1,145 @@
+use std::collections::HashMap;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::ruma::{OwnedUserId, RoomId};
+use serde_json::Value;
+
+use crate::outputs::TriageEntry;
+
+/// Events requested per page while paging back through the window.
+const PAGE: u64 = 100;
+
+/// Which messages `triage` lists.
+#[derive(Debug)]
+pub(crate) struct TriageOptions {
+    /// The reaction marking a message handled
+    pub(crate) reaction: String,
+    /// Only reactions of these users count; those of anyone if empty
+    pub(crate) by: Vec<OwnedUserId>,
+    pub(crate) since: Duration,
+    /// List the handled messages instead of the unhandled ones
+    pub(crate) handled: bool,
+}
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// Emoji keys with and without the variation selector are the same
+/// reaction to users.
+fn reaction_key(key: &str) -> &str {
+    key.trim_end_matches('\u{fe0f}')
+}
+
+/// The annotated event and the key of a reaction. m.relates_to stays
+/// unencrypted, so undecryptable reactions count too.
+fn annotation(event: &Value) -> Option<(&str, &str)> {
+    let relation = event.pointer("/content/m.relates_to")?;
+    if relation.get("rel_type").and_then(Value::as_str) != Some("m.annotation") {
+        return None;
+    }
+    Some((
+        relation.get("event_id")?.as_str()?,
+        relation.get("key")?.as_str()?,
+    ))
+}
+
+/// Messages, without their edits and redacted ones.
+fn is_message(event: &Value) -> bool {
+    event.get("type").and_then(Value::as_str) == Some("m.room.message")
+        && event.pointer("/unsigned/redacted_because").is_none()
+        && event
+            .pointer("/content/m.relates_to/rel_type")
+            .and_then(Value::as_str)
+            != Some("m.replace")
+}
+
+impl super::Client {
+    /// The messages of `room_id` sent within `opts.since` which carry the
+    /// reaction of a handler, or with `opts.handled` unset those which do
+    /// not, oldest first. Reactions always come after the message they
+    /// annotate, so one pass back through the window finds them all;
+    /// there is no request per message.
+    pub(crate) async fn triage(
+        &self,
+        room_id: &RoomId,
+        opts: &TriageOptions,
+    ) -> anyhow::Result<Vec<TriageEntry>> {
+        let cutoff = now_ms().saturating_sub(opts.since.as_millis() as u64);
+        let wanted = reaction_key(&opts.reaction);
+        let mut messages = vec![];
+        // Annotated event id to the handlers and the time of each reaction.
+        let mut handlers: HashMap<String, Vec<(String, u64)>> = HashMap::new();
+        let mut from = None;
+
+        loop {
+            let msgs = self.messages(room_id, PAGE, from).await?;
+            let mut reached = msgs.chunk.is_empty();
+            for raw in msgs.chunk {
+                let event = raw.event.deserialize_as::<Value>()?;
+                let ts = event
+                    .get("origin_server_ts")
+                    .and_then(Value::as_u64)
+                    .unwrap_or(0);
+                // Finish the page: servers with skewed clocks send older
+                // timestamps among newer ones.
+                if ts < cutoff {
+                    reached = true;
+                    continue;
+                }
+                let sender = event.get("sender").and_then(Value::as_str).unwrap_or("");
+                if let Some((target, key)) = annotation(&event) {
+                    let allowed =
+                        opts.by.is_empty() || opts.by.iter().any(|u| u.as_str() == sender);
+                    if allowed && reaction_key(key) == wanted {
+                        handlers
+                            .entry(target.to_string())
+                            .or_default()
+                            .push((sender.to_string(), ts));
+                    }
+                } else if is_message(&event) {
+                    messages.push(event);
+                }
+            }
+            from = msgs.end;
+            if reached || from.is_none() {
+                break;
+            }
+        }
+
+        let mut entries = vec![];
+        for event in messages.into_iter().rev() {
+            let text = |pointer: &str| event.pointer(pointer).and_then(Value::as_str);
+            let Some(event_id) = text("/event_id") else {
+                continue;
+            };
+            let mut handled = handlers.remove(event_id).unwrap_or_default();
+            if handled.is_empty() == opts.handled {
+                continue;
+            }
+            handled.sort_by_key(|(_, ts)| *ts);
+            let handled_at = handled.first().map(|(_, ts)| *ts);
+            let mut handled_by: Vec<String> = vec![];
+            for (user, _) in handled {
+                if !handled_by.contains(&user) {
+                    handled_by.push(user);
+                }
+            }
+            entries.push(TriageEntry {
+                event_id: event_id.to_string(),
+                sender: text("/sender").unwrap_or_default().to_string(),
+                origin_server_ts: event
+                    .get("origin_server_ts")
+                    .and_then(Value::as_u64)
+                    .unwrap_or(0),
+                body: text("/content/body").map(String::from),
+                handled_by,
+                handled_at,
+            });
+        }
+        Ok(entries)
+    }
+}
@@ -0,0 +1,351 @@
+use std::env;
+use std::fmt;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+use anyhow::{anyhow, bail};
+use base64::engine::general_purpose::STANDARD;
+use base64::Engine;
+use crypto_secretbox::aead::generic_array::GenericArray;
+use crypto_secretbox::aead::{Aead, KeyInit};
+use crypto_secretbox::XSalsa20Poly1305;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use super::config::export_config;
+use super::session::{self, meta_path, write_atomic, Meta};
+use super::CRATE_NAME;
+use crate::outputs::ConfigVault;
+use crate::terminal;
+
+/// Version of the encrypted config format: an NaCl secretbox
+/// (XSalsa20-Poly1305) of the exported config.
+const FORMAT_VERSION: u64 = 1;
+/// scrypt cost of keys derived from a passphrase, as 2^log_n.
+const SCRYPT_LOG_N: u8 = 17;
+const SCRYPT_R: u32 = 8;
+const SCRYPT_P: u32 = 1;
+/// Keyring entry of the random data key of `config encrypt --keyring`.
+const KEYRING_ENTRY: &str = "config-key";
+
+/// Where the key of the encrypted config comes from.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+enum KeySource {
+    Passphrase,
+    Keyring,
+}
+
+impl KeySource {
+    fn name(self) -> &'static str {
+        match self {
+            Self::Passphrase => "passphrase",
+            Self::Keyring => "keyring",
+        }
+    }
+}
+
+#[derive(Clone, Debug, Serialize, Deserialize)]
+struct Scrypt {
+    log_n: u8,
+    r: u32,
+    p: u32,
+    salt: String,
+}
+
+/// The encrypted config file.
+#[derive(Serialize, Deserialize)]
+struct Sealed {
+    version: u64,
+    key: KeySource,
+    /// How the key is derived from the passphrase
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    scrypt: Option<Scrypt>,
+    nonce: String,
+    ciphertext: String,
+}
+
+/// The decrypted config, kept in memory for the rest of the invocation
+/// with the key to write it again.
+struct Unlocked {
+    key: [u8; 32],
+    source: KeySource,
+    scrypt: Option<Scrypt>,
+    config: Value,
+}
+
+static UNLOCKED: Mutex<Option<Unlocked>> = Mutex::new(None);
+
+/// The encrypted config could not be decrypted.
+#[derive(Debug)]
+pub(crate) struct Locked(String);
+
+impl fmt::Display for Locked {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "could not unlock the encrypted config: {}", self.0)
+    }
+}
+
+impl std::error::Error for Locked {}
+
+pub(crate) fn vault_path() -> io::Result<PathBuf> {
+    let mut path = meta_path()?.into_os_string();
+    path.push(".enc");
+    Ok(path.into())
+}
+
+/// Whether the config is encrypted; meta.json and the session are then
+/// read from and written to the encrypted file only.
+pub(crate) fn is_encrypted() -> io::Result<bool> {
+    vault_path()?.try_exists()
+}
+
+fn random<const N: usize>() -> anyhow::Result<[u8; N]> {
+    let mut buf = [0; N];
+    getrandom::getrandom(&mut buf).map_err(|e| anyhow!("random: {}", e))?;
+    Ok(buf)
+}
+
+fn derive_key(passphrase: &str, params: &Scrypt) -> anyhow::Result<[u8; 32]> {
+    let salt = STANDARD.decode(&params.salt)?;
+    let scrypt_params = scrypt::Params::new(params.log_n, params.r, params.p, 32)
+        .map_err(|e| anyhow!("scrypt: {}", e))?;
+    let mut key = [0; 32];
+    scrypt::scrypt(passphrase.as_bytes(), &salt, &scrypt_params, &mut key)
+        .map_err(|e| anyhow!("scrypt: {}", e))?;
+    Ok(key)
+}
+
+/// The passphrase from `passphrase_file`, `$MN_CONFIG_PASSPHRASE` or the
+/// terminal, in this order. New passphrases are asked twice.
+fn read_passphrase(passphrase_file: Option<&Path>, new: bool) -> anyhow::Result<String> {
+    if let Some(path) = passphrase_file {
+        let raw =
+            fs::read_to_string(path).map_err(|e| anyhow!("read {}: {}", path.display(), e))?;
+        return Ok(raw.trim_end_matches(['\r', '\n']).to_string());
+    }
+    if let Ok(passphrase) = env::var("MN_CONFIG_PASSPHRASE") {
+        return Ok(passphrase);
+    }
+    if !terminal::interactive() {
+        bail!("no passphrase; set MN_CONFIG_PASSPHRASE or pass --passphrase-file");
+    }
+    let passphrase = rpassword::prompt_password("config passphrase: ")?;
+    if new && rpassword::prompt_password("repeat passphrase: ")? != passphrase {
+        bail!("the passphrases do not match");
+    }
+    Ok(passphrase)
+}
+
+fn keyring_key() -> anyhow::Result<[u8; 32]> {
+    let entry = keyring::Entry::new(CRATE_NAME, KEYRING_ENTRY)?;
+    let raw = STANDARD.decode(entry.get_password()?)?;
+    raw.try_into()
+        .map_err(|_| anyhow!("the data key in the keyring is not 32 bytes"))
+}
+
+fn seal(unlocked: &Unlocked) -> anyhow::Result<Vec<u8>> {
+    let cipher = XSalsa20Poly1305::new(GenericArray::from_slice(&unlocked.key));
+    let nonce = random::<24>()?;
+    let plaintext = serde_json::to_vec(&unlocked.config)?;
+    let ciphertext = cipher
+        .encrypt(GenericArray::from_slice(&nonce), plaintext.as_slice())
+        .map_err(|_| anyhow!("encryption failed"))?;
+    let sealed = Sealed {
+        version: FORMAT_VERSION,
+        key: unlocked.source,
+        scrypt: unlocked.scrypt.clone(),
+        nonce: STANDARD.encode(nonce),
+        ciphertext: STANDARD.encode(ciphertext),
+    };
+    let mut out = serde_json::to_vec(&sealed)?;
+    out.push(b'\n');
+    Ok(out)
+}
+
+fn open(passphrase_file: Option<&Path>) -> anyhow::Result<Unlocked> {
+    let raw = fs::read_to_string(vault_path()?)?;
+    let sealed: Sealed = serde_json::from_str(&raw)?;
+    if sealed.version != FORMAT_VERSION {
+        bail!("unsupported version {}", sealed.version);
+    }
+    let key = match (sealed.key, sealed.scrypt.as_ref()) {
+        (KeySource::Keyring, _) => keyring_key()?,
+        (KeySource::Passphrase, Some(params)) => {
+            derive_key(&read_passphrase(passphrase_file, false)?, params)?
+        }
+        (KeySource::Passphrase, None) => bail!("field `scrypt`: missing"),
+    };
+
+    let cipher = XSalsa20Poly1305::new(GenericArray::from_slice(&key));
+    let nonce = STANDARD.decode(&sealed.nonce)?;
+    if nonce.len() != 24 {
+        bail!("field `nonce`: not 24 bytes");
+    }
+    let plaintext = cipher
+        .decrypt(
+            GenericArray::from_slice(&nonce),
+            STANDARD.decode(&sealed.ciphertext)?.as_slice(),
+        )
+        .map_err(|_| anyhow!("wrong {} or corrupted file", sealed.key.name()))?;
+
+    Ok(Unlocked {
+        key,
+        source: sealed.key,
+        scrypt: sealed.scrypt,
+        config: serde_json::from_slice(&plaintext)?,
+    })
+}
+
+/// Decrypt the config into memory, with the passphrase of
+/// `passphrase_file` if it needs one.
+pub(crate) fn unlock(passphrase_file: Option<&Path>) -> Result<(), Locked> {
+    let mut unlocked = UNLOCKED.lock().unwrap();
+    if unlocked.is_none() {
+        *unlocked = Some(open(passphrase_file).map_err(|e| Locked(e.to_string()))?);
+    }
+    Ok(())
+}
+
+/// The field `key` of the decrypted config, i.e. "meta" or "session".
+pub(crate) fn get(key: &str) -> anyhow::Result<Value> {
+    unlock(None)?;
+    let unlocked = UNLOCKED.lock().unwrap();
+    let config = &unlocked.as_ref().unwrap().config;
+    Ok(config.get(key).cloned().unwrap_or(Value::Null))
+}
+
+/// Replace the field `key` of the decrypted config and write it again,
+/// encrypted with the same key.
+pub(crate) fn set(key: &str, value: Value) -> anyhow::Result<()> {
+    unlock(None)?;
+    let mut unlocked = UNLOCKED.lock().unwrap();
+    let unlocked = unlocked.as_mut().unwrap();
+    unlocked.config[key] = value;
+    write_atomic(vault_path()?, &seal(unlocked)?, 0o600)
+}
+
+/// Replace meta.json and the session with an encrypted file. The key is
+/// derived from a passphrase, or with `keyring` a random data key kept in
+/// the OS keyring. The old files are removed only once the new one is
+/// written.
+pub(crate) fn encrypt(
+    passphrase_file: Option<&Path>,
+    keyring: bool,
+) -> anyhow::Result<ConfigVault> {
+    if is_encrypted()? {
+        bail!("the config is encrypted already");
+    }
+    let config = export_config(false)?;
+
+    let (key, source, scrypt) = if keyring {
+        let key = random::<32>()?;
+        let entry = keyring::Entry::new(CRATE_NAME, KEYRING_ENTRY)?;
+        entry.set_password(&STANDARD.encode(key))?;
+        (key, KeySource::Keyring, None)
+    } else {
+        let params = Scrypt {
+            log_n: SCRYPT_LOG_N,
+            r: SCRYPT_R,
+            p: SCRYPT_P,
+            salt: STANDARD.encode(random::<16>()?),
+        };
+        let key = derive_key(&read_passphrase(passphrase_file, true)?, &params)?;
+        (key, KeySource::Passphrase, Some(params))
+    };
+    let unlocked = Unlocked {
+        key,
+        source,
+        scrypt,
+        config,
+    };
+    let user_id = Meta::load()?.user_id;
+    let has_session = !config_unset(&unlocked.config, "session");
+    let path = vault_path()?;
+    write_atomic(&path, &seal(&unlocked)?, 0o600)?;
+    *UNLOCKED.lock().unwrap() = Some(unlocked);
+
+    if has_session {
+        session::delete_plain_session(&user_id)?;
+    }
+    fs::remove_file(meta_path()?)?;
+
+    Ok(ConfigVault {
+        encrypted: true,
+        key: Some(source.name()),
+        path: path.display().to_string(),
+    })
+}
+
+fn config_unset(config: &Value, key: &str) -> bool {
+    config.get(key).map_or(true, Value::is_null)
+}
+
+fn write_plain(config: &Value) -> anyhow::Result<()> {
+    let meta: Meta = serde_json::from_value(config["meta"].clone())?;
+    if !config_unset(config, "session") {
+        let session = serde_json::from_value(config["session"].clone())?;
+        session::persist_session(&meta.user_id, &session)?;
+    }
+    meta.dump()
+}
+
+/// Write meta.json and the session in plain again and remove the
+/// encrypted file. It is kept until both are written.
+pub(crate) fn decrypt(passphrase_file: Option<&Path>) -> anyhow::Result<ConfigVault> {
+    if !is_encrypted()? {
+        bail!("the config is not encrypted");
+    }
+    unlock(passphrase_file)?;
+    let (config, source) = {
+        let unlocked = UNLOCKED.lock().unwrap();
+        let unlocked = unlocked.as_ref().unwrap();
+        (unlocked.config.clone(), unlocked.source)
+    };
+
+    // Move the encrypted file aside, so that the writes below go to the
+    // plain files; it is restored if they fail.
+    let path = vault_path()?;
+    let mut aside = path.clone().into_os_string();
+    aside.push(".old");
+    let aside = PathBuf::from(aside);
+    fs::rename(&path, &aside)?;
+
+    if let Err(e) = write_plain(&config) {
+        fs::rename(&aside, &path)?;
+        return Err(e);
+    }
+    fs::remove_file(&aside)?;
+    *UNLOCKED.lock().unwrap() = None;
+
+    if source == KeySource::Keyring {
+        let entry = keyring::Entry::new(CRATE_NAME, KEYRING_ENTRY)?;
+        entry.delete_password()?;
+    }
+
+    Ok(ConfigVault {
+        encrypted: false,
+        key: None,
+        path: meta_path()?.display().to_string(),
+    })
+}
+
+/// Remove the encrypted config and its data key, if any.
+pub(crate) fn delete() -> anyhow::Result<()> {
+    let path = vault_path()?;
+    let uses_keyring = match UNLOCKED.lock().unwrap().as_ref() {
+        Some(unlocked) => unlocked.source == KeySource::Keyring,
+        None => {
+            serde_json::from_str::<Sealed>(&fs::read_to_string(&path)?)?.key == KeySource::Keyring
+        }
+    };
+    fs::remove_file(&path)?;
+    *UNLOCKED.lock().unwrap() = None;
+    if uses_keyring {
+        let entry = keyring::Entry::new(CRATE_NAME, KEYRING_ENTRY)?;
+        entry.delete_password()?;
+    }
+    Ok(())
+}
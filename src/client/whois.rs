@@ -0,0 +1,172 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::io;
+use std::net::IpAddr;
+use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use matrix_sdk::ruma::UserId;
+use maxminddb::{geoip2, Reader};
+use serde_json::Value;
+
+use super::session::{user_agents_cache_path, write_atomic};
+use super::synapse::admin_v1;
+use crate::outputs::{WhoisConnection, WhoisDevice, WhoisReport};
+
+/// Window in which connections from too many countries are flagged.
+const COUNTRY_WINDOW_MS: u64 = 24 * 60 * 60 * 1000;
+
+#[derive(Debug, Default)]
+pub(crate) struct WhoisOptions {
+    /// GeoLite2 or GeoIP2 City database the session IPs are located with
+    pub(crate) geoip: Option<PathBuf>,
+    /// Flag connections from more countries within 24 hours
+    pub(crate) max_countries: usize,
+}
+
+/// A local MaxMind database; nothing is looked up online.
+struct GeoIp(Reader<Vec<u8>>);
+
+impl GeoIp {
+    fn open(path: &Path) -> anyhow::Result<Self> {
+        Ok(Self(Reader::open_readfile(path)?))
+    }
+
+    /// Country code and English city name of `ip`; none for private
+    /// addresses and those missing from the database.
+    fn locate(&self, ip: &str) -> (Option<String>, Option<String>) {
+        let Ok(ip) = ip.parse::<IpAddr>() else {
+            return (None, None);
+        };
+        let Ok(city) = self.0.lookup::<geoip2::City>(ip) else {
+            return (None, None);
+        };
+        let country = city.country.and_then(|c| c.iso_code).map(String::from);
+        let name = city
+            .city
+            .and_then(|c| c.names)
+            .and_then(|names| names.get("en").map(|name| name.to_string()));
+        (country, name)
+    }
+}
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// The user agents seen per account by earlier runs.
+fn load_user_agents(path: &Path) -> anyhow::Result<BTreeMap<String, BTreeSet<String>>> {
+    match fs::read_to_string(path) {
+        Ok(raw) => Ok(serde_json::from_str(&raw).unwrap_or_default()),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// The connections of a device over all its sessions.
+fn connections(device: &Value, geoip: Option<&GeoIp>) -> Vec<WhoisConnection> {
+    device
+        .get("sessions")
+        .and_then(Value::as_array)
+        .into_iter()
+        .flatten()
+        .filter_map(|s| s.get("connections").and_then(Value::as_array))
+        .flatten()
+        .map(|c| {
+            let ip = c
+                .get("ip")
+                .and_then(Value::as_str)
+                .unwrap_or("")
+                .to_string();
+            let (country, city) = match geoip {
+                Some(geoip) => geoip.locate(&ip),
+                None => (None, None),
+            };
+            WhoisConnection {
+                last_seen: c.get("last_seen").and_then(Value::as_u64),
+                user_agent: c
+                    .get("user_agent")
+                    .and_then(Value::as_str)
+                    .map(String::from),
+                ip,
+                country,
+                city,
+            }
+        })
+        .collect()
+}
+
+impl super::Client {
+    /// The sessions of a user by device, from the whois admin API, with
+    /// findings of anomalies: connections from more than `max_countries`
+    /// countries within 24 hours, which requires a GeoIP database, and
+    /// user agents not seen for the account by earlier runs. The first
+    /// run for an account only records its user agents.
+    pub(crate) async fn whois_user(
+        &self,
+        user_id: &UserId,
+        opts: &WhoisOptions,
+    ) -> anyhow::Result<WhoisReport> {
+        let geoip = opts.geoip.as_deref().map(GeoIp::open).transpose()?;
+        let whois = self
+            .api_get(&format!("{}/whois/{}", admin_v1(), user_id), &[])
+            .await?;
+
+        let devices: Vec<WhoisDevice> = whois
+            .get("devices")
+            .and_then(Value::as_object)
+            .into_iter()
+            .flatten()
+            .map(|(device_id, device)| WhoisDevice {
+                device_id: device_id.clone(),
+                connections: connections(device, geoip.as_ref()),
+            })
+            .collect();
+        let mut findings = vec![];
+
+        if geoip.is_some() {
+            let since = now_ms().saturating_sub(COUNTRY_WINDOW_MS);
+            let countries: BTreeSet<&str> = devices
+                .iter()
+                .flat_map(|d| &d.connections)
+                .filter(|c| c.last_seen.is_some_and(|ts| ts >= since))
+                .filter_map(|c| c.country.as_deref())
+                .collect();
+            if countries.len() > opts.max_countries {
+                findings.push(format!(
+                    "connections from {} countries within 24h: {}",
+                    countries.len(),
+                    countries.into_iter().collect::<Vec<_>>().join(", ")
+                ));
+            }
+        }
+
+        let path = user_agents_cache_path(&self.user_id)?;
+        let mut seen = load_user_agents(&path)?;
+        let first_run = !seen.contains_key(user_id.as_str());
+        let known = seen.entry(user_id.to_string()).or_default();
+        for device in &devices {
+            for connection in &device.connections {
+                let Some(ref user_agent) = connection.user_agent else {
+                    continue;
+                };
+                if known.insert(user_agent.clone()) && !first_run {
+                    findings.push(format!(
+                        "new user agent on device {} from {}: {}",
+                        device.device_id, connection.ip, user_agent
+                    ));
+                }
+            }
+        }
+        write_atomic(&path, &serde_json::to_vec(&seen)?, 0o600)?;
+
+        Ok(WhoisReport {
+            user_id: user_id.to_string(),
+            devices,
+            findings,
+        })
+    }
+}
@@ -0,0 +1,162 @@
+use anyhow::{anyhow, bail};
+
+const MONTHS: [&str; 12] = [
+    "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC",
+];
+const WEEKDAYS: [&str; 7] = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"];
+
+/// Minutes searched back for a due time, one week.
+const MAX_LOOKBACK: u64 = 7 * 24 * 60;
+
+/// A five field cron expression (minute, hour, day of month, month, day
+/// of week), evaluated in UTC. Fields are `*`, numbers, ranges `a-b`,
+/// steps `*/n` or `a-b/n` and lists of those; months and weekdays may be
+/// given by their English three letter names.
+#[derive(Clone, Debug, PartialEq)]
+pub(crate) struct Cron {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    /// Both day fields were restricted; then either of them matches, as
+    /// in crontab(5)
+    days_or: bool,
+}
+
+/// The bit set of one field, e.g. `1-5` or `MON,WED`.
+fn parse_field(field: &str, min: u32, max: u32, names: &[&str]) -> anyhow::Result<u64> {
+    let value = |s: &str| -> anyhow::Result<u32> {
+        let upper = s.to_uppercase();
+        // Month names start at 1, weekday names at 0.
+        if let Some(i) = names.iter().position(|n| *n == upper) {
+            return Ok(i as u32 + min);
+        }
+        let n: u32 = s
+            .parse()
+            .map_err(|_| anyhow!("`{}` is neither a number nor a name", s))?;
+        if n < min || n > max {
+            bail!("{} is out of range {}-{}", n, min, max);
+        }
+        Ok(n)
+    };
+
+    let mut bits = 0u64;
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => {
+                let step: u32 = step
+                    .parse()
+                    .map_err(|_| anyhow!("invalid step `{}`", step))?;
+                if step == 0 {
+                    bail!("step must not be 0");
+                }
+                (range, step)
+            }
+            None => (part, 1),
+        };
+        let (start, end) = match range {
+            "*" => (min, max),
+            _ => match range.split_once('-') {
+                Some((a, b)) => (value(a)?, value(b)?),
+                None if step > 1 => (value(range)?, max),
+                None => {
+                    let n = value(range)?;
+                    (n, n)
+                }
+            },
+        };
+        if start > end {
+            bail!("invalid range `{}`", range);
+        }
+        for n in (start..=end).step_by(step as usize) {
+            bits |= 1u64 << n;
+        }
+    }
+    Ok(bits)
+}
+
+/// Year, month and day of a day count since the unix epoch.
+fn civil_from_days(days: i64) -> (i64, u32, u32) {
+    let z = days + 719468;
+    let era = z.div_euclid(146097);
+    let doe = z.rem_euclid(146097);
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+    let month = (if mp < 10 { mp + 3 } else { mp - 9 }) as u32;
+    let year = yoe + era * 400 + i64::from(month <= 2);
+    (year, month, day)
+}
+
+impl Cron {
+    pub(crate) fn parse(expr: &str) -> anyhow::Result<Self> {
+        let expr = match expr.trim() {
+            "@hourly" => "0 * * * *",
+            "@daily" | "@midnight" => "0 0 * * *",
+            "@weekly" => "0 0 * * 0",
+            "@monthly" => "0 0 1 * *",
+            "@yearly" | "@annually" => "0 0 1 1 *",
+            expr => expr,
+        };
+        let fields: Vec<&str> = expr.split_whitespace().collect();
+        let &[minute, hour, day, month, weekday] = fields.as_slice() else {
+            bail!("cron expressions have five fields, got {}", fields.len());
+        };
+        let field = |name: &str, f: &str, min: u32, max: u32, names: &[&str]| {
+            parse_field(f, min, max, names).map_err(|e| anyhow!("{} field: {}", name, e))
+        };
+
+        let mut weekdays = field("weekday", weekday, 0, 7, &WEEKDAYS)?;
+        // 7 is Sunday as well.
+        if weekdays & (1u64 << 7) != 0 {
+            weekdays = (weekdays | 1) & !(1u64 << 7);
+        }
+        Ok(Self {
+            minutes: field("minute", minute, 0, 59, &[])?,
+            hours: field("hour", hour, 0, 23, &[])?,
+            days: field("day", day, 1, 31, &[])?,
+            months: field("month", month, 1, 12, &MONTHS)?,
+            weekdays,
+            days_or: day != "*" && weekday != "*",
+        })
+    }
+
+    /// Whether the minute starting at `ts`, in seconds since the unix
+    /// epoch, matches.
+    pub(crate) fn matches(&self, ts: u64) -> bool {
+        let minute = ts / 60 % 60;
+        let hour = ts / 3600 % 24;
+        let days = (ts / 86400) as i64;
+        let (_, month, day) = civil_from_days(days);
+        // The epoch was a Thursday.
+        let weekday = (days + 4) % 7;
+
+        let day_matches = if self.days_or {
+            self.days & (1u64 << day) != 0 || self.weekdays & (1u64 << weekday) != 0
+        } else {
+            self.days & (1u64 << day) != 0 && self.weekdays & (1u64 << weekday) != 0
+        };
+        self.minutes & (1u64 << minute) != 0
+            && self.hours & (1u64 << hour) != 0
+            && self.months & (1u64 << month) != 0
+            && day_matches
+    }
+
+    /// The latest matching minute after `after` and not later than `now`,
+    /// looking back at most a week; missed runs are not made up for.
+    pub(crate) fn latest_due(&self, after: u64, now: u64) -> Option<u64> {
+        let mut minute = now - now % 60;
+        for _ in 0..MAX_LOOKBACK {
+            if minute <= after {
+                return None;
+            }
+            if self.matches(minute) {
+                return Some(minute);
+            }
+            minute = minute.checked_sub(60)?;
+        }
+        None
+    }
+}
@@ -0,0 +1,65 @@
+use std::env;
+
+use lettre::message::Mailbox;
+use lettre::transport::smtp::authentication::Credentials;
+use lettre::{AsyncSmtpTransport, AsyncTransport, Message, Tokio1Executor};
+
+const DEFAULT_TEMPLATE: &str = "\
+Hello,
+
+{inviter} invited you to the Matrix room \"{room}\".
+
+Open the following link to join; you can create a Matrix account on the way:
+
+{link}
+";
+
+/// SMTP relay used to send invitations to people without a matrix account.
+#[derive(Clone, Debug)]
+pub(crate) struct SmtpConfig {
+    /// e.g. `smtps://relay.example.org` or `smtp://relay.example.org:587?tls=required`
+    pub(crate) url: String,
+    pub(crate) from: String,
+    /// Invitation body; `{inviter}`, `{room}` and `{link}` are replaced
+    pub(crate) template: Option<String>,
+}
+
+pub(crate) struct Invitation<'a> {
+    pub(crate) inviter: &'a str,
+    pub(crate) room: &'a str,
+    pub(crate) link: &'a str,
+}
+
+impl SmtpConfig {
+    fn render(&self, invitation: &Invitation) -> String {
+        self.template
+            .as_deref()
+            .unwrap_or(DEFAULT_TEMPLATE)
+            .replace("{inviter}", invitation.inviter)
+            .replace("{room}", invitation.room)
+            .replace("{link}", invitation.link)
+    }
+
+    pub(crate) async fn send_invitation(
+        &self,
+        to: &str,
+        invitation: &Invitation<'_>,
+    ) -> anyhow::Result<()> {
+        let mut builder = AsyncSmtpTransport::<Tokio1Executor>::from_url(&self.url)?;
+
+        // Credentials can also be part of the url, but this keeps them
+        // out of shell history and process listings.
+        if let (Ok(user), Ok(password)) = (env::var("MN_SMTP_USER"), env::var("MN_SMTP_PASSWORD")) {
+            builder = builder.credentials(Credentials::new(user, password));
+        }
+
+        let message = Message::builder()
+            .from(self.from.parse::<Mailbox>()?)
+            .to(to.parse::<Mailbox>()?)
+            .subject(format!("Invitation to {}", invitation.room))
+            .body(self.render(invitation))?;
+
+        builder.build().send(message).await?;
+        Ok(())
+    }
+}
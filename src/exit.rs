@@ -0,0 +1,86 @@
+// Exit codes with a dedicated meaning; everything else exits with 1.
+
+use std::fmt;
+
+/// Ends a command with `code` instead of 1; `mn` exits with it and the
+/// repl shows it as the status of the command. What went wrong is
+/// printed before.
+#[derive(Debug)]
+pub(crate) struct ExitCode(pub(crate) i32);
+
+impl fmt::Display for ExitCode {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "exit code {}", self.0)
+    }
+}
+
+impl std::error::Error for ExitCode {}
+
+/// A check or audit command reported violations.
+pub(crate) const FINDINGS: i32 = 2;
+
+/// The homeserver rejected the access token.
+pub(crate) const AUTH: i32 = 77;
+
+/// An approval request was rejected.
+pub(crate) const REJECTED: i32 = 10;
+
+/// Waiting for a decision or an event timed out.
+pub(crate) const TIMEOUT: i32 = 11;
+
+/// `room create --wait-join` timed out with invitees which did not answer.
+pub(crate) const JOIN_PENDING: i32 = 12;
+
+/// `room create --wait-join` saw an invitee decline.
+pub(crate) const JOIN_DECLINED: i32 = 13;
+
+/// `sync --max-lag` saw no successful sync for too long.
+pub(crate) const STALLED: i32 = 14;
+
+/// The encrypted config could not be unlocked.
+pub(crate) const LOCKED: i32 = 15;
+
+/// The lock of `--lock` is held by someone else.
+pub(crate) const HELD: i32 = 16;
+
+/// `send --wait-ack` got an ack of a hook run which did not succeed.
+pub(crate) const ACK_FAILED: i32 = 17;
+
+/// `send --fail-on-duplicate` suppressed a duplicate message.
+pub(crate) const DUPLICATE: i32 = 18;
+
+/// `room create --fail-if-exists` found the room of the alias.
+pub(crate) const EXISTS: i32 = 19;
+
+/// The invocation was interrupted with SIGINT.
+pub(crate) const INTERRUPTED: i32 = 130;
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashSet;
+
+    use super::*;
+
+    #[test]
+    fn codes_are_distinct() {
+        let codes = [
+            FINDINGS,
+            AUTH,
+            REJECTED,
+            TIMEOUT,
+            JOIN_PENDING,
+            JOIN_DECLINED,
+            STALLED,
+            LOCKED,
+            HELD,
+            ACK_FAILED,
+            DUPLICATE,
+            EXISTS,
+            INTERRUPTED,
+        ];
+        let unique: HashSet<i32> = codes.iter().copied().collect();
+        assert_eq!(unique.len(), codes.len());
+        // 1 is every other error.
+        assert!(!unique.contains(&1));
+    }
+}
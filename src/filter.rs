@@ -0,0 +1,553 @@
+use std::collections::HashMap;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, bail};
+use matrix_sdk::ruma::{OwnedRoomAliasId, OwnedRoomId, RoomAliasId};
+use regex::Regex;
+use serde_json::Value;
+
+use crate::skew::TsSource;
+
+pub(crate) const HELP: &str = "\
+Filter expressions select events, e.g.
+
+    (sender =~ \"^@bot-\" || body =~ \"ERROR\") && room != \"!noisy:example.org\"
+
+Fields:
+    sender       matrix id of the sender
+    type         event type, e.g. m.room.message
+    room         room id; == and != also take an alias like #ops:example.org
+    body         content.body
+    content.KEY  any content field; nested keys are separated by dots
+    age          time since the event was sent, e.g. age < 10m; with
+                 --ts-source arrival since the sync delivered it
+
+Operators, by increasing precedence:
+    ||  &&  !  and the comparisons ==, !=, =~ (regex), < and > (numbers and age)
+
+Values are words or double-quoted strings; in strings \\\" is a quote and
+\\\\ a backslash, other backslashes are kept, so regexes like \"\\d+\" work
+unchanged. Missing fields never match, except with !=.";
+
+#[derive(Clone, Debug, PartialEq)]
+enum Token {
+    Word(String),
+    Str(String),
+    LParen,
+    RParen,
+    Not,
+    And,
+    Or,
+    Eq,
+    Ne,
+    Match,
+    Lt,
+    Gt,
+}
+
+/// Tokens with their column, starting at 1.
+fn tokenize(expr: &str) -> anyhow::Result<Vec<(usize, Token)>> {
+    let chars: Vec<char> = expr.chars().collect();
+    let mut tokens = vec![];
+    let mut i = 0;
+    while i < chars.len() {
+        let col = i + 1;
+        let next = chars.get(i + 1).copied();
+        let (token, len) = match (chars[i], next) {
+            (c, _) if c.is_whitespace() => {
+                i += 1;
+                continue;
+            }
+            ('(', _) => (Token::LParen, 1),
+            (')', _) => (Token::RParen, 1),
+            ('&', Some('&')) => (Token::And, 2),
+            ('|', Some('|')) => (Token::Or, 2),
+            ('=', Some('=')) => (Token::Eq, 2),
+            ('=', Some('~')) => (Token::Match, 2),
+            ('!', Some('=')) => (Token::Ne, 2),
+            ('!', _) => (Token::Not, 1),
+            ('<', _) => (Token::Lt, 1),
+            ('>', _) => (Token::Gt, 1),
+            ('"', _) => {
+                let mut s = String::new();
+                let mut j = i + 1;
+                loop {
+                    match (chars.get(j), chars.get(j + 1)) {
+                        (None, _) => bail!("column {}: unterminated string", col),
+                        (Some('"'), _) => break,
+                        (Some('\\'), Some(&c @ ('"' | '\\'))) => {
+                            s.push(c);
+                            j += 2;
+                        }
+                        (Some(&c), _) => {
+                            s.push(c);
+                            j += 1;
+                        }
+                    }
+                }
+                (Token::Str(s), j + 1 - i)
+            }
+            (c, _) if is_word_char(c) => {
+                let len = chars[i..].iter().take_while(|c| is_word_char(**c)).count();
+                (Token::Word(chars[i..i + len].iter().collect()), len)
+            }
+            (c, _) => bail!("column {}: unexpected character `{}`", col, c),
+        };
+        tokens.push((col, token));
+        i += len;
+    }
+    Ok(tokens)
+}
+
+fn is_word_char(c: char) -> bool {
+    c.is_alphanumeric() || "._-@:#$+/".contains(c)
+}
+
+#[derive(Clone, Debug)]
+enum Field {
+    Sender,
+    Type,
+    Room,
+    Age,
+    /// JSON pointer into the event, e.g. `/content/body`
+    Pointer(String),
+}
+
+impl Field {
+    fn parse(name: &str) -> Option<Self> {
+        match name {
+            "sender" => Some(Self::Sender),
+            "type" => Some(Self::Type),
+            "room" => Some(Self::Room),
+            "age" => Some(Self::Age),
+            "body" => Some(Self::Pointer(String::from("/content/body"))),
+            _ => {
+                let path = name.strip_prefix("content.")?;
+                if path.is_empty() || path.split('.').any(str::is_empty) {
+                    return None;
+                }
+                Some(Self::Pointer(format!(
+                    "/content/{}",
+                    path.replace('.', "/")
+                )))
+            }
+        }
+    }
+
+    fn value(&self, room_id: &str, event: &Value, ts_source: TsSource) -> Option<Value> {
+        match self {
+            Self::Sender => event.get("sender").cloned(),
+            Self::Type => event.get("type").cloned(),
+            Self::Room => Some(Value::from(room_id)),
+            Self::Age => {
+                let ts = ts_source.ts(event)?;
+                let now = SystemTime::now()
+                    .duration_since(UNIX_EPOCH)
+                    .map(|d| d.as_millis() as u64)
+                    .unwrap_or(0);
+                Some(Value::from(now.saturating_sub(ts)))
+            }
+            Self::Pointer(pointer) => event.pointer(pointer).cloned(),
+        }
+    }
+}
+
+#[derive(Clone, Debug)]
+enum Comparison {
+    Eq(String),
+    Ne(String),
+    Match(Regex),
+    Lt(f64),
+    Gt(f64),
+}
+
+#[derive(Clone, Debug)]
+enum Expr {
+    Compare(Field, Comparison),
+    Not(Box<Expr>),
+    And(Box<Expr>, Box<Expr>),
+    Or(Box<Expr>, Box<Expr>),
+}
+
+// Strings compare as is, everything else by its JSON representation,
+// e.g. `content.count == 3` or `content.urgent == true`.
+fn as_text(value: &Value) -> String {
+    match value {
+        Value::String(s) => s.clone(),
+        other => other.to_string(),
+    }
+}
+
+impl Expr {
+    /// Add the aliases compared with `room` to `aliases`.
+    fn room_aliases(&self, aliases: &mut Vec<OwnedRoomAliasId>) {
+        match self {
+            Self::Compare(Field::Room, Comparison::Eq(value) | Comparison::Ne(value)) => {
+                if let Ok(alias) = RoomAliasId::parse(value) {
+                    if !aliases.contains(&alias) {
+                        aliases.push(alias);
+                    }
+                }
+            }
+            Self::Compare(..) => {}
+            Self::Not(expr) => expr.room_aliases(aliases),
+            Self::And(a, b) | Self::Or(a, b) => {
+                a.room_aliases(aliases);
+                b.room_aliases(aliases);
+            }
+        }
+    }
+
+    fn replace_aliases(&mut self, room_ids: &HashMap<OwnedRoomAliasId, OwnedRoomId>) {
+        match self {
+            Self::Compare(Field::Room, Comparison::Eq(value) | Comparison::Ne(value)) => {
+                let alias = RoomAliasId::parse(value.as_str()).ok();
+                if let Some(room_id) = alias.and_then(|a| room_ids.get(&a)) {
+                    *value = room_id.to_string();
+                }
+            }
+            Self::Compare(..) => {}
+            Self::Not(expr) => expr.replace_aliases(room_ids),
+            Self::And(a, b) | Self::Or(a, b) => {
+                a.replace_aliases(room_ids);
+                b.replace_aliases(room_ids);
+            }
+        }
+    }
+
+    fn eval(&self, room_id: &str, event: &Value, ts_source: TsSource) -> bool {
+        match self {
+            Self::Compare(field, comparison) => {
+                let value = field.value(room_id, event, ts_source);
+                match (comparison, value) {
+                    (Comparison::Ne(_), None) => true,
+                    (_, None) => false,
+                    (Comparison::Eq(s), Some(v)) => as_text(&v) == *s,
+                    (Comparison::Ne(s), Some(v)) => as_text(&v) != *s,
+                    (Comparison::Match(re), Some(v)) => re.is_match(&as_text(&v)),
+                    (Comparison::Lt(n), Some(v)) => v.as_f64().is_some_and(|v| v < *n),
+                    (Comparison::Gt(n), Some(v)) => v.as_f64().is_some_and(|v| v > *n),
+                }
+            }
+            Self::Not(expr) => !expr.eval(room_id, event, ts_source),
+            Self::And(a, b) => {
+                a.eval(room_id, event, ts_source) && b.eval(room_id, event, ts_source)
+            }
+            Self::Or(a, b) => {
+                a.eval(room_id, event, ts_source) || b.eval(room_id, event, ts_source)
+            }
+        }
+    }
+}
+
+struct Parser {
+    tokens: Vec<(usize, Token)>,
+    pos: usize,
+    /// Column after the last character, for errors at the end
+    end: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos).map(|(_, t)| t)
+    }
+
+    fn column(&self) -> usize {
+        self.tokens
+            .get(self.pos)
+            .map(|(col, _)| *col)
+            .unwrap_or(self.end)
+    }
+
+    fn next(&mut self) -> Option<Token> {
+        let token = self.tokens.get(self.pos).map(|(_, t)| t.clone());
+        self.pos += 1;
+        token
+    }
+
+    fn or(&mut self) -> anyhow::Result<Expr> {
+        let mut expr = self.and()?;
+        while self.peek() == Some(&Token::Or) {
+            self.next();
+            expr = Expr::Or(Box::new(expr), Box::new(self.and()?));
+        }
+        Ok(expr)
+    }
+
+    fn and(&mut self) -> anyhow::Result<Expr> {
+        let mut expr = self.unary()?;
+        while self.peek() == Some(&Token::And) {
+            self.next();
+            expr = Expr::And(Box::new(expr), Box::new(self.unary()?));
+        }
+        Ok(expr)
+    }
+
+    fn unary(&mut self) -> anyhow::Result<Expr> {
+        if self.peek() == Some(&Token::Not) {
+            self.next();
+            return Ok(Expr::Not(Box::new(self.unary()?)));
+        }
+        self.primary()
+    }
+
+    fn primary(&mut self) -> anyhow::Result<Expr> {
+        let col = self.column();
+        match self.next() {
+            Some(Token::LParen) => {
+                let expr = self.or()?;
+                let col = self.column();
+                match self.next() {
+                    Some(Token::RParen) => Ok(expr),
+                    _ => bail!("column {}: expected `)`", col),
+                }
+            }
+            Some(Token::Word(name)) => {
+                let field = Field::parse(&name)
+                    .ok_or_else(|| anyhow!("column {}: unknown field `{}`", col, name))?;
+                self.comparison(field)
+            }
+            Some(_) => bail!("column {}: expected a field, `!` or `(`", col),
+            None => bail!("column {}: unexpected end of expression", col),
+        }
+    }
+
+    fn comparison(&mut self, field: Field) -> anyhow::Result<Expr> {
+        let col = self.column();
+        let op = self.next();
+        let value_col = self.column();
+        let value = match self.next() {
+            Some(Token::Word(s)) | Some(Token::Str(s)) => s,
+            _ => bail!("column {}: expected a value", value_col),
+        };
+        let equality = matches!(op, Some(Token::Eq) | Some(Token::Ne));
+        // The client resolves aliases before the filter is applied.
+        if matches!(field, Field::Room) && equality && value.starts_with('#') {
+            RoomAliasId::parse(&value).map_err(|e| anyhow!("column {}: {}", value_col, e))?;
+        }
+        let number = || -> anyhow::Result<f64> {
+            if matches!(field, Field::Age) {
+                if let Ok(duration) = humantime::parse_duration(&value) {
+                    return Ok(duration.as_millis() as f64);
+                }
+            }
+            value
+                .parse()
+                .map_err(|_| anyhow!("column {}: `{}` is not a number", value_col, value))
+        };
+        let comparison = match op {
+            Some(Token::Eq) => Comparison::Eq(value.clone()),
+            Some(Token::Ne) => Comparison::Ne(value.clone()),
+            Some(Token::Match) => Comparison::Match(
+                Regex::new(&value)
+                    .map_err(|e| anyhow!("column {}: invalid regex: {}", value_col, e))?,
+            ),
+            Some(Token::Lt) => Comparison::Lt(number()?),
+            Some(Token::Gt) => Comparison::Gt(number()?),
+            _ => bail!("column {}: expected ==, !=, =~, < or >", col),
+        };
+        Ok(Expr::Compare(field, comparison))
+    }
+}
+
+/// A compiled `--filter-expr`.
+#[derive(Clone, Debug)]
+pub(crate) struct Filter {
+    /// None for `--filter-expr help`
+    expr: Option<Expr>,
+    /// The timestamp `age` is measured from
+    ts_source: TsSource,
+}
+
+impl Filter {
+    pub(crate) fn parse(expr: &str) -> anyhow::Result<Self> {
+        if expr.trim() == "help" {
+            return Ok(Self {
+                expr: None,
+                ts_source: TsSource::default(),
+            });
+        }
+        let mut parser = Parser {
+            tokens: tokenize(expr)?,
+            pos: 0,
+            end: expr.chars().count() + 1,
+        };
+        let parsed = parser.or()?;
+        if parser.pos < parser.tokens.len() {
+            bail!("column {}: expected `&&` or `||`", parser.column());
+        }
+        Ok(Self {
+            expr: Some(parsed),
+            ts_source: TsSource::default(),
+        })
+    }
+
+    /// Measure `age` from `ts_source` instead of origin_server_ts.
+    pub(crate) fn with_ts_source(mut self, ts_source: TsSource) -> Self {
+        self.ts_source = ts_source;
+        self
+    }
+
+    /// The aliases of the `room ==` and `room !=` comparisons; they never
+    /// match before `with_room_ids` replaced them.
+    pub(crate) fn room_aliases(&self) -> Vec<OwnedRoomAliasId> {
+        let mut aliases = vec![];
+        if let Some(ref expr) = self.expr {
+            expr.room_aliases(&mut aliases);
+        }
+        aliases
+    }
+
+    pub(crate) fn with_room_ids(
+        mut self,
+        room_ids: &HashMap<OwnedRoomAliasId, OwnedRoomId>,
+    ) -> Self {
+        if let Some(ref mut expr) = self.expr {
+            expr.replace_aliases(room_ids);
+        }
+        self
+    }
+
+    /// Whether the documentation was asked for instead.
+    pub(crate) fn is_help(&self) -> bool {
+        self.expr.is_none()
+    }
+
+    /// Whether `event` of `room_id` passes the filter.
+    pub(crate) fn matches(&self, room_id: &str, event: &Value) -> bool {
+        match self.expr {
+            Some(ref expr) => expr.eval(room_id, event, self.ts_source),
+            None => true,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    const ROOM: &str = "!room:example.org";
+
+    fn matches(expr: &str, event: &Value) -> bool {
+        Filter::parse(expr).unwrap().matches(ROOM, event)
+    }
+
+    fn error(expr: &str) -> String {
+        Filter::parse(expr).unwrap_err().to_string()
+    }
+
+    #[test]
+    fn and_binds_tighter_than_or() {
+        let event = json!({"type": "x", "sender": "@c:d", "content": {"body": "no"}});
+        assert!(matches("type == x || sender == @a:b && body == hi", &event));
+        assert!(matches("sender == @a:b && body == hi || type == x", &event));
+        assert!(!matches(
+            "type == y || sender == @c:d && body == hi",
+            &event
+        ));
+    }
+
+    #[test]
+    fn not_binds_tighter_than_and() {
+        let other = json!({"type": "y", "sender": "@a:b"});
+        let x = json!({"type": "x", "sender": "@c:d"});
+        assert!(matches("! type == x && sender == @a:b", &other));
+        assert!(!matches("! type == x && sender == @a:b", &x));
+        assert!(matches("!!type == x", &x));
+    }
+
+    #[test]
+    fn parentheses_group() {
+        let event = json!({"type": "x", "sender": "@c:d", "content": {"body": "no"}});
+        assert!(!matches(
+            "(type == x || sender == @a:b) && body == hi",
+            &event
+        ));
+        assert!(!matches("!(type == x || type == y)", &event));
+        assert!(matches(
+            "((type == x) && (body == no || body == hi))",
+            &event
+        ));
+    }
+
+    #[test]
+    fn matches_regexes() {
+        let event = json!({"sender": "@bot-ci:example.org", "content": {"body": "3 errors"}});
+        assert!(matches(r#"body =~ "^\d+ errors$""#, &event));
+        assert!(matches(r#"sender =~ "^@bot-""#, &event));
+        assert!(!matches(r#"body =~ "^errors""#, &event));
+        assert!(!matches(r#"content.missing =~ ".*""#, &event));
+    }
+
+    #[test]
+    fn unescapes_strings() {
+        let event = json!({"content": {"body": r#"say "hi" \ now"#}});
+        assert!(matches(r#"body == "say \"hi\" \\ now""#, &event));
+        // Other backslashes are kept.
+        let event = json!({"content": {"body": r"a\nb"}});
+        assert!(matches(r#"body == "a\nb""#, &event));
+    }
+
+    #[test]
+    fn compares_content_fields() {
+        let event = json!({"content": {"count": 3, "urgent": true, "a": {"b": "c"}}});
+        assert!(matches("content.count == 3", &event));
+        assert!(matches("content.count > 2 && content.count < 4", &event));
+        assert!(matches("content.urgent == true", &event));
+        assert!(matches("content.a.b == c", &event));
+        assert!(matches("content.missing != x", &event));
+        assert!(!matches("content.missing == x", &event));
+    }
+
+    #[test]
+    fn resolves_room_aliases() {
+        let filter = Filter::parse("room == #ops:example.org || room != #ops:example.org").unwrap();
+        let alias = RoomAliasId::parse("#ops:example.org").unwrap();
+        assert_eq!(filter.room_aliases(), vec![alias.clone()]);
+
+        let filter = Filter::parse("room == #ops:example.org").unwrap();
+        assert!(!filter.matches(ROOM, &json!({})));
+        let room_ids = HashMap::from([(alias, OwnedRoomId::try_from(ROOM).unwrap())]);
+        let filter = filter.with_room_ids(&room_ids);
+        assert!(filter.matches(ROOM, &json!({})));
+        assert!(!filter.matches("!other:example.org", &json!({})));
+
+        assert!(Filter::parse("room =~ \"#ops\"")
+            .unwrap()
+            .room_aliases()
+            .is_empty());
+    }
+
+    #[test]
+    fn reports_error_columns() {
+        assert_eq!(error("sender =="), "column 10: expected a value");
+        assert_eq!(error("(type == x"), "column 11: expected `)`");
+        assert_eq!(error("type == x y"), "column 11: expected `&&` or `||`");
+        assert_eq!(
+            error("type == x &&"),
+            "column 13: unexpected end of expression"
+        );
+        assert_eq!(error(r#"body == "abc"#), "column 9: unterminated string");
+        assert_eq!(error("nope == x"), "column 1: unknown field `nope`");
+        assert_eq!(error("type ~ x"), "column 6: unexpected character `~`");
+        assert_eq!(error("type x y"), "column 6: expected ==, !=, =~, < or >");
+        assert_eq!(
+            error("&& type == x"),
+            "column 1: expected a field, `!` or `(`"
+        );
+        assert_eq!(
+            error("content.count < abc"),
+            "column 17: `abc` is not a number"
+        );
+        assert!(error(r#"body =~ "(""#).starts_with("column 9: invalid regex"));
+        assert!(error("room == #ops").starts_with("column 9: "));
+    }
+
+    #[test]
+    fn parses_help() {
+        assert!(Filter::parse(" help ").unwrap().is_help());
+        assert!(!Filter::parse("type == help").unwrap().is_help());
+    }
+}
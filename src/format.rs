@@ -0,0 +1,380 @@
+use std::fs;
+use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, bail};
+use pulldown_cmark::{html, Event, Options, Parser, Tag};
+use serde_json::{json, Value};
+
+/// A message body with a plaintext fallback and its HTML representation.
+pub(crate) struct Formatted {
+    pub(crate) plain: String,
+    pub(crate) html: String,
+}
+
+impl Formatted {
+    /// Put `text` as a paragraph in front of the formatted block.
+    pub(crate) fn with_intro(self, text: &str) -> Self {
+        let text = text.trim();
+        if text.is_empty() {
+            return self;
+        }
+        Self {
+            plain: format!("{}\n\n{}", text, self.plain),
+            html: format!("<p>{}</p>{}", escape(text), self.html),
+        }
+    }
+}
+
+pub(crate) struct Table {
+    header: Vec<String>,
+    rows: Vec<Vec<String>>,
+}
+
+pub(crate) fn escape(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for c in s.chars() {
+        match c {
+            '&' => out.push_str("&amp;"),
+            '<' => out.push_str("&lt;"),
+            '>' => out.push_str("&gt;"),
+            '"' => out.push_str("&quot;"),
+            '\'' => out.push_str("&#39;"),
+            c => out.push(c),
+        }
+    }
+    out
+}
+
+/// Escape the characters of `s` which markdown would read as inline
+/// formatting, links or autolinks, e.g. in room names from remote servers.
+pub(crate) fn escape_markdown(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for c in s.chars() {
+        if matches!(
+            c,
+            '\\' | '`' | '*' | '_' | '[' | ']' | '(' | ')' | '<' | '>' | '!' | '~' | '|'
+        ) {
+            out.push('\\');
+        }
+        out.push(c);
+    }
+    out
+}
+
+/// Render markdown to HTML; the source stays the plain body. Raw HTML in
+/// the source is escaped, so that e.g. `a <b` or `<script>` show up as
+/// typed. None if the message has no formatting.
+pub(crate) fn markdown(body: &str) -> Option<Formatted> {
+    let mut options = Options::empty();
+    options.insert(Options::ENABLE_TABLES);
+    options.insert(Options::ENABLE_STRIKETHROUGH);
+    let events: Vec<Event> = Parser::new_ext(body, options)
+        .map(|event| match event {
+            Event::Html(html) => Event::Text(html),
+            // Line breaks are kept, like in the plain body.
+            Event::SoftBreak => Event::HardBreak,
+            event => event,
+        })
+        .collect();
+
+    // A single paragraph of text is sent as plain body only, as before.
+    let paragraphs = events
+        .iter()
+        .filter(|e| matches!(e, Event::Start(Tag::Paragraph)))
+        .count();
+    let formatted = events.iter().any(|e| {
+        !matches!(
+            e,
+            Event::Start(Tag::Paragraph)
+                | Event::End(Tag::Paragraph)
+                | Event::Text(_)
+                | Event::HardBreak
+        )
+    });
+    if paragraphs <= 1 && !formatted {
+        return None;
+    }
+
+    let mut out = String::new();
+    html::push_html(&mut out, events.into_iter());
+    Some(Formatted {
+        plain: body.to_string(),
+        html: out.trim_end().to_string(),
+    })
+}
+
+pub(crate) fn parse_key_val(s: &str) -> anyhow::Result<(String, String)> {
+    let Some((key, val)) = s.split_once('=') else {
+        bail!("invalid key=value pair: {}", s);
+    };
+    Ok((key.trim().to_string(), val.to_string()))
+}
+
+/// Render aligned `key: value` lines in a monospace block.
+pub(crate) fn kv_block(pairs: &[(String, String)]) -> Formatted {
+    let width = pairs
+        .iter()
+        .map(|(k, _)| k.chars().count())
+        .max()
+        .unwrap_or(0);
+    let plain = pairs
+        .iter()
+        .map(|(k, v)| format!("{:width$}  {}", format!("{}:", k), v, width = width + 1))
+        .collect::<Vec<_>>()
+        .join("\n");
+    let html = format!("<pre><code>{}</code></pre>", escape(&plain));
+
+    Formatted { plain, html }
+}
+
+/// Put `text` in a code block, e.g. command output whose alignment
+/// matters; `language` is the class of the block for highlighting, if not
+/// empty. The fence is longer than any run of backticks in `text`.
+pub(crate) fn code_block(text: &str, language: &str) -> Formatted {
+    let text = text.trim_end_matches('\n');
+    let mut longest = 0;
+    let mut run = 0;
+    for c in text.chars() {
+        run = if c == '`' { run + 1 } else { 0 };
+        longest = longest.max(run);
+    }
+    let fence = "`".repeat((longest + 1).max(3));
+    let plain = format!("{}{}\n{}\n{}", fence, language, text, fence);
+    let html = match language {
+        "" => format!("<pre><code>{}</code></pre>", escape(text)),
+        language => format!(
+            "<pre><code class=\"language-{}\">{}</code></pre>",
+            escape(language),
+            escape(text)
+        ),
+    };
+
+    Formatted { plain, html }
+}
+
+/// A point given as `LAT,LON` in decimal degrees.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Location {
+    lat: f64,
+    lon: f64,
+}
+
+pub(crate) fn parse_location(s: &str) -> anyhow::Result<Location> {
+    let usage = || {
+        anyhow!(
+            "expected LAT,LON in decimal degrees like 52.52,13.405, got {:?}",
+            s
+        )
+    };
+    let (lat, lon) = s.split_once(',').ok_or_else(usage)?;
+    let lat: f64 = lat.trim().parse().map_err(|_| usage())?;
+    let lon: f64 = lon.trim().parse().map_err(|_| usage())?;
+    if !(-90.0..=90.0).contains(&lat) {
+        bail!("latitude {} is not between -90 and 90", lat);
+    }
+    if !(-180.0..=180.0).contains(&lon) {
+        bail!("longitude {} is not between -180 and 180", lon);
+    }
+    Ok(Location { lat, lon })
+}
+
+impl Location {
+    pub(crate) fn geo_uri(&self) -> String {
+        format!("geo:{},{}", self.lat, self.lon)
+    }
+
+    /// An m.location message of our own position, with the content blocks
+    /// of extensible events (MSC3488) so that clients show a map.
+    pub(crate) fn content(&self, description: Option<&str>) -> Value {
+        let uri = self.geo_uri();
+        let body = match description {
+            Some(description) => format!("{} ({})", description, uri),
+            None => format!("Location {}", uri),
+        };
+        let ts = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_millis() as u64)
+            .unwrap_or(0);
+        let mut location = json!({ "uri": uri });
+        if let Some(description) = description {
+            location["description"] = json!(description);
+        }
+
+        json!({
+            "msgtype": "m.location",
+            "body": body,
+            "geo_uri": uri,
+            "org.matrix.msc1767.text": body,
+            "org.matrix.msc3488.location": location,
+            "org.matrix.msc3488.asset": { "type": "m.self" },
+            "org.matrix.msc3488.ts": ts,
+        })
+    }
+}
+
+impl Table {
+    /// Read a CSV file; the first line is the header.
+    pub(crate) fn from_csv(path: impl AsRef<Path>) -> anyhow::Result<Self> {
+        let mut reader = csv::ReaderBuilder::new()
+            .flexible(true)
+            .from_path(path.as_ref())?;
+        let header = reader.headers()?.iter().map(String::from).collect();
+        let mut rows = vec![];
+        for record in reader.records() {
+            rows.push(record?.iter().map(String::from).collect());
+        }
+        Ok(Self { header, rows })
+    }
+
+    /// Read a JSON file containing either an array of objects or an
+    /// array of arrays whose first entry is the header.
+    pub(crate) fn from_json(path: impl AsRef<Path>) -> anyhow::Result<Self> {
+        let raw = fs::read_to_string(path.as_ref())?;
+        let value: Value = serde_json::from_str(&raw)?;
+        let entries = value
+            .as_array()
+            .ok_or_else(|| anyhow!("table json must be an array"))?;
+
+        let cell = |v: &Value| match v {
+            Value::String(s) => s.clone(),
+            Value::Null => String::new(),
+            v => v.to_string(),
+        };
+
+        match entries.first() {
+            None => Ok(Self {
+                header: vec![],
+                rows: vec![],
+            }),
+            Some(Value::Array(first)) => Ok(Self {
+                header: first.iter().map(cell).collect(),
+                rows: entries[1..]
+                    .iter()
+                    .map(|row| {
+                        row.as_array()
+                            .map(|row| row.iter().map(cell).collect())
+                            .unwrap_or_default()
+                    })
+                    .collect(),
+            }),
+            Some(Value::Object(_)) => {
+                let mut header: Vec<String> = vec![];
+                for entry in entries {
+                    for key in entry.as_object().into_iter().flat_map(|o| o.keys()) {
+                        if !header.contains(key) {
+                            header.push(key.clone());
+                        }
+                    }
+                }
+                let rows = entries
+                    .iter()
+                    .map(|entry| {
+                        header
+                            .iter()
+                            .map(|key| entry.get(key).map(cell).unwrap_or_default())
+                            .collect()
+                    })
+                    .collect();
+                Ok(Self { header, rows })
+            }
+            Some(_) => bail!("table json must contain objects or arrays"),
+        }
+    }
+
+    /// Render the table; rows beyond `max_rows` are replaced by a footer.
+    pub(crate) fn render(&self, max_rows: usize) -> Formatted {
+        let shown = &self.rows[..self.rows.len().min(max_rows)];
+        let hidden = self.rows.len() - shown.len();
+
+        let columns = shown
+            .iter()
+            .map(Vec::len)
+            .chain([self.header.len()])
+            .max()
+            .unwrap_or(0);
+        let mut widths = vec![0; columns];
+        for row in shown.iter().chain([&self.header]) {
+            for (i, c) in row.iter().enumerate() {
+                widths[i] = widths[i].max(c.chars().count());
+            }
+        }
+
+        let plain_row = |row: &[String]| {
+            widths
+                .iter()
+                .enumerate()
+                .map(|(i, w)| format!("{:w$}", row.get(i).map(String::as_str).unwrap_or(""), w = w))
+                .collect::<Vec<_>>()
+                .join(" | ")
+                .trim_end()
+                .to_string()
+        };
+        let html_row = |tag: &str, row: &[String]| {
+            let cells: String = (0..columns)
+                .map(|i| {
+                    let c = row.get(i).map(String::as_str).unwrap_or("");
+                    format!("<{tag}>{}</{tag}>", escape(c), tag = tag)
+                })
+                .collect();
+            format!("<tr>{}</tr>", cells)
+        };
+
+        let mut plain = vec![plain_row(&self.header)];
+        plain.push(
+            widths
+                .iter()
+                .map(|w| "-".repeat(*w))
+                .collect::<Vec<_>>()
+                .join("-+-"),
+        );
+        plain.extend(shown.iter().map(|r| plain_row(r)));
+
+        let mut html = format!(
+            "<table><thead>{}</thead><tbody>",
+            html_row("th", &self.header)
+        );
+        html.extend(shown.iter().map(|r| html_row("td", r)));
+        html.push_str("</tbody></table>");
+
+        if hidden > 0 {
+            let footer = format!("+{} more rows", hidden);
+            html.push_str(&format!("<p><em>{}</em></p>", footer));
+            plain.push(footer);
+        }
+
+        Formatted {
+            plain: plain.join("\n"),
+            html,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn escapes_markdown() {
+        let name = r#"[click](https://evil.example) <img src=x onerror=alert(1)> *x*"#;
+        let body = format!(
+            "**Index**\n\n- [{}](https://matrix.to/#/!r:x)",
+            escape_markdown(name)
+        );
+        let html = markdown(&body).unwrap().html;
+        assert_eq!(
+            html,
+            "<p><strong>Index</strong></p>\n<ul>\n<li><a href=\"https://matrix.to/#/!r:x\">\
+             [click](https://evil.example) &lt;img src=x onerror=alert(1)&gt; *x*</a></li>\n</ul>"
+        );
+        let html = markdown("- <b>raw</b>\n- <https://evil.example>")
+            .unwrap()
+            .html;
+        assert!(!html.contains("<b>"), "{}", html);
+        assert!(html.contains("href"), "{}", html);
+        let html = markdown(&format!("- {}", escape_markdown("<https://evil.example>")))
+            .unwrap()
+            .html;
+        assert!(!html.contains("href"), "{}", html);
+    }
+}
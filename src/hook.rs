@@ -0,0 +1,239 @@
+use std::future::Future;
+use std::process::{ExitStatus, Stdio};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, bail};
+use clap::ValueEnum;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+use tokio::sync::oneshot;
+use tokio::time::sleep;
+use tracing::{info, warn};
+
+/// Run `cmd` with `sh -c` and feed `input` to its stdin.
+pub(crate) async fn exec(cmd: &str, input: &[u8]) -> anyhow::Result<ExitStatus> {
+    let mut child = Command::new("sh")
+        .arg("-c")
+        .arg(cmd)
+        .stdin(Stdio::piped())
+        .spawn()?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(input).await?;
+    }
+
+    Ok(child.wait().await?)
+}
+
+/// Parse a rate like `5/s`, `30/m` or `100/h` into events per second.
+pub(crate) fn parse_rate(s: &str) -> anyhow::Result<f64> {
+    let (count, unit) = s
+        .split_once('/')
+        .ok_or_else(|| anyhow!("invalid rate `{}`; expected e.g. 5/s", s))?;
+    let count: f64 = count.parse()?;
+    let seconds = match unit {
+        "s" => 1.0,
+        "m" => 60.0,
+        "h" => 3600.0,
+        _ => bail!("invalid rate unit `{}`; use s, m or h", unit),
+    };
+    if count <= 0.0 {
+        bail!("the rate must be positive");
+    }
+    Ok(count / seconds)
+}
+
+/// What happens to events arriving while the hook is rate limited.
+#[derive(Clone, Copy, Debug, PartialEq, ValueEnum)]
+pub(crate) enum Overflow {
+    /// Log and skip the event
+    Drop,
+    /// Wait for the next token, up to the queue size
+    Queue,
+    /// Run the hook once with a JSON array of all waiting events
+    Batch,
+}
+
+#[derive(Clone, Debug)]
+pub(crate) struct RateLimit {
+    /// Hook runs per second
+    pub(crate) rate: f64,
+    pub(crate) burst: u32,
+    pub(crate) overflow: Overflow,
+    pub(crate) queue: usize,
+}
+
+/// The outcome of a rate limited hook run.
+#[derive(Clone, Debug)]
+pub(crate) enum Outcome {
+    Exited(ExitStatus),
+    Failed(String),
+    Dropped,
+}
+
+struct State {
+    tokens: f64,
+    refilled: Instant,
+    queued: usize,
+    dropped: u64,
+    batch: Vec<(Vec<u8>, oneshot::Sender<Outcome>)>,
+}
+
+enum Slot {
+    Now,
+    Queued,
+    /// Waiting for a batch; the flag marks the event which runs it
+    Batch(oneshot::Receiver<Outcome>, bool),
+}
+
+/// Token bucket limiting the hook runs of `sync --exec`.
+#[derive(Clone)]
+pub(crate) struct Limiter {
+    limit: Option<RateLimit>,
+    state: Arc<Mutex<State>>,
+}
+
+impl Limiter {
+    pub(crate) fn new(limit: Option<RateLimit>) -> Self {
+        let tokens = limit.as_ref().map(|l| l.burst as f64).unwrap_or_default();
+        Self {
+            limit,
+            state: Arc::new(Mutex::new(State {
+                tokens,
+                refilled: Instant::now(),
+                queued: 0,
+                dropped: 0,
+                batch: vec![],
+            })),
+        }
+    }
+
+    /// Take a token, or return how long to wait for the next one.
+    fn take(&self, state: &mut State) -> Result<(), Duration> {
+        let Some(ref limit) = self.limit else {
+            return Ok(());
+        };
+        let now = Instant::now();
+        let elapsed = now.duration_since(state.refilled).as_secs_f64();
+        state.tokens = (state.tokens + elapsed * limit.rate).min(limit.burst as f64);
+        state.refilled = now;
+
+        if state.tokens >= 1.0 {
+            state.tokens -= 1.0;
+            Ok(())
+        } else {
+            Err(Duration::from_secs_f64((1.0 - state.tokens) / limit.rate))
+        }
+    }
+
+    async fn wait(&self) {
+        loop {
+            let result = {
+                let mut state = self.state.lock().unwrap();
+                self.take(&mut state)
+            };
+            match result {
+                Ok(()) => return,
+                Err(delay) => sleep(delay).await,
+            }
+        }
+    }
+
+    fn drop_event(&self, state: &mut State) -> Outcome {
+        state.dropped += 1;
+        warn!(
+            "hook rate limited; dropped event ({} dropped, {} queued)",
+            state.dropped, state.queued
+        );
+        Outcome::Dropped
+    }
+
+    /// Run `task`, a hook run through this limiter. Without a rate limit it
+    /// is awaited, so hooks run one after the other in event order; rate
+    /// limited runs may wait and are spawned to not hold up the sync.
+    pub(crate) async fn dispatch(&self, task: impl Future<Output = ()> + Send + 'static) {
+        if self.limit.is_some() {
+            tokio::spawn(task);
+        } else {
+            task.await;
+        }
+    }
+
+    /// Run `cmd` for `input` once the rate limit allows it.
+    pub(crate) async fn exec(&self, cmd: &str, input: &[u8]) -> Outcome {
+        let (overflow, max_queue) = match self.limit {
+            Some(ref limit) => (limit.overflow, limit.queue),
+            None => return run(cmd, input).await,
+        };
+
+        let slot = {
+            let mut state = self.state.lock().unwrap();
+            if self.take(&mut state).is_ok() {
+                Slot::Now
+            } else if overflow == Overflow::Drop || state.queued >= max_queue {
+                return self.drop_event(&mut state);
+            } else {
+                state.queued += 1;
+                info!(
+                    "hook rate limited; queued event ({} dropped, {} queued)",
+                    state.dropped, state.queued
+                );
+                if overflow == Overflow::Batch {
+                    let (tx, rx) = oneshot::channel();
+                    state.batch.push((input.to_vec(), tx));
+                    // The first waiting event runs the batch.
+                    Slot::Batch(rx, state.batch.len() == 1)
+                } else {
+                    Slot::Queued
+                }
+            }
+        };
+
+        match slot {
+            Slot::Now => run(cmd, input).await,
+            Slot::Queued => {
+                self.wait().await;
+                self.state.lock().unwrap().queued -= 1;
+                run(cmd, input).await
+            }
+            Slot::Batch(rx, leader) => {
+                if leader {
+                    self.wait().await;
+                    self.run_batch(cmd).await;
+                }
+                rx.await.unwrap_or(Outcome::Dropped)
+            }
+        }
+    }
+
+    async fn run_batch(&self, cmd: &str) {
+        let batch = {
+            let mut state = self.state.lock().unwrap();
+            state.queued -= state.batch.len();
+            std::mem::take(&mut state.batch)
+        };
+        info!("running hook for a batch of {} events", batch.len());
+
+        let mut input = b"[".to_vec();
+        for (i, (event, _)) in batch.iter().enumerate() {
+            if i > 0 {
+                input.push(b',');
+            }
+            input.extend_from_slice(event);
+        }
+        input.push(b']');
+
+        let outcome = run(cmd, &input).await;
+        for (_, tx) in batch {
+            let _ = tx.send(outcome.clone());
+        }
+    }
+}
+
+async fn run(cmd: &str, input: &[u8]) -> Outcome {
+    match exec(cmd, input).await {
+        Ok(status) => Outcome::Exited(status),
+        Err(e) => Outcome::Failed(e.to_string()),
+    }
+}
@@ -0,0 +1,126 @@
+//! The client of `mn` for programs which send or receive messages with
+//! the session of `mn login` or `mn init`:
+//!
+//! ```no_run
+//! # async fn notify() -> anyhow::Result<()> {
+//! let client = mnotify::Client::load().await?;
+//! client.send("#ops:example.org", "**deployed**", true).await?;
+//! # Ok(())
+//! # }
+//! ```
+
+use std::path::PathBuf;
+
+use anyhow::anyhow;
+use matrix_sdk::ruma::OwnedEventId;
+
+mod call;
+#[doc(hidden)]
+pub mod cli;
+mod client;
+mod cron;
+mod email;
+mod exit;
+mod filter;
+mod format;
+mod hook;
+mod link;
+mod mime;
+mod outputs;
+mod render;
+mod room_arg;
+mod skew;
+mod table;
+mod terminal;
+mod util;
+
+use crate::client::vault;
+
+const CRATE_NAME: &str = clap::crate_name!();
+
+/// How `Client::load_with` restores the session, like the global options
+/// of `mn`.
+#[derive(Clone, Debug, Default)]
+pub struct ClientOptions {
+    /// Appended to the User-Agent of every request
+    pub user_agent_suffix: Option<String>,
+    /// Sent as x-request-tag with every request
+    pub request_tag: Option<String>,
+    /// File with the passphrase of an encrypted config, instead of
+    /// `MN_CONFIG_PASSPHRASE` or the prompt
+    pub passphrase_file: Option<PathBuf>,
+}
+
+/// A logged in client with the stored session.
+#[derive(Clone)]
+pub struct Client {
+    inner: client::Client,
+}
+
+impl Client {
+    /// Restore the stored session and sync once, so that the joined rooms
+    /// are known.
+    pub async fn load() -> anyhow::Result<Self> {
+        Self::load_with(ClientOptions::default()).await
+    }
+
+    pub async fn load_with(opts: ClientOptions) -> anyhow::Result<Self> {
+        if vault::is_encrypted()? {
+            vault::unlock(opts.passphrase_file.as_deref())?;
+        }
+        let inner = client::Client::builder()
+            .load_meta()?
+            .user_agent_suffix(opts.user_agent_suffix)
+            .request_tag(opts.request_tag)
+            .build()
+            .await?
+            .ensure_login()?;
+        inner.sync_once().await?;
+        Ok(Self { inner })
+    }
+
+    /// Send a text message to a room given by id or alias, formatted as
+    /// markdown with `markdown`, like `mn send`.
+    pub async fn send(
+        &self,
+        room: &str,
+        body: &str,
+        markdown: bool,
+    ) -> anyhow::Result<OwnedEventId> {
+        let room_id = self.inner.resolve_room(&room_arg::parse(room)?).await?;
+        self.inner
+            .send_message(&room_id, body, markdown)
+            .await?
+            .ok_or_else(|| anyhow!("no event was sent to {}", room_id))
+    }
+
+    /// Send a notice, like `mn send --notice`.
+    pub async fn send_notice(
+        &self,
+        room: &str,
+        body: &str,
+        markdown: bool,
+    ) -> anyhow::Result<OwnedEventId> {
+        let room_id = self.inner.resolve_room(&room_arg::parse(room)?).await?;
+        self.inner
+            .send_notice(&room_id, body, markdown)
+            .await?
+            .ok_or_else(|| anyhow!("no event was sent to {}", room_id))
+    }
+
+    /// Run one round of the sync loop.
+    pub async fn sync_once(&self) -> anyhow::Result<()> {
+        self.inner.sync_once().await
+    }
+
+    /// Run the sync loop for the event handlers of `matrix()` until the
+    /// session is logged out; failed syncs are retried.
+    pub async fn sync(&self) -> anyhow::Result<()> {
+        self.inner.sync_forever().await
+    }
+
+    /// The matrix-sdk client, e.g. to add event handlers.
+    pub fn matrix(&self) -> &matrix_sdk::Client {
+        &self.inner
+    }
+}
@@ -0,0 +1,217 @@
+use anyhow::{anyhow, bail};
+use matrix_sdk::ruma::{
+    EventId, OwnedEventId, OwnedRoomOrAliasId, OwnedServerName, RoomOrAliasId, ServerName,
+};
+
+/// A room given as id, alias or matrix.to link, e.g.
+/// `https://matrix.to/#/!abc:example.org/$event?via=example.org`.
+#[derive(Clone, Debug)]
+pub(crate) struct RoomLink {
+    pub(crate) room: OwnedRoomOrAliasId,
+    /// Servers to join through, from the via parameters of the link
+    pub(crate) via: Vec<OwnedServerName>,
+    /// The event of a permalink
+    pub(crate) event_id: Option<OwnedEventId>,
+}
+
+/// Decode %XX sequences; invalid ones are kept as they are.
+fn percent_decode(s: &str) -> anyhow::Result<String> {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes
+            .get(i + 1..i + 3)
+            .and_then(|h| std::str::from_utf8(h).ok())
+            .and_then(|h| u8::from_str_radix(h, 16).ok());
+        match (bytes[i], hex) {
+            (b'%', Some(byte)) => {
+                out.push(byte);
+                i += 3;
+            }
+            (byte, _) => {
+                out.push(byte);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8(out).map_err(|_| anyhow!("`{}` is not valid UTF-8 when decoded", s))
+}
+
+/// The part after `matrix.to/`, if `s` is a matrix.to link.
+fn strip_matrix_to(s: &str) -> Option<&str> {
+    let rest = s
+        .strip_prefix("https://")
+        .or_else(|| s.strip_prefix("http://"))
+        .unwrap_or(s);
+    let rest = rest.strip_prefix("www.").unwrap_or(rest);
+    let rest = rest.strip_prefix("matrix.to")?;
+    // Hosts like matrix.to.example.org are not matrix.to.
+    match rest.chars().next() {
+        None | Some('/' | '#' | '?') => Some(rest),
+        _ => None,
+    }
+}
+
+impl RoomLink {
+    pub(crate) fn parse(s: &str) -> anyhow::Result<Self> {
+        let s = s.trim();
+        let Some(rest) = strip_matrix_to(s) else {
+            if s.contains("://") {
+                bail!("{} is not a matrix.to link", s);
+            }
+            let room = RoomOrAliasId::parse(percent_decode(s)?)?;
+            return Ok(Self {
+                room,
+                via: vec![],
+                event_id: None,
+            });
+        };
+
+        // Links are seen with and without the slashes around the `#`,
+        // and with the query before the fragment.
+        let (prefix, fragment) = rest
+            .split_once('#')
+            .ok_or_else(|| anyhow!("matrix.to link without `#/`"))?;
+        let fragment = fragment.strip_prefix('/').unwrap_or(fragment);
+        let (path, query) = match fragment.split_once('?') {
+            Some((path, query)) => (path, Some(query)),
+            None => (fragment, None),
+        };
+        let query = query
+            .into_iter()
+            .chain(prefix.split_once('?').map(|(_, q)| q));
+
+        // Split before decoding, so that encoded slashes stay in the ids.
+        let mut segments = path.split('/').filter(|s| !s.is_empty());
+        let room = segments
+            .next()
+            .ok_or_else(|| anyhow!("matrix.to link without a room"))
+            .and_then(percent_decode)?;
+        if room.starts_with('@') {
+            bail!("{} links to a user, not a room", room);
+        }
+        let room = RoomOrAliasId::parse(&room).map_err(|e| anyhow!("{}: {}", room, e))?;
+        let event_id = match segments.next() {
+            Some(event_id) => {
+                let event_id = percent_decode(event_id)?;
+                Some(EventId::parse(&event_id).map_err(|e| anyhow!("{}: {}", event_id, e))?)
+            }
+            None => None,
+        };
+        if let Some(extra) = segments.next() {
+            bail!("unexpected `{}` in matrix.to link", extra);
+        }
+
+        let mut via = vec![];
+        for param in query.flat_map(|q| q.split('&')) {
+            // Links copied from html keep the escaped ampersand.
+            let param = param.strip_prefix("amp;").unwrap_or(param);
+            let Some(("via", server)) = param.split_once('=') else {
+                continue;
+            };
+            let server = percent_decode(server)?;
+            via.push(ServerName::parse(&server).map_err(|e| anyhow!("via {}: {}", server, e))?);
+        }
+
+        Ok(Self {
+            room,
+            via,
+            event_id,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(s: &str) -> RoomLink {
+        RoomLink::parse(s).unwrap_or_else(|e| panic!("{}: {}", s, e))
+    }
+
+    fn via(link: &RoomLink) -> Vec<&str> {
+        link.via.iter().map(|s| s.as_str()).collect()
+    }
+
+    #[test]
+    fn parses_ids_and_aliases() {
+        assert_eq!(parse("!abc:example.org").room, "!abc:example.org");
+        assert_eq!(parse(" #ops:example.org ").room, "#ops:example.org");
+        assert_eq!(parse("%21abc%3Aexample.org").room, "!abc:example.org");
+        assert!(parse("#ops:example.org").via.is_empty());
+    }
+
+    #[test]
+    fn decodes_links() {
+        for link in [
+            "https://matrix.to/#/!abc:example.org",
+            "https://matrix.to/#/%21abc%3Aexample.org",
+            "http://www.matrix.to/#/!abc:example.org",
+            "matrix.to/#/!abc:example.org",
+        ] {
+            assert_eq!(parse(link).room, "!abc:example.org", "{}", link);
+        }
+        assert_eq!(
+            parse("https://matrix.to/#/#ops:example.org").room,
+            "#ops:example.org"
+        );
+        assert_eq!(
+            parse("https://matrix.to/#/%23ops%3Aexample.org").room,
+            "#ops:example.org"
+        );
+    }
+
+    #[test]
+    fn accepts_missing_slash() {
+        let link = parse("https://matrix.to/#!abc:example.org?via=a.org");
+        assert_eq!(link.room, "!abc:example.org");
+        assert_eq!(via(&link), ["a.org"]);
+    }
+
+    #[test]
+    fn collects_via() {
+        let link = parse("https://matrix.to/#/!abc:example.org?via=a.org&via=b.org&x=1");
+        assert_eq!(via(&link), ["a.org", "b.org"]);
+        let link = parse("https://matrix.to/?via=a.org#/!abc:example.org");
+        assert_eq!(via(&link), ["a.org"]);
+        let link = parse("https://matrix.to/#/!abc:example.org?via=a.org%3A8448");
+        assert_eq!(via(&link), ["a.org:8448"]);
+    }
+
+    #[test]
+    fn accepts_escaped_ampersands() {
+        let link = parse("https://matrix.to/#/!abc:example.org?via=a.org&amp;via=b.org");
+        assert_eq!(via(&link), ["a.org", "b.org"]);
+    }
+
+    #[test]
+    fn parses_permalinks() {
+        let link = parse("https://matrix.to/#/!abc:example.org/$event?via=a.org");
+        assert_eq!(link.room, "!abc:example.org");
+        assert_eq!(link.event_id.as_ref().unwrap(), "$event");
+        assert_eq!(via(&link), ["a.org"]);
+
+        let link = parse("https://matrix.to/#/%23ops%3Aexample.org/%24event");
+        assert_eq!(link.room, "#ops:example.org");
+        assert_eq!(link.event_id.as_ref().unwrap(), "$event");
+        assert!(parse("https://matrix.to/#/!abc:example.org/")
+            .event_id
+            .is_none());
+    }
+
+    #[test]
+    fn rejects_other_links() {
+        for link in [
+            "https://example.org/#/!abc:example.org",
+            "https://matrix.to.example.org/#/!abc:example.org",
+            "https://matrix.to/",
+            "https://matrix.to/#/",
+            "https://matrix.to/#/@alice:example.org",
+            "https://matrix.to/#/!abc:example.org/$event/extra",
+            "https://matrix.to/#/abc",
+        ] {
+            assert!(RoomLink::parse(link).is_err(), "{}", link);
+        }
+    }
+}
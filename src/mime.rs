@@ -1,3 +1,4 @@
+use std::io::Write;
 use std::path::Path;
 use std::process::{Command, Stdio};
 
@@ -27,6 +28,29 @@ pub fn guess_mime_file(path: impl AsRef<Path>) -> anyhow::Result<mime::Mime> {
     Ok(raw_mime.parse()?)
 }
 
+/// Like `guess_mime_file`, for data which is not in a file, e.g. stdin.
+pub fn guess_mime_data(data: &[u8]) -> anyhow::Result<mime::Mime> {
+    let mut child = Command::new("file")
+        .arg("--mime")
+        .arg("--brief")
+        .arg("-")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()?;
+
+    // file stops reading early; a broken pipe is expected then.
+    if let Some(mut stdin) = child.stdin.take() {
+        let _ = stdin.write_all(data);
+    }
+    let output = child.wait_with_output()?;
+
+    if !output.status.success() {
+        bail!("the file tool failed with exit code: {}", output.status);
+    }
+
+    Ok(String::from_utf8(output.stdout)?.trim().parse()?)
+}
+
 pub fn guess_mime_extension(path: impl AsRef<Path>) -> anyhow::Result<mime::Mime> {
     let extension = path.as_ref().extension();
 
@@ -39,6 +63,8 @@ pub fn guess_mime_extension(path: impl AsRef<Path>) -> anyhow::Result<mime::Mime
             "pdf" => mime::APPLICATION_PDF,
             "opus" | "ogg" => "audio/ogg".parse().unwrap(),
             "mp3" => "audio/mp3".parse().unwrap(),
+            "mp4" => "video/mp4".parse().unwrap(),
+            "webm" => "video/webm".parse().unwrap(),
             _ => mime::APPLICATION_OCTET_STREAM,
         },
     };
@@ -56,3 +82,16 @@ pub(crate) fn guess_mime(path: impl AsRef<Path>) -> anyhow::Result<mime::Mime> {
         }
     }
 }
+
+/// The mimetype of `data` read from stdin; `name` is used for the
+/// extension fallback.
+pub(crate) fn guess_mime_stdin(data: &[u8], name: &str) -> anyhow::Result<mime::Mime> {
+    match guess_mime_data(data) {
+        Ok(mime) => Ok(mime),
+        Err(e) => {
+            warn!("getting mimetype with `file` tool failed: {:?}", e);
+            warn!("choosing mimetype from file extension");
+            guess_mime_extension(name)
+        }
+    }
+}
@@ -2,7 +2,7 @@ use std::collections::BTreeMap;
 
 use matrix_sdk::ruma::api::client::sync::sync_events::UnreadNotificationsCount;
 use matrix_sdk::sync::UnreadNotificationsCount as OtherUnreadNotificationsCount;
-use serde::Serialize;
+use serde::{Deserialize, Serialize};
 
 use matrix_sdk::sync::SyncResponse as BaseSyncResponse;
 use matrix_sdk::{
@@ -16,6 +16,8 @@ use matrix_sdk::{
 };
 use serde_json::value::RawValue;
 
+use crate::call::CallPhase;
+
 #[derive(Serialize)]
 pub(crate) struct SSRoom {
     pub(crate) name: Option<String>,
@@ -33,6 +35,10 @@ pub(crate) struct Room {
     pub(crate) topic: Option<String>,
     pub(crate) display_name: String,
     pub(crate) room_id: String,
+    /// Our membership: joined, invited or left
+    pub(crate) state: &'static str,
+    pub(crate) canonical_alias: Option<String>,
+    pub(crate) joined_members: u64,
     pub(crate) guest_access: String,
     pub(crate) is_encrypted: bool,
     pub(crate) is_direct: bool,
@@ -57,6 +63,853 @@ pub(crate) struct RoomMember {
     pub(crate) avatar: String,
 }
 
+#[derive(Serialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum ApprovalDecision {
+    Approved,
+    Rejected,
+    Timeout,
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub(crate) enum AliasState {
+    Free,
+    Taken,
+    Claimed,
+    Released,
+    Failed,
+}
+
+/// An alias of `mn alias`; the output of a claim can be released later.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct AliasStatus {
+    pub(crate) alias: String,
+    pub(crate) state: AliasState,
+    /// The room a taken or claimed alias points to
+    pub(crate) room_id: Option<String>,
+    pub(crate) errcode: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ApprovalOutcome {
+    pub(crate) event_id: String,
+    pub(crate) decision: ApprovalDecision,
+    pub(crate) approvals: Vec<String>,
+    pub(crate) rejections: Vec<String>,
+}
+
+#[derive(Clone, Copy, PartialEq, Serialize)]
+#[serde(rename_all = "UPPERCASE")]
+pub(crate) enum Severity {
+    Info,
+    Warn,
+    Error,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ArchivePrune {
+    pub(crate) removed: usize,
+    pub(crate) stats: ArchiveStats,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ArchiveStats {
+    /// Whether the sync loop adds events
+    pub(crate) enabled: bool,
+    pub(crate) path: String,
+    pub(crate) events: u64,
+    pub(crate) rooms: u64,
+    /// origin_server_ts of the oldest and newest event
+    pub(crate) oldest: Option<u64>,
+    pub(crate) newest: Option<u64>,
+    /// Size of the database and its write-ahead log
+    pub(crate) bytes: u64,
+}
+
+#[derive(Serialize)]
+pub(crate) struct AuditFinding {
+    pub(crate) room_id: String,
+    pub(crate) name: Option<String>,
+    pub(crate) severity: Severity,
+    pub(crate) message: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct BackupSignature {
+    pub(crate) user_id: String,
+    pub(crate) key_id: String,
+    /// `master_key`, `device` or `unknown`
+    pub(crate) signer: &'static str,
+    pub(crate) valid: bool,
+    pub(crate) trusted: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct BackupVerification {
+    pub(crate) version: Option<String>,
+    pub(crate) algorithm: String,
+    pub(crate) trusted: bool,
+    pub(crate) signatures: Vec<BackupSignature>,
+    pub(crate) warnings: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct CallEntry {
+    #[serde(rename = "type")]
+    pub(crate) kind: &'static str,
+    pub(crate) room_id: String,
+    pub(crate) call_id: String,
+    pub(crate) phase: CallPhase,
+    pub(crate) sender: String,
+    pub(crate) ts: u64,
+    /// Since the answer, start or join; for hang ups, ends and leaves
+    pub(crate) duration_ms: Option<u64>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ConfigImport {
+    pub(crate) user_id: String,
+    /// None if the config had no session, e.g. before the first login
+    pub(crate) device_id: Option<String>,
+    pub(crate) merged: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ConfigVault {
+    pub(crate) encrypted: bool,
+    /// "passphrase" or "keyring"; None once decrypted
+    pub(crate) key: Option<&'static str>,
+    /// The file the config is in now
+    pub(crate) path: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct CursorSummary {
+    #[serde(rename = "type")]
+    pub(crate) cursor_type: String,
+    pub(crate) previous: Option<String>,
+    pub(crate) next: String,
+    pub(crate) count: usize,
+    pub(crate) advanced: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct DirectRoom {
+    pub(crate) room_id: String,
+    pub(crate) user_id: String,
+    pub(crate) created: bool,
+    pub(crate) encrypted: bool,
+    /// Direct rooms with the user which existed before
+    pub(crate) existing: Vec<String>,
+}
+
+/// A failed item of a bulk operation, one NDJSON line of `--report`.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct BatchFailure {
+    pub(crate) item: String,
+    pub(crate) action: String,
+    pub(crate) errcode: Option<String>,
+    pub(crate) error: String,
+    pub(crate) retryable: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct EventSignature {
+    pub(crate) server: String,
+    pub(crate) key_id: String,
+    pub(crate) valid: Option<bool>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct EventVerification {
+    pub(crate) event_id: String,
+    pub(crate) room_version: String,
+    pub(crate) source: &'static str,
+    /// `valid`, `invalid`, or `unverifiable` if the event lacks its hashes
+    /// and signatures, as from the client API, or a key is unknown
+    pub(crate) verdict: &'static str,
+    pub(crate) canonical_json: String,
+    pub(crate) content_hash: HashCheck,
+    pub(crate) reference_hash: Option<HashCheck>,
+    pub(crate) signatures: Vec<EventSignature>,
+}
+
+/// An event without children in the room DAG, as synapse stores it.
+#[derive(Serialize)]
+pub(crate) struct ForwardExtremity {
+    pub(crate) event_id: String,
+    pub(crate) state_group: Option<u64>,
+    pub(crate) depth: Option<u64>,
+    pub(crate) received_ts: Option<u64>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct HashCheck {
+    /// Not included in events returned by the client API
+    pub(crate) expected: Option<String>,
+    pub(crate) computed: String,
+    pub(crate) valid: Option<bool>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct IdentityProvider {
+    pub(crate) id: String,
+    pub(crate) name: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct InactiveUser {
+    pub(crate) user_id: String,
+    pub(crate) last_seen_ts: Option<u64>,
+    pub(crate) creation_ts: Option<u64>,
+    /// Applied actions; `skipped` if done by a previous run
+    pub(crate) actions: Vec<&'static str>,
+    pub(crate) error: Option<String>,
+}
+
+/// Result of `mn init`.
+#[derive(Serialize)]
+pub(crate) struct InitSummary {
+    pub(crate) user_id: String,
+    pub(crate) homeserver: String,
+    pub(crate) method: &'static str,
+    pub(crate) device_id: Option<String>,
+    pub(crate) cross_signing: bool,
+    /// `created` or `exists`; none if not asked for or failed
+    pub(crate) backup: Option<&'static str>,
+    pub(crate) default_room: Option<String>,
+    pub(crate) warnings: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct InviteeJoin {
+    pub(crate) user_id: String,
+    pub(crate) state: JoinState,
+}
+
+#[derive(Serialize)]
+pub(crate) struct JoinOutcome {
+    #[serde(rename = "type")]
+    pub(crate) kind: &'static str,
+    pub(crate) room_id: String,
+    pub(crate) inviter: Option<String>,
+    pub(crate) joined: bool,
+    pub(crate) reason: Option<String>,
+}
+
+#[derive(Clone, Copy, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum JoinState {
+    Joined,
+    /// Left or was banned after the invite
+    Declined,
+    /// Neither joined nor declined in time
+    Pending,
+}
+
+#[derive(Serialize)]
+pub(crate) struct JoinWait {
+    pub(crate) room_id: String,
+    pub(crate) invitees: Vec<InviteeJoin>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct StaleDeviceList {
+    pub(crate) user_id: String,
+    /// Devices on the server we do not know
+    pub(crate) missing: Vec<String>,
+    /// Devices we know which are gone from the server
+    pub(crate) removed: Vec<String>,
+}
+
+/// Result of `mn keys export`.
+#[derive(Serialize)]
+pub(crate) struct KeyExport {
+    pub(crate) path: String,
+    /// Exported inbound group sessions
+    pub(crate) sessions: usize,
+}
+
+/// Result of `mn keys import`.
+#[derive(Serialize)]
+pub(crate) struct KeyImport {
+    /// Sessions new to the store or better than the stored ones
+    pub(crate) imported: usize,
+    pub(crate) total: usize,
+    /// Rooms with imported sessions
+    pub(crate) rooms: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct KeyHygiene {
+    /// Signed curve25519 one-time keys left on the server
+    pub(crate) one_time_keys: u64,
+    /// Whether new one-time keys were uploaded by `--replenish`
+    pub(crate) replenished: bool,
+    /// Own devices without signature of our self-signing key
+    pub(crate) unsigned_devices: Vec<String>,
+    pub(crate) stale_device_lists: Vec<StaleDeviceList>,
+    pub(crate) warnings: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct LockStatus {
+    pub(crate) name: String,
+    /// A lease exists and has not expired
+    pub(crate) held: bool,
+    pub(crate) holder: Option<String>,
+    pub(crate) hostname: Option<String>,
+    pub(crate) device_id: Option<String>,
+    /// Unix timestamps in seconds
+    pub(crate) acquired_at: Option<u64>,
+    pub(crate) expires_at: Option<u64>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct LoginFlow {
+    #[serde(rename = "type")]
+    pub(crate) kind: String,
+    pub(crate) identity_providers: Vec<IdentityProvider>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct LoginFlows {
+    pub(crate) homeserver: String,
+    pub(crate) password: bool,
+    pub(crate) sso: bool,
+    pub(crate) token: bool,
+    pub(crate) oauth_issuer: Option<String>,
+    pub(crate) registration_open: bool,
+    /// Stages of the registration flows, e.g. m.login.registration_token
+    pub(crate) registration_stages: Vec<String>,
+    /// Null if the server does not tell before a login
+    pub(crate) refresh_tokens: Option<bool>,
+    pub(crate) flows: Vec<LoginFlow>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MarkerSummary {
+    /// The m.fully_read event the listing started after
+    pub(crate) previous: Option<String>,
+    pub(crate) next: Option<String>,
+    pub(crate) count: usize,
+    pub(crate) advanced: bool,
+    /// The marker event was unreachable and the read receipt was used
+    pub(crate) fallback: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MediaDownload {
+    pub(crate) room_id: String,
+    pub(crate) downloaded: usize,
+    /// Files which were present from an earlier run
+    pub(crate) skipped: usize,
+    pub(crate) failed: usize,
+    pub(crate) bytes: u64,
+    pub(crate) manifest: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MediaItem {
+    pub(crate) mxc_uri: String,
+    pub(crate) size: u64,
+    pub(crate) name: Option<String>,
+    pub(crate) room_id: Option<String>,
+    pub(crate) event_id: Option<String>,
+}
+
+/// An entry of manifest.json of `room download-media`, by event id.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct MediaManifestEntry {
+    pub(crate) file: String,
+    pub(crate) sender: String,
+    pub(crate) origin_server_ts: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) mimetype: Option<String>,
+}
+
+/// A line of the mapping file of `media migrate`.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct MediaMapping {
+    pub(crate) old: String,
+    pub(crate) new: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MediaMigration {
+    pub(crate) old: String,
+    pub(crate) new: Option<String>,
+    pub(crate) errcode: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MediaRewrite {
+    pub(crate) room_id: String,
+    pub(crate) event_id: String,
+    pub(crate) edit_event_id: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MediaUsage {
+    /// Either `synapse_admin` or `scan`
+    pub(crate) source: &'static str,
+    pub(crate) total_bytes: u64,
+    pub(crate) count: usize,
+    pub(crate) largest: Vec<MediaItem>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MemberMatch {
+    pub(crate) user_id: String,
+    pub(crate) display_name: Option<String>,
+    pub(crate) avatar_url: Option<String>,
+    pub(crate) membership: String,
+    /// The display name equals the query
+    pub(crate) exact: bool,
+    /// Other members of the room share the display name
+    pub(crate) ambiguous: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MemberSyncAction {
+    pub(crate) user_id: String,
+    /// invite or kick
+    pub(crate) action: &'static str,
+    pub(crate) applied: bool,
+    pub(crate) error: Option<String>,
+    pub(crate) errcode: Option<String>,
+    /// Whether a later `--retry-from` run may succeed without changes
+    pub(crate) retryable: Option<bool>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MessagePreview {
+    pub(crate) room_id: String,
+    pub(crate) event_type: &'static str,
+    pub(crate) content: serde_json::Value,
+    /// The body as rendered by `mn messages --text`
+    pub(crate) text: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct MirroredEvent {
+    /// message, edit or redaction
+    pub(crate) kind: &'static str,
+    pub(crate) source_event_id: String,
+    pub(crate) event_id: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct Pagination {
+    /// Pass this token to --from to continue with older events
+    pub(crate) end: Option<String>,
+    pub(crate) count: usize,
+    pub(crate) start_reached: bool,
+    /// The room to continue in with --follow-predecessors
+    pub(crate) room_id: Option<String>,
+    /// A predecessor room which could not be read
+    pub(crate) gap: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct PowerChange {
+    /// The changed key, nested keys joined with dots
+    pub(crate) key: String,
+    pub(crate) before: serde_json::Value,
+    pub(crate) after: serde_json::Value,
+}
+
+#[derive(Serialize)]
+pub(crate) struct PowerPresetSummary {
+    pub(crate) room_id: String,
+    pub(crate) preset: String,
+    pub(crate) changes: Vec<PowerChange>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct PowerAuditRoom {
+    pub(crate) room_id: String,
+    pub(crate) name: Option<String>,
+    /// Users with a power level of at least 50
+    pub(crate) privileged: BTreeMap<String, i64>,
+    pub(crate) findings: Vec<String>,
+}
+
+/// A step of `space publish` or `space unpublish`.
+#[derive(Serialize)]
+pub(crate) struct PublishStep {
+    /// `join_rule`, `directory`, `index_message` or `unpin`
+    pub(crate) step: &'static str,
+    pub(crate) room_id: String,
+    /// The new join rule or visibility, or the event id of the index
+    pub(crate) detail: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct PusherCheck {
+    pub(crate) app_id: String,
+    pub(crate) app_display_name: Option<String>,
+    pub(crate) device_display_name: Option<String>,
+    pub(crate) kind: String,
+    /// Push gateway of http pushers
+    pub(crate) url: Option<String>,
+    /// Whether the gateway took the pushkey; none if it was not asked
+    pub(crate) accepted: Option<bool>,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct GatewayHealth {
+    pub(crate) url: String,
+    pub(crate) status: Option<u16>,
+    pub(crate) ok: bool,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct PushTest {
+    /// The server notices room, once the notification arrived
+    pub(crate) room_id: Option<String>,
+    pub(crate) event_id: String,
+    /// Whether the push rules let the test notice notify
+    pub(crate) flagged: bool,
+    pub(crate) actions: Vec<serde_json::Value>,
+    /// Time until the notification showed up
+    pub(crate) delay_ms: Option<u64>,
+    pub(crate) pushers: Vec<PusherCheck>,
+    pub(crate) gateway: Option<GatewayHealth>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct Redaction {
+    pub(crate) event_id: String,
+    pub(crate) redaction_event_id: Option<String>,
+    pub(crate) errcode: Option<String>,
+    pub(crate) error: Option<String>,
+    pub(crate) retryable: bool,
+}
+
+/// The outcome in one room of a message sent to several.
+#[derive(Serialize)]
+pub(crate) struct RoomDelivery {
+    pub(crate) room_id: String,
+    pub(crate) event_id: Option<String>,
+    /// Skipped by --dedupe-window
+    pub(crate) duplicate: bool,
+    /// Kept in the spool for `send --flush` with --spool
+    pub(crate) spooled: bool,
+    pub(crate) errcode: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+/// The forward extremities of a room; after `--delete-extremities`
+/// those left, with the number deleted.
+#[derive(Serialize)]
+pub(crate) struct RoomExtremities {
+    pub(crate) room_id: String,
+    pub(crate) name: Option<String>,
+    pub(crate) count: u64,
+    pub(crate) extremities: Vec<ForwardExtremity>,
+    pub(crate) deleted: Option<u64>,
+}
+
+/// What `mn room info` shows of a room.
+#[derive(Serialize)]
+pub(crate) struct RoomInfo {
+    pub(crate) room_id: String,
+    pub(crate) name: Option<String>,
+    pub(crate) topic: Option<String>,
+    pub(crate) canonical_alias: Option<String>,
+    pub(crate) avatar_url: Option<String>,
+    pub(crate) joined_members: u64,
+}
+
+#[derive(Serialize)]
+pub(crate) struct RoomSpecSummary {
+    pub(crate) room_id: String,
+    pub(crate) created: bool,
+    /// The alias was taken; `room_id` is the room it points to
+    pub(crate) existed: bool,
+    pub(crate) changes: Vec<String>,
+    /// Matrix users which got an invite
+    pub(crate) invited: Vec<String>,
+    /// Email addresses which got an invitation email
+    pub(crate) emailed: Vec<String>,
+    /// Invitees which could not be reached
+    pub(crate) failed: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct UrlPreview {
+    pub(crate) url: String,
+    pub(crate) title: Option<String>,
+    pub(crate) description: Option<String>,
+    pub(crate) image: Option<String>,
+    pub(crate) og: serde_json::Value,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ScheduleEntry {
+    pub(crate) id: String,
+    pub(crate) cron: String,
+    pub(crate) room_id: String,
+    pub(crate) message: String,
+    /// Unix timestamp in seconds of the last sent cron minute
+    pub(crate) last_run: Option<u64>,
+    /// Device id of the host which sent it
+    pub(crate) last_run_by: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ScheduleSent {
+    pub(crate) id: String,
+    pub(crate) room_id: String,
+    /// Unix timestamp in seconds of the cron minute
+    pub(crate) slot: u64,
+    pub(crate) event_id: Option<String>,
+    pub(crate) error: Option<String>,
+}
+
+/// A sent message, for chaining replies to it.
+#[derive(Serialize)]
+pub(crate) struct SentMessage {
+    pub(crate) room_id: String,
+    pub(crate) event_id: String,
+}
+
+/// A reaction sent by `send --react`; a duplicate is our earlier one.
+#[derive(Serialize)]
+pub(crate) struct SentReaction {
+    pub(crate) room_id: String,
+    /// None if the homeserver rejected a duplicate it does not list
+    pub(crate) event_id: Option<String>,
+    pub(crate) relates_to: String,
+    pub(crate) key: String,
+    pub(crate) duplicate: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct SnapshotChange {
+    pub(crate) user_id: String,
+    pub(crate) before: serde_json::Value,
+    pub(crate) after: serde_json::Value,
+}
+
+#[derive(Serialize)]
+pub(crate) struct SnapshotDiff {
+    pub(crate) room_id: String,
+    /// Unix timestamps in milliseconds of the compared snapshots
+    pub(crate) old_taken_at: u64,
+    pub(crate) new_taken_at: u64,
+    pub(crate) joined: Vec<String>,
+    pub(crate) left: Vec<String>,
+    pub(crate) renamed: Vec<SnapshotChange>,
+    pub(crate) power_changed: Vec<SnapshotChange>,
+    /// Types of the key state events which changed
+    pub(crate) state_changed: Vec<String>,
+}
+
+/// The first line of a room snapshot.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct SnapshotHeader {
+    pub(crate) version: u64,
+    pub(crate) room_id: String,
+    /// Unix timestamp in milliseconds
+    pub(crate) taken_at: u64,
+    /// Content of the key state events by type
+    pub(crate) state: std::collections::BTreeMap<String, serde_json::Value>,
+}
+
+#[derive(Deserialize, Serialize)]
+pub(crate) struct SnapshotMember {
+    pub(crate) user_id: String,
+    pub(crate) display_name: Option<String>,
+    pub(crate) membership: String,
+    pub(crate) power_level: i64,
+}
+
+#[derive(Serialize)]
+pub(crate) struct SnapshotSummary {
+    pub(crate) room_id: String,
+    pub(crate) path: String,
+    pub(crate) members: usize,
+    pub(crate) gzip: bool,
+}
+
+/// Point-in-time counts of a homeserver, one line of the file of
+/// `mn synapse stats --snapshot`.
+#[derive(Deserialize, Serialize)]
+pub(crate) struct StatsSnapshot {
+    /// Unix timestamp in seconds
+    pub(crate) ts: u64,
+    pub(crate) server: String,
+    pub(crate) users: u64,
+    /// Users seen within a day and a month, if the server exposes it
+    pub(crate) active_daily: Option<u64>,
+    pub(crate) active_monthly: Option<u64>,
+    pub(crate) rooms: u64,
+    /// Local media uploaded by local users
+    pub(crate) media_bytes: u64,
+    pub(crate) media_count: u64,
+}
+
+/// Growth of one count in `mn synapse stats --report`.
+#[derive(Serialize)]
+pub(crate) struct StatsMetric {
+    pub(crate) name: &'static str,
+    #[serde(skip)]
+    pub(crate) bytes: bool,
+    pub(crate) first: u64,
+    pub(crate) last: u64,
+    pub(crate) delta: i64,
+    /// Relative to `first`; none if it is 0
+    pub(crate) percent: Option<f64>,
+    pub(crate) sparkline: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct StatsReport {
+    pub(crate) snapshots: usize,
+    /// Timestamps of the first and last snapshot
+    pub(crate) from: Option<u64>,
+    pub(crate) to: Option<u64>,
+    pub(crate) metrics: Vec<StatsMetric>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct StateChange {
+    pub(crate) event_type: String,
+    pub(crate) state_key: String,
+    /// Content before the first change; `None` if the state did not exist
+    pub(crate) before: Option<serde_json::Value>,
+    pub(crate) after: Option<serde_json::Value>,
+    pub(crate) summary: String,
+}
+
+#[derive(Serialize)]
+pub(crate) struct SpaceAccessRoom {
+    pub(crate) room_id: String,
+    pub(crate) name: Option<String>,
+    pub(crate) join_rule: String,
+    /// What happened to the user in this room, e.g. `invited` or `kicked`
+    pub(crate) action: &'static str,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct SpacePolicySummary {
+    #[serde(rename = "type")]
+    pub(crate) kind: &'static str,
+    pub(crate) space_id: String,
+    /// Number of autojoined rooms which were checked
+    pub(crate) checked: usize,
+    pub(crate) left: Vec<String>,
+}
+
+/// Outcome of `send --flush`.
+#[derive(Serialize)]
+pub(crate) struct SpoolFlush {
+    pub(crate) sent: usize,
+    /// Older than --max-age
+    pub(crate) discarded: usize,
+    /// Rejected by the homeserver; kept as `.failed` files
+    pub(crate) failed: usize,
+    /// Left in the spool as the homeserver is still unreachable
+    pub(crate) remaining: usize,
+    pub(crate) error: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct TombstoneSummary {
+    pub(crate) room_id: String,
+    pub(crate) successor: String,
+    pub(crate) event_id: String,
+    pub(crate) message_event_id: Option<String>,
+    pub(crate) changes: Vec<String>,
+}
+
+/// A message of `mn room triage` and the handlers who reacted to it.
+#[derive(Serialize)]
+pub(crate) struct TriageEntry {
+    pub(crate) event_id: String,
+    pub(crate) sender: String,
+    pub(crate) origin_server_ts: u64,
+    pub(crate) body: Option<String>,
+    /// In the order they reacted
+    pub(crate) handled_by: Vec<String>,
+    /// When the first of them reacted
+    pub(crate) handled_at: Option<u64>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct TypingEntry {
+    #[serde(rename = "type")]
+    pub(crate) kind: &'static str,
+    pub(crate) room_id: String,
+    pub(crate) user_ids: Vec<String>,
+}
+
+/// Result of `mn verify`.
+#[derive(Serialize)]
+pub(crate) struct VerificationResult {
+    pub(crate) user_id: Option<String>,
+    pub(crate) device_id: Option<String>,
+    pub(crate) verified: bool,
+    /// Why the verification was cancelled, e.g. the emojis did not match
+    pub(crate) reason: Option<String>,
+    pub(crate) timed_out: bool,
+}
+
+#[derive(Serialize)]
+pub(crate) struct WhoisConnection {
+    pub(crate) ip: String,
+    pub(crate) last_seen: Option<u64>,
+    pub(crate) user_agent: Option<String>,
+    /// ISO country code, with --geoip
+    pub(crate) country: Option<String>,
+    pub(crate) city: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct WhoisDevice {
+    pub(crate) device_id: String,
+    pub(crate) connections: Vec<WhoisConnection>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct WhoisReport {
+    pub(crate) user_id: String,
+    pub(crate) devices: Vec<WhoisDevice>,
+    pub(crate) findings: Vec<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ReadMarker {
+    pub(crate) room_id: String,
+    pub(crate) event_id: String,
+    pub(crate) thread_id: Option<String>,
+}
+
+#[derive(Serialize)]
+pub(crate) struct ReceiptEntry {
+    #[serde(rename = "type")]
+    pub(crate) kind: &'static str,
+    pub(crate) room_id: String,
+    pub(crate) event_id: String,
+    pub(crate) receipt_type: String,
+    pub(crate) user_id: String,
+    pub(crate) thread_id: Option<String>,
+    pub(crate) ts: Option<u64>,
+    /// Milliseconds between the acked event being sent and the receipt
+    pub(crate) delta_ms: Option<i64>,
+}
+
 // https://matrix-org.github.io/matrix-rust-sdk/matrix_sdk/sync/struct.SyncResponse.html
 #[derive(Serialize)]
 pub(crate) struct SyncResponse {
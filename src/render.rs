@@ -0,0 +1,633 @@
+use std::io;
+use std::time::{Duration, SystemTime};
+
+use is_terminal::IsTerminal;
+use serde_json::value::RawValue;
+use serde_json::Value;
+
+use crate::call::CallEvent;
+
+const BOLD: &str = "1";
+const ITALIC: &str = "3";
+const CODE: &str = "2";
+const STRIKE: &str = "9";
+/// Text of events whose room key is missing.
+const UNABLE_TO_DECRYPT: &str = "<unable to decrypt>";
+
+/// Remove the quoted original from a reply body; the fallback consists
+/// of leading lines starting with `>` followed by an empty line.
+pub(crate) fn strip_reply_fallback(body: &str) -> &str {
+    if !body.starts_with('>') {
+        return body;
+    }
+
+    let mut rest = body;
+    while rest.starts_with('>') {
+        rest = match rest.split_once('\n') {
+            Some((_, tail)) => tail,
+            None => "",
+        };
+    }
+    rest.strip_prefix('\n').unwrap_or(rest)
+}
+
+fn decode_entity(entity: &str) -> Option<char> {
+    match entity {
+        "amp" => Some('&'),
+        "lt" => Some('<'),
+        "gt" => Some('>'),
+        "quot" => Some('"'),
+        "apos" => Some('\''),
+        "nbsp" => Some(' '),
+        _ => {
+            let num = entity.strip_prefix('#')?;
+            let code = match num.strip_prefix(['x', 'X']) {
+                Some(hex) => u32::from_str_radix(hex, 16).ok()?,
+                None => num.parse().ok()?,
+            };
+            char::from_u32(code)
+        }
+    }
+}
+
+struct Tag<'a> {
+    name: String,
+    closing: bool,
+    attrs: &'a str,
+}
+
+impl<'a> Tag<'a> {
+    fn parse(raw: &'a str) -> Self {
+        let raw = raw.trim();
+        let (closing, raw) = match raw.strip_prefix('/') {
+            Some(rest) => (true, rest),
+            None => (false, raw),
+        };
+        let raw = raw.trim_end_matches('/');
+        let (name, attrs) = raw
+            .split_once(|c: char| c.is_ascii_whitespace())
+            .unwrap_or((raw, ""));
+        Self {
+            name: name.to_ascii_lowercase(),
+            closing,
+            attrs,
+        }
+    }
+
+    fn attr(&self, key: &str) -> Option<String> {
+        let mut rest = self.attrs;
+        while let Some(pos) = rest.find('=') {
+            let name = rest[..pos].trim();
+            let value = rest[pos + 1..].trim_start();
+            let (value, tail) = match value.chars().next() {
+                Some(q @ ('"' | '\'')) => {
+                    let value = &value[1..];
+                    let end = value.find(q).unwrap_or(value.len());
+                    (&value[..end], &value[(end + 1).min(value.len())..])
+                }
+                _ => {
+                    let end = value
+                        .find(|c: char| c.is_ascii_whitespace())
+                        .unwrap_or(value.len());
+                    (&value[..end], &value[end..])
+                }
+            };
+            // Attributes without value in front of this one end up in `name`.
+            if name.rsplit(char::is_whitespace).next() == Some(key) {
+                return Some(unescape(value));
+            }
+            rest = tail;
+        }
+        None
+    }
+}
+
+/// Remove control characters but line breaks and tabs from remote text:
+/// escape sequences in them could rewrite the terminal, set its title or
+/// hide links.
+pub(crate) fn strip_controls(s: &str) -> String {
+    s.chars()
+        .filter(|c| !c.is_control() || matches!(c, '\n' | '\t'))
+        .collect()
+}
+
+/// Decode the entities of `s`; control characters are dropped from the
+/// result.
+fn unescape(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut rest = s;
+    while let Some(pos) = rest.find('&') {
+        out.push_str(&rest[..pos]);
+        rest = &rest[pos..];
+        let decoded = rest[1..]
+            .find(';')
+            .filter(|end| *end <= 10)
+            .and_then(|end| decode_entity(&rest[1..end + 1]).map(|c| (c, end + 2)));
+        match decoded {
+            Some((c, len)) => {
+                out.push(c);
+                rest = &rest[len..];
+            }
+            None => {
+                out.push('&');
+                rest = &rest[1..];
+            }
+        }
+    }
+    out.push_str(rest);
+    strip_controls(&out)
+}
+
+enum List {
+    Unordered,
+    Ordered(u64),
+}
+
+/// Converts the HTML subset of the matrix spec to plain text, optionally
+/// with ANSI escape sequences for styling.
+struct Renderer {
+    ansi: bool,
+    out: String,
+    styles: Vec<&'static str>,
+    lists: Vec<List>,
+    links: Vec<(Option<String>, usize)>,
+    quote_depth: usize,
+    in_pre: usize,
+    skip: usize,
+    line_start: bool,
+    pending_space: bool,
+}
+
+impl Renderer {
+    fn new(ansi: bool) -> Self {
+        Self {
+            ansi,
+            out: String::new(),
+            styles: vec![],
+            lists: vec![],
+            links: vec![],
+            quote_depth: 0,
+            in_pre: 0,
+            skip: 0,
+            line_start: true,
+            pending_space: false,
+        }
+    }
+
+    fn apply_styles(&mut self) {
+        if !self.ansi {
+            return;
+        }
+        self.out.push_str("\x1b[0m");
+        if !self.styles.is_empty() {
+            self.out
+                .push_str(&format!("\x1b[{}m", self.styles.join(";")));
+        }
+    }
+
+    fn push_style(&mut self, style: &'static str) {
+        self.styles.push(style);
+        self.apply_styles();
+    }
+
+    fn pop_style(&mut self, style: &'static str) {
+        if let Some(pos) = self.styles.iter().rposition(|s| *s == style) {
+            self.styles.remove(pos);
+            self.apply_styles();
+        }
+    }
+
+    fn newline(&mut self) {
+        self.out.push('\n');
+        self.line_start = true;
+        self.pending_space = false;
+    }
+
+    /// End the current line unless nothing was written on it yet.
+    fn line_break(&mut self) {
+        if !self.line_start {
+            self.newline();
+        }
+    }
+
+    /// Separate blocks like paragraphs by an empty line; inside of
+    /// quotes a line break is enough.
+    fn block_break(&mut self) {
+        self.line_break();
+        if self.quote_depth == 0 && !self.out.is_empty() && !self.out.ends_with("\n\n") {
+            self.newline();
+        }
+    }
+
+    fn write_prefix(&mut self) {
+        for _ in 0..self.quote_depth {
+            self.out.push_str("> ");
+        }
+        if self.in_pre == 0 {
+            for _ in 1..self.lists.len() {
+                self.out.push_str("  ");
+            }
+        }
+        self.line_start = false;
+    }
+
+    fn text(&mut self, text: &str) {
+        if self.skip > 0 {
+            return;
+        }
+
+        if self.in_pre > 0 {
+            for (i, line) in text.split('\n').enumerate() {
+                if i > 0 {
+                    self.newline();
+                }
+                if !line.is_empty() {
+                    if self.line_start {
+                        self.write_prefix();
+                    }
+                    self.out.push_str(line);
+                }
+            }
+            return;
+        }
+
+        for (i, word) in text.split(char::is_whitespace).enumerate() {
+            if i > 0 {
+                self.pending_space = true;
+            }
+            if word.is_empty() {
+                continue;
+            }
+            if self.line_start {
+                self.write_prefix();
+            } else if self.pending_space {
+                self.out.push(' ');
+            }
+            self.out.push_str(word);
+            self.pending_space = false;
+        }
+    }
+
+    fn open(&mut self, tag: &Tag) {
+        if tag.name == "mx-reply" {
+            self.skip += 1;
+        }
+        if self.skip > 0 {
+            return;
+        }
+
+        match tag.name.as_str() {
+            "b" | "strong" => self.push_style(BOLD),
+            "i" | "em" => self.push_style(ITALIC),
+            "del" | "s" | "strike" => self.push_style(STRIKE),
+            "code" if self.in_pre == 0 => self.push_style(CODE),
+            "pre" => {
+                self.block_break();
+                self.in_pre += 1;
+                self.push_style(CODE);
+            }
+            "br" => {
+                self.newline();
+            }
+            "hr" => {
+                self.block_break();
+                self.text("---");
+                self.block_break();
+            }
+            "p" | "div" | "table" => self.block_break(),
+            "tr" => self.line_break(),
+            "td" | "th" => self.text(" "),
+            "h1" | "h2" | "h3" | "h4" | "h5" | "h6" => {
+                self.block_break();
+                self.push_style(BOLD);
+            }
+            "blockquote" => {
+                self.block_break();
+                self.quote_depth += 1;
+            }
+            "ul" => {
+                self.line_break();
+                self.lists.push(List::Unordered);
+            }
+            "ol" => {
+                self.line_break();
+                let start = tag.attr("start").and_then(|s| s.parse().ok()).unwrap_or(1);
+                self.lists.push(List::Ordered(start));
+            }
+            "li" => {
+                self.line_break();
+                let bullet = match self.lists.last_mut() {
+                    Some(List::Ordered(n)) => {
+                        *n += 1;
+                        format!("{}. ", *n - 1)
+                    }
+                    _ => String::from("- "),
+                };
+                self.write_prefix();
+                self.out.push_str(&bullet);
+            }
+            "a" => {
+                let href = tag.attr("href");
+                let start = self.out.len();
+                self.links.push((href, start));
+            }
+            "img" => {
+                let alt = tag.attr("alt").or_else(|| tag.attr("title"));
+                self.text(&format!("[{}]", alt.as_deref().unwrap_or("image")));
+            }
+            _ => {}
+        }
+    }
+
+    fn close(&mut self, tag: &Tag) {
+        if tag.name == "mx-reply" {
+            self.skip = self.skip.saturating_sub(1);
+            return;
+        }
+        if self.skip > 0 {
+            return;
+        }
+
+        match tag.name.as_str() {
+            "b" | "strong" => self.pop_style(BOLD),
+            "i" | "em" => self.pop_style(ITALIC),
+            "del" | "s" | "strike" => self.pop_style(STRIKE),
+            "code" if self.in_pre == 0 => self.pop_style(CODE),
+            "pre" => {
+                self.pop_style(CODE);
+                self.in_pre = self.in_pre.saturating_sub(1);
+                self.block_break();
+            }
+            "p" | "div" | "table" => self.block_break(),
+            "h1" | "h2" | "h3" | "h4" | "h5" | "h6" => {
+                self.pop_style(BOLD);
+                self.block_break();
+            }
+            "blockquote" => {
+                self.quote_depth = self.quote_depth.saturating_sub(1);
+                self.block_break();
+            }
+            "ul" | "ol" => {
+                self.lists.pop();
+                self.line_break();
+            }
+            "a" => {
+                let Some((Some(href), start)) = self.links.pop() else {
+                    return;
+                };
+                let text = self.out.get(start..).unwrap_or("").trim();
+                // Pills and bare links already show the target.
+                if text != href && !href.starts_with("https://matrix.to/") {
+                    self.text(" ");
+                    self.text(&format!("<{}>", href));
+                }
+            }
+            _ => {}
+        }
+    }
+
+    fn render(mut self, html: &str) -> String {
+        let mut rest = html;
+
+        while !rest.is_empty() {
+            let Some(pos) = rest.find('<') else {
+                self.text(&unescape(rest));
+                break;
+            };
+            if pos > 0 {
+                self.text(&unescape(&rest[..pos]));
+            }
+            rest = &rest[pos..];
+
+            if let Some(comment) = rest.strip_prefix("<!--") {
+                rest = comment.split_once("-->").map_or("", |(_, tail)| tail);
+                continue;
+            }
+
+            let Some(end) = rest.find('>') else {
+                // Not a tag after all.
+                self.text(&unescape(rest));
+                break;
+            };
+            let tag = Tag::parse(&rest[1..end]);
+            if tag.closing {
+                self.close(&tag);
+            } else {
+                self.open(&tag);
+            }
+            rest = &rest[end + 1..];
+        }
+
+        if self.ansi && !self.styles.is_empty() {
+            self.out.push_str("\x1b[0m");
+        }
+        self.out.trim_end().to_string()
+    }
+}
+
+pub(crate) fn html_to_text(html: &str, ansi: bool) -> String {
+    Renderer::new(ansi).render(html)
+}
+
+/// Readable text of a message event content.
+pub(crate) fn message_text(content: &Value, raw_body: bool, ansi: bool) -> Option<String> {
+    let body = content.get("body").and_then(Value::as_str)?;
+    if raw_body {
+        return Some(strip_controls(body));
+    }
+
+    let text = match content.get("formatted_body").and_then(Value::as_str) {
+        Some(html)
+            if content.get("format").and_then(Value::as_str) == Some("org.matrix.custom.html") =>
+        {
+            html_to_text(html, ansi)
+        }
+        _ => strip_controls(strip_reply_fallback(body).trim_end()),
+    };
+
+    let text = match content.get("msgtype").and_then(Value::as_str) {
+        Some(kind @ ("m.image" | "m.file" | "m.audio" | "m.video")) => {
+            let url = content
+                .get("url")
+                .or_else(|| content.pointer("/file/url"))
+                .and_then(Value::as_str)
+                .unwrap_or("");
+            format!("[{}: {}] {}", &kind[2..], text, strip_controls(url))
+        }
+        Some("m.emote") => format!("* {}", text),
+        _ => text,
+    };
+
+    Some(text)
+}
+
+/// One line per event: timestamp, sender and the readable text.
+pub(crate) fn event_line(event: &Value, raw_body: bool, ansi: bool) -> Option<String> {
+    let text = match event.get("type").and_then(Value::as_str) {
+        Some("m.room.message") => message_text(event.get("content")?, raw_body, ansi)?,
+        Some("m.room.encrypted") => String::from(UNABLE_TO_DECRYPT),
+        _ => CallEvent::parse(event)?.phase.describe().to_string(),
+    };
+    let sender = event
+        .get("sender_attribution")
+        .or_else(|| event.get("sender"))
+        .and_then(Value::as_str)
+        .map(strip_controls)
+        .unwrap_or_default();
+    let ts = event
+        .get("origin_server_ts")
+        .and_then(Value::as_u64)
+        .map(|ms| SystemTime::UNIX_EPOCH + Duration::from_millis(ms))
+        .map(|t| humantime::format_rfc3339_seconds(t).to_string())
+        .unwrap_or_default();
+    // The clock of the sending server is off.
+    let suspect = if event.get("ts_suspect") == Some(&Value::Bool(true)) {
+        "?"
+    } else {
+        ""
+    };
+
+    Some(format!("{}{} {}: {}", ts, suspect, sender, text))
+}
+
+/// Print the readable lines of `events`; styling is only used on terminals.
+pub(crate) fn print_event_lines(events: &[&RawValue], raw_body: bool) -> anyhow::Result<()> {
+    let ansi = io::stdout().is_terminal();
+    for event in events {
+        let event: Value = serde_json::from_str(event.get())?;
+        if let Some(line) = event_line(&event, raw_body, ansi) {
+            println!("{}", line);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    #[test]
+    fn strips_reply_fallback() {
+        let body = "> <@alice:example.org> hello\n> there\n\nanswer\n> not a quote";
+        assert_eq!(strip_reply_fallback(body), "answer\n> not a quote");
+        assert_eq!(strip_reply_fallback("> only quoted"), "");
+        assert_eq!(strip_reply_fallback("no reply"), "no reply");
+        assert_eq!(strip_reply_fallback("text\n> later"), "text\n> later");
+    }
+
+    #[test]
+    fn renders_nested_lists() {
+        let html = "<ul><li>one<ul><li>two</li><li>three</li></ul></li><li>four</li></ul>";
+        assert_eq!(
+            html_to_text(html, false),
+            "- one\n  - two\n  - three\n- four"
+        );
+
+        let html = "<ol start=\"3\"><li>a</li><li>b<ol><li>c</li></ol></li></ol>";
+        assert_eq!(html_to_text(html, false), "3. a\n4. b\n  1. c");
+    }
+
+    #[test]
+    fn renders_links() {
+        let html = r#"see <a href="https://example.org/?a=1&amp;b=2">the site</a>."#;
+        assert_eq!(
+            html_to_text(html, false),
+            "see the site <https://example.org/?a=1&b=2>."
+        );
+        let html = r#"<a href="https://example.org">https://example.org</a>"#;
+        assert_eq!(html_to_text(html, false), "https://example.org");
+        let html = r#"hi <a href="https://matrix.to/#/@alice:example.org">Alice</a>"#;
+        assert_eq!(html_to_text(html, false), "hi Alice");
+        assert_eq!(html_to_text("<a name=x>anchor</a>", false), "anchor");
+    }
+
+    #[test]
+    fn drops_mx_reply() {
+        let html = "<mx-reply><blockquote><a href=\"https://matrix.to/#/!r:x/$e\">In reply to</a> \
+                    <b>quoted</b></blockquote></mx-reply>answer";
+        assert_eq!(html_to_text(html, false), "answer");
+    }
+
+    #[test]
+    fn decodes_entities() {
+        let html = "a &amp; b &lt;c&gt; &quot;d&quot; &#39;e&#39; &#x41; &bogus; & f";
+        assert_eq!(
+            html_to_text(html, false),
+            "a & b <c> \"d\" 'e' A &bogus; & f"
+        );
+    }
+
+    #[test]
+    fn strips_control_characters() {
+        let html = "a&#27;[2Jb\x1b]0;title\x07c &#x9b;d&#127;<br>e\tf";
+        assert_eq!(html_to_text(html, false), "a[2Jb]0;titlec d\ne f");
+        let html = "<pre>x\x1b[31m\ty\r</pre>";
+        assert_eq!(html_to_text(html, false), "x[31m\ty");
+        let html = "<a href=\"https://example.org/&#27;]8;;\">link</a>";
+        assert_eq!(html_to_text(html, false), "link <https://example.org/]8;;>");
+
+        let content = json!({"msgtype": "m.text", "body": "hi\x1b[2J\nthere\u{9b}1m"});
+        assert_eq!(
+            message_text(&content, false, false).unwrap(),
+            "hi[2J\nthere1m"
+        );
+        assert_eq!(
+            message_text(&content, true, false).unwrap(),
+            "hi[2J\nthere1m"
+        );
+        let event = json!({
+            "type": "m.room.message",
+            "sender": "@eve\x1b[8m:example.org",
+            "content": {"msgtype": "m.text", "body": "x"},
+        });
+        assert_eq!(
+            event_line(&event, false, false).unwrap(),
+            " @eve[8m:example.org: x"
+        );
+    }
+
+    #[test]
+    fn keeps_preformatted_text() {
+        let html =
+            "<p>before</p><pre><code>fn main() {\n    x  &lt; y\n}\n</code></pre><p>after</p>";
+        assert_eq!(
+            html_to_text(html, false),
+            "before\n\nfn main() {\n    x  < y\n}\n\nafter"
+        );
+    }
+
+    #[test]
+    fn collapses_blockquotes() {
+        let html = "<blockquote><p>a</p><p>b</p></blockquote><p>c</p>";
+        assert_eq!(html_to_text(html, false), "> a\n> b\n\nc");
+    }
+
+    #[test]
+    fn styles_with_ansi() {
+        assert_eq!(
+            html_to_text("<b>bold <i>both</i></b>", true),
+            "\x1b[0m\x1b[1mbold\x1b[0m\x1b[1;3m both\x1b[0m\x1b[1m\x1b[0m"
+        );
+        assert_eq!(html_to_text("<b>bold <i>both</i></b>", false), "bold both");
+    }
+
+    #[test]
+    fn prefers_formatted_body() {
+        let content = json!({
+            "msgtype": "m.text",
+            "body": "> <@alice:example.org> hi\n\n**yes**",
+            "format": "org.matrix.custom.html",
+            "formatted_body": "<mx-reply>hi</mx-reply><strong>yes</strong>",
+        });
+        assert_eq!(message_text(&content, false, false).unwrap(), "yes");
+        assert_eq!(
+            message_text(&content, true, false).unwrap(),
+            "> <@alice:example.org> hi\n\n**yes**"
+        );
+
+        let content = json!({"msgtype": "m.emote", "body": "> <@a:b> x\n\nwaves"});
+        assert_eq!(message_text(&content, false, false).unwrap(), "* waves");
+    }
+}
@@ -0,0 +1,37 @@
+use std::fmt;
+
+use matrix_sdk::ruma::{OwnedRoomAliasId, OwnedRoomId, RoomAliasId, RoomId};
+use serde::{Deserialize, Serialize};
+
+/// A room given by id or by `#alias:server`. Resolving an alias needs the
+/// homeserver, so it is left to `Client::resolve_room` when the command
+/// runs instead of the argument parser.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(untagged)]
+pub(crate) enum RoomArg {
+    Id(OwnedRoomId),
+    Alias(OwnedRoomAliasId),
+}
+
+/// Parse a room argument given by id or by `#alias:server`.
+pub(crate) fn parse(arg: &str) -> anyhow::Result<RoomArg> {
+    if arg.starts_with('#') {
+        return Ok(RoomArg::Alias(RoomAliasId::parse(arg)?));
+    }
+    Ok(RoomArg::Id(RoomId::parse(arg)?))
+}
+
+impl From<OwnedRoomId> for RoomArg {
+    fn from(room_id: OwnedRoomId) -> Self {
+        Self::Id(room_id)
+    }
+}
+
+impl fmt::Display for RoomArg {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Id(room_id) => room_id.fmt(f),
+            Self::Alias(alias) => alias.fmt(f),
+        }
+    }
+}
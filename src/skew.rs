@@ -0,0 +1,171 @@
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use clap::ValueEnum;
+use serde_json::{json, Value};
+
+/// Deviations of origin_server_ts from our clock up to this are normal
+/// delays of federation and sync.
+pub(crate) const DEFAULT_THRESHOLD: &str = "5m";
+
+/// Which timestamp time windows like `age < 10m` and `--since` use.
+#[derive(Clone, Copy, Debug, Default, PartialEq, ValueEnum)]
+pub(crate) enum TsSource {
+    /// origin_server_ts, set by the clock of the sending server
+    #[default]
+    Origin,
+    /// arrival_ts, when the sync delivered the event to us; events
+    /// without one, e.g. from the history, fall back to origin_server_ts
+    Arrival,
+}
+
+impl TsSource {
+    /// The timestamp of `event` in milliseconds.
+    pub(crate) fn ts(self, event: &Value) -> Option<u64> {
+        let origin = || event.get("origin_server_ts").and_then(Value::as_u64);
+        match self {
+            Self::Origin => origin(),
+            Self::Arrival => event
+                .get("arrival_ts")
+                .and_then(Value::as_u64)
+                .or_else(origin),
+        }
+    }
+}
+
+/// How timestamps of clock-skewed servers are handled.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Skew {
+    pub(crate) source: TsSource,
+    /// Events whose origin_server_ts is further from their arrival are
+    /// marked `ts_suspect`
+    pub(crate) threshold: Duration,
+}
+
+impl Default for Skew {
+    fn default() -> Self {
+        Self {
+            source: TsSource::default(),
+            threshold: humantime::parse_duration(DEFAULT_THRESHOLD).unwrap(),
+        }
+    }
+}
+
+fn now_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+impl Skew {
+    /// Add the arrival time to an event the sync just delivered, and
+    /// `"ts_suspect": true` if its origin_server_ts lies more than the
+    /// threshold in the future or in the past of it.
+    ///
+    /// The arrival is now minus the `unsigned.age` of the event, if the
+    /// server sent one: servers pass on the age as a duration, which no
+    /// clock skews, and events of the initial sync keep their real age.
+    pub(crate) fn annotate(&self, event: &mut Value) {
+        self.annotate_at(event, now_millis());
+    }
+
+    fn annotate_at(&self, event: &mut Value, now: u64) {
+        let age = event.pointer("/unsigned/age").and_then(Value::as_u64);
+        let arrival = now.saturating_sub(age.unwrap_or(0));
+        let origin = event.get("origin_server_ts").and_then(Value::as_u64);
+        let Some(map) = event.as_object_mut() else {
+            return;
+        };
+        map.insert(String::from("arrival_ts"), json!(arrival));
+        if origin.is_some_and(|ts| ts.abs_diff(arrival) > self.threshold.as_millis() as u64) {
+            map.insert(String::from("ts_suspect"), json!(true));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::filter::Filter;
+
+    const NOW: u64 = 1_700_000_000_000;
+
+    fn skew(threshold: &str) -> Skew {
+        Skew {
+            source: TsSource::Origin,
+            threshold: humantime::parse_duration(threshold).unwrap(),
+        }
+    }
+
+    fn annotated(skew: &Skew, mut event: Value) -> Value {
+        skew.annotate_at(&mut event, NOW);
+        event
+    }
+
+    #[test]
+    fn suspects_beyond_threshold() {
+        let skew = skew("5m");
+        let minutes = |n: u64| n * 60_000;
+        for (origin, suspect) in [
+            (NOW, false),
+            (NOW - minutes(5), false),
+            (NOW + minutes(5), false),
+            (NOW - minutes(5) - 1, true),
+            (NOW + minutes(5) + 1, true),
+        ] {
+            let event = annotated(&skew, json!({"origin_server_ts": origin}));
+            assert_eq!(event["arrival_ts"], json!(NOW));
+            assert_eq!(
+                event.get("ts_suspect") == Some(&json!(true)),
+                suspect,
+                "{}",
+                origin
+            );
+        }
+    }
+
+    #[test]
+    fn arrives_before_the_age() {
+        let skew = skew("1m");
+        // An hour old event of the initial sync, sent by a server whose
+        // clock is right.
+        let event = json!({
+            "origin_server_ts": NOW - 3_600_000,
+            "unsigned": {"age": 3_600_000},
+        });
+        let event = annotated(&skew, event);
+        assert_eq!(event["arrival_ts"], json!(NOW - 3_600_000));
+        assert!(event.get("ts_suspect").is_none());
+
+        let event = annotated(&skew, json!({"origin_server_ts": NOW + 3_600_000}));
+        assert_eq!(event["ts_suspect"], json!(true));
+        let event = annotated(&skew, json!({"type": "m.room.message"}));
+        assert!(event.get("ts_suspect").is_none());
+    }
+
+    #[test]
+    fn selects_the_timestamp() {
+        let event = json!({"origin_server_ts": 1, "arrival_ts": 2});
+        assert_eq!(TsSource::Origin.ts(&event), Some(1));
+        assert_eq!(TsSource::Arrival.ts(&event), Some(2));
+        let event = json!({"origin_server_ts": 1});
+        assert_eq!(TsSource::Arrival.ts(&event), Some(1));
+        assert_eq!(TsSource::Arrival.ts(&json!({})), None);
+    }
+
+    #[test]
+    fn filters_age_by_source() {
+        // Sent by a server whose clock is a day behind, delivered just now.
+        let now = now_millis();
+        let event = json!({"origin_server_ts": now - 86_400_000, "arrival_ts": now});
+        let filter = Filter::parse("age < 10m").unwrap();
+        let room = "!room:example.org";
+        assert!(!filter
+            .clone()
+            .with_ts_source(TsSource::Origin)
+            .matches(room, &event));
+        assert!(filter
+            .with_ts_source(TsSource::Arrival)
+            .matches(room, &event));
+    }
+}
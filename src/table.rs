@@ -0,0 +1,440 @@
+use std::env;
+use std::io;
+
+use clap::ValueEnum;
+use is_terminal::IsTerminal;
+
+/// Separates the columns.
+const GAP: &str = "  ";
+/// Shrunk columns keep at least this many characters.
+const MIN_SHRUNK: usize = 8;
+const BYTE_UNITS: [&str; 5] = ["KiB", "MiB", "GiB", "TiB", "PiB"];
+const COUNT_UNITS: [&str; 3] = ["k", "M", "G"];
+const SPARKS: [char; 8] = ['▁', '▂', '▃', '▄', '▅', '▆', '▇', '█'];
+
+/// How byte sizes and counts are printed in tables.
+#[derive(Clone, Copy, Debug, PartialEq, ValueEnum)]
+pub(crate) enum Units {
+    /// Exact numbers
+    Raw,
+    /// Byte sizes like 1.5 MiB, counts from 10000 on like 12k
+    Human,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Align {
+    Left,
+    Right,
+}
+
+/// A column of a table.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Column {
+    title: &'static str,
+    align: Align,
+    /// Whether the column is shortened to fit the terminal; ids are not,
+    /// they must stay usable.
+    shrink: bool,
+}
+
+impl Column {
+    pub(crate) fn text(title: &'static str) -> Self {
+        Self {
+            title,
+            align: Align::Left,
+            shrink: false,
+        }
+    }
+
+    /// Free text like room names, shortened to the terminal width.
+    pub(crate) fn name(title: &'static str) -> Self {
+        Self {
+            title,
+            align: Align::Left,
+            shrink: true,
+        }
+    }
+
+    pub(crate) fn number(title: &'static str) -> Self {
+        Self {
+            title,
+            align: Align::Right,
+            shrink: false,
+        }
+    }
+}
+
+/// A value of a row, formatted by the table.
+#[derive(Clone, Debug)]
+pub(crate) enum Cell {
+    Text(String),
+    Count(u64),
+    Bytes(u64),
+    /// A signed difference of counts or, with `bytes`, of byte sizes
+    Change {
+        delta: i64,
+        bytes: bool,
+    },
+    /// Printed as `-`
+    Unknown,
+}
+
+impl From<&str> for Cell {
+    fn from(text: &str) -> Self {
+        Cell::Text(text.to_string())
+    }
+}
+
+impl From<String> for Cell {
+    fn from(text: String) -> Self {
+        Cell::Text(text)
+    }
+}
+
+impl<T: Into<Cell>> From<Option<T>> for Cell {
+    fn from(value: Option<T>) -> Self {
+        value.map_or(Cell::Unknown, Into::into)
+    }
+}
+
+/// How tables are written.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct TableOptions {
+    pub(crate) units: Units,
+    /// Shorten the name columns to this width; `None` keeps all rows whole
+    pub(crate) width: Option<usize>,
+}
+
+impl TableOptions {
+    /// Fit the table into the terminal unless `no_truncate`; output into
+    /// pipes is not truncated. `COLUMNS` overrides the detected width.
+    pub(crate) fn new(units: Units, no_truncate: bool) -> Self {
+        Self {
+            units,
+            width: if no_truncate { None } else { terminal_width() },
+        }
+    }
+}
+
+fn terminal_width() -> Option<usize> {
+    if let Some(columns) = env::var("COLUMNS").ok().and_then(|c| c.parse().ok()) {
+        return Some(columns);
+    }
+    if !io::stdout().is_terminal() {
+        return None;
+    }
+    terminal_size::terminal_size().map(|(width, _)| width.0 as usize)
+}
+
+fn human_bytes(bytes: u64) -> String {
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut value = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while value >= 1024.0 && unit < BYTE_UNITS.len() - 1 {
+        value /= 1024.0;
+        unit += 1;
+    }
+    if value < 10.0 {
+        format!("{:.1} {}", value, BYTE_UNITS[unit])
+    } else {
+        format!("{:.0} {}", value, BYTE_UNITS[unit])
+    }
+}
+
+/// Counts below 10000 stay exact, they are short enough.
+fn human_count(count: u64) -> String {
+    if count < 10_000 {
+        return count.to_string();
+    }
+    let mut value = count as f64 / 1000.0;
+    let mut unit = 0;
+    while value >= 1000.0 && unit < COUNT_UNITS.len() - 1 {
+        value /= 1000.0;
+        unit += 1;
+    }
+    if value < 10.0 {
+        format!("{:.1}{}", value, COUNT_UNITS[unit])
+    } else {
+        format!("{:.0}{}", value, COUNT_UNITS[unit])
+    }
+}
+
+/// `values` as bars from the smallest to the largest of them.
+pub(crate) fn sparkline(values: &[u64]) -> String {
+    let (Some(min), Some(max)) = (values.iter().min(), values.iter().max()) else {
+        return String::new();
+    };
+    let range = (max - min).max(1) as f64;
+    values
+        .iter()
+        .map(|v| {
+            let level = ((v - min) as f64 / range * (SPARKS.len() - 1) as f64).round();
+            SPARKS[level as usize]
+        })
+        .collect()
+}
+
+/// `text` cut to `width` characters, marking the cut with an ellipsis.
+fn truncate(text: &str, width: usize) -> String {
+    if text.chars().count() <= width {
+        return text.to_string();
+    }
+    let mut cut: String = text.chars().take(width.saturating_sub(1)).collect();
+    cut.push('…');
+    cut
+}
+
+/// Rows of list commands as aligned columns: numbers to the right, byte
+/// sizes and counts per `TableOptions::units`, and name columns shortened
+/// to the terminal width.
+pub(crate) struct Table {
+    columns: Vec<Column>,
+    rows: Vec<Vec<String>>,
+    opts: TableOptions,
+}
+
+impl Table {
+    pub(crate) fn new(columns: &[Column], opts: TableOptions) -> Self {
+        Self {
+            columns: columns.to_vec(),
+            rows: vec![],
+            opts,
+        }
+    }
+
+    pub(crate) fn row(&mut self, cells: Vec<Cell>) {
+        let human = self.opts.units == Units::Human;
+        let row = cells
+            .into_iter()
+            .map(|cell| match cell {
+                Cell::Text(text) => text.replace(['\n', '\t'], " "),
+                Cell::Count(n) if human => human_count(n),
+                Cell::Bytes(n) if human => human_bytes(n),
+                Cell::Count(n) | Cell::Bytes(n) => n.to_string(),
+                Cell::Change { delta, bytes } => {
+                    let sign = if delta < 0 { "-" } else { "+" };
+                    let n = delta.unsigned_abs();
+                    let n = match (human, bytes) {
+                        (true, true) => human_bytes(n),
+                        (true, false) => human_count(n),
+                        (false, _) => n.to_string(),
+                    };
+                    format!("{}{}", sign, n)
+                }
+                Cell::Unknown => String::from("-"),
+            })
+            .collect();
+        self.rows.push(row);
+    }
+
+    /// The width of each column, with the name columns shrunk until the
+    /// table fits `opts.width` or they reach `MIN_SHRUNK`.
+    fn widths(&self) -> Vec<usize> {
+        let mut widths: Vec<usize> = self
+            .columns
+            .iter()
+            .enumerate()
+            .map(|(i, column)| {
+                self.rows
+                    .iter()
+                    .filter_map(|row| row.get(i))
+                    .map(|cell| cell.chars().count())
+                    .chain([column.title.chars().count()])
+                    .max()
+                    .unwrap_or(0)
+            })
+            .collect();
+        let Some(limit) = self.opts.width else {
+            return widths;
+        };
+
+        let total =
+            |widths: &[usize]| widths.iter().sum::<usize>() + GAP.len() * (widths.len() - 1);
+        while total(&widths) > limit {
+            // Take from the widest name column first.
+            let widest = self
+                .columns
+                .iter()
+                .enumerate()
+                .filter(|(i, column)| column.shrink && widths[*i] > MIN_SHRUNK)
+                .max_by_key(|(i, _)| widths[*i])
+                .map(|(i, _)| i);
+            let Some(i) = widest else {
+                break;
+            };
+            widths[i] -= 1;
+        }
+        widths
+    }
+
+    pub(crate) fn render(&self) -> String {
+        if self.columns.is_empty() {
+            return String::new();
+        }
+        let widths = self.widths();
+        let header: Vec<String> = self.columns.iter().map(|c| c.title.to_string()).collect();
+
+        let mut out = String::new();
+        for row in std::iter::once(&header).chain(&self.rows) {
+            let mut line = String::new();
+            for (i, column) in self.columns.iter().enumerate() {
+                let cell = truncate(row.get(i).map_or("", String::as_str), widths[i]);
+                if i > 0 {
+                    line.push_str(GAP);
+                }
+                let pad = " ".repeat(widths[i] - cell.chars().count());
+                match column.align {
+                    Align::Left => {
+                        line.push_str(&cell);
+                        line.push_str(&pad);
+                    }
+                    Align::Right => {
+                        line.push_str(&pad);
+                        line.push_str(&cell);
+                    }
+                }
+            }
+            out.push_str(line.trim_end());
+            out.push('\n');
+        }
+        out
+    }
+
+    pub(crate) fn print(&self) {
+        print!("{}", self.render());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn table(units: Units, width: Option<usize>) -> Table {
+        let columns = [
+            Column::name("NAME"),
+            Column::text("ROOM"),
+            Column::number("MEMBERS"),
+            Column::number("SIZE"),
+            Column::number("CHANGE"),
+        ];
+        let mut table = Table::new(&columns, TableOptions { units, width });
+        table.row(vec![
+            "General chat with a long name".into(),
+            "!a:example.org".into(),
+            Cell::Count(12),
+            Cell::Bytes(1536),
+            Cell::Change {
+                delta: -3,
+                bytes: false,
+            },
+        ]);
+        table.row(vec![
+            "Ops\tteam".into(),
+            "!bb:example.org".into(),
+            Cell::Count(12_345),
+            Cell::Bytes(5 * 1024 * 1024 * 1024),
+            Cell::Change {
+                delta: 2_500_000,
+                bytes: true,
+            },
+        ]);
+        table.row(vec![
+            Cell::from(None::<String>),
+            "!c:example.org".into(),
+            Cell::Count(1_500_000),
+            Cell::Bytes(900),
+            Cell::Change {
+                delta: 0,
+                bytes: false,
+            },
+        ]);
+        table
+    }
+
+    #[test]
+    fn renders_human_units() {
+        assert_eq!(
+            table(Units::Human, None).render(),
+            "\
+NAME                           ROOM             MEMBERS     SIZE    CHANGE
+General chat with a long name  !a:example.org        12  1.5 KiB        -3
+Ops team                       !bb:example.org      12k  5.0 GiB  +2.4 MiB
+-                              !c:example.org      1.5M    900 B        +0
+"
+        );
+    }
+
+    #[test]
+    fn renders_raw_units() {
+        assert_eq!(
+            table(Units::Raw, None).render(),
+            "\
+NAME                           ROOM             MEMBERS        SIZE    CHANGE
+General chat with a long name  !a:example.org        12        1536        -3
+Ops team                       !bb:example.org    12345  5368709120  +2500000
+-                              !c:example.org   1500000         900        +0
+"
+        );
+    }
+
+    #[test]
+    fn truncates_names_to_width() {
+        assert_eq!(
+            table(Units::Human, Some(60)).render(),
+            "\
+NAME             ROOM             MEMBERS     SIZE    CHANGE
+General chat w…  !a:example.org        12  1.5 KiB        -3
+Ops team         !bb:example.org      12k  5.0 GiB  +2.4 MiB
+-                !c:example.org      1.5M    900 B        +0
+"
+        );
+        // Names keep MIN_SHRUNK characters and ids are never cut, even
+        // if the table stays too wide.
+        assert_eq!(
+            table(Units::Human, Some(10)).render(),
+            "\
+NAME      ROOM             MEMBERS     SIZE    CHANGE
+General…  !a:example.org        12  1.5 KiB        -3
+Ops team  !bb:example.org      12k  5.0 GiB  +2.4 MiB
+-         !c:example.org      1.5M    900 B        +0
+"
+        );
+    }
+
+    #[test]
+    fn no_truncate_keeps_rows_whole() {
+        let opts = TableOptions::new(Units::Human, true);
+        assert_eq!(opts.width, None);
+        assert_eq!(
+            table(Units::Human, opts.width).render(),
+            table(Units::Human, None).render()
+        );
+    }
+
+    #[test]
+    fn abbreviates_counts() {
+        assert_eq!(human_count(9_999), "9999");
+        assert_eq!(human_count(10_000), "10k");
+        assert_eq!(human_count(12_345), "12k");
+        assert_eq!(human_count(1_500_000), "1.5M");
+        assert_eq!(human_count(2_000_000_000), "2.0G");
+        assert_eq!(human_count(5_000_000_000_000), "5000G");
+    }
+
+    #[test]
+    fn abbreviates_bytes() {
+        assert_eq!(human_bytes(1023), "1023 B");
+        assert_eq!(human_bytes(1024), "1.0 KiB");
+        assert_eq!(human_bytes(10 * 1024), "10 KiB");
+        assert_eq!(human_bytes(3 * 1024 * 1024 * 1024 * 1024), "3.0 TiB");
+    }
+
+    #[test]
+    fn draws_sparklines() {
+        assert_eq!(sparkline(&[]), "");
+        assert_eq!(sparkline(&[5, 5]), "▁▁");
+        assert_eq!(sparkline(&[0, 7, 14]), "▁▅█");
+    }
+}
@@ -1,4 +1,4 @@
-use std::io::{self, Read};
+use std::io::{self, Read, Write};
 
 use is_terminal::IsTerminal;
 use prompts::{confirm::ConfirmPrompt, Prompt};
@@ -30,3 +30,43 @@ pub(crate) async fn confirm(question: &str) -> anyhow::Result<bool> {
         None => Ok(false),
     }
 }
+
+/// Whether there is someone to ask; prompts are skipped in scripts.
+pub(crate) fn interactive() -> bool {
+    io::stdin().is_terminal()
+}
+
+/// Ask for a line of input; `None` without a terminal.
+pub(crate) fn ask(question: &str) -> io::Result<Option<String>> {
+    if !interactive() {
+        return Ok(None);
+    }
+    eprint!("{}: ", question);
+    io::stderr().flush()?;
+    let mut res = String::new();
+    io::stdin().read_line(&mut res)?;
+    Ok(Some(res.trim().to_string()))
+}
+
+/// Let the user pick one of `options` by its number; `None` without a
+/// terminal or for an empty answer.
+pub(crate) fn choose(question: &str, options: &[String]) -> io::Result<Option<usize>> {
+    if !interactive() {
+        return Ok(None);
+    }
+    for (n, option) in options.iter().enumerate() {
+        eprintln!("  {}) {}", n + 1, option);
+    }
+    loop {
+        let Some(answer) = ask(question)? else {
+            return Ok(None);
+        };
+        if answer.is_empty() {
+            return Ok(None);
+        }
+        match answer.parse::<usize>() {
+            Ok(n) if (1..=options.len()).contains(&n) => return Ok(Some(n - 1)),
+            _ => eprintln!("enter a number from 1 to {}", options.len()),
+        }
+    }
+}